@@ -18,13 +18,16 @@ func CheckPermissions(clientset kubernetes.Interface, namespace *string) error {
 
 	klog.Infof("Checking permissions in namespace: %s", ns)
 
-	// Check ConfigMaps read permissions (get, list)
+	// Check ConfigMaps read permissions (get, list, watch)
 	if err := checkResourcePermission(clientset, ctx, ns, "configmaps", "get"); err != nil {
 		return fmt.Errorf("missing ConfigMaps get permission: %w", err)
 	}
 	if err := checkResourcePermission(clientset, ctx, ns, "configmaps", "list"); err != nil {
 		return fmt.Errorf("missing ConfigMaps list permission: %w", err)
 	}
+	if err := checkResourcePermission(clientset, ctx, ns, "configmaps", "watch"); err != nil {
+		return fmt.Errorf("missing ConfigMaps watch permission: %w", err)
+	}
 
 	// Check ConfigMaps write permissions (create, update)
 	if err := checkResourcePermission(clientset, ctx, ns, "configmaps", "create"); err != nil {
@@ -34,24 +37,38 @@ func CheckPermissions(clientset kubernetes.Interface, namespace *string) error {
 		return fmt.Errorf("missing ConfigMaps update permission: %w", err)
 	}
 
-	// Check Services read permissions (list)
+	// Check Services read permissions (list, watch)
 	if err := checkResourcePermission(clientset, ctx, ns, "services", "list"); err != nil {
 		return fmt.Errorf("missing Services list permission: %w", err)
 	}
+	if err := checkResourcePermission(clientset, ctx, ns, "services", "watch"); err != nil {
+		return fmt.Errorf("missing Services watch permission: %w", err)
+	}
 
 	klog.Infof("All required permissions verified in namespace: %s", ns)
 	return nil
 }
 
-// checkResourcePermission checks if the current user has permission to perform a verb on a resource
+// checkResourcePermission checks if the current user has permission to perform a verb on a core resource
 func checkResourcePermission(clientset kubernetes.Interface, ctx context.Context, namespace, resource, verb string) error {
+	return checkGroupResourcePermission(clientset, ctx, namespace, "", resource, verb)
+}
+
+// checkGroupResourcePermission checks if the current user has permission to perform a verb on a resource of an API group
+func checkGroupResourcePermission(clientset kubernetes.Interface, ctx context.Context, namespace, group, resource, verb string) error {
+	return checkSubresourcePermission(clientset, ctx, namespace, group, resource, "", verb)
+}
+
+// checkSubresourcePermission checks if the current user has permission to perform a verb on a subresource, such as status
+func checkSubresourcePermission(clientset kubernetes.Interface, ctx context.Context, namespace, group, resource, subresource, verb string) error {
 	sar := &authorizationv1.SelfSubjectAccessReview{
 		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
 			ResourceAttributes: &authorizationv1.ResourceAttributes{
-				Namespace: namespace,
-				Verb:      verb,
-				Group:     "",
-				Resource:  resource,
+				Namespace:   namespace,
+				Verb:        verb,
+				Group:       group,
+				Resource:    resource,
+				Subresource: subresource,
 			},
 		},
 	}
@@ -67,4 +84,140 @@ func checkResourcePermission(clientset kubernetes.Interface, ctx context.Context
 
 	klog.Infof("Permission check passed: %s %s in namespace %s", verb, resource, namespace)
 	return nil
-}
\ No newline at end of file
+}
+// CheckClusterWidePermissions verifies the permissions required to discover Services in every namespace.
+// When watchNamespaces is true, it also verifies that Namespaces can be watched for label selection.
+// These permissions must be granted by a ClusterRole.
+func CheckClusterWidePermissions(clientset kubernetes.Interface, watchNamespaces bool) error {
+	ctx := context.Background()
+
+	klog.Info("Checking cluster-wide permissions")
+
+	// Check Services read permissions across all namespaces (list, watch)
+	if err := checkResourcePermission(clientset, ctx, "", "services", "list"); err != nil {
+		return fmt.Errorf("missing cluster-wide Services list permission: %w", err)
+	}
+	if err := checkResourcePermission(clientset, ctx, "", "services", "watch"); err != nil {
+		return fmt.Errorf("missing cluster-wide Services watch permission: %w", err)
+	}
+
+	if watchNamespaces {
+		// Check Namespaces read permissions (list, watch)
+		if err := checkResourcePermission(clientset, ctx, "", "namespaces", "list"); err != nil {
+			return fmt.Errorf("missing Namespaces list permission: %w", err)
+		}
+		if err := checkResourcePermission(clientset, ctx, "", "namespaces", "watch"); err != nil {
+			return fmt.Errorf("missing Namespaces watch permission: %w", err)
+		}
+	}
+
+	klog.Info("All required cluster-wide permissions verified")
+	return nil
+}
+
+// CheckEndpointSlicePermissions verifies that EndpointSlices can be listed and watched in namespace,
+// an empty namespace checks across all namespaces
+func CheckEndpointSlicePermissions(clientset kubernetes.Interface, namespace string) error {
+	ctx := context.Background()
+
+	// Check EndpointSlices read permissions (list, watch)
+	if err := checkGroupResourcePermission(clientset, ctx, namespace, "discovery.k8s.io", "endpointslices", "list"); err != nil {
+		return fmt.Errorf("missing EndpointSlices list permission: %w", err)
+	}
+	if err := checkGroupResourcePermission(clientset, ctx, namespace, "discovery.k8s.io", "endpointslices", "watch"); err != nil {
+		return fmt.Errorf("missing EndpointSlices watch permission: %w", err)
+	}
+
+	klog.Infof("EndpointSlices permissions verified in namespace: %q", namespace)
+	return nil
+}
+
+// CheckPodPermissions verifies that Pods can be listed and watched in namespace to read their probes,
+// an empty namespace checks across all namespaces
+func CheckPodPermissions(clientset kubernetes.Interface, namespace string) error {
+	ctx := context.Background()
+
+	// Check Pods read permissions (list, watch)
+	if err := checkResourcePermission(clientset, ctx, namespace, "pods", "list"); err != nil {
+		return fmt.Errorf("missing Pods list permission: %w", err)
+	}
+	if err := checkResourcePermission(clientset, ctx, namespace, "pods", "watch"); err != nil {
+		return fmt.Errorf("missing Pods watch permission: %w", err)
+	}
+
+	klog.Infof("Pods permissions verified in namespace: %q", namespace)
+	return nil
+}
+
+// CheckServicePatchPermissions verifies that Services can be patched in namespace to write their export status,
+// an empty namespace checks across all namespaces
+func CheckServicePatchPermissions(clientset kubernetes.Interface, namespace string) error {
+	ctx := context.Background()
+
+	// Check Services write permission (patch)
+	if err := checkResourcePermission(clientset, ctx, namespace, "services", "patch"); err != nil {
+		return fmt.Errorf("missing Services patch permission: %w", err)
+	}
+
+	klog.Infof("Services patch permission verified in namespace: %q", namespace)
+	return nil
+}
+
+// CheckServiceExportPermissions verifies that MCS ServiceExports can be watched in namespace and their
+// status updated, an empty namespace checks across all namespaces
+func CheckServiceExportPermissions(clientset kubernetes.Interface, namespace string) error {
+	ctx := context.Background()
+
+	// Check ServiceExports read permissions (list, watch) and status write permission
+	if err := checkGroupResourcePermission(clientset, ctx, namespace, "multicluster.x-k8s.io", "serviceexports", "list"); err != nil {
+		return fmt.Errorf("missing ServiceExports list permission: %w", err)
+	}
+	if err := checkGroupResourcePermission(clientset, ctx, namespace, "multicluster.x-k8s.io", "serviceexports", "watch"); err != nil {
+		return fmt.Errorf("missing ServiceExports watch permission: %w", err)
+	}
+	if err := checkSubresourcePermission(clientset, ctx, namespace, "multicluster.x-k8s.io", "serviceexports", "status", "update"); err != nil {
+		return fmt.Errorf("missing ServiceExports status update permission: %w", err)
+	}
+
+	klog.Infof("ServiceExports permissions verified in namespace: %q", namespace)
+	return nil
+}
+
+// CheckServiceImportPermissions verifies that MCS ServiceImports can be managed in namespace,
+// an empty namespace checks across all namespaces
+func CheckServiceImportPermissions(clientset kubernetes.Interface, namespace string) error {
+	ctx := context.Background()
+
+	// Check ServiceImports read and write permissions (list, create, update, delete) and status write permission
+	for _, verb := range []string{"list", "create", "update", "delete"} {
+		if err := checkGroupResourcePermission(clientset, ctx, namespace, "multicluster.x-k8s.io", "serviceimports", verb); err != nil {
+			return fmt.Errorf("missing ServiceImports %s permission: %w", verb, err)
+		}
+	}
+	if err := checkSubresourcePermission(clientset, ctx, namespace, "multicluster.x-k8s.io", "serviceimports", "status", "update"); err != nil {
+		return fmt.Errorf("missing ServiceImports status update permission: %w", err)
+	}
+
+	klog.Infof("ServiceImports permissions verified in namespace: %q", namespace)
+	return nil
+}
+
+// CheckCrossClusterServicePermissions verifies that CrossClusterServices can be watched in namespace and their
+// status updated, an empty namespace checks across all namespaces
+func CheckCrossClusterServicePermissions(clientset kubernetes.Interface, namespace string) error {
+	ctx := context.Background()
+
+	// Check CrossClusterServices read permissions (list, watch) and status write permission
+	if err := checkGroupResourcePermission(clientset, ctx, namespace, "cross-cluster.io", "crossclusterservices", "list"); err != nil {
+		return fmt.Errorf("missing CrossClusterServices list permission: %w", err)
+	}
+	if err := checkGroupResourcePermission(clientset, ctx, namespace, "cross-cluster.io", "crossclusterservices", "watch"); err != nil {
+		return fmt.Errorf("missing CrossClusterServices watch permission: %w", err)
+	}
+	if err := checkSubresourcePermission(clientset, ctx, namespace, "cross-cluster.io", "crossclusterservices", "status", "update"); err != nil {
+		return fmt.Errorf("missing CrossClusterServices status update permission: %w", err)
+	}
+
+	klog.Infof("CrossClusterServices permissions verified in namespace: %q", namespace)
+	return nil
+}
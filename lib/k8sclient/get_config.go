@@ -11,6 +11,17 @@ import (
 	"k8s.io/klog/v2"
 )
 
+// kubeconfigCliArgument is registered at package initialization so that callers
+// can define their own flags and call flag.Parse() before GetConfig()
+var kubeconfigCliArgument = registerKubeconfigFlag()
+
+func registerKubeconfigFlag() *string {
+	if home := homedir.HomeDir(); home != "" {
+		return flag.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
+	}
+	return flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
+}
+
 func GetConfig() (config *rest.Config, err error) {
 	var inClusterErr, outOfClusterErr error
 
@@ -32,13 +43,9 @@ func GetConfigInCluster() (*rest.Config, error) {
 }
 
 func GetConfigOutOfCluster() (*rest.Config, error) {
-	var kubeconfigCliArgument *string
-	if home := homedir.HomeDir(); home != "" {
-		kubeconfigCliArgument = flag.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
-	} else {
-		kubeconfigCliArgument = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
+	if !flag.Parsed() {
+		flag.Parse()
 	}
-	flag.Parse()
 
 	return clientcmd.BuildConfigFromFlags("", *kubeconfigCliArgument)
 }
@@ -46,4 +46,15 @@ func GetAllServicesInCurrentNamespace(clientset kubernetes.Interface, namespace
 		klog.Infof("Found %d Service(s) in namespace %s\n", len(serviceList.Items), ns)
 		return serviceList, nil
 	}
-}
\ No newline at end of file
+}
+// GetAllServicesInAllNamespaces retrieves all Services from every namespace
+func GetAllServicesInAllNamespaces(clientset kubernetes.Interface) (*v1.ServiceList, error) {
+	serviceList, err := clientset.CoreV1().Services(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		klog.Errorf("Error listing Services in all namespaces: %v\n", err)
+		return serviceList, err
+	}
+
+	klog.Infof("Found %d Service(s) in all namespaces\n", len(serviceList.Items))
+	return serviceList, nil
+}
@@ -2,11 +2,16 @@ package k8sclient
 
 import (
 	"context"
+	"reflect"
+	"strings"
 	"testing"
 
+	authorizationv1 "k8s.io/api/authorization/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 func TestGetAllConfigMapsInCurrentNamespace(t *testing.T) {
@@ -225,3 +230,223 @@ func TestCheckPermissions_NilNamespace(t *testing.T) {
 		t.Errorf("Expected error from fake clientset, got nil")
 	}
 }
+
+func TestUpdateCaddyConfigMapKey_KeepsOtherKeys(t *testing.T) {
+	namespace := "test-ns"
+	existingConfig := "service1.test-ns.svc.clusterwise.remote {\n    reverse_proxy service1.test-ns.svc.cluster.local\n}\n"
+	clientset := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      CaddyConfigMapName,
+				Namespace: namespace,
+			},
+			Data: map[string]string{
+				CaddyConfigKey: existingConfig,
+			},
+		},
+	)
+	jsonConfig := `{"apps":{"http":{"servers":{}}}}`
+
+	err := UpdateCaddyConfigMapKey(clientset, &namespace, CaddyJSONConfigKey, jsonConfig)
+
+	if err != nil {
+		t.Errorf("Expected no error, got: %v", err)
+	}
+
+	cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(context.Background(), CaddyConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get ConfigMap: %v", err)
+	}
+
+	if cm.Data[CaddyJSONConfigKey] != jsonConfig {
+		t.Errorf("Expected JSON content: %s, got: %s", jsonConfig, cm.Data[CaddyJSONConfigKey])
+	}
+
+	if cm.Data[CaddyConfigKey] != existingConfig {
+		t.Errorf("Expected Caddyfile to be kept, got: %s", cm.Data[CaddyConfigKey])
+	}
+}
+
+func TestReplaceCaddyConfig(t *testing.T) {
+	namespace := "test-ns"
+	clientset := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      CaddyConfigMapName,
+				Namespace: namespace,
+			},
+			Data: map[string]string{
+				CaddyConfigKey: "# placeholder",
+				"other":        "kept",
+			},
+		},
+	)
+	jsonConfig := `{"apps":{"http":{"servers":{}}}}`
+
+	err := ReplaceCaddyConfig(clientset, &namespace, CaddyJSONConfigKey, jsonConfig)
+
+	if err != nil {
+		t.Errorf("Expected no error, got: %v", err)
+	}
+
+	cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(context.Background(), CaddyConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get ConfigMap: %v", err)
+	}
+
+	if cm.Data[CaddyJSONConfigKey] != jsonConfig {
+		t.Errorf("Expected JSON content: %s, got: %s", jsonConfig, cm.Data[CaddyJSONConfigKey])
+	}
+
+	if _, exists := cm.Data[CaddyConfigKey]; exists {
+		t.Errorf("Expected the Caddyfile to be removed, got: %v", cm.Data)
+	}
+
+	if cm.Data["other"] != "kept" {
+		t.Errorf("Expected other keys to be kept, got: %v", cm.Data)
+	}
+}
+
+func TestGetAllServicesInAllNamespaces(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "service1",
+				Namespace: "ns1",
+			},
+		},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "service2",
+				Namespace: "ns2",
+			},
+		},
+	)
+
+	serviceList, err := GetAllServicesInAllNamespaces(clientset)
+
+	if err != nil {
+		t.Errorf("Expected no error, got: %v", err)
+	}
+
+	if serviceList == nil {
+		t.Fatal("Expected non-nil ServiceList")
+	}
+
+	if len(serviceList.Items) != 2 {
+		t.Errorf("Expected 2 Services, got: %d", len(serviceList.Items))
+	}
+}
+
+func TestCheckClusterWidePermissions(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	// Expected to return error because fake clientset does not support AuthorizationV1 API
+	err := CheckClusterWidePermissions(clientset, true)
+
+	if err == nil {
+		t.Errorf("Expected error from fake clientset, got nil")
+	}
+}
+
+func TestCheckEndpointSlicePermissions(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		sar := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		// Only grant EndpointSlices of the discovery.k8s.io group
+		sar.Status.Allowed = sar.Spec.ResourceAttributes.Group == "discovery.k8s.io" && sar.Spec.ResourceAttributes.Resource == "endpointslices"
+		return true, sar, nil
+	})
+
+	if err := CheckEndpointSlicePermissions(clientset, "test-ns"); err != nil {
+		t.Errorf("Expected EndpointSlices permissions to be granted, got: %v", err)
+	}
+}
+
+func TestCheckPodPermissions(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		sar := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		// Grant listing Pods but not watching them
+		attributes := sar.Spec.ResourceAttributes
+		sar.Status.Allowed = attributes.Resource == "pods" && attributes.Verb == "list"
+		return true, sar, nil
+	})
+
+	err := CheckPodPermissions(clientset, "test-ns")
+	if err == nil || !strings.Contains(err.Error(), "watch") {
+		t.Errorf("Expected the missing watch permission to be reported, got: %v", err)
+	}
+}
+
+func TestCheckServiceExportPermissions(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		sar := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		// Grant ServiceExports, but their status only when allowed below
+		attributes := sar.Spec.ResourceAttributes
+		sar.Status.Allowed = attributes.Group == "multicluster.x-k8s.io" && attributes.Resource == "serviceexports" && attributes.Subresource == ""
+		return true, sar, nil
+	})
+
+	err := CheckServiceExportPermissions(clientset, "test-ns")
+	if err == nil || !strings.Contains(err.Error(), "status update") {
+		t.Errorf("Expected the missing status permission to be reported, got: %v", err)
+	}
+}
+
+func TestCheckCrossClusterServicePermissions(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		sar := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		// Grant list and watch on CrossClusterServices, deny everything else
+		attributes := sar.Spec.ResourceAttributes
+		sar.Status.Allowed = attributes.Group == "cross-cluster.io" && attributes.Resource == "crossclusterservices" && attributes.Verb != "update"
+		return true, sar, nil
+	})
+
+	err := CheckCrossClusterServicePermissions(clientset, "test-ns")
+	if err == nil || !strings.Contains(err.Error(), "status update") {
+		t.Errorf("Expected the missing status permission to be reported, got: %v", err)
+	}
+}
+
+func TestCheckServicePatchPermissions(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		sar := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		// Grant reading Services only
+		sar.Status.Allowed = sar.Spec.ResourceAttributes.Resource == "services" && sar.Spec.ResourceAttributes.Verb != "patch"
+		return true, sar, nil
+	})
+
+	err := CheckServicePatchPermissions(clientset, "test-ns")
+	if err == nil || !strings.Contains(err.Error(), "patch") {
+		t.Errorf("Expected the missing patch permission to be reported, got: %v", err)
+	}
+}
+
+func TestPatchServiceAnnotations(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "test-ns",
+			Annotations: map[string]string{"keep": "yes", "stale": "old"},
+		},
+	})
+
+	domains := "web.test-ns.svc.foo.remote"
+	err := PatchServiceAnnotations(clientset, "test-ns", "web", map[string]*string{"domains": &domains, "stale": nil}, "test-manager")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	service, err := clientset.CoreV1().Services("test-ns").Get(context.Background(), "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get Service: %v", err)
+	}
+	expected := map[string]string{"keep": "yes", "domains": domains}
+	if !reflect.DeepEqual(service.Annotations, expected) {
+		t.Errorf("Expected annotations %v, got: %v", expected, service.Annotations)
+	}
+}
@@ -0,0 +1,30 @@
+package k8sclient
+
+import (
+	"context"
+	"encoding/json"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// PatchServiceAnnotations sets the annotations of a Service with a merge patch written under fieldManager,
+// a nil value removes the annotation. Other annotations are left untouched.
+func PatchServiceAnnotations(clientset kubernetes.Interface, namespace, name string, annotations map[string]*string, fieldManager string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = clientset.CoreV1().Services(namespace).Patch(context.Background(), name, types.MergePatchType, patch, metav1.PatchOptions{FieldManager: fieldManager})
+	if err != nil {
+		klog.Errorf("Failed to patch annotations of Service %s/%s: %v", namespace, name, err)
+		return err
+	}
+	klog.V(4).Infof("Patched annotations of Service %s/%s", namespace, name)
+	return nil
+}
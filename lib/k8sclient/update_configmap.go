@@ -12,37 +12,67 @@ import (
 
 const CaddyConfigMapName = "caddy-config"
 const CaddyConfigKey = "Caddyfile"
+const CaddyJSONConfigKey = "caddy.json"
 
 // UpdateCaddyConfigMap creates or updates the ConfigMap with Caddy configuration
 func UpdateCaddyConfigMap(clientset kubernetes.Interface, namespaceProvided *string, caddyConfig string) error {
+	return UpdateCaddyConfigMapKey(clientset, namespaceProvided, CaddyConfigKey, caddyConfig)
+}
+
+// UpdateCaddyConfigMapKey creates or updates the ConfigMap with Caddy configuration stored under key,
+// other keys of an existing ConfigMap are left untouched
+func UpdateCaddyConfigMapKey(clientset kubernetes.Interface, namespaceProvided *string, key string, caddyConfig string) error {
+	return UpdateConfigMapData(clientset, namespaceProvided, CaddyConfigMapName, map[string]string{key: caddyConfig})
+}
+
+// ReplaceCaddyConfig creates or updates the ConfigMap with Caddy configuration stored under key, one of
+// CaddyConfigKey and CaddyJSONConfigKey, and removes the other one so a stale configuration in the other
+// format is never loaded. Other keys of an existing ConfigMap are left untouched.
+func ReplaceCaddyConfig(clientset kubernetes.Interface, namespaceProvided *string, key string, caddyConfig string) error {
+	stale := CaddyJSONConfigKey
+	if key == CaddyJSONConfigKey {
+		stale = CaddyConfigKey
+	}
+	return updateConfigMap(clientset, namespaceProvided, CaddyConfigMapName, map[string]string{key: caddyConfig}, []string{stale})
+}
+
+// UpdateConfigMapData creates or updates the ConfigMap name with the given keys,
+// other keys of an existing ConfigMap are left untouched
+func UpdateConfigMapData(clientset kubernetes.Interface, namespaceProvided *string, name string, data map[string]string) error {
+	return updateConfigMap(clientset, namespaceProvided, name, data, nil)
+}
+
+// updateConfigMap creates or updates the ConfigMap name with the given keys and removes the keys in remove
+func updateConfigMap(clientset kubernetes.Interface, namespaceProvided *string, name string, data map[string]string, remove []string) error {
 	ctx := context.Background()
 	ns := getCurrentNamespaceOrProvided(namespaceProvided)
 
 	configMaps := clientset.CoreV1().ConfigMaps(ns)
 
 	// Check if ConfigMap exists
-	existingCM, err := configMaps.Get(ctx, CaddyConfigMapName, metav1.GetOptions{})
+	existingCM, err := configMaps.Get(ctx, name, metav1.GetOptions{})
 	if err != nil {
 		if errors.IsNotFound(err) {
 			// ConfigMap does not exist, create it
 			newCM := &v1.ConfigMap{
 				ObjectMeta: metav1.ObjectMeta{
-					Name:      CaddyConfigMapName,
+					Name:      name,
 					Namespace: ns,
 				},
-				Data: map[string]string{
-					CaddyConfigKey: caddyConfig,
-				},
+				Data: make(map[string]string, len(data)),
+			}
+			for key, value := range data {
+				newCM.Data[key] = value
 			}
 			_, err = configMaps.Create(ctx, newCM, metav1.CreateOptions{})
 			if err != nil {
-				klog.Errorf("Failed to create ConfigMap %s: %v", CaddyConfigMapName, err)
+				klog.Errorf("Failed to create ConfigMap %s: %v", name, err)
 				return err
 			}
-			klog.Infof("Created ConfigMap %s successfully", CaddyConfigMapName)
+			klog.Infof("Created ConfigMap %s successfully", name)
 			return nil
 		}
-		klog.Errorf("Failed to get ConfigMap %s: %v", CaddyConfigMapName, err)
+		klog.Errorf("Failed to get ConfigMap %s: %v", name, err)
 		return err
 	}
 
@@ -50,13 +80,18 @@ func UpdateCaddyConfigMap(clientset kubernetes.Interface, namespaceProvided *str
 	if existingCM.Data == nil {
 		existingCM.Data = make(map[string]string)
 	}
-	existingCM.Data[CaddyConfigKey] = caddyConfig
+	for _, key := range remove {
+		delete(existingCM.Data, key)
+	}
+	for key, value := range data {
+		existingCM.Data[key] = value
+	}
 
 	_, err = configMaps.Update(ctx, existingCM, metav1.UpdateOptions{})
 	if err != nil {
-		klog.Errorf("Failed to update ConfigMap %s: %v", CaddyConfigMapName, err)
+		klog.Errorf("Failed to update ConfigMap %s: %v", name, err)
 		return err
 	}
-	klog.Infof("Updated ConfigMap %s successfully", CaddyConfigMapName)
+	klog.Infof("Updated ConfigMap %s successfully", name)
 	return nil
-}
\ No newline at end of file
+}
@@ -1,16 +1,136 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 
 	k8sclient "github.com/wold9168/k8s-cross-cluster/lib/k8sclient"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/apis/crosscluster/v1alpha1"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/caddyadmin"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/catalog"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/clusteridentity"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/controller"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/coredns"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/crossclusterservice"
 	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/mcs"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/peers"
 )
 
 func main() {
+	klog.InitFlags(nil)
+	resyncPeriod := flag.Duration("resync-period", 10*time.Minute, "informer resync period, only used as a safety net since changes are watched")
+	workers := flag.Int("workers", 1, "number of reconcile workers")
+	caddyAdminURL := flag.String("caddy-admin-url", "", "Caddy admin API address (e.g. "+caddyadmin.DefaultAdminURL+") used to load the config live; empty disables it and only the ConfigMap is written")
+	caddyAdminTimeout := flag.Duration("caddy-admin-timeout", 5*time.Second, "timeout for each request to the Caddy admin API")
+	configFormat := flag.String("config-format", controller.ConfigFormatCaddyfile, "format of the generated Caddy config: \"caddyfile\" (ConfigMap key Caddyfile) or \"json\" (ConfigMap key caddy.json, requires -caddy-admin-url), the key of the other format is removed")
+	l4Forwarding := flag.Bool("l4-forwarding", false, "forward non-HTTP Service ports (TCP/UDP) with the built-in layer-4 forwarder, one listener per exported port; the listener ports must be exposed on the proxy Service, peers have no outbound layer-4 route yet")
+	l4ListenHost := flag.String("l4-listen-host", "", "address the layer-4 listeners bind to, empty binds all interfaces")
+	exportMode := flag.String("export-mode", generator.ExportModeAllow, "default for Services without the cross-cluster.io/export annotation or label: \"allow\" exports them, \"deny\" requires opting in")
+	proxyServiceName := flag.String("proxy-service", "tailscale-proxy", "name of the proxy's own Service, never exported to avoid loops")
+	allNamespaces := flag.Bool("all-namespaces", false, "discover Services in every namespace instead of only the manager's namespace (requires the ClusterRole of tailscale-rbac-all-namespaces.yaml)")
+	namespaceSelector := flag.String("namespace-selector", "", "label selector restricting discovery to matching namespaces, implies -all-namespaces (e.g. cross-cluster.io/export=true)")
+	remoteDomainTemplate := flag.String("remote-domain-template", generator.DefaultRemoteDomainTemplate, "Go template of remote domains, they must end in -remote-zone, variables: .Service .Namespace .ClusterName .ClusterDomain .Zone .PortName .Port .Labels")
+	upstreamHostTemplate := flag.String("upstream-host-template", generator.DefaultUpstreamHostTemplate, "Go template of the local upstream host, same variables as -remote-domain-template")
+	clusterDomain := flag.String("cluster-domain", "", "DNS domain of the local cluster used for upstream hosts, empty reads the CLUSTER_DOMAIN key of -cluster-name-configmap or detects it from /etc/resolv.conf")
+	clusterName := flag.String("cluster-name", "", "name of the local cluster used in remote domains, read by the flag source")
+	clusterNameSources := flag.String("cluster-name-sources", strings.Join(clusteridentity.DefaultSources, ","), "comma-separated sources asked in order for the cluster name: flag, env ($"+clusteridentity.EnvClusterName+"), configmap, clusterproperty (about.k8s.io "+clusteridentity.ClusterPropertyName+"), kube-system-uid")
+	clusterNameConfigMap := flag.String("cluster-name-configmap", clusteridentity.DefaultConfigMapRef.Namespace+"/"+clusteridentity.DefaultConfigMapRef.Name, "<namespace>/<name> of the ConfigMap read by the configmap source, also holding the CLUSTER_DOMAIN override")
+	clusterNameKey := flag.String("cluster-name-key", clusteridentity.DefaultConfigMapRef.Key, "key of the cluster name in -cluster-name-configmap")
+	allowPlaceholderClusterName := flag.Bool("allow-placeholder-cluster-name", false, "publish under the placeholder name \""+clusteridentity.PlaceholderClusterName+"\" when no source names the cluster, two such clusters publish colliding domains")
+	coreDNSMode := flag.String("coredns-mode", coredns.ModeNone, "make remote domains resolvable in this cluster: \"none\", \"corefile\" (managed block in kube-system/coredns) or \"custom\" (key cross-cluster.server in kube-system/coredns-custom)")
+	remoteZone := flag.String("remote-zone", coredns.DefaultZone, "DNS zone of the remote domains, routed to the proxy Service by CoreDNS and served by the embedded DNS server")
+	dnsListenAddress := flag.String("dns-listen-address", "", "address of the embedded authoritative DNS server for -remote-zone (e.g. :5353), empty disables it")
+	headlessPodRoutes := flag.Bool("headless-pod-routes", true, "watch EndpointSlices and give every pod of a headless Service its own remote domain (<hostname>.<service remote domain>), for StatefulSets")
+	endpointAware := flag.Bool("endpoint-aware", false, "watch EndpointSlices and answer 503 with a body naming the cluster and Service on the HTTP routes of Services without ready endpoints, instead of an opaque 502")
+	podUpstreams := flag.Bool("pod-upstreams", false, "proxy HTTP routes directly to the ready pod addresses of their Service instead of its ClusterIP, implies -endpoint-aware")
+	lbPolicy := flag.String("lb-policy", "", "load-balancing policy across pod upstreams: round_robin, random, least_conn, first, ip_hash, client_ip_hash or uri_hash (default Caddy's, random)")
+	probeHealthChecks := flag.Bool("probe-health-checks", false, "watch Pods and derive active and passive health checks of the HTTP routes proxied to pods (pod upstreams or headless Services) from the HTTP readinessProbe of their pods, the "+generator.AnnotationHealthCheckPath+" and related annotations apply either way")
+	externalNameServices := flag.String("external-name-services", generator.BackendPolicyProxy, "ExternalName Services: \"proxy\" to spec.externalName with the Host header set to it (override with the "+generator.AnnotationUpstreamHostHeader+" annotation) or \"skip\"")
+	selectorLessServices := flag.String("selectorless-services", generator.BackendPolicyProxy, "Services without a selector: \"proxy\" always publishes them, \"endpoints\" only while their manual EndpointSlices have a ready endpoint, \"skip\" never")
+	staticPeers := flag.String("peers", "", "comma-separated peer cluster names whose remote domains (*.svc.<peer>.<remote-zone>) are forwarded from the local proxy to <peer>"+generator.DefaultGatewaySuffix+" over the tailnet")
+	peerGatewayPort := flag.Int("peer-gateway-port", generator.DefaultGatewayPort, "port of Caddy on the peer gateways reached over the tailnet")
+	outboundProxyURL := flag.String("outbound-proxy-url", generator.DefaultForwardProxyURL, "tailscale proxy the peer gateways are dialed through, the HTTP proxy (http://127.0.0.1:1050) or SOCKS5 (socks5://127.0.0.1:1055)")
+	peerDiscovery := flag.String("peer-discovery", "", "discover peer clusters from their <cluster>"+generator.DefaultGatewaySuffix+" gateways: \"localapi\" (tailscaled socket), \"tailscale\" or \"headscale\" (API key in $"+peers.EnvAPIKey+"), empty disables it")
+	peerDiscoveryInterval := flag.Duration("peer-discovery-interval", peers.DefaultInterval, "how often peer clusters are discovered")
+	peerAPIURL := flag.String("peer-api-url", "", "control-plane API of -peer-discovery tailscale (default "+peers.DefaultTailscaleAPIURL+") or headscale (required)")
+	tailnet := flag.String("tailnet", peers.DefaultTailnet, "tailnet listed by -peer-discovery tailscale, \"-\" is the tailnet of the API key")
+	tailscaleSocket := flag.String("tailscale-socket", peers.DefaultLocalAPISocket, "tailscaled socket used by -peer-discovery localapi")
+	catalogPort := flag.Int("catalog-port", 0, "serve the export catalog on 127.0.0.1:<port>"+catalog.Path+", reachable by peers over the tailnet only (e.g. "+strconv.Itoa(catalog.DefaultPort)+"), 0 disables it; the manager must run as a container of the tailscale pod, tailscaled only forwards to that pod's loopback")
+	fetchPeerCatalogs := flag.Bool("fetch-peer-catalogs", false, "fetch the export catalog of every peer and forward only the remote domains it exports instead of *.svc.<peer>.<remote-zone>, peers that never returned a catalog keep the wildcard")
+	catalogFetchInterval := flag.Duration("catalog-fetch-interval", catalog.DefaultFetchInterval, "how often peer catalogs are fetched")
+	catalogStaleAfter := flag.Duration("catalog-stale-after", catalog.DefaultStaleAfter, "stop routing to a peer whose catalog could not be fetched for this long")
+	mcsExports := flag.Bool("mcs-exports", false, "export exactly the Services with a "+mcs.Group+" ServiceExport of the same name, reporting Valid and Ready conditions on it, instead of -export-mode and the "+generator.AnnotationExport+" annotation")
+	mcsImports := flag.Bool("mcs-imports", false, "create a ServiceImport backed by the proxy Service for every HTTP Service exported by this cluster or a peer, reachable as <service>.<namespace>.svc."+mcs.ClusterSetDomain+" through a CoreDNS multicluster plugin, requires -fetch-peer-catalogs")
+	mcsImportPort := flag.Int("mcs-import-port", mcs.DefaultImportPort, "port of the proxy Service serving Caddy's HTTP sites, the port of the ServiceImports")
+	annotateServices := flag.Bool("annotate-services", true, "write the remote domains, cluster name and the time they were first published onto every exported Service, and why a Service was skipped, as "+controller.AnnotationRemoteDomains+" and related annotations")
+	recordEvents := flag.Bool("events", true, "record Kubernetes Events for publish outcomes, missing permissions and skipped Services, repeated Events are aggregated")
+	podName := flag.String("pod-name", os.Getenv("POD_NAME"), "name of the manager's own Pod, Events about the manager are recorded on it (default $POD_NAME, the hostname when unset)")
+	crossClusterServices := flag.Bool("cross-cluster-services", false, "export the Services referenced by "+v1alpha1.GroupName+" CrossClusterServices with their routing options and report the generated domains in their status, the CRD must be installed")
+	coreDNSCleanup := flag.Bool("coredns-cleanup", false, "remove the CoreDNS server block in both modes and exit, run when uninstalling")
+	flag.Parse()
+
+	if err := controller.ValidateConfigFormat(*configFormat); err != nil {
+		klog.Fatalf("Invalid -config-format: %v", err)
+	}
+	// Caddy 只监视启动时选定的配置文件，JSON 配置须经 admin API 加载才能即时生效
+	if *configFormat == controller.ConfigFormatJSON && *caddyAdminURL == "" {
+		klog.Fatalf("-config-format %s requires -caddy-admin-url, Caddy does not pick up caddy.json from the ConfigMap until it restarts", controller.ConfigFormatJSON)
+	}
+	if err := generator.ValidateExportMode(*exportMode); err != nil {
+		klog.Fatalf("Invalid -export-mode: %v", err)
+	}
+	if err := generator.ValidateForwardProxyURL(*outboundProxyURL); err != nil {
+		klog.Fatalf("Invalid -outbound-proxy-url: %v", err)
+	}
+	if err := generator.ValidateLBPolicy(*lbPolicy); err != nil {
+		klog.Fatalf("Invalid -lb-policy: %v", err)
+	}
+	backendPolicy := generator.BackendPolicy{ExternalName: *externalNameServices, SelectorLess: *selectorLessServices}
+	if err := generator.ValidateBackendPolicy(backendPolicy); err != nil {
+		klog.Fatalf("Invalid Service backend policy: %v", err)
+	}
+	domainTemplates, err := generator.NewDomainTemplates(*remoteDomainTemplate, *upstreamHostTemplate)
+	if err != nil {
+		klog.Fatalf("Invalid domain template: %v", err)
+	}
+	// 远程域名必须位于 -remote-zone 之内，否则 CoreDNS、内置 DNS 与 catalog 均无法匹配
+	domainTemplates, err = domainTemplates.WithZone(*remoteZone)
+	if err != nil {
+		klog.Fatalf("Invalid -remote-domain-template or -remote-zone: %v", err)
+	}
+	if err := coredns.ValidateMode(*coreDNSMode); err != nil {
+		klog.Fatalf("Invalid -coredns-mode: %v", err)
+	}
+	sources, err := clusteridentity.ParseSources(*clusterNameSources)
+	if err != nil {
+		klog.Fatalf("Invalid -cluster-name-sources: %v", err)
+	}
+	clusterNameRef, err := clusteridentity.ParseConfigMapRef(*clusterNameConfigMap, *clusterNameKey)
+	if err != nil {
+		klog.Fatalf("Invalid -cluster-name-configmap: %v", err)
+	}
+	var selector labels.Selector
+	if *namespaceSelector != "" {
+		parsed, err := labels.Parse(*namespaceSelector)
+		if err != nil {
+			klog.Fatalf("Invalid -namespace-selector: %v", err)
+		}
+		selector = parsed
+	}
+
 	// Authentication
 	config, err := k8sclient.GetConfig()
 	if err != nil {
@@ -24,58 +144,170 @@ func main() {
 		panic(err.Error())
 	}
 
-	for {
-		// 鉴权检查：验证当前上下文是否支持读写 ConfigMaps 和读取 Services
-		if err := k8sclient.CheckPermissions(clientset, nil); err != nil {
-			klog.Errorf("Permission check failed: %v, retrying in 10 seconds...", err)
-			time.Sleep(10 * time.Second)
-			continue
+	// 卸载时清理 CoreDNS 中由本程序管理的配置后退出
+	if *coreDNSCleanup {
+		failed := false
+		for _, mode := range []string{coredns.ModeCorefile, coredns.ModeCustom} {
+			if err := coredns.NewManager(clientset, mode, *remoteZone).Cleanup(context.Background()); err != nil {
+				klog.Errorf("CoreDNS cleanup in %s mode failed: %v", mode, err)
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
 		}
+		return
+	}
+
+	// ClusterProperty 是 CRD，需通过 dynamic 客户端读取
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		klog.Error("Creating dynamic client failed due to ", err.Error())
+		panic(err.Error())
+	}
+	// 按 -cluster-name-sources 的顺序确定集群名称，默认拒绝使用占位名称以免与其他集群的域名冲突
+	clusterIdentity, err := clusteridentity.NewChainFromSources(sources, clusteridentity.Config{
+		FlagValue:        *clusterName,
+		ConfigMap:        clusterNameRef,
+		Clientset:        clientset,
+		DynamicClient:    dynamicClient,
+		AllowPlaceholder: *allowPlaceholderClusterName,
+	})
+	if err != nil {
+		klog.Fatalf("Invalid cluster name sources: %v", err)
+	}
 
-		// 获取当前命名空间中的所有 ConfigMap
-		configMapList, err := k8sclient.GetAllConfigMapsInCurrentNamespace(clientset, nil)
+	// 确定当前命名空间，Service 的监听与 Caddy ConfigMap 的写入都在该命名空间中进行
+	namespace, err := k8sclient.GetCurrentNamespace()
+	if err != nil {
+		klog.Warningf("Could not determine current namespace, using '%s': %v", namespace, err)
+	}
+
+	// 通过 tailnet 控制面或 tailscaled LocalAPI 发现其他集群的网关
+	var peerRegistry *peers.Registry
+	if *peerDiscovery != "" {
+		source, err := peers.NewSource(*peerDiscovery, peers.SourceConfig{
+			Socket:  *tailscaleSocket,
+			APIURL:  *peerAPIURL,
+			Tailnet: *tailnet,
+			APIKey:  os.Getenv(peers.EnvAPIKey),
+			Timeout: 10 * time.Second,
+		})
 		if err != nil {
-			// 如果获取 ConfigMap 失败，记录错误但不 panic，继续执行
-			klog.Errorf("Failed to list ConfigMaps: %v\n", err)
-		} else {
-			for _, cm := range configMapList.Items {
-				klog.Infof("Successfully retrieved ConfigMap: %s\n", cm.Name)
-			}
+			klog.Fatalf("Invalid -peer-discovery: %v", err)
 		}
+		peerRegistry = peers.NewRegistry(source, generator.DefaultGatewaySuffix, *peerDiscoveryInterval)
+	}
 
-		// 获取当前命名空间中的所有 Service
-		serviceList, err := k8sclient.GetAllServicesInCurrentNamespace(clientset, nil)
+	// 通过 tailnet 拉取其他集群导出的服务目录，只转发其中列出的域名
+	var catalogFetcher *catalog.Fetcher
+	if *fetchPeerCatalogs {
+		port := *catalogPort
+		if port == 0 {
+			port = catalog.DefaultPort
+		}
+		catalogFetcher, err = catalog.NewFetcher(catalog.FetcherOptions{
+			ProxyURL:   *outboundProxyURL,
+			Port:       port,
+			Interval:   *catalogFetchInterval,
+			StaleAfter: *catalogStaleAfter,
+		})
 		if err != nil {
-			// 如果获取 Service 失败，记录错误但不 panic，继续执行
-			klog.Errorf("Failed to list Services: %v\n", err)
-		} else {
-			for _, svc := range serviceList.Items {
-				klog.Infof("Successfully retrieved Service: %s\n", svc.Name)
-			}
+			klog.Fatalf("Invalid -outbound-proxy-url: %v", err)
+		}
+	}
 
-			// 根据 Service 生成对应的跨集群访问域名
-			remoteDomains, domainMapping := generator.GenerateCrossClusterServiceDomains(clientset, serviceList)
-			for _, remoteDomain := range remoteDomains {
-				klog.Infof("Remote domain: %s -> Local domain: %s\n", remoteDomain, domainMapping[remoteDomain])
-			}
+	// Kubernetes Multi-Cluster Services API：以 ServiceExport 作为导出信号，并为其他集群导出的服务创建 ServiceImport
+	var mcsManager *mcs.Manager
+	if *mcsExports || *mcsImports {
+		if *mcsImports && !*fetchPeerCatalogs {
+			klog.Fatal("-mcs-imports requires -fetch-peer-catalogs, the peer catalogs list the Services to import")
+		}
+		mcsManager = mcs.NewManager(dynamicClient, mcs.Options{
+			Exports:    *mcsExports,
+			Imports:    *mcsImports,
+			ImportPort: int32(*mcsImportPort),
+		})
+	}
 
-			// 根据跨集群访问域名生成对应的 ConfigMap
-			caddyConfig := generator.GenerateCaddyConfig(remoteDomains, domainMapping)
+	// CrossClusterService 是 CRD，需通过 dynamic 客户端读取并写回状态
+	var crossClusterServiceManager *crossclusterservice.Manager
+	if *crossClusterServices {
+		crossClusterServiceManager = crossclusterservice.NewManager(dynamicClient)
+	}
 
-			// 将 ConfigMap 写入到集群中
-			targetNamespace, nsErr := k8sclient.GetCurrentNamespace()
-			if nsErr != nil {
-				klog.Warningf("Could not determine current namespace: %v", nsErr)
-				targetNamespace = "unknown"
-			}
-			klog.Infof("Writing Caddy config to namespace '%s':\n%s", targetNamespace, caddyConfig)
-			err = k8sclient.UpdateCaddyConfigMap(clientset, nil, caddyConfig)
-			if err != nil {
-				klog.Errorf("Failed to update Caddy ConfigMap: %v", err)
-			}
+	// 在 CoreDNS 中将远程域名解析到 tailscale-proxy Service
+	var coreDNSManager *coredns.Manager
+	if *coreDNSMode != coredns.ModeNone {
+		coreDNSManager = coredns.NewManager(clientset, *coreDNSMode, *remoteZone)
+	}
+
+	// 以 Kubernetes Event 记录发布结果、权限缺失与被跳过的 Service，重复的 Event 会被聚合
+	var recorder record.EventRecorder
+	if *recordEvents {
+		var stopRecorder func()
+		recorder, stopRecorder = controller.NewEventRecorder(clientset)
+		defer stopRecorder()
+		if *podName == "" {
+			// Pod 的主机名默认即为 Pod 名称
+			*podName, _ = os.Hostname()
 		}
+	}
+
+	// 收到 SIGINT/SIGTERM 时取消 context，使控制器优雅退出
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// 基于 informer 与 workqueue 的控制器：监听 Service 与集群名称 ConfigMap 的变化并重新生成 Caddy 配置
+	ctrl := controller.New(clientset, controller.Options{
+		Namespace:            namespace,
+		ResyncPeriod:         *resyncPeriod,
+		CaddyAdminURL:        *caddyAdminURL,
+		CaddyAdminTimeout:    *caddyAdminTimeout,
+		ConfigFormat:         *configFormat,
+		L4Forwarding:         *l4Forwarding,
+		L4ListenHost:         *l4ListenHost,
+		ExportMode:           *exportMode,
+		ProxyServiceName:     *proxyServiceName,
+		AllNamespaces:        *allNamespaces,
+		NamespaceSelector:    selector,
+		DomainTemplates:      domainTemplates,
+		ClusterDomain:        *clusterDomain,
+		ClusterIdentity:      clusterIdentity,
+		ClusterNameConfigMap: clusterNameRef,
+		CoreDNS:              coreDNSManager,
+		DNSListenAddress:     *dnsListenAddress,
+		DNSZone:              *remoteZone,
+		HeadlessPodRoutes:    *headlessPodRoutes,
+		BackendPolicy:        backendPolicy,
+		EndpointAware:        *endpointAware,
+		PodUpstreams:         *podUpstreams,
+		LBPolicy:             *lbPolicy,
+		ProbeHealthChecks:    *probeHealthChecks,
+		Peers:                splitList(*staticPeers),
+		PeerGatewayPort:      int32(*peerGatewayPort),
+		OutboundProxyURL:     *outboundProxyURL,
+		PeerRegistry:         peerRegistry,
+		CatalogPort:          *catalogPort,
+		CatalogFetcher:       catalogFetcher,
+		MCS:                  mcsManager,
+		AnnotateServices:     *annotateServices,
+		EventRecorder:        recorder,
+		PodName:              *podName,
+		CrossClusterServices: crossClusterServiceManager,
+	})
+	if err := ctrl.Run(ctx, *workers); err != nil {
+		klog.Fatalf("Controller exited with error: %v", err)
+	}
+}
 
-		// 每次循环后暂停 10 秒，避免对 API Server 造成过大压力
-		time.Sleep(10 * time.Second)
+// splitList splits a comma-separated flag value, dropping empty items
+func splitList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
+	return items
 }
@@ -0,0 +1,5 @@
+// Package v1alpha1 holds the CrossClusterService API, read and written through the dynamic client
+//
+// +k8s:deepcopy-gen=package
+// +groupName=cross-cluster.io
+package v1alpha1
@@ -0,0 +1,32 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// GroupName is the API group of the cross-cluster resources, the prefix of the cross-cluster.io annotations
+const GroupName = "cross-cluster.io"
+
+// SchemeGroupVersion is the group version of the types of this package
+var SchemeGroupVersion = schema.GroupVersion{Group: GroupName, Version: "v1alpha1"}
+
+// CrossClusterServiceGVR is the resource of CrossClusterServices
+var CrossClusterServiceGVR = SchemeGroupVersion.WithResource("crossclusterservices")
+
+var (
+	// SchemeBuilder registers the types of this package
+	SchemeBuilder = runtime.NewSchemeBuilder(addKnownTypes)
+	// AddToScheme adds the types of this package to a scheme
+	AddToScheme = SchemeBuilder.AddToScheme
+)
+
+func addKnownTypes(scheme *runtime.Scheme) error {
+	scheme.AddKnownTypes(SchemeGroupVersion,
+		&CrossClusterService{},
+		&CrossClusterServiceList{},
+	)
+	metav1.AddToGroupVersion(scheme, SchemeGroupVersion)
+	return nil
+}
@@ -0,0 +1,81 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ConditionReady reports whether every route of the referenced Service is published
+const ConditionReady = "Ready"
+
+// Reasons of the Ready condition
+const (
+	// ReasonPublished means the routes are in the Caddy configuration written last
+	ReasonPublished = "Published"
+	// ReasonInvalid means the spec or the referenced Service has errors, listed in status.validationErrors
+	ReasonInvalid = "Invalid"
+	// ReasonPending means the Caddy configuration holding the routes has not been written yet
+	ReasonPending = "Pending"
+)
+
+// CrossClusterService exports a Service to the peer clusters with routing options
+// that do not fit in annotations, and reports whether the export works
+//
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+type CrossClusterService struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CrossClusterServiceSpec   `json:"spec,omitempty"`
+	Status CrossClusterServiceStatus `json:"status,omitempty"`
+}
+
+// CrossClusterServiceSpec references the exported Service and how it is routed.
+// The options take precedence over the cross-cluster.io annotations of the Service.
+type CrossClusterServiceSpec struct {
+	// ServiceName is the Service in the same namespace, the name of the CrossClusterService when empty
+	ServiceName string `json:"serviceName,omitempty"`
+	// Ports restricts the exported ports by name or number, every port when empty
+	Ports []string `json:"ports,omitempty"`
+	// Protocols overrides protocol detection per port name or number: http, tcp or udp
+	Protocols map[string]string `json:"protocols,omitempty"`
+	// ListenPorts sets the layer-4 listener port per port name or number
+	ListenPorts map[string]int32 `json:"listenPorts,omitempty"`
+	// Aliases are extra hostnames of the service-level domain
+	Aliases []string `json:"aliases,omitempty"`
+	// UpstreamHostHeader is "preserve", "upstream" or a hostname sent as the Host header
+	UpstreamHostHeader string `json:"upstreamHostHeader,omitempty"`
+}
+
+// CrossClusterServiceStatus reports the routes generated for the Service
+type CrossClusterServiceStatus struct {
+	// ObservedGeneration is the generation of the spec the status was computed from
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// RemoteDomains are the published domains of the Service, sorted
+	RemoteDomains []string `json:"remoteDomains,omitempty"`
+	// Upstream is the local address the service-level domain is proxied to
+	Upstream string `json:"upstream,omitempty"`
+	// ConfigRevision identifies the Caddy configuration the routes were published in
+	ConfigRevision string `json:"configRevision,omitempty"`
+	// ValidationErrors lists the spec errors and the routes left out
+	ValidationErrors []string `json:"validationErrors,omitempty"`
+	// Conditions holds the Ready condition
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// CrossClusterServiceList is a list of CrossClusterServices
+//
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+type CrossClusterServiceList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []CrossClusterService `json:"items"`
+}
+
+// TargetService returns the name of the referenced Service
+func (c *CrossClusterService) TargetService() string {
+	if c.Spec.ServiceName != "" {
+		return c.Spec.ServiceName
+	}
+	return c.Name
+}
@@ -0,0 +1,120 @@
+package caddyadmin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// DefaultAdminURL is the address Caddy's admin API listens on by default inside the pod
+	DefaultAdminURL = "http://localhost:2019"
+
+	// ContentTypeCaddyfile makes Caddy adapt the request body with the Caddyfile adapter
+	ContentTypeCaddyfile = "text/caddyfile"
+	// ContentTypeJSON is Caddy's native JSON configuration
+	ContentTypeJSON = "application/json"
+)
+
+// maxErrorBodySize limits how much of an error response is kept in the returned error
+const maxErrorBodySize = 4096
+
+// UnreachableError is returned when the admin API could not be contacted at all,
+// as opposed to Caddy answering and rejecting the configuration
+type UnreachableError struct {
+	Err error
+}
+
+func (e *UnreachableError) Error() string {
+	return fmt.Sprintf("caddy admin API unreachable: %v", e.Err)
+}
+
+func (e *UnreachableError) Unwrap() error {
+	return e.Err
+}
+
+// IsUnreachable reports whether err means the admin API could not be contacted
+func IsUnreachable(err error) bool {
+	var unreachable *UnreachableError
+	return errors.As(err, &unreachable)
+}
+
+// Client is a minimal client for Caddy's admin API
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+// NewClient creates a client for the admin API at baseURL
+func NewClient(baseURL string, timeout time.Duration) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: timeout},
+	}
+}
+
+// Load replaces Caddy's running configuration through POST /load and verifies it was accepted.
+// contentType selects the config adapter, e.g. ContentTypeCaddyfile or ContentTypeJSON.
+func (c *Client) Load(ctx context.Context, config []byte, contentType string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/load", bytes.NewReader(config))
+	if err != nil {
+		return fmt.Errorf("failed to build /load request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	// Force a reload even when Caddy considers the configuration unchanged
+	req.Header.Set("Cache-Control", "must-revalidate")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return &UnreachableError{Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("caddy rejected configuration: %s: %s", resp.Status, readErrorBody(resp.Body))
+	}
+
+	if err := c.verify(ctx); err != nil {
+		return fmt.Errorf("failed to verify loaded configuration: %w", err)
+	}
+
+	klog.Infof("Loaded configuration into Caddy through admin API %s", c.BaseURL)
+	return nil
+}
+
+// verify reads back the active configuration to make sure Caddy is serving a config after /load
+func (c *Client) verify(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+"/config/", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return &UnreachableError{Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET /config/ returned %s: %s", resp.Status, readErrorBody(resp.Body))
+	}
+
+	var active json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&active); err != nil {
+		return fmt.Errorf("GET /config/ returned invalid JSON: %w", err)
+	}
+	return nil
+}
+
+func readErrorBody(body io.Reader) string {
+	data, _ := io.ReadAll(io.LimitReader(body, maxErrorBodySize))
+	return strings.TrimSpace(string(data))
+}
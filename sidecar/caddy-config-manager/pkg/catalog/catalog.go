@@ -0,0 +1,211 @@
+package catalog
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+)
+
+const (
+	// Version is the catalog format version, a catalog with another version is refused
+	Version = 1
+	// Path is where the catalog is served, versioned like the format
+	Path = "/v1/catalog"
+	// DefaultPort is the suggested catalog port, the configured one is reserved from layer-4 listeners
+	DefaultPort = 2020
+	// AnnotationMetadataPrefix marks Service annotations published as catalog metadata,
+	// e.g. meta.cross-cluster.io/owner: payments-team is published as owner: payments-team
+	AnnotationMetadataPrefix = "meta.cross-cluster.io/"
+)
+
+// Catalog lists the Services a cluster exports
+type Catalog struct {
+	Version     int       `json:"version"`
+	Cluster     string    `json:"cluster"`
+	GeneratedAt time.Time `json:"generatedAt"`
+	Services    []Service `json:"services"`
+}
+
+// Service is an exported Service and the remote domains reaching it
+type Service struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// RemoteDomain is the service-level domain, served with Protocol
+	RemoteDomain string            `json:"remoteDomain"`
+	Protocol     string            `json:"protocol"`
+	Aliases      []string          `json:"aliases,omitempty"`
+	Ports        []Port            `json:"ports,omitempty"`
+	PodDomains   []string          `json:"podDomains,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// Port is an exported Service port
+type Port struct {
+	Name     string `json:"name,omitempty"`
+	Port     int32  `json:"port"`
+	Protocol string `json:"protocol"`
+	// RemoteDomains are the per-port domains, by name and by number
+	RemoteDomains []string `json:"remoteDomains"`
+	// ListenPort is the gateway port of a layer-4 port, 0 for HTTP ports
+	ListenPort int32 `json:"listenPort,omitempty"`
+}
+
+// Build builds the catalog of the routes published for the Services of serviceList, the same
+// routes the Caddy configuration is rendered from. Metadata is read from the Service annotations.
+func Build(cluster string, serviceList *v1.ServiceList, routes []generator.ServiceRoute, listeners []generator.L4Listener) *Catalog {
+	catalog := &Catalog{Version: Version, Cluster: cluster, GeneratedAt: time.Now().UTC(), Services: make([]Service, 0)}
+
+	metadata := make(map[string]map[string]string)
+	if serviceList != nil {
+		for i := range serviceList.Items {
+			service := &serviceList.Items[i]
+			metadata[service.Namespace+"/"+service.Name] = serviceMetadata(service)
+		}
+	}
+	listenPorts := make(map[string]int32, len(listeners))
+	for _, listener := range listeners {
+		listenPorts[portKey(listener.Namespace, listener.ServiceName, listener.Protocol, listener.Port)] = listener.ListenPort
+	}
+
+	index := make(map[string]int)
+	for _, route := range routes {
+		key := route.Namespace + "/" + route.ServiceName
+		i, exists := index[key]
+		if !exists {
+			i = len(catalog.Services)
+			index[key] = i
+			catalog.Services = append(catalog.Services, Service{
+				Namespace: route.Namespace,
+				Name:      route.ServiceName,
+				Metadata:  metadata[key],
+			})
+		}
+		service := &catalog.Services[i]
+
+		switch {
+		case route.Pod != "":
+			service.PodDomains = append(service.PodDomains, route.RemoteDomain)
+		case route.PortLabel == "":
+			service.RemoteDomain = route.RemoteDomain
+			service.Protocol = route.Protocol
+			service.Aliases = route.Aliases
+		default:
+			port := findPort(service, route)
+			port.RemoteDomains = append(port.RemoteDomains, route.RemoteDomain)
+		}
+	}
+
+	for i := range catalog.Services {
+		service := &catalog.Services[i]
+		for j := range service.Ports {
+			port := &service.Ports[j]
+			if port.Protocol != generator.ProtocolHTTP {
+				port.ListenPort = listenPorts[portKey(service.Namespace, service.Name, port.Protocol, port.Port)]
+			}
+		}
+	}
+	sort.Slice(catalog.Services, func(i, j int) bool {
+		if catalog.Services[i].Namespace != catalog.Services[j].Namespace {
+			return catalog.Services[i].Namespace < catalog.Services[j].Namespace
+		}
+		return catalog.Services[i].Name < catalog.Services[j].Name
+	})
+	return catalog
+}
+
+// Validate checks a catalog fetched from cluster
+func (c *Catalog) Validate(cluster string) error {
+	if c.Version != Version {
+		return fmt.Errorf("unsupported catalog version %d, expected %d", c.Version, Version)
+	}
+	if c.Cluster != cluster {
+		return fmt.Errorf("catalog is for cluster %q, expected %q", c.Cluster, cluster)
+	}
+	return nil
+}
+
+// HTTPHosts returns the domains of the catalog served by Caddy, sorted and deduplicated.
+// Only domains under suffix are returned, a peer cannot claim names outside its own domains.
+func (c *Catalog) HTTPHosts(suffix string) []string {
+	hosts, _ := c.partitionHTTPHosts(suffix)
+	return hosts
+}
+
+// IgnoredHTTPHosts returns the domains of the catalog served by Caddy that HTTPHosts leaves out,
+// e.g. aliases or domains of a custom remote domain template, sorted and deduplicated
+func (c *Catalog) IgnoredHTTPHosts(suffix string) []string {
+	_, ignored := c.partitionHTTPHosts(suffix)
+	return ignored
+}
+
+// partitionHTTPHosts splits the HTTP domains of the catalog, aliases included, into those under suffix and the others
+func (c *Catalog) partitionHTTPHosts(suffix string) ([]string, []string) {
+	seen := make(map[string]bool)
+	add := func(domains ...string) {
+		for _, domain := range domains {
+			if domain != "" {
+				seen[domain] = strings.HasSuffix(domain, suffix)
+			}
+		}
+	}
+	for _, service := range c.Services {
+		if service.Protocol == generator.ProtocolHTTP {
+			add(service.RemoteDomain)
+			add(service.Aliases...)
+			add(service.PodDomains...)
+		}
+		for _, port := range service.Ports {
+			if port.Protocol == generator.ProtocolHTTP {
+				add(port.RemoteDomains...)
+			}
+		}
+	}
+
+	hosts := make([]string, 0, len(seen))
+	ignored := make([]string, 0)
+	for host, inside := range seen {
+		if inside {
+			hosts = append(hosts, host)
+		} else {
+			ignored = append(ignored, host)
+		}
+	}
+	sort.Strings(hosts)
+	sort.Strings(ignored)
+	return hosts, ignored
+}
+
+// findPort returns the catalog port of a per-port route, adding it on first use
+func findPort(service *Service, route generator.ServiceRoute) *Port {
+	for i := range service.Ports {
+		if service.Ports[i].Port == route.Port && service.Ports[i].Protocol == route.Protocol {
+			return &service.Ports[i]
+		}
+	}
+	service.Ports = append(service.Ports, Port{Name: route.PortName, Port: route.Port, Protocol: route.Protocol})
+	return &service.Ports[len(service.Ports)-1]
+}
+
+func serviceMetadata(service *v1.Service) map[string]string {
+	var metadata map[string]string
+	for key, value := range service.Annotations {
+		name, found := strings.CutPrefix(key, AnnotationMetadataPrefix)
+		if !found || name == "" {
+			continue
+		}
+		if metadata == nil {
+			metadata = make(map[string]string)
+		}
+		metadata[name] = value
+	}
+	return metadata
+}
+
+func portKey(namespace, service, protocol string, port int32) string {
+	return fmt.Sprintf("%s/%s/%s/%d", namespace, service, protocol, port)
+}
@@ -0,0 +1,296 @@
+package catalog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+)
+
+const (
+	// DefaultFetchInterval is how often peer catalogs are fetched
+	DefaultFetchInterval = 30 * time.Second
+	// DefaultStaleAfter is how long a peer catalog is used after the last successful fetch
+	DefaultStaleAfter = 5 * time.Minute
+)
+
+// FetcherOptions describes how peer catalogs are reached
+type FetcherOptions struct {
+	// ProxyURL is the tailscale proxy the peer gateways are dialed through, generator.DefaultForwardProxyURL when empty
+	ProxyURL string
+	// Port is the catalog port of the peer gateways, DefaultPort when 0
+	Port int
+	// GatewaySuffix forms the gateway hostname of a peer, generator.DefaultGatewaySuffix when empty
+	GatewaySuffix string
+	// Interval, StaleAfter and Timeout default to DefaultFetchInterval, DefaultStaleAfter and 10s
+	Interval   time.Duration
+	StaleAfter time.Duration
+	Timeout    time.Duration
+}
+
+// PeerCatalog is the last catalog fetched from a peer
+type PeerCatalog struct {
+	Catalog *Catalog
+	// LastFetched is the time of the last successful fetch, zero if none
+	LastFetched time.Time
+	// LastError is the error of the last fetch, nil when it succeeded
+	LastError error
+	// Stale is set when no fetch succeeded within the stale timeout, its catalog is then not used
+	Stale bool
+	etag  string
+}
+
+// Fetcher periodically fetches the catalogs of the peer clusters
+type Fetcher struct {
+	client        *http.Client
+	port          int
+	gatewaySuffix string
+	interval      time.Duration
+	staleAfter    time.Duration
+
+	mu       sync.RWMutex
+	catalogs map[string]*PeerCatalog
+	onChange func()
+}
+
+// NewFetcher creates a fetcher, an invalid proxy URL is refused
+func NewFetcher(opts FetcherOptions) (*Fetcher, error) {
+	proxyURL := opts.ProxyURL
+	if proxyURL == "" {
+		proxyURL = generator.DefaultForwardProxyURL
+	}
+	if err := generator.ValidateForwardProxyURL(proxyURL); err != nil {
+		return nil, err
+	}
+	proxy, _ := url.Parse(proxyURL)
+
+	f := &Fetcher{
+		client:        &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxy)}, Timeout: opts.Timeout},
+		port:          opts.Port,
+		gatewaySuffix: opts.GatewaySuffix,
+		interval:      opts.Interval,
+		staleAfter:    opts.StaleAfter,
+		catalogs:      make(map[string]*PeerCatalog),
+	}
+	if f.client.Timeout == 0 {
+		f.client.Timeout = 10 * time.Second
+	}
+	if f.port == 0 {
+		f.port = DefaultPort
+	}
+	if f.gatewaySuffix == "" {
+		f.gatewaySuffix = generator.DefaultGatewaySuffix
+	}
+	if f.interval == 0 {
+		f.interval = DefaultFetchInterval
+	}
+	if f.staleAfter == 0 {
+		f.staleAfter = DefaultStaleAfter
+	}
+	return f, nil
+}
+
+// SetOnChange registers a function called after a fetch changed a catalog or a peer became stale
+func (f *Fetcher) SetOnChange(onChange func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.onChange = onChange
+}
+
+// Run fetches the catalogs of the peers returned by peers every interval until ctx is done
+func (f *Fetcher) Run(ctx context.Context, peers func() []string) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		f.FetchAll(ctx, peers())
+	}, f.interval)
+}
+
+// FetchAll fetches the catalog of every peer once and forgets the peers no longer listed
+func (f *Fetcher) FetchAll(ctx context.Context, peers []string) {
+	changed := false
+	listed := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		listed[peer] = true
+		updated, err := f.fetch(ctx, peer)
+		if err != nil {
+			klog.Warningf("Failed to fetch the catalog of peer %s: %v", peer, err)
+		}
+		changed = changed || updated
+	}
+
+	f.mu.Lock()
+	for peer, entry := range f.catalogs {
+		if !listed[peer] {
+			delete(f.catalogs, peer)
+			changed = true
+			continue
+		}
+		if stale := time.Since(entry.LastFetched) > f.staleAfter; stale != entry.Stale {
+			if stale {
+				klog.Warningf("Catalog of peer %s is stale, not fetched since %s", peer, entry.LastFetched.Format(time.RFC3339))
+			}
+			entry.Stale = stale
+			changed = true
+		}
+	}
+	onChange := f.onChange
+	f.mu.Unlock()
+
+	if changed && onChange != nil {
+		onChange()
+	}
+}
+
+// fetch gets the catalog of a peer, reporting whether it changed
+func (f *Fetcher) fetch(ctx context.Context, peer string) (bool, error) {
+	f.mu.RLock()
+	entry := f.catalogs[peer]
+	etag := ""
+	if entry != nil {
+		etag = entry.etag
+	}
+	f.mu.RUnlock()
+
+	catalog, newETag, err := f.get(ctx, peer, etag)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.catalogs[peer] == nil {
+		f.catalogs[peer] = &PeerCatalog{}
+	}
+	entry = f.catalogs[peer]
+	entry.LastError = err
+	if err != nil {
+		return false, err
+	}
+	entry.LastFetched = time.Now()
+	if catalog == nil {
+		// 304, the known catalog is still current
+		return false, nil
+	}
+	entry.Catalog = catalog
+	entry.etag = newETag
+	return true, nil
+}
+
+// get requests the catalog from the peer gateway, a nil catalog means it did not change since etag
+func (f *Fetcher) get(ctx context.Context, peer, etag string) (*Catalog, string, error) {
+	endpoint := "http://" + net.JoinHostPort(peer+f.gatewaySuffix, strconv.Itoa(f.port)) + Path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, etag, nil
+	case http.StatusOK:
+	default:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, "", fmt.Errorf("%s returned %s: %s", endpoint, resp.Status, body)
+	}
+
+	var catalog Catalog
+	if err := json.NewDecoder(resp.Body).Decode(&catalog); err != nil {
+		return nil, "", fmt.Errorf("failed to decode catalog: %w", err)
+	}
+	if err := catalog.Validate(peer); err != nil {
+		return nil, "", err
+	}
+	return &catalog, resp.Header.Get("ETag"), nil
+}
+
+// Hosts returns the HTTP hosts of every peer that returned a catalog, keyed by peer, for
+// generator.OutboundOptions.PeerHosts. A peer's hosts are limited to *.svc.<peer>.<zone>, a peer
+// whose catalog is stale has none. Peers that never returned a catalog are left out.
+func (f *Fetcher) Hosts(zone string) map[string][]string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	hosts := make(map[string][]string)
+	for peer, entry := range f.catalogs {
+		switch {
+		case entry.Catalog == nil:
+			continue
+		case entry.Stale:
+			hosts[peer] = nil
+		default:
+			hosts[peer] = entry.Catalog.HTTPHosts(".svc." + peer + "." + zone)
+		}
+	}
+	return hosts
+}
+
+// IgnoredHosts returns the HTTP hosts Hosts leaves out of every peer with a fresh catalog, keyed by
+// peer, only listing the peers with such hosts. A peer with no host left is not routed at all.
+func (f *Fetcher) IgnoredHosts(zone string) map[string][]string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	ignored := make(map[string][]string)
+	for peer, entry := range f.catalogs {
+		if entry.Catalog == nil || entry.Stale {
+			continue
+		}
+		if hosts := entry.Catalog.IgnoredHTTPHosts(".svc." + peer + "." + zone); len(hosts) > 0 {
+			ignored[peer] = hosts
+		}
+	}
+	return ignored
+}
+
+// Catalogs returns the fresh catalogs keyed by peer
+func (f *Fetcher) Catalogs() map[string]*Catalog {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	catalogs := make(map[string]*Catalog)
+	for peer, entry := range f.catalogs {
+		if entry.Catalog != nil && !entry.Stale {
+			catalogs[peer] = entry.Catalog
+		}
+	}
+	return catalogs
+}
+
+// Stale returns the peers marked stale by the last FetchAll, sorted
+func (f *Fetcher) Stale() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	stale := make([]string, 0)
+	for peer, entry := range f.catalogs {
+		if entry.Stale {
+			stale = append(stale, peer)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+// Catalog returns the last catalog fetched from a peer, nil if none
+func (f *Fetcher) Catalog(peer string) *PeerCatalog {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	entry := f.catalogs[peer]
+	if entry == nil {
+		return nil
+	}
+	copied := *entry
+	return &copied
+}
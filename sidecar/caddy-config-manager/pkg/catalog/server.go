@@ -0,0 +1,119 @@
+package catalog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// Server serves the local catalog on the pod's loopback interface. Userspace tailscaled forwards
+// the connections it accepts on the tailnet to the pod's loopback, so the catalog is reachable from
+// peers through their gateway but not from the cluster network. The manager must therefore run as
+// a container of the tailscale pod, a server in another pod is never reached.
+type Server struct {
+	mu   sync.RWMutex
+	body []byte
+	etag string
+
+	listener net.Listener
+	server   *http.Server
+}
+
+// NewServer creates a server answering 503 until the first Update
+func NewServer() *Server {
+	return &Server{}
+}
+
+// Update replaces the served catalog, the generation time is left out of the ETag so an
+// unchanged catalog keeps it
+func (s *Server) Update(catalog *Catalog) error {
+	body, err := json.MarshalIndent(catalog, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode catalog: %w", err)
+	}
+	withoutTime := *catalog
+	withoutTime.GeneratedAt = time.Time{}
+	key, err := json.Marshal(withoutTime)
+	if err != nil {
+		return fmt.Errorf("failed to encode catalog: %w", err)
+	}
+	hash := fnv.New64a()
+	hash.Write(key)
+	etag := strconv.Quote(strconv.FormatUint(hash.Sum64(), 16))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if etag != s.etag {
+		s.body = body
+		s.etag = etag
+	}
+	return nil
+}
+
+// ServeHTTP answers GET Path with the catalog, 304 when If-None-Match matches its ETag
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != Path {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.RLock()
+	body, etag := s.body, s.etag
+	s.mu.RUnlock()
+	if body == nil {
+		http.Error(w, "catalog not generated yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// Start listens on 127.0.0.1:port and serves in the background until Close
+func (s *Server) Start(port int) error {
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	s.server = &http.Server{Handler: s, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			klog.Errorf("Catalog server stopped: %v", err)
+		}
+	}()
+	klog.Infof("Serving the export catalog on %s%s", listener.Addr(), Path)
+	return nil
+}
+
+// Addr returns the listening address, nil before Start
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Close stops the server
+func (s *Server) Close() {
+	if s.server != nil {
+		s.server.Close()
+	}
+}
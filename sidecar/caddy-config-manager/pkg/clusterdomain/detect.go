@@ -0,0 +1,90 @@
+package clusterdomain
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// DefaultClusterDomain is the Kubernetes default --cluster-domain
+	DefaultClusterDomain = "cluster.local"
+	// DefaultResolvConfPath is where the kubelet writes the pod's resolver configuration
+	DefaultResolvConfPath = "/etc/resolv.conf"
+)
+
+// Sources of the cluster domain, in order of precedence
+const (
+	SourceFlag       = "flag"
+	SourceConfigMap  = "configmap"
+	SourceResolvConf = "resolv.conf"
+	SourceDefault    = "default"
+)
+
+// Result is the cluster domain in use and the source it was taken from
+type Result struct {
+	Domain string
+	Source string
+}
+
+// Resolve picks the cluster domain by precedence: the flag override, the ConfigMap override,
+// the domain detected from resolv.conf and finally DefaultClusterDomain.
+// Invalid overrides are ignored with a warning.
+func Resolve(flagValue, configMapValue, detected string) Result {
+	candidates := []Result{
+		{Domain: flagValue, Source: SourceFlag},
+		{Domain: configMapValue, Source: SourceConfigMap},
+		{Domain: detected, Source: SourceResolvConf},
+	}
+	for _, candidate := range candidates {
+		domain := normalize(candidate.Domain)
+		if domain == "" {
+			continue
+		}
+		if errs := validation.IsDNS1123Subdomain(domain); len(errs) > 0 {
+			klog.Warningf("Ignoring invalid cluster domain %q from %s: %s", candidate.Domain, candidate.Source, strings.Join(errs, "; "))
+			continue
+		}
+		return Result{Domain: domain, Source: candidate.Source}
+	}
+	return Result{Domain: DefaultClusterDomain, Source: SourceDefault}
+}
+
+// DetectFromResolvConf reads the cluster domain from the search list of a resolv.conf file.
+// Returns an empty string if the file cannot be read or has no Kubernetes search domain.
+func DetectFromResolvConf(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		klog.V(2).Infof("Could not read %s to detect the cluster domain: %v", path, err)
+		return ""
+	}
+	defer file.Close()
+
+	return ParseResolvConf(file)
+}
+
+// ParseResolvConf finds the cluster domain in a resolv.conf search list.
+// Pods get "<namespace>.svc.<domain> svc.<domain> <domain>", the first "svc.<domain>" entry wins.
+func ParseResolvConf(r io.Reader) string {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "search" {
+			continue
+		}
+		for _, search := range fields[1:] {
+			if domain, found := strings.CutPrefix(normalize(search), "svc."); found && domain != "" {
+				return domain
+			}
+		}
+	}
+	return ""
+}
+
+func normalize(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
@@ -0,0 +1,137 @@
+package clusteridentity
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/client-go/dynamic"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+)
+
+// Sources of the cluster name
+const (
+	SourceFlag            = "flag"
+	SourceEnv             = "env"
+	SourceConfigMap       = "configmap"
+	SourceClusterProperty = "clusterproperty"
+	SourceKubeSystemUID   = "kube-system-uid"
+	// SourcePlaceholder is reported when no source has a name and the placeholder is allowed
+	SourcePlaceholder = "placeholder"
+)
+
+// PlaceholderClusterName is the name used when the cluster has not been named,
+// two clusters using it would publish the same remote domains
+const PlaceholderClusterName = generator.DefaultClusterName
+
+// Identity is the name of the local cluster and the source it was read from
+type Identity struct {
+	Name   string
+	Source string
+}
+
+// Provider is a source of the cluster name
+type Provider interface {
+	// Source names the provider in logs and status, e.g. SourceConfigMap
+	Source() string
+	// ClusterName returns the cluster name, or an empty string when this source does not name the cluster.
+	// An error means the source could not be read and the name is unknown.
+	ClusterName(ctx context.Context) (string, error)
+}
+
+// Chain asks its providers in order, the first one returning a name wins
+type Chain struct {
+	providers        []Provider
+	allowPlaceholder bool
+}
+
+// NewChain creates a chain of providers.
+// Unless allowPlaceholder is set, resolving fails when no provider names the cluster
+// or when the name found is PlaceholderClusterName.
+func NewChain(allowPlaceholder bool, providers ...Provider) *Chain {
+	return &Chain{providers: providers, allowPlaceholder: allowPlaceholder}
+}
+
+// UseConfigMapLister makes the configmap providers reading the ConfigMap of ref read it from lister,
+// an informer cache already watching it, instead of the API server on every resolution
+func (c *Chain) UseConfigMapLister(lister corelisters.ConfigMapLister, ref ConfigMapRef) {
+	for _, provider := range c.providers {
+		if p, ok := provider.(*configMapProvider); ok && p.ref.Namespace == ref.Namespace && p.ref.Name == ref.Name {
+			p.lister = lister
+		}
+	}
+}
+
+// HasSource reports whether a provider of the chain reads source
+func (c *Chain) HasSource(source string) bool {
+	for _, provider := range c.providers {
+		if provider.Source() == source {
+			return true
+		}
+	}
+	return false
+}
+
+// ClusterPropertyClient returns the client of the clusterproperty provider, nil when the chain has none
+func (c *Chain) ClusterPropertyClient() dynamic.Interface {
+	for _, provider := range c.providers {
+		if p, ok := provider.(*clusterPropertyProvider); ok {
+			return p.client
+		}
+	}
+	return nil
+}
+
+// UseClusterPropertyLister makes the clusterproperty providers read the ClusterProperty from lister once
+// hasSynced reports true. The API server is read until then, the informer never syncs while the list is denied.
+func (c *Chain) UseClusterPropertyLister(lister cache.GenericLister, hasSynced cache.InformerSynced) {
+	for _, provider := range c.providers {
+		if p, ok := provider.(*clusterPropertyProvider); ok {
+			p.lister = lister
+			p.hasSynced = hasSynced
+		}
+	}
+}
+
+// UseNamespaceLister makes the kube-system-uid providers read the kube-system Namespace from lister once
+// hasSynced reports true, the API server is read until then
+func (c *Chain) UseNamespaceLister(lister corelisters.NamespaceLister, hasSynced cache.InformerSynced) {
+	for _, provider := range c.providers {
+		if p, ok := provider.(*kubeSystemUIDProvider); ok {
+			p.lister = lister
+			p.hasSynced = hasSynced
+		}
+	}
+}
+
+// Resolve returns the identity from the first provider naming the cluster.
+// A provider failing stops the resolution, falling through to the next source would make the name flap.
+func (c *Chain) Resolve(ctx context.Context) (Identity, error) {
+	sources := make([]string, 0, len(c.providers))
+	for _, provider := range c.providers {
+		sources = append(sources, provider.Source())
+		name, err := provider.ClusterName(ctx)
+		if err != nil {
+			return Identity{}, fmt.Errorf("failed to read cluster name from %s: %w", provider.Source(), err)
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			klog.V(4).Infof("Cluster name source %s has no name, trying the next one", provider.Source())
+			continue
+		}
+		if name == PlaceholderClusterName && !c.allowPlaceholder {
+			return Identity{}, fmt.Errorf("cluster name from %s is the placeholder %q, set a real cluster name or allow the placeholder", provider.Source(), name)
+		}
+		return Identity{Name: name, Source: provider.Source()}, nil
+	}
+
+	if c.allowPlaceholder {
+		return Identity{Name: PlaceholderClusterName, Source: SourcePlaceholder}, nil
+	}
+	return Identity{}, fmt.Errorf("no cluster name found in sources [%s], set a cluster name or allow the placeholder %q",
+		strings.Join(sources, ", "), PlaceholderClusterName)
+}
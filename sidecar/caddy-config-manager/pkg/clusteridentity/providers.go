@@ -0,0 +1,189 @@
+package clusteridentity
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+)
+
+// ConfigMapRef locates the cluster name in a ConfigMap
+type ConfigMapRef struct {
+	Namespace string
+	Name      string
+	Key       string
+}
+
+// DefaultConfigMapRef is the tailscale-cluster-name ConfigMap created by apply-tailscale.sh
+var DefaultConfigMapRef = ConfigMapRef{
+	Namespace: generator.ClusterNameConfigMapNamespace,
+	Name:      generator.ClusterNameConfigMapName,
+	Key:       generator.ClusterNameConfigMapKey,
+}
+
+// ParseConfigMapRef parses <namespace>/<name> with the given key
+func ParseConfigMapRef(value, key string) (ConfigMapRef, error) {
+	namespace, name, found := strings.Cut(value, "/")
+	if !found || namespace == "" || name == "" || key == "" {
+		return ConfigMapRef{}, fmt.Errorf("expected <namespace>/<name> and a key, got %q and %q", value, key)
+	}
+	return ConfigMapRef{Namespace: namespace, Name: name, Key: key}, nil
+}
+
+// String formats the reference as <namespace>/<name>:<key>
+func (r ConfigMapRef) String() string {
+	return r.Namespace + "/" + r.Name + ":" + r.Key
+}
+
+// ClusterPropertyGVR is the resource of KEP-2149 ClusterProperties
+var ClusterPropertyGVR = schema.GroupVersionResource{Group: "about.k8s.io", Version: "v1alpha1", Resource: "clusterproperties"}
+
+// ClusterPropertyName is the well-known ClusterProperty holding the cluster ID within its ClusterSet
+const ClusterPropertyName = "cluster.clusterset.k8s.io"
+
+// KubeSystemNamespace's UID is stable for the lifetime of the cluster
+const KubeSystemNamespace = "kube-system"
+
+// kubeSystemUIDLength is how many hex digits of the kube-system UID are kept in the derived name
+const kubeSystemUIDLength = 12
+
+type staticProvider struct {
+	source string
+	name   string
+}
+
+// NewStaticProvider names the cluster with a fixed value, e.g. from a flag or an environment variable
+func NewStaticProvider(source, name string) Provider {
+	return &staticProvider{source: source, name: name}
+}
+
+func (p *staticProvider) Source() string { return p.source }
+
+func (p *staticProvider) ClusterName(ctx context.Context) (string, error) {
+	return p.name, nil
+}
+
+type configMapProvider struct {
+	clientset kubernetes.Interface
+	ref       ConfigMapRef
+	// lister replaces the API server reads once set, see Chain.UseConfigMapLister
+	lister corelisters.ConfigMapLister
+}
+
+// NewConfigMapProvider reads the cluster name from a ConfigMap key, a missing ConfigMap or key names nothing
+func NewConfigMapProvider(clientset kubernetes.Interface, ref ConfigMapRef) Provider {
+	return &configMapProvider{clientset: clientset, ref: ref}
+}
+
+func (p *configMapProvider) Source() string { return SourceConfigMap }
+
+func (p *configMapProvider) ClusterName(ctx context.Context) (string, error) {
+	var configMap *v1.ConfigMap
+	var err error
+	if p.lister != nil {
+		configMap, err = p.lister.ConfigMaps(p.ref.Namespace).Get(p.ref.Name)
+	} else {
+		configMap, err = p.clientset.CoreV1().ConfigMaps(p.ref.Namespace).Get(ctx, p.ref.Name, metav1.GetOptions{})
+	}
+	if apierrors.IsNotFound(err) {
+		klog.V(2).Infof("ConfigMap %s/%s not found", p.ref.Namespace, p.ref.Name)
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return configMap.Data[p.ref.Key], nil
+}
+
+type clusterPropertyProvider struct {
+	client dynamic.Interface
+	// lister replaces the API server reads once hasSynced reports true, see Chain.UseClusterPropertyLister
+	lister    cache.GenericLister
+	hasSynced cache.InformerSynced
+}
+
+// NewClusterPropertyProvider reads the cluster name from the cluster.clusterset.k8s.io ClusterProperty.
+// A missing ClusterProperty or CRD names nothing, as does a denied read so the RBAC stays optional.
+func NewClusterPropertyProvider(client dynamic.Interface) Provider {
+	return &clusterPropertyProvider{client: client}
+}
+
+func (p *clusterPropertyProvider) Source() string { return SourceClusterProperty }
+
+func (p *clusterPropertyProvider) ClusterName(ctx context.Context) (string, error) {
+	var property *unstructured.Unstructured
+	var err error
+	if p.lister != nil && p.hasSynced() {
+		var obj runtime.Object
+		if obj, err = p.lister.Get(ClusterPropertyName); err == nil {
+			var ok bool
+			if property, ok = obj.(*unstructured.Unstructured); !ok {
+				return "", fmt.Errorf("unexpected ClusterProperty %s of type %T", ClusterPropertyName, obj)
+			}
+		}
+	} else {
+		property, err = p.client.Resource(ClusterPropertyGVR).Get(ctx, ClusterPropertyName, metav1.GetOptions{})
+	}
+	if apierrors.IsNotFound(err) {
+		klog.V(2).Infof("ClusterProperty %s not found", ClusterPropertyName)
+		return "", nil
+	}
+	if apierrors.IsForbidden(err) {
+		klog.Warningf("Not allowed to read ClusterProperty %s, skipping: %v", ClusterPropertyName, err)
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	value, _, err := unstructured.NestedString(property.Object, "spec", "value")
+	if err != nil {
+		return "", fmt.Errorf("invalid ClusterProperty %s: %w", ClusterPropertyName, err)
+	}
+	return value, nil
+}
+
+type kubeSystemUIDProvider struct {
+	clientset kubernetes.Interface
+	// lister replaces the API server reads once hasSynced reports true, see Chain.UseNamespaceLister
+	lister    corelisters.NamespaceLister
+	hasSynced cache.InformerSynced
+}
+
+// NewKubeSystemUIDProvider derives cluster-<12 hex digits> from the UID of the kube-system namespace,
+// stable across restarts but meaningless to humans
+func NewKubeSystemUIDProvider(clientset kubernetes.Interface) Provider {
+	return &kubeSystemUIDProvider{clientset: clientset}
+}
+
+func (p *kubeSystemUIDProvider) Source() string { return SourceKubeSystemUID }
+
+func (p *kubeSystemUIDProvider) ClusterName(ctx context.Context) (string, error) {
+	var namespace *v1.Namespace
+	var err error
+	if p.lister != nil && p.hasSynced() {
+		namespace, err = p.lister.Get(KubeSystemNamespace)
+	} else {
+		namespace, err = p.clientset.CoreV1().Namespaces().Get(ctx, KubeSystemNamespace, metav1.GetOptions{})
+	}
+	if err != nil {
+		return "", err
+	}
+	uid := strings.ToLower(strings.ReplaceAll(string(namespace.UID), "-", ""))
+	if len(uid) < kubeSystemUIDLength {
+		return "", fmt.Errorf("namespace %s has an unexpected UID %q", KubeSystemNamespace, namespace.UID)
+	}
+	return "cluster-" + uid[:kubeSystemUIDLength], nil
+}
@@ -0,0 +1,83 @@
+package clusteridentity
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// EnvClusterName is the environment variable read by the env source
+const EnvClusterName = "CROSS_CLUSTER_NAME"
+
+// DefaultSources are asked in this order unless configured otherwise,
+// kube-system-uid is opt-in as the derived name is not readable
+var DefaultSources = []string{SourceFlag, SourceEnv, SourceConfigMap, SourceClusterProperty}
+
+// Config holds what the providers of NewChainFromSources need
+type Config struct {
+	// FlagValue is the cluster name given on the command line
+	FlagValue string
+	// ConfigMap locates the cluster name ConfigMap, the zero value uses DefaultConfigMapRef
+	ConfigMap ConfigMapRef
+	Clientset kubernetes.Interface
+	// DynamicClient reads ClusterProperties, the clusterproperty source is skipped when nil
+	DynamicClient dynamic.Interface
+	// AllowPlaceholder allows running with PlaceholderClusterName
+	AllowPlaceholder bool
+}
+
+// ParseSources parses a comma-separated list of sources and checks every source is known
+func ParseSources(value string) ([]string, error) {
+	sources := make([]string, 0)
+	for _, source := range strings.Split(value, ",") {
+		source = strings.TrimSpace(source)
+		if source == "" {
+			continue
+		}
+		switch source {
+		case SourceFlag, SourceEnv, SourceConfigMap, SourceClusterProperty, SourceKubeSystemUID:
+			sources = append(sources, source)
+		default:
+			return nil, fmt.Errorf("unknown cluster name source %q", source)
+		}
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no cluster name source in %q", value)
+	}
+	return sources, nil
+}
+
+// NewChainFromSources creates a chain asking the named sources in order, nil sources uses DefaultSources
+func NewChainFromSources(sources []string, config Config) (*Chain, error) {
+	if sources == nil {
+		sources = DefaultSources
+	}
+	ref := config.ConfigMap
+	if ref == (ConfigMapRef{}) {
+		ref = DefaultConfigMapRef
+	}
+
+	providers := make([]Provider, 0, len(sources))
+	for _, source := range sources {
+		switch source {
+		case SourceFlag:
+			providers = append(providers, NewStaticProvider(SourceFlag, config.FlagValue))
+		case SourceEnv:
+			providers = append(providers, NewStaticProvider(SourceEnv, os.Getenv(EnvClusterName)))
+		case SourceConfigMap:
+			providers = append(providers, NewConfigMapProvider(config.Clientset, ref))
+		case SourceClusterProperty:
+			if config.DynamicClient != nil {
+				providers = append(providers, NewClusterPropertyProvider(config.DynamicClient))
+			}
+		case SourceKubeSystemUID:
+			providers = append(providers, NewKubeSystemUIDProvider(config.Clientset))
+		default:
+			return nil, fmt.Errorf("unknown cluster name source %q", source)
+		}
+	}
+	return NewChain(config.AllowPlaceholder, providers...), nil
+}
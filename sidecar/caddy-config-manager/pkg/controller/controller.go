@@ -0,0 +1,1033 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+
+	k8sclient "github.com/wold9168/k8s-cross-cluster/lib/k8sclient"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/apis/crosscluster/v1alpha1"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/caddyadmin"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/catalog"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/clusterdomain"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/clusteridentity"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/coredns"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/crossclusterservice"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/dnsserver"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/forwarder"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/mcs"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/peers"
+)
+
+// reconcileKey is the only key ever put on the workqueue.
+// All exported Services are rendered into one consolidated Caddy configuration,
+// so every event triggers the same full reconcile and duplicate events collapse.
+const reconcileKey = "caddy-config"
+
+// permissionRetryInterval is the interval between permission checks while access is missing
+const permissionRetryInterval = 10 * time.Second
+
+// coreDNSRetryInterval is how long to wait before retrying a failed CoreDNS update
+const coreDNSRetryInterval = 30 * time.Second
+
+// Options configures the controller
+type Options struct {
+	// Namespace is the namespace whose Services are exported and where the Caddy ConfigMap is written
+	Namespace string
+	// ResyncPeriod is the informer resync period, used only as a safety net
+	ResyncPeriod time.Duration
+	// CaddyAdminURL enables pushing the configuration through Caddy's admin API when not empty
+	CaddyAdminURL string
+	// CaddyAdminTimeout bounds each request to the admin API
+	CaddyAdminTimeout time.Duration
+	// ConfigFormat is either ConfigFormatCaddyfile (default) or ConfigFormatJSON
+	ConfigFormat string
+	// L4Forwarding enables the built-in TCP/UDP forwarder for non-HTTP Service ports
+	L4Forwarding bool
+	// L4ListenHost is the address layer-4 listeners bind to, empty binds all interfaces
+	L4ListenHost string
+	// ExportMode is generator.ExportModeAllow (default) or generator.ExportModeDeny
+	ExportMode string
+	// ProxyServiceName is the name of the proxy's own Service in Namespace, never exported
+	ProxyServiceName string
+	// AllNamespaces discovers Services in every namespace instead of only Namespace
+	AllNamespaces bool
+	// NamespaceSelector restricts discovery to namespaces whose labels match, implies AllNamespaces
+	NamespaceSelector labels.Selector
+	// DomainTemplates renders remote domains and upstream hosts, nil uses the default naming scheme in DNSZone
+	DomainTemplates *generator.DomainTemplates
+	// ClusterDomain overrides the cluster DNS domain, empty uses the ConfigMap override or detection
+	ClusterDomain string
+	// ResolvConfPath is the resolv.conf the cluster domain is detected from, empty uses /etc/resolv.conf
+	ResolvConfPath string
+	// ClusterIdentity resolves the cluster name, nil reads it from ClusterNameConfigMap and refuses the placeholder
+	ClusterIdentity *clusteridentity.Chain
+	// ClusterNameConfigMap is the watched ConfigMap holding the cluster name and the CLUSTER_DOMAIN override,
+	// the zero value uses clusteridentity.DefaultConfigMapRef
+	ClusterNameConfigMap clusteridentity.ConfigMapRef
+	// CoreDNS maintains the server block resolving remote domains to the proxy Service, nil disables it
+	CoreDNS *coredns.Manager
+	// DNSListenAddress enables the embedded DNS server for the remote zone on this address when not empty
+	DNSListenAddress string
+	// DNSZone is the zone of the remote domains, served by the embedded DNS server and matched by
+	// outbound routes, coredns.DefaultZone when empty
+	DNSZone string
+	// Peers are the peer clusters whose remote domains are routed to their tailnet gateway, none when empty
+	Peers []string
+	// PeerGatewayPort is the port of the peer gateways, generator.DefaultGatewayPort when 0
+	PeerGatewayPort int32
+	// PeerRegistry discovers peer clusters, routed like Peers and resolved by the embedded DNS server, optional
+	PeerRegistry *peers.Registry
+	// CatalogPort serves the export catalog on 127.0.0.1:<port>, reachable over the tailnet only, 0 disables it.
+	// Peers only reach it when the manager runs in the tailscale pod, tailscaled forwards to that pod's loopback.
+	CatalogPort int
+	// CatalogFetcher fetches the peer catalogs, outbound routes are then limited to the hosts peers export, optional
+	CatalogFetcher *catalog.Fetcher
+	// MCS implements the Multi-Cluster Services API, nil disables it. ServiceImports are only managed
+	// with a CatalogFetcher, the peer catalogs list the Services to import.
+	MCS *mcs.Manager
+	// AnnotateServices writes the remote domains, cluster name and publish time of the exported Services,
+	// and why a Service was skipped, as annotations onto the Services
+	AnnotateServices bool
+	// EventRecorder records Events on the Services, the caddy-config ConfigMap and the manager's Pod, nil disables them
+	EventRecorder record.EventRecorder
+	// PodName is the manager's own Pod in Namespace, Events meant for it are dropped when empty
+	PodName string
+	// CrossClusterServices exports the Services referenced by CrossClusterServices and reports their status, optional
+	CrossClusterServices *crossclusterservice.Manager
+	// OutboundProxyURL is the tailscale proxy peer gateways are dialed through, generator.DefaultForwardProxyURL when empty
+	OutboundProxyURL string
+	// HeadlessPodRoutes watches EndpointSlices to give every pod of a headless Service its own remote domain
+	HeadlessPodRoutes bool
+	// EndpointAware watches EndpointSlices and answers 503 on the routes of Services without ready endpoints
+	EndpointAware bool
+	// PodUpstreams proxies the HTTP routes to the ready pod addresses of their Service, implies EndpointAware
+	PodUpstreams bool
+	// LBPolicy is the load-balancing policy across pod upstreams, see generator.ValidateLBPolicy
+	LBPolicy string
+	// ProbeHealthChecks watches Pods to derive the health checks of the HTTP routes proxied to pods from the HTTP readinessProbe
+	// of their pods. The health check annotations of the Services are honored either way.
+	ProbeHealthChecks bool
+	// BackendPolicy decides how ExternalName and selector-less Services are published, both are proxied by default.
+	// generator.BackendPolicyEndpoints for selector-less Services watches EndpointSlices.
+	BackendPolicy generator.BackendPolicy
+}
+
+// Controller watches Services and the cluster name ConfigMap and keeps the Caddy configuration in sync
+type Controller struct {
+	clientset    kubernetes.Interface
+	namespace    string
+	configFormat string
+	exportPolicy generator.ExportPolicy
+	templates    *generator.DomainTemplates
+
+	backendPolicy     generator.BackendPolicy
+	headlessPodRoutes bool
+	// endpointAware is true when the routes follow the ready endpoints of their Service
+	endpointAware   bool
+	endpointOptions generator.EndpointOptions
+	// serviceAnnotations writes the export status onto the Services
+	serviceAnnotations bool
+
+	// clusterDomainOverride is the cluster domain set by flag, detectedClusterDomain the one read from resolv.conf
+	clusterDomainOverride string
+	detectedClusterDomain string
+	// clusterDomain is the cluster domain in use and its source
+	clusterDomain clusterdomain.Result
+
+	clusterIdentity *clusteridentity.Chain
+	// clusterNameConfigMap is the ConfigMap watched for cluster name changes
+	clusterNameConfigMap clusteridentity.ConfigMapRef
+	// identity is the cluster identity in use
+	identity clusteridentity.Identity
+
+	// clusterWide is true when Services are discovered in every namespace
+	clusterWide bool
+	// namespaceSelector is nil unless discovery is restricted by namespace labels
+	namespaceSelector labels.Selector
+
+	serviceInformerFactory     informers.SharedInformerFactory
+	clusterNameInformerFactory informers.SharedInformerFactory
+	// kubeSystemInformerFactory is nil unless the kube-system-uid source names the cluster
+	kubeSystemInformerFactory informers.SharedInformerFactory
+	// clusterPropertyInformerFactory is nil unless the clusterproperty source names the cluster,
+	// it is only started when the API server serves ClusterProperties
+	clusterPropertyInformerFactory dynamicinformer.DynamicSharedInformerFactory
+
+	serviceLister     corelisters.ServiceLister
+	namespaceLister   corelisters.NamespaceLister
+	clusterNameLister corelisters.ConfigMapLister
+	// endpointSliceLister is nil unless headless pod routes, the endpoints policy or endpoint-aware routes need EndpointSlices
+	endpointSliceLister discoverylisters.EndpointSliceLister
+	// podLister is nil unless health checks are derived from readinessProbes
+	podLister  corelisters.PodLister
+	cacheSyncs []cache.InformerSynced
+
+	queue workqueue.TypedRateLimitingInterface[string]
+
+	// adminClient is nil when pushing through the Caddy admin API is disabled
+	adminClient *caddyadmin.Client
+	// forwarder is nil when layer-4 forwarding is disabled
+	forwarder *forwarder.Forwarder
+	// reservedPorts are never assigned to layer-4 listeners, the pod's other servers listen on them
+	reservedPorts map[int32]bool
+	// coreDNS is nil when the CoreDNS integration is disabled
+	coreDNS *coredns.Manager
+	// dnsServer is nil when the embedded DNS server is disabled
+	dnsServer        *dnsserver.Server
+	dnsListenAddress string
+
+	// outbound holds the static settings of the outbound routes, peers and local cluster are set by reconcile
+	outbound     generator.OutboundOptions
+	peerRegistry *peers.Registry
+
+	catalogServer  *catalog.Server
+	catalogPort    int
+	catalogFetcher *catalog.Fetcher
+	// localCluster is the cluster name of the last reconcile, read by the catalog fetcher
+	localCluster atomic.Value
+
+	// dynamicInformerFactories watch the custom resources, started after the permission check
+	dynamicInformerFactories []dynamicinformer.DynamicSharedInformerFactory
+	// mcs is nil when the MCS API is disabled
+	mcs *mcs.Manager
+	// serviceExportLister is nil unless ServiceExports are the export signal
+	serviceExportLister cache.GenericLister
+	// crossClusterServices is nil when CrossClusterServices are not watched
+	crossClusterServices      *crossclusterservice.Manager
+	crossClusterServiceLister cache.GenericLister
+
+	// published reports whether lastConfig has been written at least once
+	published  bool
+	lastConfig string
+	// publishedAt is when lastConfig was written
+	publishedAt time.Time
+	// adminPending reports whether lastConfig still has to be loaded through the admin API
+	adminPending bool
+	// lastStatus is the status last written to the status ConfigMap
+	lastStatus map[string]string
+
+	// recorder is nil when Events are disabled
+	recorder record.EventRecorder
+	podName  string
+	// lastSkipped holds the rejections of each skipped Service Events were last recorded for
+	lastSkipped map[string]string
+}
+
+// New creates a controller backed by shared informers for Services and for the cluster name ConfigMap.
+// Services are watched in opts.Namespace, or in every namespace when AllNamespaces or NamespaceSelector is set,
+// in which case Namespaces are watched as well so label changes are picked up.
+func New(clientset kubernetes.Interface, opts Options) *Controller {
+	clusterWide := opts.AllNamespaces || opts.NamespaceSelector != nil
+	serviceNamespace := opts.Namespace
+	if clusterWide {
+		serviceNamespace = metav1.NamespaceAll
+	}
+
+	serviceInformerFactory := informers.NewSharedInformerFactoryWithOptions(clientset, opts.ResyncPeriod,
+		informers.WithNamespace(serviceNamespace))
+	clusterNameConfigMap := opts.ClusterNameConfigMap
+	if clusterNameConfigMap == (clusteridentity.ConfigMapRef{}) {
+		clusterNameConfigMap = clusteridentity.DefaultConfigMapRef
+	}
+	clusterIdentity := opts.ClusterIdentity
+	if clusterIdentity == nil {
+		clusterIdentity = clusteridentity.NewChain(false, clusteridentity.NewConfigMapProvider(clientset, clusterNameConfigMap))
+	}
+
+	clusterNameInformerFactory := informers.NewSharedInformerFactoryWithOptions(clientset, opts.ResyncPeriod,
+		informers.WithNamespace(clusterNameConfigMap.Namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", clusterNameConfigMap.Name).String()
+		}))
+
+	serviceInformer := serviceInformerFactory.Core().V1().Services()
+	configMapInformer := clusterNameInformerFactory.Core().V1().ConfigMaps()
+	// The informer watches the cluster name ConfigMap anyway, resolving the identity reads its cache
+	clusterIdentity.UseConfigMapLister(configMapInformer.Lister(), clusterNameConfigMap)
+
+	configFormat := opts.ConfigFormat
+	if configFormat == "" {
+		configFormat = ConfigFormatCaddyfile
+	}
+	templates := opts.DomainTemplates
+	if templates == nil {
+		templates = generator.DefaultDomainTemplates()
+		if opts.DNSZone != "" {
+			if zoned, err := templates.WithZone(opts.DNSZone); err != nil {
+				klog.Warningf("Ignoring DNS zone %q for the remote domains: %v", opts.DNSZone, err)
+			} else {
+				templates = zoned
+			}
+		}
+	}
+	resolvConfPath := opts.ResolvConfPath
+	if resolvConfPath == "" {
+		resolvConfPath = clusterdomain.DefaultResolvConfPath
+	}
+
+	c := &Controller{
+		clientset:    clientset,
+		namespace:    opts.Namespace,
+		configFormat: configFormat,
+		templates:    templates,
+		// resolv.conf is written once by the kubelet when the pod starts, reading it once is enough
+		clusterDomainOverride: opts.ClusterDomain,
+		detectedClusterDomain: clusterdomain.DetectFromResolvConf(resolvConfPath),
+		clusterIdentity:       clusterIdentity,
+		clusterNameConfigMap:  clusterNameConfigMap,
+		coreDNS:               opts.CoreDNS,
+		backendPolicy:         opts.BackendPolicy,
+		headlessPodRoutes:     opts.HeadlessPodRoutes,
+		serviceAnnotations:    opts.AnnotateServices,
+		endpointAware:         opts.EndpointAware || opts.PodUpstreams,
+		endpointOptions:       generator.EndpointOptions{PodUpstreams: opts.PodUpstreams, LBPolicy: opts.LBPolicy},
+		recorder:              opts.EventRecorder,
+		podName:               opts.PodName,
+		exportPolicy: generator.ExportPolicy{
+			Mode:             opts.ExportMode,
+			ProxyNamespace:   opts.Namespace,
+			ProxyServiceName: opts.ProxyServiceName,
+		},
+		clusterWide:                clusterWide,
+		namespaceSelector:          opts.NamespaceSelector,
+		serviceInformerFactory:     serviceInformerFactory,
+		clusterNameInformerFactory: clusterNameInformerFactory,
+		serviceLister:              serviceInformer.Lister(),
+		clusterNameLister:          configMapInformer.Lister(),
+		cacheSyncs:                 []cache.InformerSynced{serviceInformer.Informer().HasSynced, configMapInformer.Informer().HasSynced},
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
+			workqueue.DefaultTypedControllerRateLimiter[string](),
+			workqueue.TypedRateLimitingQueueConfig[string]{Name: "caddy-config-manager"},
+		),
+	}
+
+	if opts.CaddyAdminURL != "" {
+		c.adminClient = caddyadmin.NewClient(opts.CaddyAdminURL, opts.CaddyAdminTimeout)
+	}
+	if opts.L4Forwarding {
+		c.forwarder = forwarder.New(opts.L4ListenHost)
+		c.reservedPorts = reservedListenPorts(opts)
+	}
+	zone := opts.DNSZone
+	if zone == "" {
+		zone = coredns.DefaultZone
+	}
+	c.outbound = generator.OutboundOptions{
+		Peers:           opts.Peers,
+		Zone:            zone,
+		GatewayPort:     opts.PeerGatewayPort,
+		ForwardProxyURL: opts.OutboundProxyURL,
+	}
+	if opts.DNSListenAddress != "" {
+		c.dnsServer = dnsserver.NewServer(zone)
+		c.dnsListenAddress = opts.DNSListenAddress
+	}
+	if opts.CatalogPort > 0 {
+		c.catalogServer = catalog.NewServer()
+		c.catalogPort = opts.CatalogPort
+	}
+	if opts.CatalogFetcher != nil {
+		c.catalogFetcher = opts.CatalogFetcher
+		c.catalogFetcher.SetOnChange(c.enqueue)
+	}
+	if opts.PeerRegistry != nil {
+		c.peerRegistry = opts.PeerRegistry
+		c.peerRegistry.SetOnChange(c.enqueue)
+	}
+
+	serviceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.enqueue() },
+		UpdateFunc: func(oldObj, newObj interface{}) { c.enqueue() },
+		DeleteFunc: func(obj interface{}) { c.enqueue() },
+	})
+	if c.namespaceSelector != nil {
+		namespaceInformer := serviceInformerFactory.Core().V1().Namespaces()
+		c.namespaceLister = namespaceInformer.Lister()
+		c.cacheSyncs = append(c.cacheSyncs, namespaceInformer.Informer().HasSynced)
+		namespaceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj interface{}) { c.enqueue() },
+			UpdateFunc: func(oldObj, newObj interface{}) { c.enqueue() },
+			DeleteFunc: func(obj interface{}) { c.enqueue() },
+		})
+	}
+	if opts.HeadlessPodRoutes || opts.BackendPolicy.SelectorLess == generator.BackendPolicyEndpoints || c.endpointAware {
+		endpointSliceInformer := serviceInformerFactory.Discovery().V1().EndpointSlices()
+		c.endpointSliceLister = endpointSliceInformer.Lister()
+		c.cacheSyncs = append(c.cacheSyncs, endpointSliceInformer.Informer().HasSynced)
+		endpointSliceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj interface{}) { c.enqueue() },
+			UpdateFunc: func(oldObj, newObj interface{}) { c.enqueue() },
+			DeleteFunc: func(obj interface{}) { c.enqueue() },
+		})
+	}
+	if opts.ProbeHealthChecks {
+		podInformer := serviceInformerFactory.Core().V1().Pods()
+		c.podLister = podInformer.Lister()
+		c.cacheSyncs = append(c.cacheSyncs, podInformer.Informer().HasSynced)
+		podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) { c.enqueue() },
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				if podProbesChanged(oldObj, newObj) {
+					c.enqueue()
+				}
+			},
+			DeleteFunc: func(obj interface{}) { c.enqueue() },
+		})
+	}
+	if opts.MCS != nil {
+		c.mcs = opts.MCS
+		if c.mcs.Exports() {
+			factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(c.mcs.Client(), opts.ResyncPeriod, serviceNamespace, nil)
+			c.dynamicInformerFactories = append(c.dynamicInformerFactories, factory)
+			serviceExportInformer := factory.ForResource(mcs.ServiceExportGVR)
+			c.serviceExportLister = serviceExportInformer.Lister()
+			c.cacheSyncs = append(c.cacheSyncs, serviceExportInformer.Informer().HasSynced)
+			serviceExportInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+				AddFunc:    func(obj interface{}) { c.enqueue() },
+				UpdateFunc: func(oldObj, newObj interface{}) { c.enqueue() },
+				DeleteFunc: func(obj interface{}) { c.enqueue() },
+			})
+		}
+	}
+	if opts.CrossClusterServices != nil {
+		c.crossClusterServices = opts.CrossClusterServices
+		factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(c.crossClusterServices.Client(), opts.ResyncPeriod, serviceNamespace, nil)
+		c.dynamicInformerFactories = append(c.dynamicInformerFactories, factory)
+		crossClusterServiceInformer := factory.ForResource(v1alpha1.CrossClusterServiceGVR)
+		c.crossClusterServiceLister = crossClusterServiceInformer.Lister()
+		c.cacheSyncs = append(c.cacheSyncs, crossClusterServiceInformer.Informer().HasSynced)
+		crossClusterServiceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj interface{}) { c.enqueue() },
+			UpdateFunc: func(oldObj, newObj interface{}) { c.enqueue() },
+			DeleteFunc: func(obj interface{}) { c.enqueue() },
+		})
+	}
+	// The other cluster name sources are watched as well, their informers are not waited for:
+	// the providers read the API server until they sync, which never happens while the list is denied
+	if clusterIdentity.HasSource(clusteridentity.SourceKubeSystemUID) {
+		c.kubeSystemInformerFactory = informers.NewSharedInformerFactoryWithOptions(clientset, opts.ResyncPeriod,
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.FieldSelector = fields.OneTermEqualSelector("metadata.name", clusteridentity.KubeSystemNamespace).String()
+			}))
+		kubeSystemInformer := c.kubeSystemInformerFactory.Core().V1().Namespaces()
+		clusterIdentity.UseNamespaceLister(kubeSystemInformer.Lister(), kubeSystemInformer.Informer().HasSynced)
+		kubeSystemInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj interface{}) { c.enqueue() },
+			UpdateFunc: func(oldObj, newObj interface{}) { c.enqueue() },
+			DeleteFunc: func(obj interface{}) { c.enqueue() },
+		})
+	}
+	if client := clusterIdentity.ClusterPropertyClient(); client != nil {
+		c.clusterPropertyInformerFactory = dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, opts.ResyncPeriod, metav1.NamespaceAll,
+			func(options *metav1.ListOptions) {
+				options.FieldSelector = fields.OneTermEqualSelector("metadata.name", clusteridentity.ClusterPropertyName).String()
+			})
+		clusterPropertyInformer := c.clusterPropertyInformerFactory.ForResource(clusteridentity.ClusterPropertyGVR)
+		clusterIdentity.UseClusterPropertyLister(clusterPropertyInformer.Lister(), clusterPropertyInformer.Informer().HasSynced)
+		clusterPropertyInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj interface{}) { c.enqueue() },
+			UpdateFunc: func(oldObj, newObj interface{}) { c.enqueue() },
+			DeleteFunc: func(obj interface{}) { c.enqueue() },
+		})
+	}
+	configMapInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: c.isClusterNameConfigMap,
+		Handler: cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj interface{}) { c.enqueue() },
+			UpdateFunc: func(oldObj, newObj interface{}) { c.enqueue() },
+			DeleteFunc: func(obj interface{}) { c.enqueue() },
+		},
+	})
+
+	return c
+}
+
+// Run waits for the required permissions, starts the informers and processes the workqueue until ctx is cancelled
+func (c *Controller) Run(ctx context.Context, workers int) error {
+	defer utilruntime.HandleCrash()
+	defer c.queue.ShutDown()
+	if c.forwarder != nil {
+		defer c.forwarder.Close()
+	}
+
+	// Wait until the permissions are granted instead of failing, RBAC may be applied after the pod starts
+	err := wait.PollUntilContextCancel(ctx, permissionRetryInterval, true, func(ctx context.Context) (bool, error) {
+		if err := c.checkPermissions(); err != nil {
+			klog.Errorf("Permission check failed: %v, retrying in %s...", err, permissionRetryInterval)
+			c.recordPermissionDenied(err)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		return fmt.Errorf("permission check aborted: %w", err)
+	}
+
+	if c.dnsServer != nil {
+		if err := c.dnsServer.Start(c.dnsListenAddress); err != nil {
+			return fmt.Errorf("failed to start DNS server: %w", err)
+		}
+		defer c.dnsServer.Close()
+	}
+	if c.catalogServer != nil {
+		if err := c.catalogServer.Start(c.catalogPort); err != nil {
+			return fmt.Errorf("failed to start catalog server: %w", err)
+		}
+		defer c.catalogServer.Close()
+	}
+
+	klog.Info("Starting informers")
+	c.serviceInformerFactory.Start(ctx.Done())
+	c.clusterNameInformerFactory.Start(ctx.Done())
+	if c.kubeSystemInformerFactory != nil {
+		c.kubeSystemInformerFactory.Start(ctx.Done())
+	}
+	if c.clusterPropertyInformerFactory != nil {
+		if c.clusterPropertiesServed() {
+			c.clusterPropertyInformerFactory.Start(ctx.Done())
+		} else {
+			// Without the CRD the source names nothing, an empty synced cache answers instead of the API server
+			klog.Infof("ClusterProperties are not served, the %s source names nothing until the manager restarts", clusteridentity.SourceClusterProperty)
+			c.clusterIdentity.UseClusterPropertyLister(
+				cache.NewGenericLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}), clusteridentity.ClusterPropertyGVR.GroupResource()),
+				func() bool { return true })
+		}
+	}
+	for _, factory := range c.dynamicInformerFactories {
+		factory.Start(ctx.Done())
+	}
+
+	klog.Info("Waiting for informer caches to sync")
+	if ok := cache.WaitForCacheSync(ctx.Done(), c.cacheSyncs...); !ok {
+		return fmt.Errorf("failed to wait for caches to sync")
+	}
+
+	if c.peerRegistry != nil {
+		go c.peerRegistry.Run(ctx)
+	}
+	if c.catalogFetcher != nil {
+		go c.catalogFetcher.Run(ctx, c.peerClusters)
+	}
+
+	// Always publish once after the initial sync, even if no event arrived
+	c.enqueue()
+
+	klog.Infof("Starting %d worker(s)", workers)
+	for i := 0; i < workers; i++ {
+		go wait.UntilWithContext(ctx, c.runWorker, time.Second)
+	}
+
+	<-ctx.Done()
+	klog.Info("Shutting down workers")
+	return nil
+}
+
+func (c *Controller) enqueue() {
+	c.queue.Add(reconcileKey)
+}
+
+func (c *Controller) runWorker(ctx context.Context) {
+	for c.processNextWorkItem(ctx) {
+	}
+}
+
+func (c *Controller) processNextWorkItem(ctx context.Context) bool {
+	key, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	if err := c.reconcile(ctx); err != nil {
+		klog.Errorf("Reconcile failed: %v, requeuing", err)
+		c.reportError(err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+
+	c.queue.Forget(key)
+	return true
+}
+
+// reconcile renders the Caddy configuration from the informer cache and writes it when it changed
+func (c *Controller) reconcile(ctx context.Context) error {
+	// Never publish under an unknown or placeholder name, it could collide with another cluster's domains
+	identity, err := c.clusterIdentity.Resolve(ctx)
+	if err != nil {
+		c.event(v1.EventTypeWarning, EventReasonClusterNameUnresolved, err.Error(), c.podReference())
+		return err
+	}
+	if identity != c.identity {
+		klog.Infof("Using cluster name %q from %s", identity.Name, identity.Source)
+		c.identity = identity
+		if name, err := generator.NormalizeClusterName(identity.Name); err == nil {
+			c.localCluster.Store(name)
+		}
+	}
+
+	services, err := c.listServices()
+	if err != nil {
+		return err
+	}
+
+	// Listers return objects in random order, sort them to keep the rendered configuration stable
+	sort.Slice(services, func(i, j int) bool {
+		if services[i].Namespace != services[j].Namespace {
+			return services[i].Namespace < services[j].Namespace
+		}
+		return services[i].Name < services[j].Name
+	})
+	allServices := &v1.ServiceList{Items: make([]v1.Service, 0, len(services))}
+	for _, svc := range services {
+		allServices.Items = append(allServices.Items, *svc)
+	}
+	crossClusterServices, err := c.listCrossClusterServices()
+	if err != nil {
+		return err
+	}
+	bindings := crossclusterservice.Apply(allServices, crossClusterServices)
+	allServices = bindings.Services
+	slices, err := c.listEndpointSlices()
+	if err != nil {
+		return err
+	}
+	exports, err := c.listServiceExports()
+	if err != nil {
+		return err
+	}
+	probedPods, err := c.listPods()
+	if err != nil {
+		return err
+	}
+	exportPolicy := c.exportPolicy
+	if c.serviceExportLister != nil {
+		exportPolicy.Exports = mcs.ExportedServices(exports)
+		// A CrossClusterService exports its Service like a ServiceExport
+		for _, target := range bindings.Targets {
+			exportPolicy.Exports[target] = true
+		}
+	}
+	serviceList, skipped := generator.FilterServiceBackends(
+		generator.FilterExportedServices(allServices, exportPolicy),
+		c.backendPolicy,
+		generator.ReadyServicesFromEndpointSlices(slices),
+	)
+
+	templates := c.templates.WithClusterDomain(c.resolveClusterDomain().Domain)
+
+	// Layer-4 routes only exist when the forwarder serves them
+	var listeners []generator.L4Listener
+	if c.forwarder != nil {
+		var failed []generator.RouteRejection
+		listeners, failed, err = c.applyListeners(generator.GenerateL4ListenersWithTemplates(templates, c.reservedPorts, serviceList))
+		if err != nil {
+			return err
+		}
+		skipped = append(skipped, failed...)
+	}
+
+	var pods generator.PodHostnames
+	if c.headlessPodRoutes {
+		pods = generator.PodHostnamesFromEndpointSlices(slices)
+	}
+	outbound := c.outbound
+	outbound.LocalCluster = identity.Name
+	if c.peerRegistry != nil {
+		outbound.Peers = append(append([]string(nil), outbound.Peers...), c.peerRegistry.Clusters()...)
+	}
+	if c.catalogFetcher != nil {
+		outbound.PeerHosts = c.catalogFetcher.Hosts(outbound.Zone)
+	}
+	outboundRoutes := generator.GenerateOutboundRoutes(outbound)
+	peers := make([]string, 0, len(outboundRoutes))
+	for _, route := range outboundRoutes {
+		peers = append(peers, route.Peer)
+	}
+
+	routes, rejections := generator.GenerateServiceRouteTable(templates, identity.Name, serviceList, pods)
+	rejections = append(skipped, rejections...)
+	rejections = append(rejections, generator.RejectPeerAliases(routes, outboundRoutes)...)
+	c.recordSkipped(services, rejections)
+	if c.dnsServer != nil {
+		c.dnsServer.Update(dnsserver.BuildTable(routes, listeners, dnsserver.TableOptions{
+			ProxyAddresses: c.proxyAddresses(),
+			Outbound:       outboundRoutes,
+		}))
+	}
+	localCatalog := catalog.Build(identity.Name, serviceList, routes, listeners)
+	if c.catalogServer != nil {
+		if err := c.catalogServer.Update(localCatalog); err != nil {
+			klog.Warningf("Failed to update the export catalog: %v", err)
+		}
+	}
+
+	status := map[string]string{
+		StatusClusterNameKey:         identity.Name,
+		StatusClusterNameSourceKey:   identity.Source,
+		StatusClusterDomainKey:       c.clusterDomain.Domain,
+		StatusClusterDomainSourceKey: c.clusterDomain.Source,
+		StatusRejectedRoutesKey:      formatRejections(rejections),
+		StatusOutboundPeersKey:       strings.Join(peers, ","),
+		StatusErrorKey:               "",
+	}
+	if c.catalogFetcher != nil {
+		status[StatusStalePeersKey] = strings.Join(c.catalogFetcher.Stale(), ",")
+		ignored := c.catalogFetcher.IgnoredHosts(outbound.Zone)
+		for peer, hosts := range ignored {
+			klog.V(2).Infof("Not routing hosts %s of peer %s outside .svc.%s.%s", strings.Join(hosts, ", "), peer, peer, outbound.Zone)
+		}
+		status[StatusIgnoredPeerHostsKey] = formatIgnoredHosts(ignored)
+	}
+	var imports []mcs.Import
+	if c.mcs != nil && c.mcs.Imports() && c.catalogFetcher != nil {
+		imports = mcs.DesiredImports(localCatalog, c.catalogFetcher.Catalogs(), c.importNamespace())
+		status[StatusServiceImportsKey] = formatImports(imports)
+	}
+	if c.coreDNS != nil {
+		status[StatusCoreDNSKey] = c.applyCoreDNS(ctx)
+	}
+	if err := c.updateStatus(status); err != nil {
+		klog.Warningf("Failed to update status ConfigMap %s: %v", StatusConfigMapName, err)
+	}
+	remoteDomains, domainMapping := generator.DomainMappingFromRoutes(routes)
+	for _, remoteDomain := range remoteDomains {
+		klog.V(4).Infof("Remote domain: %s -> Local domain: %s", remoteDomain, domainMapping[remoteDomain])
+	}
+	siteOptions := generator.SiteOptionsFromRoutes(routes)
+	if c.endpointAware {
+		endpointOptions := c.endpointOptions
+		endpointOptions.ClusterName = identity.Name
+		generator.ApplyServiceEndpoints(siteOptions, routes, generator.ServiceEndpointsFromEndpointSlices(serviceList, slices), endpointOptions)
+	}
+	generator.ApplyHealthChecks(siteOptions, routes, generator.ServiceHealthChecks(serviceList, probedPods))
+	remoteDomains = generator.AppendOutboundSites(remoteDomains, domainMapping, siteOptions, outboundRoutes)
+	if imports != nil {
+		remoteDomains = mcs.AppendImportSites(remoteDomains, domainMapping, siteOptions, imports, identity.Name, outbound)
+	}
+	caddyConfig, err := c.render(remoteDomains, domainMapping, siteOptions)
+	if err != nil {
+		return err
+	}
+
+	if c.published && caddyConfig.content == c.lastConfig && !c.adminPending {
+		klog.V(4).Info("Caddy config unchanged, skipping update")
+	} else if err := c.publish(ctx, caddyConfig); err != nil {
+		return err
+	}
+
+	if c.mcs != nil {
+		c.applyMCS(ctx, exports, mcs.ExportResult{
+			Services:   allServices,
+			Routes:     routes,
+			Rejections: rejections,
+			Policy:     exportPolicy,
+			Published:  true,
+		}, imports)
+	}
+	if c.serviceAnnotations {
+		c.annotateServices(services, identity.Name, routes, rejections)
+	}
+	if c.crossClusterServices != nil {
+		c.crossClusterServices.UpdateStatus(ctx, crossClusterServices, crossclusterservice.StatusInput{
+			Bindings:   bindings,
+			Routes:     routes,
+			Rejections: rejections,
+			Revision:   c.configRevision(),
+		})
+	}
+	return nil
+}
+
+// clusterPropertiesServed reports whether the API server serves ClusterProperties, an informer on a missing CRD
+// would fail to list forever
+func (c *Controller) clusterPropertiesServed() bool {
+	groupVersion := clusteridentity.ClusterPropertyGVR.GroupVersion().String()
+	resources, err := c.clientset.Discovery().ServerResourcesForGroupVersion(groupVersion)
+	if err != nil {
+		klog.V(2).Infof("Failed to discover %s: %v", groupVersion, err)
+		return false
+	}
+	for _, resource := range resources.APIResources {
+		if resource.Name == clusteridentity.ClusterPropertyGVR.Resource {
+			return true
+		}
+	}
+	return false
+}
+
+// reservedListenPorts adds the ports this manager is configured to listen on, the export catalog,
+// the embedded DNS server and Caddy's admin API, to the ports of the pod's other containers.
+// Caddy serves its admin API on the default address even when the manager does not push through it
+func reservedListenPorts(opts Options) map[int32]bool {
+	reserved := make(map[int32]bool, len(generator.ReservedListenPorts)+3)
+	for port := range generator.ReservedListenPorts {
+		reserved[port] = true
+	}
+	if opts.CatalogPort > 0 {
+		reserved[int32(opts.CatalogPort)] = true
+	}
+	if opts.DNSListenAddress != "" {
+		if _, port, err := net.SplitHostPort(opts.DNSListenAddress); err == nil {
+			addPort(reserved, port)
+		}
+	}
+	adminURL := opts.CaddyAdminURL
+	if adminURL == "" {
+		adminURL = caddyadmin.DefaultAdminURL
+	}
+	if parsed, err := url.Parse(adminURL); err == nil {
+		addPort(reserved, parsed.Port())
+	}
+	return reserved
+}
+
+func addPort(ports map[int32]bool, value string) {
+	if port, err := strconv.ParseInt(value, 10, 32); err == nil && port > 0 {
+		ports[int32(port)] = true
+	}
+}
+
+// applyListeners starts the layer-4 listeners and returns the running ones. A listener failing to start,
+// e.g. on a privileged or already used port, is logged and rejected on its Service instead of failing
+// the reconcile, so the other Services are still published.
+func (c *Controller) applyListeners(listeners []generator.L4Listener) ([]generator.L4Listener, []generator.RouteRejection, error) {
+	err := c.forwarder.Apply(listeners)
+	if err == nil {
+		return listeners, nil, nil
+	}
+	var applyErr *forwarder.ApplyError
+	if !errors.As(err, &applyErr) {
+		return nil, nil, fmt.Errorf("failed to apply layer-4 listeners: %w", err)
+	}
+
+	failed := make(map[string]bool, len(applyErr.Failures))
+	rejections := make([]generator.RouteRejection, 0, len(applyErr.Failures))
+	for _, failure := range applyErr.Failures {
+		l := failure.Listener
+		klog.Warningf("Failed to start layer-4 listener %s for %s/%s: %v", l.Key(), l.Namespace, l.ServiceName, failure.Err)
+		failed[l.Key()] = true
+		rejections = append(rejections, generator.RouteRejection{
+			Namespace:   l.Namespace,
+			ServiceName: l.ServiceName,
+			PortName:    l.PortName,
+			Port:        l.Port,
+			Reason:      fmt.Sprintf("layer-4 listener %s failed to start: %v", l.Key(), failure.Err),
+		})
+	}
+	running := make([]generator.L4Listener, 0, len(listeners))
+	for _, l := range listeners {
+		if !failed[l.Key()] {
+			running = append(running, l)
+		}
+	}
+	return running, rejections, nil
+}
+
+// applyCoreDNS points the remote zone at the proxy Service and returns the outcome for the status.
+// CoreDNS is not required for publishing, a failure is retried later without failing the reconcile.
+func (c *Controller) applyCoreDNS(ctx context.Context) string {
+	err := c.coreDNS.Apply(ctx, coredns.StanzaOptions{
+		ProxyService:   c.exportPolicy.ProxyServiceName,
+		ProxyNamespace: c.namespace,
+		ClusterDomain:  c.clusterDomain.Domain,
+	})
+	if err != nil {
+		klog.Warningf("Failed to update CoreDNS configuration: %v, retrying in %s", err, coreDNSRetryInterval)
+		c.queue.AddAfter(reconcileKey, coreDNSRetryInterval)
+		return "error: " + err.Error()
+	}
+	return "managed in " + c.coreDNS.Location()
+}
+
+// proxyAddresses returns the ClusterIPs of the proxy's own Service, the local answer of the DNS server
+func (c *Controller) proxyAddresses() []net.IP {
+	proxy, err := c.serviceLister.Services(c.namespace).Get(c.exportPolicy.ProxyServiceName)
+	if err != nil {
+		klog.Warningf("Proxy Service %s/%s not found, DNS names will have no addresses: %v", c.namespace, c.exportPolicy.ProxyServiceName, err)
+		return nil
+	}
+	addresses := make([]net.IP, 0, len(proxy.Spec.ClusterIPs))
+	for _, clusterIP := range proxy.Spec.ClusterIPs {
+		if ip := net.ParseIP(clusterIP); ip != nil {
+			addresses = append(addresses, ip)
+		}
+	}
+	return addresses
+}
+
+// resolveClusterDomain picks the cluster domain from the flag, the CLUSTER_DOMAIN key of the
+// cluster name ConfigMap or resolv.conf, and logs whenever the result changes
+func (c *Controller) resolveClusterDomain() clusterdomain.Result {
+	configMapValue := ""
+	cm, err := c.clusterNameLister.ConfigMaps(c.clusterNameConfigMap.Namespace).Get(c.clusterNameConfigMap.Name)
+	if err == nil {
+		configMapValue = cm.Data[generator.ClusterDomainConfigMapKey]
+	}
+
+	result := clusterdomain.Resolve(c.clusterDomainOverride, configMapValue, c.detectedClusterDomain)
+	if result != c.clusterDomain {
+		klog.Infof("Using cluster domain %q from %s", result.Domain, result.Source)
+		c.clusterDomain = result
+	}
+	return result
+}
+
+// checkPermissions verifies the permissions in the manager's namespace and, in cluster-wide mode,
+// the ClusterRole permissions needed to watch Services, EndpointSlices, Pods, Namespaces and the MCS resources everywhere
+func (c *Controller) checkPermissions() error {
+	if err := k8sclient.CheckPermissions(c.clientset, &c.namespace); err != nil {
+		return err
+	}
+	if c.endpointSliceLister != nil {
+		namespace := c.namespace
+		if c.clusterWide {
+			namespace = metav1.NamespaceAll
+		}
+		if err := k8sclient.CheckEndpointSlicePermissions(c.clientset, namespace); err != nil {
+			return err
+		}
+	}
+	if c.podLister != nil {
+		namespace := c.namespace
+		if c.clusterWide {
+			namespace = metav1.NamespaceAll
+		}
+		if err := k8sclient.CheckPodPermissions(c.clientset, namespace); err != nil {
+			return err
+		}
+	}
+	if c.serviceExportLister != nil {
+		if err := k8sclient.CheckServiceExportPermissions(c.clientset, c.importNamespace()); err != nil {
+			return err
+		}
+	}
+	if c.mcs != nil && c.mcs.Imports() {
+		if err := k8sclient.CheckServiceImportPermissions(c.clientset, c.importNamespace()); err != nil {
+			return err
+		}
+	}
+	if c.serviceAnnotations {
+		if err := k8sclient.CheckServicePatchPermissions(c.clientset, c.importNamespace()); err != nil {
+			return err
+		}
+	}
+	if c.crossClusterServiceLister != nil {
+		if err := k8sclient.CheckCrossClusterServicePermissions(c.clientset, c.importNamespace()); err != nil {
+			return err
+		}
+	}
+	if c.clusterWide {
+		return k8sclient.CheckClusterWidePermissions(c.clientset, c.namespaceSelector != nil)
+	}
+	return nil
+}
+
+// listServices lists the discovered Services from the informer cache
+func (c *Controller) listServices() ([]*v1.Service, error) {
+	if !c.clusterWide {
+		services, err := c.serviceLister.Services(c.namespace).List(labels.Everything())
+		if err != nil {
+			return nil, fmt.Errorf("failed to list Services from cache: %w", err)
+		}
+		return services, nil
+	}
+
+	services, err := c.serviceLister.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Services from cache: %w", err)
+	}
+	if c.namespaceSelector == nil {
+		return services, nil
+	}
+
+	// Keep the Services whose namespace matches the selector, evaluating each namespace once
+	matches := make(map[string]bool)
+	selected := make([]*v1.Service, 0, len(services))
+	for _, svc := range services {
+		match, evaluated := matches[svc.Namespace]
+		if !evaluated {
+			ns, err := c.namespaceLister.Get(svc.Namespace)
+			match = err == nil && c.namespaceSelector.Matches(labels.Set(ns.Labels))
+			matches[svc.Namespace] = match
+		}
+		if match {
+			selected = append(selected, svc)
+		}
+	}
+	return selected, nil
+}
+
+// peerClusters returns the peer clusters whose catalog is fetched: the static peers and the discovered ones,
+// without the local cluster
+func (c *Controller) peerClusters() []string {
+	candidates := c.outbound.Peers
+	if c.peerRegistry != nil {
+		candidates = append(append([]string(nil), candidates...), c.peerRegistry.Clusters()...)
+	}
+	localCluster, _ := c.localCluster.Load().(string)
+	seen := make(map[string]bool)
+	clusters := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		cluster, err := generator.NormalizeClusterName(candidate)
+		if err != nil || cluster == localCluster || seen[cluster] {
+			continue
+		}
+		seen[cluster] = true
+		clusters = append(clusters, cluster)
+	}
+	return clusters
+}
+
+// listEndpointSlices lists the EndpointSlices of the discovered namespaces from the cache, nil when not watched
+func (c *Controller) listEndpointSlices() ([]*discoveryv1.EndpointSlice, error) {
+	if c.endpointSliceLister == nil {
+		return nil, nil
+	}
+	namespace := c.namespace
+	if c.clusterWide {
+		namespace = metav1.NamespaceAll
+	}
+	slices, err := c.endpointSliceLister.EndpointSlices(namespace).List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list EndpointSlices from cache: %w", err)
+	}
+	return slices, nil
+}
+
+// isClusterNameConfigMap filters events down to the cluster name ConfigMap
+func (c *Controller) isClusterNameConfigMap(obj interface{}) bool {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	cm, ok := obj.(*v1.ConfigMap)
+	if !ok {
+		return false
+	}
+	return cm.Namespace == c.clusterNameConfigMap.Namespace && cm.Name == c.clusterNameConfigMap.Name
+}
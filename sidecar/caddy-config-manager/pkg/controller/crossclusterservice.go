@@ -0,0 +1,54 @@
+package controller
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/apis/crosscluster/v1alpha1"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/crossclusterservice"
+)
+
+// listCrossClusterServices lists the CrossClusterServices of the discovered namespaces from the cache, nil when not watched.
+// Objects that cannot be converted are logged and skipped.
+func (c *Controller) listCrossClusterServices() ([]*v1alpha1.CrossClusterService, error) {
+	if c.crossClusterServiceLister == nil {
+		return nil, nil
+	}
+	lister := c.crossClusterServiceLister.List
+	if !c.clusterWide {
+		lister = c.crossClusterServiceLister.ByNamespace(c.namespace).List
+	}
+	objects, err := lister(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list CrossClusterServices from cache: %w", err)
+	}
+	resources := make([]*v1alpha1.CrossClusterService, 0, len(objects))
+	for _, object := range objects {
+		u, ok := object.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		resource, err := crossclusterservice.FromUnstructured(u)
+		if err != nil {
+			klog.Warning(err)
+			continue
+		}
+		resources = append(resources, resource)
+	}
+	return resources, nil
+}
+
+// configRevision identifies the Caddy configuration last written, empty before the first write
+func (c *Controller) configRevision() string {
+	if !c.published {
+		return ""
+	}
+	hash := fnv.New64a()
+	hash.Write([]byte(c.lastConfig))
+	return strconv.FormatUint(hash.Sum64(), 16)
+}
@@ -0,0 +1,113 @@
+package controller
+
+import (
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+
+	k8sclient "github.com/wold9168/k8s-cross-cluster/lib/k8sclient"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+)
+
+// EventComponent is the source component of the recorded Events
+const EventComponent = "caddy-config-manager"
+
+// Reasons of the recorded Events
+const (
+	// EventReasonPublished is recorded on the caddy-config ConfigMap when a new configuration is written
+	EventReasonPublished = "Published"
+	// EventReasonPublishFailed is recorded on the caddy-config ConfigMap and the manager's Pod when writing fails
+	EventReasonPublishFailed = "PublishFailed"
+	// EventReasonPermissionDenied is recorded on the manager's Pod while a required permission is missing
+	EventReasonPermissionDenied = "PermissionDenied"
+	// EventReasonClusterNameUnresolved is recorded on the manager's Pod while no cluster name can be used
+	EventReasonClusterNameUnresolved = "ClusterNameUnresolved"
+	// EventReasonExportSkipped is recorded on a Service when it or some of its routes are left out
+	EventReasonExportSkipped = "ExportSkipped"
+)
+
+// Aggregation of the Events: a repeated Event only bumps the count of the first one, past eventAggregateMax
+// Events of the same reason within eventAggregateInterval seconds their messages are folded into one,
+// and each object gets eventBurst Events then one every 5 minutes
+const (
+	eventAggregateMax      = 5
+	eventAggregateInterval = 600
+	eventBurst             = 10
+	eventQPS               = 1.0 / 300
+)
+
+// NewEventRecorder returns a recorder writing Events through clientset, aggregating repeated Events so a
+// failing reconcile loop does not flood the API server, and a function stopping it
+func NewEventRecorder(clientset kubernetes.Interface) (record.EventRecorder, func()) {
+	broadcaster := record.NewBroadcaster(record.WithCorrelatorOptions(record.CorrelatorOptions{
+		MaxEvents:            eventAggregateMax,
+		MaxIntervalInSeconds: eventAggregateInterval,
+		BurstSize:            eventBurst,
+		QPS:                  eventQPS,
+	}))
+	broadcaster.StartStructuredLogging(4)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: EventComponent}), broadcaster.Shutdown
+}
+
+// podReference is the manager's own Pod, nil when its name is unknown
+func (c *Controller) podReference() *v1.ObjectReference {
+	if c.podName == "" {
+		return nil
+	}
+	return &v1.ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: c.namespace, Name: c.podName}
+}
+
+// configMapReference is the caddy-config ConfigMap
+func (c *Controller) configMapReference() *v1.ObjectReference {
+	return &v1.ObjectReference{APIVersion: "v1", Kind: "ConfigMap", Namespace: c.namespace, Name: k8sclient.CaddyConfigMapName}
+}
+
+// event records an Event on every object that is not nil, nothing when Events are disabled
+func (c *Controller) event(eventType, reason, message string, objects ...runtime.Object) {
+	if c.recorder == nil {
+		return
+	}
+	for _, object := range objects {
+		if ref, ok := object.(*v1.ObjectReference); ok && ref == nil {
+			continue
+		}
+		c.recorder.Event(object, eventType, reason, message)
+	}
+}
+
+// recordSkipped records an ExportSkipped Event on the Services whose rejections changed since the last reconcile
+func (c *Controller) recordSkipped(services []*v1.Service, rejections []generator.RouteRejection) {
+	if c.recorder == nil {
+		return
+	}
+	reasons := make(map[string][]string)
+	for _, rejection := range rejections {
+		key := rejection.Namespace + "/" + rejection.ServiceName
+		reasons[key] = append(reasons[key], rejection.String())
+	}
+
+	skipped := make(map[string]string, len(reasons))
+	for _, service := range services {
+		key := service.Namespace + "/" + service.Name
+		if len(reasons[key]) == 0 {
+			continue
+		}
+		message := strings.Join(reasons[key], "; ")
+		skipped[key] = message
+		if c.lastSkipped[key] != message {
+			c.recorder.Event(service, v1.EventTypeWarning, EventReasonExportSkipped, message)
+		}
+	}
+	c.lastSkipped = skipped
+}
+
+// recordPermissionDenied records a PermissionDenied Event on the manager's Pod
+func (c *Controller) recordPermissionDenied(err error) {
+	c.event(v1.EventTypeWarning, EventReasonPermissionDenied, err.Error(), c.podReference())
+}
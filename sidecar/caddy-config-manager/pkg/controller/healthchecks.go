@@ -0,0 +1,42 @@
+package controller
+
+import (
+	"fmt"
+	"reflect"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// listPods lists the pods of the discovered namespaces from the cache, nil when readinessProbes are not watched
+func (c *Controller) listPods() ([]*v1.Pod, error) {
+	if c.podLister == nil {
+		return nil, nil
+	}
+	namespace := c.namespace
+	if c.clusterWide {
+		namespace = metav1.NamespaceAll
+	}
+	pods, err := c.podLister.Pods(namespace).List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Pods from cache: %w", err)
+	}
+	return pods, nil
+}
+
+// podProbesChanged reports whether a pod update can change the derived health checks, the labels
+// selecting it or its containers. Status updates, by far the most frequent, are ignored.
+func podProbesChanged(oldObj, newObj interface{}) bool {
+	oldPod, ok := oldObj.(*v1.Pod)
+	if !ok {
+		return true
+	}
+	newPod, ok := newObj.(*v1.Pod)
+	if !ok {
+		return true
+	}
+	return !reflect.DeepEqual(oldPod.Labels, newPod.Labels) ||
+		(oldPod.DeletionTimestamp == nil) != (newPod.DeletionTimestamp == nil) ||
+		!reflect.DeepEqual(oldPod.Spec.Containers, newPod.Spec.Containers)
+}
@@ -0,0 +1,77 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/mcs"
+)
+
+// mcsRetryInterval is how long to wait before retrying a failed ServiceImport sync
+const mcsRetryInterval = 30 * time.Second
+
+// listServiceExports lists the ServiceExports of the discovered namespaces from the cache, nil when not watched
+func (c *Controller) listServiceExports() ([]*unstructured.Unstructured, error) {
+	if c.serviceExportLister == nil {
+		return nil, nil
+	}
+	lister := c.serviceExportLister.List
+	if !c.clusterWide {
+		lister = c.serviceExportLister.ByNamespace(c.namespace).List
+	}
+	objects, err := lister(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ServiceExports from cache: %w", err)
+	}
+	exports := make([]*unstructured.Unstructured, 0, len(objects))
+	for _, object := range objects {
+		if export, ok := object.(*unstructured.Unstructured); ok {
+			exports = append(exports, export)
+		}
+	}
+	return exports, nil
+}
+
+// importNamespace is where ServiceImports are managed, the namespaces whose Services are discovered
+func (c *Controller) importNamespace() string {
+	if c.clusterWide {
+		return metav1.NamespaceAll
+	}
+	return c.namespace
+}
+
+// applyMCS reports the conditions of the ServiceExports and syncs the ServiceImports once the
+// configuration serving them is published. Neither is required for publishing, failures are retried later.
+func (c *Controller) applyMCS(ctx context.Context, exports []*unstructured.Unstructured, result mcs.ExportResult, imports []mcs.Import) {
+	if c.serviceExportLister != nil {
+		c.mcs.UpdateExportStatus(ctx, exports, result)
+	}
+	if imports == nil {
+		return
+	}
+	addresses := c.proxyAddresses()
+	ips := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		ips = append(ips, address.String())
+	}
+	if err := c.mcs.SyncImports(ctx, imports, c.importNamespace(), ips); err != nil {
+		klog.Warningf("%v, retrying in %s", err, mcsRetryInterval)
+		c.queue.AddAfter(reconcileKey, mcsRetryInterval)
+	}
+}
+
+// formatImports renders the imported Services as <namespace>/<name>, comma separated
+func formatImports(imports []mcs.Import) string {
+	keys := make([]string, 0, len(imports))
+	for _, imported := range imports {
+		keys = append(keys, imported.Namespace+"/"+imported.Name)
+	}
+	return strings.Join(keys, ",")
+}
@@ -0,0 +1,68 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/klog/v2"
+
+	k8sclient "github.com/wold9168/k8s-cross-cluster/lib/k8sclient"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/caddyadmin"
+)
+
+// adminRetryInterval is how long to wait before retrying the admin API after falling back to the ConfigMap
+const adminRetryInterval = 30 * time.Second
+
+// publish delivers the rendered configuration to Caddy.
+// When the admin API is enabled the configuration is loaded live and then persisted to the ConfigMap,
+// so a restarted Caddy starts from the same configuration. If the admin API is unreachable the
+// ConfigMap is still written and the admin push is retried later. A configuration rejected by Caddy
+// is never persisted. The outcome is recorded as an Event.
+func (c *Controller) publish(ctx context.Context, caddyConfig renderedConfig) error {
+	if err := c.write(ctx, caddyConfig); err != nil {
+		c.event(v1.EventTypeWarning, EventReasonPublishFailed, err.Error(), c.configMapReference(), c.podReference())
+		return err
+	}
+	c.event(v1.EventTypeNormal, EventReasonPublished, "Published Caddy configuration revision "+c.configRevision(), c.configMapReference())
+	return nil
+}
+
+// write loads the configuration through the admin API and persists it to the ConfigMap
+func (c *Controller) write(ctx context.Context, caddyConfig renderedConfig) error {
+	adminPending := false
+	if c.adminClient != nil {
+		err := c.adminClient.Load(ctx, []byte(caddyConfig.content), caddyConfig.contentType)
+		switch {
+		case err == nil:
+		case caddyadmin.IsUnreachable(err):
+			klog.Warningf("%v, falling back to ConfigMap %s", err, k8sclient.CaddyConfigMapName)
+			adminPending = true
+		default:
+			return fmt.Errorf("failed to load Caddy config through admin API: %w", err)
+		}
+	}
+
+	klog.Infof("Writing Caddy config to namespace '%s' under key '%s':\n%s", c.namespace, caddyConfig.configMapKey, caddyConfig.content)
+	if err := k8sclient.ReplaceCaddyConfig(c.clientset, &c.namespace, caddyConfig.configMapKey, caddyConfig.content); err != nil {
+		if apierrors.IsForbidden(err) {
+			// Access was revoked after startup, report exactly which permission is missing
+			if permErr := c.checkPermissions(); permErr != nil {
+				klog.Errorf("Permission check failed: %v", permErr)
+				c.recordPermissionDenied(permErr)
+			}
+		}
+		return fmt.Errorf("failed to update Caddy ConfigMap: %w", err)
+	}
+
+	c.published = true
+	c.lastConfig = caddyConfig.content
+	c.publishedAt = time.Now()
+	c.adminPending = adminPending
+	if adminPending {
+		c.queue.AddAfter(reconcileKey, adminRetryInterval)
+	}
+	return nil
+}
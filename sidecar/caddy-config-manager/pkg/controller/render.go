@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"fmt"
+
+	k8sclient "github.com/wold9168/k8s-cross-cluster/lib/k8sclient"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/caddyadmin"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+)
+
+const (
+	// ConfigFormatCaddyfile renders Caddyfile text
+	ConfigFormatCaddyfile = "caddyfile"
+	// ConfigFormatJSON renders Caddy's native JSON configuration
+	ConfigFormatJSON = "json"
+)
+
+// ValidateConfigFormat returns an error if format is not a supported configuration format
+func ValidateConfigFormat(format string) error {
+	switch format {
+	case ConfigFormatCaddyfile, ConfigFormatJSON:
+		return nil
+	default:
+		return fmt.Errorf("unsupported config format %q, expected %q or %q", format, ConfigFormatCaddyfile, ConfigFormatJSON)
+	}
+}
+
+// renderedConfig is a Caddy configuration together with how it is delivered
+type renderedConfig struct {
+	// content is the configuration itself
+	content string
+	// contentType selects the adapter when loading through the admin API
+	contentType string
+	// configMapKey is the key of the caddy-config ConfigMap the configuration is persisted under
+	configMapKey string
+}
+
+// render renders the remote domain mapping and the site options in the configured format
+func (c *Controller) render(remoteDomains []string, domainMapping map[string]string, siteOptions map[string]generator.SiteOptions) (renderedConfig, error) {
+	if c.configFormat == ConfigFormatJSON {
+		data, err := generator.GenerateCaddyJSONConfigWithOptions(remoteDomains, domainMapping, siteOptions)
+		if err != nil {
+			return renderedConfig{}, fmt.Errorf("failed to render Caddy JSON config: %w", err)
+		}
+		return renderedConfig{
+			content:      string(data),
+			contentType:  caddyadmin.ContentTypeJSON,
+			configMapKey: k8sclient.CaddyJSONConfigKey,
+		}, nil
+	}
+
+	return renderedConfig{
+		content:      generator.GenerateCaddyConfigWithOptions(remoteDomains, domainMapping, siteOptions),
+		contentType:  caddyadmin.ContentTypeCaddyfile,
+		configMapKey: k8sclient.CaddyConfigKey,
+	}, nil
+}
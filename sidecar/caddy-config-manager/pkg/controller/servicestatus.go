@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+
+	k8sclient "github.com/wold9168/k8s-cross-cluster/lib/k8sclient"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+)
+
+// ServiceStatusFieldManager is the field manager of the status annotations, distinct from the
+// managers of the Service spec so the annotations never conflict with them
+const ServiceStatusFieldManager = "caddy-config-manager-status"
+
+// Annotations written onto the discovered Services
+const (
+	// AnnotationRemoteDomains lists the remote domains of an exported Service, sorted and comma separated.
+	// The per-pod domains of headless Services are left out.
+	AnnotationRemoteDomains = "cross-cluster.io/remote-domains"
+	// AnnotationClusterName is the cluster name the remote domains were rendered with
+	AnnotationClusterName = "cross-cluster.io/cluster-name"
+	// AnnotationPublishedAt is the time of the first successful publish of the Service's current remote domains,
+	// RFC 3339 in UTC. It is only rewritten along with the other annotations, so publishing leaves unchanged Services alone.
+	AnnotationPublishedAt = "cross-cluster.io/published-at"
+	// AnnotationWarning lists why the Service or some of its routes were skipped, separated by "; "
+	AnnotationWarning = "cross-cluster.io/warning"
+)
+
+var serviceStatusAnnotations = []string{AnnotationRemoteDomains, AnnotationClusterName, AnnotationPublishedAt, AnnotationWarning}
+
+// serviceStatus computes the status annotations of every discovered Service, keyed by <namespace>/<name>.
+// Services without routes nor rejections get none.
+func serviceStatus(clusterName string, publishedAt time.Time, routes []generator.ServiceRoute, rejections []generator.RouteRejection) map[string]map[string]string {
+	domains := make(map[string][]string)
+	for _, route := range routes {
+		if route.Pod != "" {
+			continue
+		}
+		key := route.Namespace + "/" + route.ServiceName
+		domains[key] = append(domains[key], route.RemoteDomain)
+	}
+	warnings := make(map[string][]string)
+	for _, rejection := range rejections {
+		key := rejection.Namespace + "/" + rejection.ServiceName
+		warnings[key] = append(warnings[key], rejection.String())
+	}
+
+	status := make(map[string]map[string]string)
+	for key, remoteDomains := range domains {
+		sort.Strings(remoteDomains)
+		status[key] = map[string]string{
+			AnnotationRemoteDomains: strings.Join(remoteDomains, ","),
+			AnnotationClusterName:   clusterName,
+			AnnotationPublishedAt:   publishedAt.UTC().Format(time.RFC3339),
+		}
+	}
+	for key, reasons := range warnings {
+		if status[key] == nil {
+			status[key] = make(map[string]string)
+		}
+		status[key][AnnotationWarning] = strings.Join(reasons, "; ")
+	}
+	return status
+}
+
+// annotateServices patches the status annotations of the Services whose annotations differ from the
+// computed ones, removing the annotations a Service no longer gets. The publish time alone never
+// triggers a patch, each patch fires a Service event and another reconcile. A failed patch is logged
+// by k8sclient and retried on the next reconcile.
+func (c *Controller) annotateServices(services []*v1.Service, clusterName string, routes []generator.ServiceRoute, rejections []generator.RouteRejection) {
+	status := serviceStatus(clusterName, c.publishedAt, routes, rejections)
+	for _, service := range services {
+		desired := status[service.Namespace+"/"+service.Name]
+		patch := make(map[string]*string)
+		for _, annotation := range serviceStatusAnnotations {
+			current, exists := service.Annotations[annotation]
+			value, wanted := desired[annotation]
+			switch {
+			case wanted && annotation == AnnotationPublishedAt:
+				// Stamped below when something else changes, or when missing
+				if !exists {
+					patch[annotation] = &value
+				}
+			case wanted && (!exists || current != value):
+				patch[annotation] = &value
+			case !wanted && exists:
+				patch[annotation] = nil
+			}
+		}
+		if publishedAt, wanted := desired[AnnotationPublishedAt]; wanted && len(patch) > 0 {
+			patch[AnnotationPublishedAt] = &publishedAt
+		}
+		if len(patch) == 0 {
+			continue
+		}
+		_ = k8sclient.PatchServiceAnnotations(c.clientset, service.Namespace, service.Name, patch, ServiceStatusFieldManager)
+	}
+}
@@ -0,0 +1,90 @@
+package controller
+
+import (
+	"maps"
+	"sort"
+	"strings"
+
+	"k8s.io/klog/v2"
+
+	k8sclient "github.com/wold9168/k8s-cross-cluster/lib/k8sclient"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+)
+
+// StatusConfigMapName is the ConfigMap in the manager's namespace where the controller reports its status
+const StatusConfigMapName = "caddy-config-manager-status"
+
+// Keys of the status ConfigMap
+const (
+	// StatusClusterNameKey is the cluster name used in remote domains
+	StatusClusterNameKey = "clusterName"
+	// StatusClusterNameSourceKey is where the cluster name came from, see the clusteridentity sources
+	StatusClusterNameSourceKey = "clusterNameSource"
+	// StatusClusterDomainKey is the cluster DNS domain used for upstream hosts
+	StatusClusterDomainKey = "clusterDomain"
+	// StatusClusterDomainSourceKey is where the cluster domain came from: flag, configmap, resolv.conf or default
+	StatusClusterDomainSourceKey = "clusterDomainSource"
+	// StatusRejectedRoutesKey lists the routes left out of the configuration, one per line, empty when none
+	StatusRejectedRoutesKey = "rejectedRoutes"
+	// StatusOutboundPeersKey lists the peer clusters with an outbound route, comma separated
+	StatusOutboundPeersKey = "outboundPeers"
+	// StatusStalePeersKey lists the peer clusters whose export catalog could not be fetched in time, comma separated
+	StatusStalePeersKey = "stalePeers"
+	// StatusIgnoredPeerHostsKey lists the hosts of the peer catalogs outside .svc.<peer>.<zone> and not routed,
+	// one peer per line as <peer>: <host>, <host>
+	StatusIgnoredPeerHostsKey = "ignoredPeerHosts"
+	// StatusServiceImportsKey lists the Services imported under clusterset.local, <namespace>/<name> comma separated
+	StatusServiceImportsKey = "serviceImports"
+	// StatusCoreDNSKey reports where the CoreDNS server block is managed or why it could not be written
+	StatusCoreDNSKey = "coreDNS"
+	// StatusErrorKey is the error preventing the configuration from being published, cleared by the next reconcile generating routes
+	StatusErrorKey = "error"
+)
+
+// updateStatus writes status to the status ConfigMap when it changed since the last successful write.
+// Failures are only logged by the caller, the status is retried on the next reconcile.
+func (c *Controller) updateStatus(status map[string]string) error {
+	if c.lastStatus != nil && maps.Equal(c.lastStatus, status) {
+		return nil
+	}
+	if err := k8sclient.UpdateConfigMapData(c.clientset, &c.namespace, StatusConfigMapName, status); err != nil {
+		return err
+	}
+	c.lastStatus = status
+	return nil
+}
+
+// reportError records err in the status ConfigMap, keeping the rest of the last status
+func (c *Controller) reportError(err error) {
+	status := maps.Clone(c.lastStatus)
+	if status == nil {
+		status = make(map[string]string)
+	}
+	status[StatusErrorKey] = err.Error()
+	if updateErr := c.updateStatus(status); updateErr != nil {
+		klog.Warningf("Failed to update status ConfigMap %s: %v", StatusConfigMapName, updateErr)
+	}
+}
+
+// formatRejections renders the rejected routes one per line
+func formatRejections(rejections []generator.RouteRejection) string {
+	lines := make([]string, 0, len(rejections))
+	for _, rejection := range rejections {
+		lines = append(lines, rejection.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// formatIgnoredHosts renders the ignored hosts of the peers one peer per line, sorted by peer
+func formatIgnoredHosts(ignored map[string][]string) string {
+	peers := make([]string, 0, len(ignored))
+	for peer := range ignored {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	lines := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		lines = append(lines, peer+": "+strings.Join(ignored[peer], ", "))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,202 @@
+package coredns
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// Modes of the CoreDNS integration
+const (
+	// ModeNone leaves CoreDNS alone
+	ModeNone = "none"
+	// ModeCorefile edits a managed block in the Corefile of the coredns ConfigMap
+	ModeCorefile = "corefile"
+	// ModeCustom owns a key of the coredns-custom ConfigMap, imported by distributions such as k3s and AKS
+	ModeCustom = "custom"
+)
+
+const (
+	// Namespace is where CoreDNS and its ConfigMaps live
+	Namespace = "kube-system"
+	// CorefileConfigMapName and CorefileKey locate the main Corefile
+	CorefileConfigMapName = "coredns"
+	CorefileKey           = "Corefile"
+	// CustomConfigMapName is the ConfigMap whose *.server keys are imported as extra server blocks
+	CustomConfigMapName = "coredns-custom"
+	// CustomKey is the key owned in CustomConfigMapName
+	CustomKey = "cross-cluster.server"
+)
+
+// ValidateMode checks that mode is ModeNone, ModeCorefile or ModeCustom
+func ValidateMode(mode string) error {
+	switch mode {
+	case ModeNone, ModeCorefile, ModeCustom:
+		return nil
+	default:
+		return fmt.Errorf("unknown CoreDNS mode %q, expected %q, %q or %q", mode, ModeNone, ModeCorefile, ModeCustom)
+	}
+}
+
+// Manager keeps the cross-cluster server block in the CoreDNS configuration.
+// CoreDNS picks up the change through its reload plugin.
+type Manager struct {
+	clientset kubernetes.Interface
+	mode      string
+	zone      string
+
+	// lastStanza is the stanza last written, to avoid rewriting an unchanged ConfigMap
+	lastStanza string
+}
+
+// NewManager creates a manager for mode, zone is the DNS zone of the remote domains
+func NewManager(clientset kubernetes.Interface, mode, zone string) *Manager {
+	if zone == "" {
+		zone = DefaultZone
+	}
+	return &Manager{clientset: clientset, mode: mode, zone: zone}
+}
+
+// Mode returns the integration mode
+func (m *Manager) Mode() string {
+	return m.mode
+}
+
+// Location describes the ConfigMap key being managed, for logs and status
+func (m *Manager) Location() string {
+	switch m.mode {
+	case ModeCorefile:
+		return fmt.Sprintf("%s/%s:%s", Namespace, CorefileConfigMapName, CorefileKey)
+	case ModeCustom:
+		return fmt.Sprintf("%s/%s:%s", Namespace, CustomConfigMapName, CustomKey)
+	default:
+		return ""
+	}
+}
+
+// Apply writes the server block routing the zone to the proxy Service.
+// The ConfigMap is only read and written when the stanza changed since the last successful Apply,
+// edits outside the managed block or key are preserved.
+func (m *Manager) Apply(ctx context.Context, opts StanzaOptions) error {
+	opts.Zone = m.zone
+	stanza := RenderStanza(opts)
+	if stanza == m.lastStanza {
+		return nil
+	}
+
+	var err error
+	switch m.mode {
+	case ModeCorefile:
+		err = m.updateCorefile(ctx, func(corefile string) string { return MergeCorefile(corefile, stanza) })
+	case ModeCustom:
+		err = m.updateCustom(ctx, &stanza)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	klog.Infof("Updated CoreDNS server block for zone %s in %s", m.zone, m.Location())
+	m.lastStanza = stanza
+	return nil
+}
+
+// Cleanup removes the managed block or key, used when uninstalling
+func (m *Manager) Cleanup(ctx context.Context) error {
+	var err error
+	switch m.mode {
+	case ModeCorefile:
+		err = m.updateCorefile(ctx, func(corefile string) string {
+			cleaned, _ := RemoveManagedBlock(corefile)
+			return cleaned
+		})
+		if apierrors.IsNotFound(err) {
+			// Nothing to clean up where there is no Corefile
+			err = nil
+		}
+	case ModeCustom:
+		err = m.updateCustom(ctx, nil)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	klog.Infof("Removed CoreDNS server block from %s", m.Location())
+	m.lastStanza = ""
+	return nil
+}
+
+// updateCorefile rewrites the Corefile of the coredns ConfigMap, the ConfigMap must already exist
+func (m *Manager) updateCorefile(ctx context.Context, edit func(string) string) error {
+	configMaps := m.clientset.CoreV1().ConfigMaps(Namespace)
+	configMap, err := configMaps.Get(ctx, CorefileConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get ConfigMap %s/%s: %w", Namespace, CorefileConfigMapName, err)
+	}
+
+	corefile := configMap.Data[CorefileKey]
+	edited := edit(corefile)
+	if edited == corefile {
+		return nil
+	}
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string)
+	}
+	configMap.Data[CorefileKey] = edited
+
+	// Update carries the resourceVersion, a concurrent edit by the user fails here instead of being lost
+	if _, err := configMaps.Update(ctx, configMap, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update ConfigMap %s/%s: %w", Namespace, CorefileConfigMapName, err)
+	}
+	return nil
+}
+
+// updateCustom sets CustomKey of the coredns-custom ConfigMap to stanza, or deletes the key when stanza is nil
+func (m *Manager) updateCustom(ctx context.Context, stanza *string) error {
+	configMaps := m.clientset.CoreV1().ConfigMaps(Namespace)
+	configMap, err := configMaps.Get(ctx, CustomConfigMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		if stanza == nil {
+			return nil
+		}
+		configMap = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: CustomConfigMapName, Namespace: Namespace},
+			Data:       map[string]string{CustomKey: *stanza},
+		}
+		if _, err := configMaps.Create(ctx, configMap, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create ConfigMap %s/%s: %w", Namespace, CustomConfigMapName, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get ConfigMap %s/%s: %w", Namespace, CustomConfigMapName, err)
+	}
+
+	current, exists := configMap.Data[CustomKey]
+	switch {
+	case stanza == nil && !exists:
+		return nil
+	case stanza == nil:
+		delete(configMap.Data, CustomKey)
+	case exists && current == *stanza:
+		return nil
+	default:
+		if configMap.Data == nil {
+			configMap.Data = make(map[string]string)
+		}
+		configMap.Data[CustomKey] = *stanza
+	}
+
+	if _, err := configMaps.Update(ctx, configMap, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update ConfigMap %s/%s: %w", Namespace, CustomConfigMapName, err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package coredns
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+)
+
+const (
+	// BeginMarker opens the block managed in the Corefile, everything up to EndMarker is overwritten
+	BeginMarker = "# BEGIN k8s-cross-cluster: managed by caddy-config-manager, edits inside this block are overwritten"
+	// EndMarker closes the managed block
+	EndMarker = "# END k8s-cross-cluster"
+
+	// beginMarkerPrefix identifies the managed block regardless of the comment following it
+	beginMarkerPrefix = "# BEGIN k8s-cross-cluster"
+
+	// DefaultZone is the zone of the remote domains unless -remote-zone sets another
+	DefaultZone = generator.DefaultZone
+	// localResolver is the main server block of the CoreDNS pod, which resolves cluster names
+	localResolver = "127.0.0.1:53"
+)
+
+// StanzaOptions describes where queries for the remote zone are sent
+type StanzaOptions struct {
+	// Zone is the DNS zone of the remote domains, DefaultZone unless templates use another suffix
+	Zone string
+	// ProxyService and ProxyNamespace name the tailscale-proxy Service answering for the zone
+	ProxyService   string
+	ProxyNamespace string
+	// ClusterDomain is the DNS domain of the local cluster
+	ClusterDomain string
+}
+
+// RenderStanza renders a CoreDNS server block for the zone. Every name in the zone is rewritten to the
+// proxy Service and forwarded to the local resolver, the answer carries the original name again.
+// The block never contains double quotes so it can be located inside the JSON encoding of the ConfigMap.
+func RenderStanza(opts StanzaOptions) string {
+	zone := strings.Trim(opts.Zone, ".")
+	proxyHost := fmt.Sprintf("%s.%s.svc.%s.", opts.ProxyService, opts.ProxyNamespace, opts.ClusterDomain)
+
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "%s:53 {\n", zone)
+	builder.WriteString("    errors\n")
+	builder.WriteString("    cache 30\n")
+	fmt.Fprintf(&builder, "    rewrite stop name regex (.*)\\.%s\\.$ %s answer auto\n", regexp.QuoteMeta(zone), proxyHost)
+	fmt.Fprintf(&builder, "    forward . %s\n", localResolver)
+	builder.WriteString("}\n")
+	return builder.String()
+}
+
+// MergeCorefile places stanza in the managed block of corefile, replacing the previous block
+// or appending one, the rest of the Corefile is kept byte for byte
+func MergeCorefile(corefile, stanza string) string {
+	block := BeginMarker + "\n" + stanza + EndMarker + "\n"
+	before, after, found := cutManagedBlock(corefile)
+	if !found {
+		if corefile != "" && !strings.HasSuffix(corefile, "\n") {
+			corefile += "\n"
+		}
+		return corefile + block
+	}
+	return before + block + after
+}
+
+// RemoveManagedBlock removes the managed block from corefile, reporting whether there was one
+func RemoveManagedBlock(corefile string) (string, bool) {
+	before, after, found := cutManagedBlock(corefile)
+	if !found {
+		return corefile, false
+	}
+	return before + after, true
+}
+
+// cutManagedBlock splits corefile around the managed block, lines included.
+// A block missing its end marker extends to the end of the Corefile.
+func cutManagedBlock(corefile string) (before, after string, found bool) {
+	start := markerLine(corefile, beginMarkerPrefix, 0)
+	if start < 0 {
+		return corefile, "", false
+	}
+	end := markerLine(corefile, EndMarker, start)
+	if end < 0 {
+		return corefile[:start], "", true
+	}
+	lineEnd := strings.IndexByte(corefile[end:], '\n')
+	if lineEnd < 0 {
+		return corefile[:start], "", true
+	}
+	return corefile[:start], corefile[end+lineEnd+1:], true
+}
+
+// markerLine returns the offset of the first line at or after from starting with prefix, -1 if none
+func markerLine(corefile, prefix string, from int) int {
+	for offset := from; offset < len(corefile); {
+		if strings.HasPrefix(corefile[offset:], prefix) {
+			return offset
+		}
+		next := strings.IndexByte(corefile[offset:], '\n')
+		if next < 0 {
+			return -1
+		}
+		offset += next + 1
+	}
+	return -1
+}
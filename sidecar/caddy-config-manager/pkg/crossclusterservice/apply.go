@@ -0,0 +1,180 @@
+package crossclusterservice
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/apis/crosscluster/v1alpha1"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+)
+
+// Bindings are the CrossClusterServices applied to their Services
+type Bindings struct {
+	// Services are the discovered Services, the referenced ones carrying the options as annotations
+	Services *v1.ServiceList
+	// Errors are the validation errors keyed by CrossClusterService <namespace>/<name>
+	Errors map[string][]string
+	// Targets are the referenced Services keyed by CrossClusterService <namespace>/<name>, as <namespace>/<service>
+	Targets map[string]string
+}
+
+// FromUnstructured converts a CrossClusterService read through the dynamic client
+func FromUnstructured(object *unstructured.Unstructured) (*v1alpha1.CrossClusterService, error) {
+	var resource v1alpha1.CrossClusterService
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(object.Object, &resource); err != nil {
+		return nil, fmt.Errorf("invalid CrossClusterService %s/%s: %w", object.GetNamespace(), object.GetName(), err)
+	}
+	return &resource, nil
+}
+
+// Apply exports the Services referenced by the CrossClusterServices, writing their options into the
+// cross-cluster.io annotations of copies of the Services so the generator handles them like annotated
+// Services. The options replace the annotations of the same meaning. A Service referenced twice is
+// bound to the oldest CrossClusterService. Invalid options are left out and reported.
+func Apply(serviceList *v1.ServiceList, resources []*v1alpha1.CrossClusterService) Bindings {
+	bindings := Bindings{
+		Services: &v1.ServiceList{Items: make([]v1.Service, 0)},
+		Errors:   make(map[string][]string),
+		Targets:  make(map[string]string),
+	}
+	index := make(map[string]int)
+	if serviceList != nil {
+		for i := range serviceList.Items {
+			service := &serviceList.Items[i]
+			index[service.Namespace+"/"+service.Name] = i
+			bindings.Services.Items = append(bindings.Services.Items, *service)
+		}
+	}
+
+	ordered := append([]*v1alpha1.CrossClusterService(nil), resources...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		ti, tj := ordered[i].CreationTimestamp, ordered[j].CreationTimestamp
+		if !ti.Equal(&tj) {
+			return ti.Before(&tj)
+		}
+		return ordered[i].Namespace+"/"+ordered[i].Name < ordered[j].Namespace+"/"+ordered[j].Name
+	})
+
+	owners := make(map[string]string)
+	for _, resource := range ordered {
+		key := resource.Namespace + "/" + resource.Name
+		target := resource.Namespace + "/" + resource.TargetService()
+		if owner, exists := owners[target]; exists {
+			bindings.Errors[key] = append(bindings.Errors[key], fmt.Sprintf("Service %s is already exported by CrossClusterService %s", target, owner))
+			continue
+		}
+		owners[target] = key
+		bindings.Targets[key] = target
+
+		i, exists := index[target]
+		if !exists {
+			bindings.Errors[key] = append(bindings.Errors[key], fmt.Sprintf("Service %s not found", target))
+			continue
+		}
+		// The Service is shared with the informer cache, only its copy is annotated
+		service := bindings.Services.Items[i].DeepCopy()
+		bindings.Errors[key] = append(bindings.Errors[key], applySpec(service, resource.Spec)...)
+		bindings.Services.Items[i] = *service
+	}
+	return bindings
+}
+
+// applySpec writes the options of spec into the annotations of service, returning the invalid ones
+func applySpec(service *v1.Service, spec v1alpha1.CrossClusterServiceSpec) []string {
+	var errs []string
+	if service.Annotations == nil {
+		service.Annotations = make(map[string]string)
+	}
+	service.Annotations[generator.AnnotationExport] = "true"
+
+	if len(spec.Ports) > 0 {
+		ports := make([]string, 0, len(spec.Ports))
+		for _, port := range spec.Ports {
+			if !hasPort(service, port) {
+				errs = append(errs, fmt.Sprintf("port %q matches no port of the Service", port))
+				continue
+			}
+			ports = append(ports, port)
+		}
+		// An empty list exports nothing rather than every port
+		if len(ports) == 0 {
+			ports = append(ports, "-")
+		}
+		service.Annotations[generator.AnnotationExportPorts] = strings.Join(ports, ",")
+	}
+
+	if len(spec.Protocols) > 0 {
+		protocols := make([]string, 0, len(spec.Protocols))
+		for _, port := range sortedKeys(spec.Protocols) {
+			protocol := strings.ToLower(spec.Protocols[port])
+			switch {
+			case !hasPort(service, port):
+				errs = append(errs, fmt.Sprintf("protocol of port %q: no such port", port))
+			case protocol != generator.ProtocolHTTP && protocol != generator.ProtocolTCP && protocol != generator.ProtocolUDP:
+				errs = append(errs, fmt.Sprintf("protocol of port %q: unsupported protocol %q, expected http, tcp or udp", port, spec.Protocols[port]))
+			default:
+				protocols = append(protocols, port+"="+protocol)
+			}
+		}
+		service.Annotations[generator.AnnotationProtocol] = strings.Join(protocols, ",")
+	}
+
+	if len(spec.ListenPorts) > 0 {
+		listenPorts := make([]string, 0, len(spec.ListenPorts))
+		for _, port := range sortedKeys(spec.ListenPorts) {
+			listenPort := spec.ListenPorts[port]
+			switch {
+			case !hasPort(service, port):
+				errs = append(errs, fmt.Sprintf("listen port of port %q: no such port", port))
+			case listenPort < 1 || listenPort > 65535:
+				errs = append(errs, fmt.Sprintf("listen port of port %q: %d is out of range", port, listenPort))
+			default:
+				listenPorts = append(listenPorts, port+"="+strconv.Itoa(int(listenPort)))
+			}
+		}
+		service.Annotations[generator.AnnotationListenPorts] = strings.Join(listenPorts, ",")
+	}
+
+	if len(spec.Aliases) > 0 {
+		aliases := make([]string, 0, len(spec.Aliases))
+		for _, alias := range spec.Aliases {
+			alias = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(alias), "."))
+			if err := generator.ValidateAlias(alias); err != nil {
+				errs = append(errs, fmt.Sprintf("alias %q: %v", alias, err))
+				continue
+			}
+			aliases = append(aliases, alias)
+		}
+		service.Annotations[generator.AnnotationAliases] = strings.Join(aliases, ",")
+	}
+
+	if spec.UpstreamHostHeader != "" {
+		service.Annotations[generator.AnnotationUpstreamHostHeader] = spec.UpstreamHostHeader
+	}
+	return errs
+}
+
+// hasPort reports whether port is the name or number of a port of service
+func hasPort(service *v1.Service, port string) bool {
+	for _, servicePort := range service.Spec.Ports {
+		if (servicePort.Name != "" && servicePort.Name == port) || strconv.Itoa(int(servicePort.Port)) == port {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,111 @@
+package crossclusterservice
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog/v2"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/apis/crosscluster/v1alpha1"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+)
+
+// StatusInput is the outcome of a reconcile the statuses are computed from
+type StatusInput struct {
+	Bindings   Bindings
+	Routes     []generator.ServiceRoute
+	Rejections []generator.RouteRejection
+	// Revision identifies the Caddy configuration last written, empty when none was
+	Revision string
+}
+
+// Manager reports the status of CrossClusterServices through the dynamic client
+type Manager struct {
+	client dynamic.Interface
+}
+
+// NewManager creates a manager using client for CrossClusterServices
+func NewManager(client dynamic.Interface) *Manager {
+	return &Manager{client: client}
+}
+
+// Client returns the dynamic client, used to watch CrossClusterServices
+func (m *Manager) Client() dynamic.Interface {
+	return m.client
+}
+
+// Status computes the status of a CrossClusterService, keeping the transition time of an unchanged condition
+func Status(resource *v1alpha1.CrossClusterService, input StatusInput) v1alpha1.CrossClusterServiceStatus {
+	key := resource.Namespace + "/" + resource.Name
+	status := v1alpha1.CrossClusterServiceStatus{
+		ObservedGeneration: resource.Generation,
+		ValidationErrors:   append([]string(nil), input.Bindings.Errors[key]...),
+		Conditions:         append([]metav1.Condition(nil), resource.Status.Conditions...),
+	}
+
+	target, bound := input.Bindings.Targets[key]
+	if bound {
+		namespace, name, _ := strings.Cut(target, "/")
+		for _, route := range input.Routes {
+			if route.Namespace != namespace || route.ServiceName != name {
+				continue
+			}
+			status.RemoteDomains = append(status.RemoteDomains, route.RemoteDomain)
+			if (route.PortLabel == "" && route.Pod == "") || status.Upstream == "" {
+				status.Upstream = route.Upstream
+			}
+		}
+		sort.Strings(status.RemoteDomains)
+		for _, rejection := range input.Rejections {
+			if rejection.Namespace == namespace && rejection.ServiceName == name {
+				status.ValidationErrors = append(status.ValidationErrors, rejection.String())
+			}
+		}
+	}
+
+	ready := metav1.Condition{Type: v1alpha1.ConditionReady, ObservedGeneration: resource.Generation}
+	switch {
+	case len(status.ValidationErrors) > 0:
+		ready.Status, ready.Reason, ready.Message = metav1.ConditionFalse, v1alpha1.ReasonInvalid, status.ValidationErrors[0]
+	case len(status.RemoteDomains) == 0:
+		ready.Status, ready.Reason, ready.Message = metav1.ConditionFalse, v1alpha1.ReasonInvalid, "no route generated"
+	case input.Revision == "":
+		ready.Status, ready.Reason, ready.Message = metav1.ConditionFalse, v1alpha1.ReasonPending, "Caddy configuration not written yet"
+	default:
+		status.ConfigRevision = input.Revision
+		ready.Status, ready.Reason, ready.Message = metav1.ConditionTrue, v1alpha1.ReasonPublished, "published in revision "+input.Revision
+	}
+	meta.SetStatusCondition(&status.Conditions, ready)
+	return status
+}
+
+// UpdateStatus writes the status of every CrossClusterService that changed.
+// A failure is logged and retried on the next reconcile.
+func (m *Manager) UpdateStatus(ctx context.Context, resources []*v1alpha1.CrossClusterService, input StatusInput) {
+	for _, resource := range resources {
+		status := Status(resource, input)
+		if equality.Semantic.DeepEqual(status, resource.Status) {
+			continue
+		}
+		updated := resource.DeepCopy()
+		updated.Status = status
+		object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(updated)
+		if err != nil {
+			klog.Warningf("Failed to convert CrossClusterService %s/%s: %v", resource.Namespace, resource.Name, err)
+			continue
+		}
+		_, err = m.client.Resource(v1alpha1.CrossClusterServiceGVR).Namespace(resource.Namespace).
+			UpdateStatus(ctx, &unstructured.Unstructured{Object: object}, metav1.UpdateOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			klog.Warningf("Failed to update the status of CrossClusterService %s/%s: %v", resource.Namespace, resource.Name, err)
+		}
+	}
+}
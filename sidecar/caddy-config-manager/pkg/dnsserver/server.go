@@ -0,0 +1,330 @@
+package dnsserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// DefaultTTL is the TTL of every answer, short so route changes are picked up quickly
+	DefaultTTL = 30
+
+	// maxUDPSize is the largest response sent over UDP, larger ones are truncated so the client retries over TCP
+	maxUDPSize = 512
+	// tcpTimeout bounds how long a TCP client may take to send its query
+	tcpTimeout = 10 * time.Second
+)
+
+// Server is an authoritative DNS server for the remote zone, answering from the current routing table.
+// Names of the local cluster resolve to the tailscale-proxy Service, and so do the names of other clusters
+// with an outbound route, the proxy forwarding them to the peer's gateway over the tailnet.
+type Server struct {
+	zone string
+	ttl  uint32
+
+	mu    sync.RWMutex
+	table *Table
+
+	udp net.PacketConn
+	tcp net.Listener
+	wg  sync.WaitGroup
+}
+
+// NewServer creates a server for zone, e.g. "remote"
+func NewServer(zone string) *Server {
+	return &Server{
+		zone:  canonicalName(strings.Trim(zone, ".")),
+		ttl:   DefaultTTL,
+		table: BuildTable(nil, nil, TableOptions{}),
+	}
+}
+
+// Update replaces the records served
+func (s *Server) Update(table *Table) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.table = table
+}
+
+// Start listens on addr over UDP and TCP and serves queries in the background until Close
+func (s *Server) Start(addr string) error {
+	udp, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on udp %s: %w", addr, err)
+	}
+	// Bind TCP to the port UDP got, so ":0" works as well
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		udp.Close()
+		return fmt.Errorf("failed to listen on tcp %s: %w", udp.LocalAddr(), err)
+	}
+	s.udp = udp
+	s.tcp = tcp
+
+	s.wg.Add(2)
+	go s.serveUDP()
+	go s.serveTCP()
+	klog.Infof("Serving DNS for zone %s on %s", s.zone, udp.LocalAddr())
+	return nil
+}
+
+// Addr returns the address the server listens on, nil before Start
+func (s *Server) Addr() net.Addr {
+	if s.udp == nil {
+		return nil
+	}
+	return s.udp.LocalAddr()
+}
+
+// Close stops serving and waits for the serving goroutines to exit
+func (s *Server) Close() {
+	if s.udp != nil {
+		s.udp.Close()
+	}
+	if s.tcp != nil {
+		s.tcp.Close()
+	}
+	s.wg.Wait()
+}
+
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				klog.Errorf("DNS UDP read failed: %v", err)
+			}
+			return
+		}
+		response := s.answer(buf[:n], maxUDPSize)
+		if response == nil {
+			continue
+		}
+		if _, err := s.udp.WriteTo(response, addr); err != nil {
+			klog.V(2).Infof("DNS UDP write to %s failed: %v", addr, err)
+		}
+	}
+}
+
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				klog.Errorf("DNS TCP accept failed: %v", err)
+			}
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+			s.serveTCPConn(conn)
+		}()
+	}
+}
+
+// serveTCPConn answers length-prefixed queries until the client closes the connection
+func (s *Server) serveTCPConn(conn net.Conn) {
+	for {
+		conn.SetDeadline(time.Now().Add(tcpTimeout))
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		query := make([]byte, length)
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		response := s.answer(query, 0)
+		if response == nil {
+			return
+		}
+		framed := make([]byte, 2+len(response))
+		binary.BigEndian.PutUint16(framed, uint16(len(response)))
+		copy(framed[2:], response)
+		if _, err := conn.Write(framed); err != nil {
+			return
+		}
+	}
+}
+
+// answer builds the response to query, truncated to maxSize when maxSize is not 0.
+// Returns nil when the query cannot be parsed well enough to answer.
+func (s *Server) answer(query []byte, maxSize int) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return s.build(header, nil, dnsmessage.RCodeFormatError, nil, nil)
+	}
+	if header.OpCode != 0 {
+		return s.build(header, &question, dnsmessage.RCodeNotImplemented, nil, nil)
+	}
+
+	rcode, answers, authority := s.resolve(question)
+	response := s.build(header, &question, rcode, answers, authority)
+	if maxSize > 0 && len(response) > maxSize {
+		header.Truncated = true
+		response = s.build(header, &question, rcode, nil, nil)
+	}
+	return response
+}
+
+// resolve looks question up in the zone
+func (s *Server) resolve(question dnsmessage.Question) (dnsmessage.RCode, []dnsmessage.Resource, []dnsmessage.Resource) {
+	name := strings.ToLower(question.Name.String())
+	if name != s.zone && !strings.HasSuffix(name, "."+s.zone) {
+		// Not authoritative for anything else
+		return dnsmessage.RCodeRefused, nil, nil
+	}
+
+	s.mu.RLock()
+	table := s.table
+	s.mu.RUnlock()
+
+	soa := []dnsmessage.Resource{s.soa(table)}
+	switch {
+	case name == s.zone:
+		if question.Type == dnsmessage.TypeSOA {
+			return dnsmessage.RCodeSuccess, soa, nil
+		}
+		return dnsmessage.RCodeSuccess, nil, soa
+	case table.hasName(name):
+		return dnsmessage.RCodeSuccess, s.addressRecords(question, table.ipv4, table.ipv6), nil
+	case len(table.srv[name]) > 0:
+		if question.Type != dnsmessage.TypeSRV {
+			return dnsmessage.RCodeSuccess, nil, soa
+		}
+		return dnsmessage.RCodeSuccess, s.srvRecords(question, table.srv[name]), nil
+	}
+
+	return dnsmessage.RCodeNameError, nil, soa
+}
+
+func (s *Server) addressRecords(question dnsmessage.Question, ipv4, ipv6 []net.IP) []dnsmessage.Resource {
+	records := make([]dnsmessage.Resource, 0)
+	header := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: s.ttl}
+	if question.Type == dnsmessage.TypeA || question.Type == dnsmessage.TypeALL {
+		for _, ip := range ipv4 {
+			var a dnsmessage.AResource
+			copy(a.A[:], ip)
+			header.Type = dnsmessage.TypeA
+			records = append(records, dnsmessage.Resource{Header: header, Body: &a})
+		}
+	}
+	if question.Type == dnsmessage.TypeAAAA || question.Type == dnsmessage.TypeALL {
+		for _, ip := range ipv6 {
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], ip.To16())
+			header.Type = dnsmessage.TypeAAAA
+			records = append(records, dnsmessage.Resource{Header: header, Body: &aaaa})
+		}
+	}
+	return records
+}
+
+func (s *Server) srvRecords(question dnsmessage.Question, targets []SRVTarget) []dnsmessage.Resource {
+	records := make([]dnsmessage.Resource, 0, len(targets))
+	for _, target := range targets {
+		records = append(records, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: s.ttl},
+			Body: &dnsmessage.SRVResource{
+				Priority: 0,
+				Weight:   100 / uint16(len(targets)),
+				Port:     target.Port,
+				Target:   dnsmessage.MustNewName(target.Target),
+			},
+		})
+	}
+	return records
+}
+
+// soa is the zone's SOA record, also used in negative answers so resolvers cache them for the TTL
+func (s *Server) soa(table *Table) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(s.zone), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: s.ttl},
+		Body: &dnsmessage.SOAResource{
+			NS:      dnsmessage.MustNewName("ns." + s.zone),
+			MBox:    dnsmessage.MustNewName("hostmaster." + s.zone),
+			Serial:  table.serial,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			MinTTL:  s.ttl,
+		},
+	}
+}
+
+func (s *Server) build(query dnsmessage.Header, question *dnsmessage.Question, rcode dnsmessage.RCode, answers, authority []dnsmessage.Resource) []byte {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:               query.ID,
+		Response:         true,
+		OpCode:           query.OpCode,
+		Authoritative:    rcode != dnsmessage.RCodeRefused,
+		Truncated:        query.Truncated,
+		RecursionDesired: query.RecursionDesired,
+		RCode:            rcode,
+	})
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil
+	}
+	if question != nil {
+		if err := builder.Question(*question); err != nil {
+			return nil
+		}
+	}
+	if err := builder.StartAnswers(); err != nil {
+		return nil
+	}
+	for _, answer := range answers {
+		if err := addResource(&builder, answer); err != nil {
+			klog.Errorf("Failed to build DNS answer for %s: %v", answer.Header.Name, err)
+			return nil
+		}
+	}
+	if err := builder.StartAuthorities(); err != nil {
+		return nil
+	}
+	for _, record := range authority {
+		if err := addResource(&builder, record); err != nil {
+			return nil
+		}
+	}
+	response, err := builder.Finish()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+func addResource(builder *dnsmessage.Builder, resource dnsmessage.Resource) error {
+	switch body := resource.Body.(type) {
+	case *dnsmessage.AResource:
+		return builder.AResource(resource.Header, *body)
+	case *dnsmessage.AAAAResource:
+		return builder.AAAAResource(resource.Header, *body)
+	case *dnsmessage.SRVResource:
+		return builder.SRVResource(resource.Header, *body)
+	case *dnsmessage.SOAResource:
+		return builder.SOAResource(resource.Header, *body)
+	default:
+		return fmt.Errorf("unsupported record type %T", body)
+	}
+}
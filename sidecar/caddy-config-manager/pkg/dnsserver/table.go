@@ -0,0 +1,190 @@
+package dnsserver
+
+import (
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+)
+
+// DefaultHTTPPort is the tailscale-proxy Service port in front of Caddy
+const DefaultHTTPPort = 80
+
+// SRVTarget is the target of an SRV record
+type SRVTarget struct {
+	Target string
+	Port   uint16
+}
+
+// TableOptions describes how the names of the routing table are reached
+type TableOptions struct {
+	// ProxyAddresses are the ClusterIPs of the tailscale-proxy Service, every local name resolves to them
+	ProxyAddresses []net.IP
+	// HTTPPort is the proxy port serving HTTP routes, DefaultHTTPPort when 0
+	HTTPPort uint16
+	// Outbound are the routes to the peer clusters, the names they match resolve to the proxy too
+	// as it forwards them to the peers
+	Outbound []generator.OutboundRoute
+}
+
+// Table is an immutable snapshot of the records served for the zone
+type Table struct {
+	names map[string]bool
+	// wildcards holds the parent names of wildcard aliases, *.<name> answers for any single label under them
+	wildcards map[string]bool
+	srv       map[string][]SRVTarget
+	// peerHosts are the host patterns of the outbound routes, a "*" label matching any one label
+	peerHosts []string
+	ipv4      []net.IP
+	ipv6      []net.IP
+	// serial is a hash of the records, it only changes when they do
+	serial uint32
+}
+
+// BuildTable builds the records from the routing table, the same routes DomainMappingFromRoutes flattens
+// for the Caddy configuration, so DNS and proxy always agree on the names that exist.
+// Every remote domain and alias gets A/AAAA records of the proxy, a wildcard alias covers one label, and so do the
+// names of the peer clusters matched by an outbound route. Every named port gets an SRV record
+// _<port-name>._<tcp|udp>.<service-domain> targeting its per-port domain, on the HTTP port for routes
+// served by Caddy and on the listener port for layer-4 routes, like Kubernetes does for Services.
+func BuildTable(routes []generator.ServiceRoute, listeners []generator.L4Listener, opts TableOptions) *Table {
+	httpPort := opts.HTTPPort
+	if httpPort == 0 {
+		httpPort = DefaultHTTPPort
+	}
+	listenPorts := make(map[string]int32, len(listeners))
+	for _, listener := range listeners {
+		listenPorts[listenerKey(listener.Namespace, listener.ServiceName, listener.Protocol, listener.Port)] = listener.ListenPort
+	}
+
+	table := &Table{
+		names:     make(map[string]bool, len(routes)),
+		wildcards: make(map[string]bool),
+		srv:       make(map[string][]SRVTarget),
+	}
+	for _, route := range opts.Outbound {
+		for _, host := range route.Hosts {
+			table.peerHosts = append(table.peerHosts, canonicalName(host))
+		}
+	}
+	for _, ip := range opts.ProxyAddresses {
+		if ip4 := ip.To4(); ip4 != nil {
+			table.ipv4 = append(table.ipv4, ip4)
+		} else if ip.To16() != nil {
+			table.ipv6 = append(table.ipv6, ip)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, route := range routes {
+		table.names[canonicalName(route.RemoteDomain)] = true
+		for _, alias := range route.Aliases {
+			if parent, found := strings.CutPrefix(alias, generator.WildcardPrefix); found {
+				table.wildcards[canonicalName(parent)] = true
+			} else {
+				table.names[canonicalName(alias)] = true
+			}
+		}
+		if route.PortName == "" || route.PortLabel != route.PortName {
+			continue
+		}
+
+		proto := "tcp"
+		if route.Protocol == generator.ProtocolUDP {
+			proto = "udp"
+		}
+		port := httpPort
+		if route.Protocol != generator.ProtocolHTTP {
+			listenPort, exists := listenPorts[listenerKey(route.Namespace, route.ServiceName, route.Protocol, route.Port)]
+			if !exists {
+				continue
+			}
+			port = uint16(listenPort)
+		}
+
+		name := canonicalName("_" + route.PortName + "._" + proto + "." + route.ServiceDomain)
+		target := SRVTarget{Target: canonicalName(route.RemoteDomain), Port: port}
+		if key := name + " " + target.Target; !seen[key] {
+			seen[key] = true
+			table.srv[name] = append(table.srv[name], target)
+		}
+	}
+	for name := range table.srv {
+		sort.Slice(table.srv[name], func(i, j int) bool { return table.srv[name][i].Target < table.srv[name][j].Target })
+	}
+	table.serial = table.hash()
+	return table
+}
+
+// hash digests the records in a stable order, so rebuilding the same records keeps the SOA serial
+// and secondaries or caches comparing it do not refresh the zone for nothing
+func (t *Table) hash() uint32 {
+	lines := make([]string, 0, len(t.names)+len(t.wildcards)+len(t.srv)+len(t.peerHosts)+len(t.ipv4)+len(t.ipv6))
+	for name := range t.names {
+		lines = append(lines, "name "+name)
+	}
+	for parent := range t.wildcards {
+		lines = append(lines, "wildcard "+parent)
+	}
+	for name, targets := range t.srv {
+		for _, target := range targets {
+			lines = append(lines, "srv "+name+" "+target.Target+" "+strconv.Itoa(int(target.Port)))
+		}
+	}
+	for _, host := range t.peerHosts {
+		lines = append(lines, "peer "+host)
+	}
+	for _, ip := range append(append([]net.IP{}, t.ipv4...), t.ipv6...) {
+		lines = append(lines, "ip "+ip.String())
+	}
+	sort.Strings(lines)
+
+	h := fnv.New32a()
+	for _, line := range lines {
+		h.Write([]byte(line))
+		h.Write([]byte{'\n'})
+	}
+	return h.Sum32()
+}
+
+// Serial returns the SOA serial of the table
+func (t *Table) Serial() uint32 {
+	return t.serial
+}
+
+// Names returns how many names the table answers for, SRV names and wildcards included
+func (t *Table) Names() int {
+	return len(t.names) + len(t.srv) + len(t.wildcards)
+}
+
+// hasName reports whether name has address records, directly, through a wildcard alias or an outbound route
+func (t *Table) hasName(name string) bool {
+	if t.names[name] {
+		return true
+	}
+	if _, parent, found := strings.Cut(name, "."); found && t.wildcards[parent] {
+		return true
+	}
+	for _, host := range t.peerHosts {
+		if generator.HostsOverlap(host, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func listenerKey(namespace, service, protocol string, port int32) string {
+	return namespace + "/" + service + "/" + protocol + "/" + strconv.Itoa(int(port))
+}
+
+// canonicalName lowercases name and makes it fully qualified
+func canonicalName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
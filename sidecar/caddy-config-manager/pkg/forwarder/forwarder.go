@@ -0,0 +1,162 @@
+package forwarder
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+)
+
+const (
+	// dialTimeout bounds connecting to a TCP upstream
+	dialTimeout = 10 * time.Second
+	// udpSessionIdleTimeout closes UDP sessions without traffic in either direction
+	udpSessionIdleTimeout = 60 * time.Second
+	// udpBufferSize fits the largest UDP datagram
+	udpBufferSize = 65535
+)
+
+// ListenerFailure is a desired listener that could not be started, e.g. its port is in use or privileged
+type ListenerFailure struct {
+	Listener generator.L4Listener
+	Err      error
+}
+
+// ApplyError lists the listeners Apply failed to start, the other listeners were applied
+type ApplyError struct {
+	Failures []ListenerFailure
+}
+
+func (e *ApplyError) Error() string {
+	errs := make([]string, 0, len(e.Failures))
+	for _, failure := range e.Failures {
+		errs = append(errs, fmt.Sprintf("listener %s for %s/%s: %v", failure.Listener.Key(), failure.Listener.Namespace, failure.Listener.ServiceName, failure.Err))
+	}
+	return fmt.Sprintf("failed to start %d listener(s): %s", len(e.Failures), strings.Join(errs, "; "))
+}
+
+// listener is a running TCP or UDP listener whose upstream can be swapped without restarting it
+type listener interface {
+	setUpstream(upstream string)
+	close()
+}
+
+// Forwarder runs layer-4 listeners forwarding TCP and UDP traffic to Service upstreams
+type Forwarder struct {
+	// listenHost is the address listeners bind to, empty binds all interfaces
+	listenHost string
+
+	mu        sync.Mutex
+	listeners map[string]listener
+}
+
+// New creates a forwarder binding its listeners to listenHost
+func New(listenHost string) *Forwarder {
+	return &Forwarder{
+		listenHost: listenHost,
+		listeners:  make(map[string]listener),
+	}
+}
+
+// Apply reconciles the running listeners with the desired ones.
+// Listeners no longer desired are closed, new ones are started and existing ones keep their socket
+// and only switch upstream, so established connections survive unrelated changes.
+// Listeners that fail to start are reported in the returned *ApplyError, the others are still applied.
+func (f *Forwarder) Apply(desired []generator.L4Listener) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	wanted := make(map[string]generator.L4Listener, len(desired))
+	for _, l := range desired {
+		wanted[l.Key()] = l
+	}
+
+	for key, running := range f.listeners {
+		if _, exists := wanted[key]; !exists {
+			running.close()
+			delete(f.listeners, key)
+			klog.Infof("Stopped layer-4 listener %s", key)
+		}
+	}
+
+	var failures []ListenerFailure
+	for _, key := range sortedKeys(wanted) {
+		l := wanted[key]
+		if running, exists := f.listeners[key]; exists {
+			running.setUpstream(l.Upstream)
+			continue
+		}
+
+		address := net.JoinHostPort(f.listenHost, strconv.Itoa(int(l.ListenPort)))
+		var (
+			started listener
+			err     error
+		)
+		switch l.Protocol {
+		case generator.ProtocolTCP:
+			started, err = startTCPListener(address, l.Upstream)
+		case generator.ProtocolUDP:
+			started, err = startUDPListener(address, l.Upstream)
+		default:
+			err = fmt.Errorf("unsupported protocol %q", l.Protocol)
+		}
+		if err != nil {
+			failures = append(failures, ListenerFailure{Listener: l, Err: err})
+			continue
+		}
+
+		f.listeners[key] = started
+		klog.Infof("Started layer-4 listener %s -> %s (%s/%s)", key, l.Upstream, l.Namespace, l.ServiceName)
+	}
+
+	if len(failures) > 0 {
+		return &ApplyError{Failures: failures}
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of the listeners in order, so failures are reported in a stable order
+func sortedKeys(listeners map[string]generator.L4Listener) []string {
+	keys := make([]string, 0, len(listeners))
+	for key := range listeners {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Close stops every listener
+func (f *Forwarder) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for key, running := range f.listeners {
+		running.close()
+		delete(f.listeners, key)
+	}
+}
+
+// upstreamAddress holds an upstream that can be read and replaced concurrently
+type upstreamAddress struct {
+	mu       sync.RWMutex
+	upstream string
+}
+
+func (u *upstreamAddress) get() string {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.upstream
+}
+
+func (u *upstreamAddress) setUpstream(upstream string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.upstream = upstream
+}
@@ -0,0 +1,114 @@
+package forwarder
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+// tcpListener accepts TCP connections and pipes each one to a new upstream connection
+type tcpListener struct {
+	upstreamAddress
+
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func startTCPListener(address, upstream string) (*tcpListener, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &tcpListener{
+		upstreamAddress: upstreamAddress{upstream: upstream},
+		listener:        ln,
+		conns:           make(map[net.Conn]struct{}),
+	}
+	l.wg.Add(1)
+	go l.serve()
+	return l, nil
+}
+
+func (l *tcpListener) serve() {
+	defer l.wg.Done()
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				klog.Errorf("Accept on %s failed: %v", l.listener.Addr(), err)
+			}
+			return
+		}
+		l.wg.Add(1)
+		go l.handle(conn)
+	}
+}
+
+func (l *tcpListener) handle(client net.Conn) {
+	defer l.wg.Done()
+	defer client.Close()
+
+	upstream := l.get()
+	server, err := net.DialTimeout("tcp", upstream, dialTimeout)
+	if err != nil {
+		klog.Errorf("Failed to dial upstream %s for %s: %v", upstream, client.RemoteAddr(), err)
+		return
+	}
+	defer server.Close()
+
+	l.track(client, server)
+	defer l.untrack(client, server)
+
+	// Copy both directions, propagating half-closes so request/response protocols finish cleanly
+	done := make(chan struct{}, 2)
+	go pipe(server, client, done)
+	go pipe(client, server, done)
+	<-done
+	<-done
+}
+
+func pipe(dst, src net.Conn, done chan<- struct{}) {
+	_, _ = io.Copy(dst, src)
+	if tcpConn, ok := dst.(*net.TCPConn); ok {
+		_ = tcpConn.CloseWrite()
+	} else {
+		_ = dst.Close()
+	}
+	done <- struct{}{}
+}
+
+func (l *tcpListener) track(conns ...net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, conn := range conns {
+		l.conns[conn] = struct{}{}
+	}
+}
+
+func (l *tcpListener) untrack(conns ...net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, conn := range conns {
+		delete(l.conns, conn)
+	}
+}
+
+// close stops accepting and terminates the established connections
+func (l *tcpListener) close() {
+	_ = l.listener.Close()
+
+	l.mu.Lock()
+	for conn := range l.conns {
+		_ = conn.Close()
+	}
+	l.mu.Unlock()
+
+	l.wg.Wait()
+}
@@ -0,0 +1,122 @@
+package forwarder
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// udpListener relays datagrams to the upstream, keeping one upstream socket per client address
+// so replies are routed back to the client that sent the request
+type udpListener struct {
+	upstreamAddress
+
+	conn net.PacketConn
+	wg   sync.WaitGroup
+
+	mu       sync.Mutex
+	sessions map[string]*net.UDPConn
+}
+
+func startUDPListener(address, upstream string) (*udpListener, error) {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &udpListener{
+		upstreamAddress: upstreamAddress{upstream: upstream},
+		conn:            conn,
+		sessions:        make(map[string]*net.UDPConn),
+	}
+	l.wg.Add(1)
+	go l.serve()
+	return l, nil
+}
+
+func (l *udpListener) serve() {
+	defer l.wg.Done()
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, client, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				klog.Errorf("Read on %s failed: %v", l.conn.LocalAddr(), err)
+			}
+			return
+		}
+
+		session, err := l.session(client)
+		if err != nil {
+			klog.Errorf("Failed to open UDP session to %s for %s: %v", l.get(), client, err)
+			continue
+		}
+		_ = session.SetDeadline(time.Now().Add(udpSessionIdleTimeout))
+		if _, err := session.Write(buf[:n]); err != nil {
+			klog.Errorf("Failed to forward datagram from %s: %v", client, err)
+		}
+	}
+}
+
+// session returns the upstream socket of a client, creating it on the first datagram
+func (l *udpListener) session(client net.Addr) (*net.UDPConn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if session, exists := l.sessions[client.String()]; exists {
+		return session, nil
+	}
+
+	upstream, err := net.ResolveUDPAddr("udp", l.get())
+	if err != nil {
+		return nil, err
+	}
+	session, err := net.DialUDP("udp", nil, upstream)
+	if err != nil {
+		return nil, err
+	}
+	l.sessions[client.String()] = session
+
+	l.wg.Add(1)
+	go l.reply(client, session)
+	return session, nil
+}
+
+// reply relays upstream datagrams back to the client until the session is idle
+func (l *udpListener) reply(client net.Addr, session *net.UDPConn) {
+	defer l.wg.Done()
+	defer func() {
+		l.mu.Lock()
+		delete(l.sessions, client.String())
+		l.mu.Unlock()
+		_ = session.Close()
+	}()
+
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, err := session.Read(buf)
+		if err != nil {
+			return
+		}
+		_ = session.SetDeadline(time.Now().Add(udpSessionIdleTimeout))
+		if _, err := l.conn.WriteTo(buf[:n], client); err != nil {
+			return
+		}
+	}
+}
+
+// close stops the listener and every session
+func (l *udpListener) close() {
+	_ = l.conn.Close()
+
+	l.mu.Lock()
+	for _, session := range l.sessions {
+		_ = session.Close()
+	}
+	l.mu.Unlock()
+
+	l.wg.Wait()
+}
@@ -0,0 +1,86 @@
+package generator
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// WildcardPrefix starts a wildcard alias, which matches exactly one more label
+const WildcardPrefix = "*."
+
+// ValidateAlias checks that alias is a valid DNS name, optionally starting with a single "*." wildcard label
+func ValidateAlias(alias string) error {
+	name := strings.TrimPrefix(alias, WildcardPrefix)
+	if strings.Contains(name, "*") {
+		return fmt.Errorf("%q may only use a wildcard as its first label", alias)
+	}
+	if name != alias && !strings.Contains(name, ".") {
+		return fmt.Errorf("%q is a wildcard over a top-level domain", alias)
+	}
+	return ValidateDomainName(name)
+}
+
+// parseAliases reads the cross-cluster.io/aliases annotation, a comma separated list of hostnames
+// normalized to lowercase without a trailing dot, in annotation order without duplicates
+func parseAliases(value string) []string {
+	aliases := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(value, ",") {
+		alias := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(item), "."))
+		if alias == "" || seen[alias] {
+			continue
+		}
+		seen[alias] = true
+		aliases = append(aliases, alias)
+	}
+	return aliases
+}
+
+// attachAliases adds the valid aliases of the Service to its service-level HTTP route and returns the
+// rejected ones. Aliases are served by Caddy only, a Service without such a route cannot have any.
+func attachAliases(service *v1.Service, routes []ServiceRoute) []RouteRejection {
+	aliases := parseAliases(service.Annotations[AnnotationAliases])
+	if len(aliases) == 0 {
+		return nil
+	}
+
+	var serviceRoute *ServiceRoute
+	for i := range routes {
+		if routes[i].PortLabel == "" && routes[i].Pod == "" && routes[i].Protocol == ProtocolHTTP {
+			serviceRoute = &routes[i]
+			break
+		}
+	}
+
+	rejections := make([]RouteRejection, 0)
+	for _, alias := range aliases {
+		reason := ""
+		if err := ValidateAlias(alias); err != nil {
+			reason = "invalid alias: " + err.Error()
+		} else if serviceRoute == nil {
+			reason = "aliases need an HTTP service-level route"
+		}
+		if reason != "" {
+			rejections = append(rejections, RouteRejection{Namespace: service.Namespace, ServiceName: service.Name, RemoteDomain: alias, Reason: reason})
+			continue
+		}
+		serviceRoute.Aliases = append(serviceRoute.Aliases, alias)
+	}
+	return rejections
+}
+
+// HostsOverlap reports whether two host patterns match a common hostname, a "*" label matching any one label
+func HostsOverlap(a, b string) bool {
+	aLabels, bLabels := strings.Split(a, "."), strings.Split(b, ".")
+	if len(aLabels) != len(bLabels) {
+		return false
+	}
+	for i := range aLabels {
+		if aLabels[i] != bLabels[i] && aLabels[i] != "*" && bLabels[i] != "*" {
+			return false
+		}
+	}
+	return true
+}
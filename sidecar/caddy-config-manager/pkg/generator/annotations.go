@@ -0,0 +1,69 @@
+package generator
+
+import (
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// AnnotationExport decides whether a Service is exported ("true") or not ("false"),
+	// it is read from the annotations and, if absent there, from the labels
+	AnnotationExport = "cross-cluster.io/export"
+	// AnnotationExportPorts restricts the exported ports of a Service, e.g. "http,9090"
+	AnnotationExportPorts = "cross-cluster.io/export-ports"
+	// AnnotationProtocol overrides protocol detection, either one protocol for every port ("tcp")
+	// or a per-port list keyed by port name or number ("postgres=tcp,8080=http")
+	AnnotationProtocol = "cross-cluster.io/protocol"
+	// AnnotationListenPorts overrides the layer-4 listener port of Service ports, e.g. "postgres=15432,6379=16379"
+	AnnotationListenPorts = "cross-cluster.io/listen-ports"
+	// AnnotationUpstreamHostHeader sets the Host header sent upstream: "preserve" keeps the remote domain,
+	// "upstream" uses the upstream host and any other value is sent as is, e.g. "api.example.com"
+	AnnotationUpstreamHostHeader = "cross-cluster.io/upstream-host-header"
+	// AnnotationAliases lists extra hostnames of the Service's service-level domain, e.g. "payments.prod.remote,*.payments.prod.remote",
+	// an alias already claimed by another Service is kept by the oldest one and a wildcard alias covering another host is rejected
+	AnnotationAliases = "cross-cluster.io/aliases"
+	// AnnotationHealthCheck set to "false" disables the health checks of a Service, including the ones derived from its readinessProbe
+	AnnotationHealthCheck = "cross-cluster.io/health-check"
+	// AnnotationHealthCheckPath enables active health checks requesting this path on every upstream, e.g. "/healthz"
+	AnnotationHealthCheckPath = "cross-cluster.io/health-check-path"
+	// AnnotationHealthCheckPort is the port of the active health checks when it is not the proxied port, e.g. "8081"
+	AnnotationHealthCheckPort = "cross-cluster.io/health-check-port"
+	// AnnotationHealthCheckInterval is the interval between active health checks, e.g. "10s"
+	AnnotationHealthCheckInterval = "cross-cluster.io/health-check-interval"
+	// AnnotationHealthCheckTimeout is the timeout of an active health check, e.g. "2s"
+	AnnotationHealthCheckTimeout = "cross-cluster.io/health-check-timeout"
+	// AnnotationHealthCheckStatus is the status an active health check expects, a code ("200") or a class ("2xx")
+	AnnotationHealthCheckStatus = "cross-cluster.io/health-check-status"
+	// AnnotationFailDuration enables passive health checks, remembering a failed request this long, e.g. "30s"
+	AnnotationFailDuration = "cross-cluster.io/fail-duration"
+	// AnnotationMaxFails is the number of failed requests within the fail duration taking an upstream out, e.g. "3"
+	AnnotationMaxFails = "cross-cluster.io/max-fails"
+	// AnnotationUnhealthyStatus lists the response statuses counted as failed requests, e.g. "5xx" or "502,503"
+	AnnotationUnhealthyStatus = "cross-cluster.io/unhealthy-status"
+)
+
+// parsePortValues parses a comma separated list of <port-name-or-number>=<value> pairs
+func parsePortValues(value string) map[string]string {
+	values := make(map[string]string)
+	for _, item := range strings.Split(value, ",") {
+		key, val, found := strings.Cut(strings.TrimSpace(item), "=")
+		if !found {
+			continue
+		}
+		values[strings.TrimSpace(key)] = strings.TrimSpace(val)
+	}
+	return values
+}
+
+// lookupPortValue finds the value of a port in a parsed per-port list, by name first and then by number
+func lookupPortValue(values map[string]string, port v1.ServicePort) (string, bool) {
+	if port.Name != "" {
+		if val, exists := values[port.Name]; exists {
+			return val, true
+		}
+	}
+	val, exists := values[strconv.Itoa(int(port.Port))]
+	return val, exists
+}
@@ -0,0 +1,102 @@
+package generator
+
+import (
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// ProtocolHTTP ports are served by Caddy's reverse_proxy
+	ProtocolHTTP = "http"
+	// ProtocolTCP ports are forwarded at layer 4 over TCP
+	ProtocolTCP = "tcp"
+	// ProtocolUDP ports are forwarded at layer 4 over UDP
+	ProtocolUDP = "udp"
+)
+
+// httpAppProtocols are appProtocol values Caddy can reverse proxy over plain HTTP/1.1.
+// TLS and h2c upstreams (https, kubernetes.io/wss, kubernetes.io/h2c) are forwarded at layer 4 instead
+var httpAppProtocols = map[string]bool{
+	"http":             true,
+	"kubernetes.io/ws": true,
+}
+
+// httpPortNamePrefixes and tcpPortNamePrefixes follow the common <protocol>[-<suffix>] port naming convention
+var httpPortNamePrefixes = []string{"http", "web"}
+var tcpPortNamePrefixes = []string{"tcp", "tls", "https", "h2c", "grpc", "mysql", "postgres", "postgresql", "redis", "mongo", "mongodb", "kafka", "amqp", "nats", "zookeeper", "memcached", "dns", "ldap", "smtp"}
+
+// wellKnownTCPPorts are non-HTTP ports detected when neither appProtocol nor the port name tell
+var wellKnownTCPPorts = map[int32]bool{
+	22: true, 25: true, 53: true, 389: true, 1433: true, 1521: true, 2181: true, 3306: true,
+	4222: true, 5432: true, 5672: true, 6379: true, 9042: true, 9092: true, 11211: true, 27017: true,
+}
+
+// ClassifyServicePort decides whether a Service port is proxied as HTTP or forwarded at layer 4.
+// UDP ports are always forwarded over UDP. For TCP ports the detection order is the
+// cross-cluster.io/protocol annotation, appProtocol, the port name and well-known port numbers.
+// Ports not detected as anything else stay HTTP.
+// Returns an empty string for ports that cannot be forwarded (SCTP).
+func ClassifyServicePort(service *v1.Service, port v1.ServicePort) string {
+	switch port.Protocol {
+	case v1.ProtocolUDP:
+		return ProtocolUDP
+	case v1.ProtocolSCTP:
+		return ""
+	}
+
+	if value, exists := service.Annotations[AnnotationProtocol]; exists {
+		if !strings.Contains(value, "=") {
+			if protocol := normalizeProtocol(value); protocol != "" {
+				return protocol
+			}
+		} else if perPort, found := lookupPortValue(parsePortValues(value), port); found {
+			if protocol := normalizeProtocol(perPort); protocol != "" {
+				return protocol
+			}
+		}
+	}
+
+	if port.AppProtocol != nil && *port.AppProtocol != "" {
+		if httpAppProtocols[strings.ToLower(*port.AppProtocol)] {
+			return ProtocolHTTP
+		}
+		return ProtocolTCP
+	}
+
+	if port.Name != "" {
+		name := strings.ToLower(port.Name)
+		if hasProtocolPrefix(name, httpPortNamePrefixes) {
+			return ProtocolHTTP
+		}
+		if hasProtocolPrefix(name, tcpPortNamePrefixes) {
+			return ProtocolTCP
+		}
+	}
+
+	if wellKnownTCPPorts[port.Port] {
+		return ProtocolTCP
+	}
+
+	return ProtocolHTTP
+}
+
+// normalizeProtocol maps an annotation value of a TCP port to a protocol
+func normalizeProtocol(value string) string {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case ProtocolHTTP:
+		return ProtocolHTTP
+	case ProtocolTCP, "https", "h2c":
+		return ProtocolTCP
+	}
+	return ""
+}
+
+func hasProtocolPrefix(name string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if name == prefix || strings.HasPrefix(name, prefix+"-") {
+			return true
+		}
+	}
+	return false
+}
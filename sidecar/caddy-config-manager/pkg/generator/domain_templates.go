@@ -0,0 +1,173 @@
+package generator
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+const (
+	// DefaultRemoteDomainTemplate renders <port>.<service>.<namespace>.svc.<cluster>.<zone>,
+	// the port label only being present for per-port routes
+	DefaultRemoteDomainTemplate = "{{with .PortName}}{{.}}.{{end}}{{.Service}}.{{.Namespace}}.svc.{{.ClusterName}}.{{.Zone}}"
+	// DefaultUpstreamHostTemplate renders the in-cluster DNS name of the Service
+	DefaultUpstreamHostTemplate = "{{.Service}}.{{.Namespace}}.svc.{{.ClusterDomain}}"
+	// DefaultClusterDomain is used for .ClusterDomain unless another cluster domain is set
+	DefaultClusterDomain = "cluster.local"
+	// DefaultZone is used for .Zone unless another zone is set
+	DefaultZone = "remote"
+)
+
+// DomainTemplateData is the data available to domain templates
+type DomainTemplateData struct {
+	Service     string
+	Namespace   string
+	ClusterName string
+	// ClusterDomain is the DNS domain of the local cluster, e.g. cluster.local
+	ClusterDomain string
+	// Zone is the DNS zone of the remote domains, e.g. remote
+	Zone string
+	// PortName is the port name or number a per-port route is reachable by, empty for the service-level route
+	PortName string
+	// Port is the Service port number, 0 for the service-level route of a Service without ports
+	Port   int32
+	Labels map[string]string
+}
+
+// DomainTemplates renders remote domains and upstream hosts from Go templates
+type DomainTemplates struct {
+	remote        *template.Template
+	upstream      *template.Template
+	clusterDomain string
+	zone          string
+}
+
+// NewDomainTemplates parses and validates the remote domain and upstream host templates.
+// Both templates must render valid DNS names for sample data, and the remote domain template must
+// render distinct names for distinct services, namespaces, clusters and ports so routes cannot collide.
+// Missing labels render as empty strings, use e.g. {{or .Labels.team "shared"}} to provide a default.
+func NewDomainTemplates(remoteTemplate, upstreamTemplate string) (*DomainTemplates, error) {
+	remote, err := template.New("remote").Option("missingkey=zero").Parse(remoteTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote domain template: %w", err)
+	}
+	upstream, err := template.New("upstream").Option("missingkey=zero").Parse(upstreamTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream host template: %w", err)
+	}
+
+	t := &DomainTemplates{remote: remote, upstream: upstream, clusterDomain: DefaultClusterDomain, zone: DefaultZone}
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// DefaultDomainTemplates returns the templates producing the built-in naming scheme
+func DefaultDomainTemplates() *DomainTemplates {
+	t, err := NewDomainTemplates(DefaultRemoteDomainTemplate, DefaultUpstreamHostTemplate)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// WithClusterDomain returns a copy of the templates rendering .ClusterDomain as clusterDomain
+func (t *DomainTemplates) WithClusterDomain(clusterDomain string) *DomainTemplates {
+	copied := *t
+	copied.clusterDomain = clusterDomain
+	return &copied
+}
+
+// WithZone returns a copy of the templates rendering .Zone as zone. The remote domains must end in
+// the zone, which CoreDNS, the embedded DNS server and the peer catalogs are limited to.
+func (t *DomainTemplates) WithZone(zone string) (*DomainTemplates, error) {
+	zone = strings.ToLower(strings.Trim(zone, "."))
+	if err := ValidateDomainName(zone); err != nil {
+		return nil, fmt.Errorf("invalid zone: %w", err)
+	}
+	copied := *t
+	copied.zone = zone
+	domain, err := copied.RemoteDomain(DomainTemplateData{Service: "service", Namespace: "namespace", ClusterName: "cluster", PortName: "http", Port: 80})
+	if err != nil {
+		return nil, fmt.Errorf("remote domain template failed for sample data: %w", err)
+	}
+	if !strings.HasSuffix(domain, "."+zone) {
+		return nil, fmt.Errorf("remote domain template renders %q outside the zone %q, nothing would resolve it", domain, zone)
+	}
+	return &copied, nil
+}
+
+// Zone returns the zone used for .Zone
+func (t *DomainTemplates) Zone() string {
+	return t.zone
+}
+
+// ClusterDomain returns the cluster domain used for .ClusterDomain
+func (t *DomainTemplates) ClusterDomain() string {
+	return t.clusterDomain
+}
+
+// RemoteDomain renders the remote domain of a route
+func (t *DomainTemplates) RemoteDomain(data DomainTemplateData) (string, error) {
+	return t.render(t.remote, data)
+}
+
+// UpstreamHost renders the local host a route is proxied to
+func (t *DomainTemplates) UpstreamHost(data DomainTemplateData) (string, error) {
+	return t.render(t.upstream, data)
+}
+
+func (t *DomainTemplates) render(tmpl *template.Template, data DomainTemplateData) (string, error) {
+	if data.Labels == nil {
+		data.Labels = map[string]string{}
+	}
+	if data.ClusterDomain == "" {
+		data.ClusterDomain = t.clusterDomain
+	}
+	if data.Zone == "" {
+		data.Zone = t.zone
+	}
+	var builder strings.Builder
+	if err := tmpl.Execute(&builder, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(builder.String()), nil
+}
+
+// validate renders the templates for sample data and checks the results
+func (t *DomainTemplates) validate() error {
+	base := DomainTemplateData{Service: "service", Namespace: "namespace", ClusterName: "cluster", PortName: "http", Port: 80}
+	variants := []DomainTemplateData{
+		base,
+		{Service: "other", Namespace: base.Namespace, ClusterName: base.ClusterName, PortName: base.PortName, Port: base.Port},
+		{Service: base.Service, Namespace: "other", ClusterName: base.ClusterName, PortName: base.PortName, Port: base.Port},
+		{Service: base.Service, Namespace: base.Namespace, ClusterName: "other", PortName: base.PortName, Port: base.Port},
+		{Service: base.Service, Namespace: base.Namespace, ClusterName: base.ClusterName, PortName: "grpc", Port: 9000},
+		{Service: base.Service, Namespace: base.Namespace, ClusterName: base.ClusterName},
+	}
+
+	seen := make(map[string]DomainTemplateData)
+	for _, data := range variants {
+		domain, err := t.RemoteDomain(data)
+		if err != nil {
+			return fmt.Errorf("remote domain template failed for sample data: %w", err)
+		}
+		if err := ValidateDomainName(domain); err != nil {
+			return fmt.Errorf("remote domain template renders an invalid domain: %w", err)
+		}
+		if previous, exists := seen[domain]; exists {
+			return fmt.Errorf("remote domain template renders %q for both %+v and %+v, it must use .Service, .Namespace, .ClusterName and .PortName", domain, previous, data)
+		}
+		seen[domain] = data
+	}
+
+	host, err := t.UpstreamHost(base)
+	if err != nil {
+		return fmt.Errorf("upstream host template failed for sample data: %w", err)
+	}
+	if err := ValidateDomainName(host); err != nil {
+		return fmt.Errorf("upstream host template renders an invalid host: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package generator
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// ExportModeAllow exports every Service unless it opts out with cross-cluster.io/export: "false"
+	ExportModeAllow = "allow"
+	// ExportModeDeny exports only Services opting in with cross-cluster.io/export: "true"
+	ExportModeDeny = "deny"
+)
+
+// ExportPolicy decides which Services and ports are published to remote clusters
+type ExportPolicy struct {
+	// Mode is ExportModeAllow (default when empty) or ExportModeDeny
+	Mode string
+	// ProxyNamespace and ProxyServiceName identify the proxy's own Service, which is never exported to avoid loops
+	ProxyNamespace   string
+	ProxyServiceName string
+	// Exports lists the exported Services by <namespace>/<name> when not nil, e.g. from ServiceExports.
+	// Mode and the cross-cluster.io/export annotation are then ignored.
+	Exports map[string]bool
+}
+
+// ValidateExportMode returns an error if mode is not a supported export mode
+func ValidateExportMode(mode string) error {
+	switch mode {
+	case ExportModeAllow, ExportModeDeny:
+		return nil
+	default:
+		return fmt.Errorf("unsupported export mode %q, expected %q or %q", mode, ExportModeAllow, ExportModeDeny)
+	}
+}
+
+// IsServiceExported reports whether a Service is exported under the policy.
+// The proxy's own Service is never exported and the Kubernetes API Service (default/kubernetes)
+// is only exported when it explicitly opts in.
+func IsServiceExported(service *v1.Service, policy ExportPolicy) bool {
+	if service.Namespace == policy.ProxyNamespace && service.Name == policy.ProxyServiceName {
+		return false
+	}
+
+	if policy.Exports != nil {
+		return policy.Exports[service.Namespace+"/"+service.Name]
+	}
+
+	if explicit, found := exportDecision(service); found {
+		return explicit
+	}
+
+	if service.Namespace == "default" && service.Name == "kubernetes" {
+		return false
+	}
+
+	return policy.Mode != ExportModeDeny
+}
+
+// exportDecision reads the cross-cluster.io/export annotation, falling back to the label of the same name
+func exportDecision(service *v1.Service) (bool, bool) {
+	value, exists := service.Annotations[AnnotationExport]
+	if !exists {
+		value, exists = service.Labels[AnnotationExport]
+	}
+	if !exists {
+		return false, false
+	}
+
+	exported, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		klog.Warningf("Service %s/%s has invalid %s value %q, using the default export mode", service.Namespace, service.Name, AnnotationExport, value)
+		return false, false
+	}
+	return exported, true
+}
+
+// FilterExportedServices returns the exported Services with their ports restricted by cross-cluster.io/export-ports.
+// A Service whose ports are all filtered out is dropped. The input list is not modified.
+func FilterExportedServices(serviceList *v1.ServiceList, policy ExportPolicy) *v1.ServiceList {
+	exported := &v1.ServiceList{Items: make([]v1.Service, 0)}
+	if serviceList == nil {
+		return exported
+	}
+
+	for i := range serviceList.Items {
+		service := &serviceList.Items[i]
+		if !IsServiceExported(service, policy) {
+			klog.V(4).Infof("Service %s/%s is not exported", service.Namespace, service.Name)
+			continue
+		}
+
+		value, exists := service.Annotations[AnnotationExportPorts]
+		if !exists || len(service.Spec.Ports) == 0 {
+			exported.Items = append(exported.Items, *service)
+			continue
+		}
+
+		selected := make(map[string]bool)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				selected[item] = true
+			}
+		}
+
+		filtered := service.DeepCopy()
+		filtered.Spec.Ports = filtered.Spec.Ports[:0]
+		for _, port := range service.Spec.Ports {
+			if (port.Name != "" && selected[port.Name]) || selected[strconv.Itoa(int(port.Port))] {
+				filtered.Spec.Ports = append(filtered.Spec.Ports, port)
+			}
+		}
+		if len(filtered.Spec.Ports) == 0 {
+			klog.Warningf("Service %s/%s: %s %q matches no port, not exporting it", service.Namespace, service.Name, AnnotationExportPorts, value)
+			continue
+		}
+		exported.Items = append(exported.Items, *filtered)
+	}
+
+	return exported
+}
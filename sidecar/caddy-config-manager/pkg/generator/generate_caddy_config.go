@@ -1,17 +1,45 @@
 package generator
 
 import (
+	"strconv"
 	"strings"
 
 	"k8s.io/klog/v2"
 )
 
+// CaddyHTTPPort is the plain HTTP port Caddy serves every site on, the caddy-http targetPort of the
+// tailscale-proxy Service. Both the Caddyfile and the JSON configuration listen on it without automatic HTTPS.
+const CaddyHTTPPort = 2015
+
 // GenerateCaddyConfig generates Caddy configuration from remote domains and their mappings
-// The configuration format:
-// <remote-domain> {
+// The configuration format, every site address is http://<host>:<CaddyHTTPPort>:
+// http://<remote-domain>:2015 {
 //     reverse_proxy <local-domain>
 // }
 func GenerateCaddyConfig(remoteDomains []string, domainMapping map[string]string) string {
+	return GenerateCaddyConfigWithOptions(remoteDomains, domainMapping, nil)
+}
+
+// GenerateCaddyConfigWithOptions generates Caddy configuration like GenerateCaddyConfig,
+// listing the aliases of a site after its remote domain and adding a block to reverse_proxy when needed:
+// http://<remote-domain>:2015, http://<alias>:2015... {
+//     reverse_proxy <local-domain or upstreams> {
+//         lb_policy <lb-policy>
+//         health_uri <path>
+//         ...
+//         fail_duration <duration>
+//         ...
+//         header_up Host <host-header>
+//         transport http {
+//             forward_proxy_url <forward-proxy-url>
+//         }
+//     }
+// }
+// An unavailable site answers instead:
+// http://<remote-domain>:2015 {
+//     respond "<unavailable>" 503
+// }
+func GenerateCaddyConfigWithOptions(remoteDomains []string, domainMapping map[string]string, siteOptions map[string]SiteOptions) string {
 	var builder strings.Builder
 
 	for _, remoteDomain := range remoteDomains {
@@ -21,10 +49,46 @@ func GenerateCaddyConfig(remoteDomains []string, domainMapping map[string]string
 			continue
 		}
 
-		builder.WriteString(remoteDomain)
+		options := siteOptions[remoteDomain]
+		builder.WriteString(siteAddress(remoteDomain))
+		for _, alias := range options.Aliases {
+			builder.WriteString(", ")
+			builder.WriteString(siteAddress(alias))
+		}
 		builder.WriteString(" {\n")
+		if options.Unavailable != "" {
+			builder.WriteString("    respond ")
+			builder.WriteString(strconv.Quote(options.Unavailable))
+			builder.WriteString(" 503\n}\n")
+			continue
+		}
 		builder.WriteString("    reverse_proxy ")
-		builder.WriteString(localDomain)
+		if len(options.Upstreams) > 0 {
+			builder.WriteString(strings.Join(options.Upstreams, " "))
+		} else {
+			builder.WriteString(localDomain)
+		}
+		if options.HostHeader != "" || options.ForwardProxyURL != "" || options.LBPolicy != "" || !options.HealthCheck.IsZero() {
+			builder.WriteString(" {\n")
+			if options.LBPolicy != "" {
+				builder.WriteString("        lb_policy ")
+				builder.WriteString(options.LBPolicy)
+				builder.WriteString("\n")
+			}
+			writeHealthCheck(&builder, options.HealthCheck)
+			if options.HostHeader != "" {
+				builder.WriteString("        header_up Host ")
+				builder.WriteString(options.HostHeader)
+				builder.WriteString("\n")
+			}
+			if options.ForwardProxyURL != "" {
+				builder.WriteString("        transport http {\n")
+				builder.WriteString("            forward_proxy_url ")
+				builder.WriteString(options.ForwardProxyURL)
+				builder.WriteString("\n        }\n")
+			}
+			builder.WriteString("    }")
+		}
 		builder.WriteString("\n}\n")
 	}
 
@@ -36,4 +100,51 @@ func GenerateCaddyConfig(remoteDomains []string, domainMapping map[string]string
 	}
 
 	return config
-}
\ No newline at end of file
+}
+
+// writeHealthCheck writes the active and passive health check subdirectives of a reverse_proxy block
+func writeHealthCheck(builder *strings.Builder, check HealthCheck) {
+	subdirective := func(name, value string) {
+		builder.WriteString("        ")
+		builder.WriteString(name)
+		builder.WriteString(" ")
+		builder.WriteString(value)
+		builder.WriteString("\n")
+	}
+	if active := check.Active; active.Path != "" {
+		subdirective("health_uri", active.Path)
+		if active.Port != 0 {
+			subdirective("health_port", strconv.Itoa(int(active.Port)))
+		}
+		if active.Interval > 0 {
+			subdirective("health_interval", active.Interval.String())
+		}
+		if active.Timeout > 0 {
+			subdirective("health_timeout", active.Timeout.String())
+		}
+		if active.ExpectStatus != "" {
+			subdirective("health_status", active.ExpectStatus)
+		}
+		if active.Passes > 0 {
+			subdirective("health_passes", strconv.Itoa(int(active.Passes)))
+		}
+		if active.Fails > 0 {
+			subdirective("health_fails", strconv.Itoa(int(active.Fails)))
+		}
+	}
+	if passive := check.Passive; passive.FailDuration > 0 {
+		subdirective("fail_duration", passive.FailDuration.String())
+		if passive.MaxFails > 0 {
+			subdirective("max_fails", strconv.Itoa(int(passive.MaxFails)))
+		}
+		if len(passive.UnhealthyStatus) > 0 {
+			subdirective("unhealthy_status", strings.Join(passive.UnhealthyStatus, " "))
+		}
+	}
+}
+
+// siteAddress is the address of a site serving host in plain HTTP on CaddyHTTPPort, the scheme keeps
+// Caddy from enabling automatic HTTPS and binding :80 and :443
+func siteAddress(host string) string {
+	return "http://" + host + ":" + strconv.Itoa(CaddyHTTPPort)
+}
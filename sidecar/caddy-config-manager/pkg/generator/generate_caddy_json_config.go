@@ -0,0 +1,283 @@
+package generator
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// CaddyJSONServerName is the name of the HTTP server holding the cross-cluster routes,
+// it can be addressed directly for partial updates, e.g. /config/apps/http/servers/cross-cluster/routes
+const CaddyJSONServerName = "cross-cluster"
+
+// DefaultCaddyJSONListen is CaddyHTTPPort, the port of the sites of the Caddyfile too
+var DefaultCaddyJSONListen = []string{":" + strconv.Itoa(CaddyHTTPPort)}
+
+// wildcardRouteIDSuffix is appended to the @id of the route holding the wildcard hosts of a site with exact hosts
+const wildcardRouteIDSuffix = "#wildcard"
+
+// defaultUpstreamPort is the port reverse_proxy dials when the upstream has none, same as the Caddyfile adapter
+const defaultUpstreamPort = "80"
+
+// CaddyJSONConfig is the subset of Caddy's native JSON configuration produced by the generator
+type CaddyJSONConfig struct {
+	Apps CaddyJSONApps `json:"apps"`
+}
+
+// CaddyJSONApps holds the Caddy apps, only the http app is used
+type CaddyJSONApps struct {
+	HTTP CaddyJSONHTTPApp `json:"http"`
+}
+
+// CaddyJSONHTTPApp is the http app, servers are keyed by name
+type CaddyJSONHTTPApp struct {
+	Servers map[string]*CaddyJSONServer `json:"servers"`
+}
+
+// CaddyJSONServer is a single HTTP server with its listeners and routes
+type CaddyJSONServer struct {
+	Listen         []string                 `json:"listen"`
+	Routes         []CaddyJSONRoute         `json:"routes"`
+	AutomaticHTTPS *CaddyJSONAutomaticHTTPS `json:"automatic_https,omitempty"`
+}
+
+// CaddyJSONAutomaticHTTPS controls automatic HTTPS of a server
+type CaddyJSONAutomaticHTTPS struct {
+	Disable bool `json:"disable,omitempty"`
+}
+
+// CaddyJSONRoute matches requests and hands them to handlers
+type CaddyJSONRoute struct {
+	ID       string             `json:"@id,omitempty"`
+	Match    []CaddyJSONMatcher `json:"match,omitempty"`
+	Handle   []CaddyJSONHandler `json:"handle"`
+	Terminal bool               `json:"terminal,omitempty"`
+}
+
+// CaddyJSONMatcher is a request matcher set, all fields must match
+type CaddyJSONMatcher struct {
+	Host []string `json:"host,omitempty"`
+}
+
+// CaddyJSONHandler is an HTTP handler, the fields used depend on Handler
+type CaddyJSONHandler struct {
+	Handler       string                  `json:"handler"`
+	Upstreams     []CaddyJSONUpstream     `json:"upstreams,omitempty"`
+	LoadBalancing *CaddyJSONLoadBalancing `json:"load_balancing,omitempty"`
+	HealthChecks  *CaddyJSONHealthChecks  `json:"health_checks,omitempty"`
+	Headers       *CaddyJSONHeaders       `json:"headers,omitempty"`
+	Transport     *CaddyJSONTransport     `json:"transport,omitempty"`
+	// StatusCode and Body are the response of a static_response handler
+	StatusCode int    `json:"status_code,omitempty"`
+	Body       string `json:"body,omitempty"`
+}
+
+// CaddyJSONLoadBalancing selects the upstream of each request
+type CaddyJSONLoadBalancing struct {
+	SelectionPolicy *CaddyJSONSelectionPolicy `json:"selection_policy,omitempty"`
+}
+
+// CaddyJSONSelectionPolicy is a load-balancing policy, named like the lb_policy Caddyfile subdirective
+type CaddyJSONSelectionPolicy struct {
+	Policy string `json:"policy"`
+}
+
+// CaddyJSONHealthChecks takes the unhealthy upstreams out of rotation
+type CaddyJSONHealthChecks struct {
+	Active  *CaddyJSONActiveHealthChecks  `json:"active,omitempty"`
+	Passive *CaddyJSONPassiveHealthChecks `json:"passive,omitempty"`
+}
+
+// CaddyJSONActiveHealthChecks requests every upstream in the background, durations are Go duration strings
+type CaddyJSONActiveHealthChecks struct {
+	URI      string `json:"uri"`
+	Port     int    `json:"port,omitempty"`
+	Interval string `json:"interval,omitempty"`
+	Timeout  string `json:"timeout,omitempty"`
+	// ExpectStatus is a status code, or a single digit for a status class
+	ExpectStatus int `json:"expect_status,omitempty"`
+	Passes       int `json:"passes,omitempty"`
+	Fails        int `json:"fails,omitempty"`
+}
+
+// CaddyJSONPassiveHealthChecks counts the failed proxied requests of every upstream
+type CaddyJSONPassiveHealthChecks struct {
+	FailDuration string `json:"fail_duration"`
+	MaxFails     int    `json:"max_fails,omitempty"`
+	// UnhealthyStatus lists status codes, or single digits for status classes
+	UnhealthyStatus []int `json:"unhealthy_status,omitempty"`
+}
+
+// CaddyJSONTransport configures how reverse_proxy dials its upstreams
+type CaddyJSONTransport struct {
+	Protocol        string `json:"protocol"`
+	ForwardProxyURL string `json:"forward_proxy_url,omitempty"`
+}
+
+// CaddyJSONHeaders manipulates the headers of proxied requests
+type CaddyJSONHeaders struct {
+	Request *CaddyJSONHeaderOps `json:"request,omitempty"`
+}
+
+// CaddyJSONHeaderOps replaces header fields, keyed by field name
+type CaddyJSONHeaderOps struct {
+	Set map[string][]string `json:"set,omitempty"`
+}
+
+// CaddyJSONUpstream is a reverse_proxy backend
+type CaddyJSONUpstream struct {
+	Dial string `json:"dial"`
+}
+
+// GenerateCaddyJSONConfig generates Caddy's native JSON configuration from remote domains and their mappings.
+// Every remote domain becomes a route on the cross-cluster server with a host matcher and a reverse_proxy
+// handler. Each route gets an @id of the remote domain so it can be updated through the admin API alone.
+// Automatic HTTPS is disabled as traffic already arrives encrypted over the tailnet.
+func GenerateCaddyJSONConfig(remoteDomains []string, domainMapping map[string]string) ([]byte, error) {
+	return GenerateCaddyJSONConfigWithOptions(remoteDomains, domainMapping, nil)
+}
+
+// GenerateCaddyJSONConfigWithOptions generates Caddy's native JSON configuration like GenerateCaddyJSONConfig,
+// matching the aliases of each site too and applying its options, health checks included, to the reverse_proxy handler.
+// An unavailable site gets a static_response handler answering 503 instead.
+// Routes are matched in order, so the exact hosts of every site come first and the wildcard hosts,
+// e.g. wildcard aliases and the peers' domains, in routes of their own after them.
+func GenerateCaddyJSONConfigWithOptions(remoteDomains []string, domainMapping map[string]string, siteOptions map[string]SiteOptions) ([]byte, error) {
+	routes := make([]CaddyJSONRoute, 0, len(remoteDomains))
+	wildcardRoutes := make([]CaddyJSONRoute, 0)
+	addRoutes := func(remoteDomain string, aliases []string, handler CaddyJSONHandler) {
+		var exact, wildcard []string
+		for _, host := range append([]string{remoteDomain}, aliases...) {
+			if strings.Contains(host, "*") {
+				wildcard = append(wildcard, host)
+			} else {
+				exact = append(exact, host)
+			}
+		}
+		if len(exact) > 0 {
+			routes = append(routes, CaddyJSONRoute{
+				ID:       remoteDomain,
+				Match:    []CaddyJSONMatcher{{Host: exact}},
+				Handle:   []CaddyJSONHandler{handler},
+				Terminal: true,
+			})
+		}
+		if len(wildcard) > 0 {
+			id := remoteDomain
+			if len(exact) > 0 {
+				id += wildcardRouteIDSuffix
+			}
+			wildcardRoutes = append(wildcardRoutes, CaddyJSONRoute{
+				ID:       id,
+				Match:    []CaddyJSONMatcher{{Host: wildcard}},
+				Handle:   []CaddyJSONHandler{handler},
+				Terminal: true,
+			})
+		}
+	}
+
+	for _, remoteDomain := range remoteDomains {
+		localDomain, exists := domainMapping[remoteDomain]
+		if !exists {
+			klog.Warningf("No mapping found for remote domain: %s, skipping", remoteDomain)
+			continue
+		}
+
+		options := siteOptions[remoteDomain]
+		if options.Unavailable != "" {
+			addRoutes(remoteDomain, options.Aliases, CaddyJSONHandler{Handler: "static_response", StatusCode: 503, Body: options.Unavailable})
+			continue
+		}
+
+		handler := CaddyJSONHandler{
+			Handler:   "reverse_proxy",
+			Upstreams: []CaddyJSONUpstream{{Dial: dialAddress(localDomain)}},
+		}
+		if len(options.Upstreams) > 0 {
+			handler.Upstreams = make([]CaddyJSONUpstream, 0, len(options.Upstreams))
+			for _, upstream := range options.Upstreams {
+				handler.Upstreams = append(handler.Upstreams, CaddyJSONUpstream{Dial: dialAddress(upstream)})
+			}
+		}
+		if options.LBPolicy != "" {
+			handler.LoadBalancing = &CaddyJSONLoadBalancing{SelectionPolicy: &CaddyJSONSelectionPolicy{Policy: options.LBPolicy}}
+		}
+		handler.HealthChecks = jsonHealthChecks(options.HealthCheck)
+		if options.HostHeader != "" {
+			handler.Headers = &CaddyJSONHeaders{Request: &CaddyJSONHeaderOps{Set: map[string][]string{"Host": {options.HostHeader}}}}
+		}
+		if options.ForwardProxyURL != "" {
+			handler.Transport = &CaddyJSONTransport{Protocol: "http", ForwardProxyURL: options.ForwardProxyURL}
+		}
+		addRoutes(remoteDomain, options.Aliases, handler)
+	}
+	routes = append(routes, wildcardRoutes...)
+
+	config := CaddyJSONConfig{
+		Apps: CaddyJSONApps{
+			HTTP: CaddyJSONHTTPApp{
+				Servers: map[string]*CaddyJSONServer{
+					CaddyJSONServerName: {
+						Listen:         DefaultCaddyJSONListen,
+						Routes:         routes,
+						AutomaticHTTPS: &CaddyJSONAutomaticHTTPS{Disable: true},
+					},
+				},
+			},
+		},
+	}
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	klog.Infof("Generated Caddy JSON configuration with %d route(s)", len(routes))
+	return data, nil
+}
+
+// jsonHealthChecks converts a health check to the health_checks of a reverse_proxy handler, nil when disabled
+func jsonHealthChecks(check HealthCheck) *CaddyJSONHealthChecks {
+	if check.IsZero() {
+		return nil
+	}
+	healthChecks := &CaddyJSONHealthChecks{}
+	if active := check.Active; active.Path != "" {
+		healthChecks.Active = &CaddyJSONActiveHealthChecks{
+			URI:    active.Path,
+			Port:   int(active.Port),
+			Passes: int(active.Passes),
+			Fails:  int(active.Fails),
+		}
+		if active.Interval > 0 {
+			healthChecks.Active.Interval = active.Interval.String()
+		}
+		if active.Timeout > 0 {
+			healthChecks.Active.Timeout = active.Timeout.String()
+		}
+		if active.ExpectStatus != "" {
+			healthChecks.Active.ExpectStatus = statusCode(active.ExpectStatus)
+		}
+	}
+	if passive := check.Passive; passive.FailDuration > 0 {
+		healthChecks.Passive = &CaddyJSONPassiveHealthChecks{
+			FailDuration: passive.FailDuration.String(),
+			MaxFails:     int(passive.MaxFails),
+		}
+		for _, status := range passive.UnhealthyStatus {
+			healthChecks.Passive.UnhealthyStatus = append(healthChecks.Passive.UnhealthyStatus, statusCode(status))
+		}
+	}
+	return healthChecks
+}
+
+// dialAddress returns the upstream as host:port, reverse_proxy in JSON requires an explicit port
+func dialAddress(upstream string) string {
+	if _, _, err := net.SplitHostPort(upstream); err == nil {
+		return upstream
+	}
+	return net.JoinHostPort(upstream, defaultUpstreamPort)
+}
@@ -0,0 +1,121 @@
+package generator
+
+import (
+	"net"
+	"sort"
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// ReservedListenPorts are used by other containers of the tailscale-proxy pod and never assigned to layer-4 listeners:
+// the tailscale HTTP and SOCKS5 proxies and Caddy's HTTP/HTTPS servers.
+// The ports the manager itself is configured with are added by the caller
+var ReservedListenPorts = map[int32]bool{1050: true, 1055: true, CaddyHTTPPort: true, 2016: true}
+
+// L4Listener is a layer-4 listener of the sidecar forwarding one Service port
+type L4Listener struct {
+	// ListenPort is the port the sidecar listens on, reachable through the tailnet gateway
+	ListenPort int32
+	// Protocol is ProtocolTCP or ProtocolUDP
+	Protocol string
+	// Upstream is <local-domain>:<port> of the Service port
+	Upstream string
+
+	Namespace   string
+	ServiceName string
+	PortName    string
+	Port        int32
+}
+
+// Key identifies the listener socket
+func (l L4Listener) Key() string {
+	return l.Protocol + "/" + strconv.Itoa(int(l.ListenPort))
+}
+
+// GenerateL4Listeners generates one listener per non-HTTP Service port with the default domain templates.
+// Listeners preserve the Service port number unless the cross-cluster.io/listen-ports annotation overrides it,
+// so the same port is used in every cluster. Services are processed in namespace/name order and the first
+// Service claiming a port keeps it, a later Service claiming the same port is skipped with a warning,
+// which keeps existing listeners stable when Services are added.
+func GenerateL4Listeners(serviceList *v1.ServiceList) []L4Listener {
+	return GenerateL4ListenersWithTemplates(DefaultDomainTemplates(), ReservedListenPorts, serviceList)
+}
+
+// GenerateL4ListenersWithTemplates generates the layer-4 listeners like GenerateL4Listeners,
+// rendering upstream hosts with the given templates and skipping the reserved listen ports
+func GenerateL4ListenersWithTemplates(templates *DomainTemplates, reserved map[int32]bool, serviceList *v1.ServiceList) []L4Listener {
+	listeners := make([]L4Listener, 0)
+	if serviceList == nil {
+		return listeners
+	}
+
+	services := make([]*v1.Service, 0, len(serviceList.Items))
+	for i := range serviceList.Items {
+		services = append(services, &serviceList.Items[i])
+	}
+	sort.SliceStable(services, func(i, j int) bool {
+		if services[i].Namespace != services[j].Namespace {
+			return services[i].Namespace < services[j].Namespace
+		}
+		return services[i].Name < services[j].Name
+	})
+
+	claimed := make(map[string]string)
+	for _, service := range services {
+		listenPorts := parsePortValues(service.Annotations[AnnotationListenPorts])
+		localDomain, err := serviceUpstreamHost(templates, service, DomainTemplateData{
+			Service:   service.Name,
+			Namespace: service.Namespace,
+			Labels:    service.Labels,
+		})
+		if err != nil {
+			klog.Warningf("Failed to render upstream host of Service %s/%s: %v, skipping", service.Namespace, service.Name, err)
+			continue
+		}
+
+		for _, port := range service.Spec.Ports {
+			protocol := ClassifyServicePort(service, port)
+			if protocol != ProtocolTCP && protocol != ProtocolUDP {
+				continue
+			}
+
+			listenPort := port.Port
+			if override, exists := lookupPortValue(listenPorts, port); exists {
+				parsed, err := strconv.ParseInt(override, 10, 32)
+				if err != nil || parsed < 1 || parsed > 65535 {
+					klog.Warningf("Invalid listen port %q for Service %s/%s port %d, using %d", override, service.Namespace, service.Name, port.Port, port.Port)
+				} else {
+					listenPort = int32(parsed)
+				}
+			}
+
+			listener := L4Listener{
+				ListenPort:  listenPort,
+				Protocol:    protocol,
+				Upstream:    net.JoinHostPort(localDomain, strconv.Itoa(int(port.Port))),
+				Namespace:   service.Namespace,
+				ServiceName: service.Name,
+				PortName:    port.Name,
+				Port:        port.Port,
+			}
+
+			if reserved[listenPort] {
+				klog.Warningf("Service %s/%s port %d: listen port %d is reserved by the proxy pod, set %s to choose another one",
+					service.Namespace, service.Name, port.Port, listenPort, AnnotationListenPorts)
+				continue
+			}
+			if owner, exists := claimed[listener.Key()]; exists {
+				klog.Warningf("Service %s/%s port %d: listen port %s already used by %s, set %s to choose another one",
+					service.Namespace, service.Name, port.Port, listener.Key(), owner, AnnotationListenPorts)
+				continue
+			}
+			claimed[listener.Key()] = service.Namespace + "/" + service.Name
+
+			listeners = append(listeners, listener)
+		}
+	}
+
+	return listeners
+}
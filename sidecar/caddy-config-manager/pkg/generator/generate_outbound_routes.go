@@ -0,0 +1,190 @@
+package generator
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// DefaultRemoteZone is the zone the default remote domain template renders under
+	DefaultRemoteZone = "remote"
+	// DefaultGatewaySuffix is appended to a cluster name to form its tailnet gateway hostname, as TS_HOSTNAME does
+	DefaultGatewaySuffix = "-tsgateway"
+	// DefaultGatewayPort is Caddy's HTTP port in the peer's tailscale-proxy pod, userspace tailscaled
+	// forwards tailnet connections to the pod's own ports
+	DefaultGatewayPort = CaddyHTTPPort
+	// DefaultForwardProxyURL is the HTTP proxy of the tailscale container (TS_OUTBOUND_HTTP_PROXY_LISTEN),
+	// socks5://127.0.0.1:1055 (TS_SOCKS5_SERVER) works as well
+	DefaultForwardProxyURL = "http://127.0.0.1:1050"
+)
+
+// OutboundOptions describes how peer clusters are reached
+type OutboundOptions struct {
+	// Peers are the names of the peer clusters, the local cluster is skipped
+	Peers        []string
+	LocalCluster string
+	// PeerHosts restricts the routes to the hosts each peer exports, keyed by peer, when not nil.
+	// A peer listed without hosts is then not routed, a peer missing from it is routed by wildcard.
+	// When nil every peer domain is routed by wildcard.
+	PeerHosts map[string][]string
+	// Zone is the remote domain zone, DefaultRemoteZone when empty
+	Zone string
+	// GatewaySuffix, GatewayPort and ForwardProxyURL default to DefaultGatewaySuffix, DefaultGatewayPort and DefaultForwardProxyURL
+	GatewaySuffix   string
+	GatewayPort     int32
+	ForwardProxyURL string
+}
+
+// ValidateForwardProxyURL checks that value is an http, https or socks5 proxy URL with a host
+func ValidateForwardProxyURL(value string) error {
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	switch parsed.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return fmt.Errorf("unsupported proxy scheme %q in %q, expected http, https or socks5", parsed.Scheme, value)
+	}
+	if parsed.Host == "" {
+		return fmt.Errorf("proxy URL %q has no host", value)
+	}
+	return nil
+}
+
+// OutboundRoute forwards the remote domains of a peer cluster to its tailnet gateway
+type OutboundRoute struct {
+	Peer string
+	// Hosts match the peer's service-level, per-port and per-pod domains: *.*.svc.<peer>.<zone> and *.*.*.svc.<peer>.<zone>,
+	// or the hosts it exports when they are known
+	Hosts []string
+	// Upstream is <peer><gateway-suffix>:<gateway-port>, resolved by tailscale MagicDNS through the forward proxy
+	Upstream        string
+	ForwardProxyURL string
+	// HostHeader replaces the Host header, empty to pass it through
+	HostHeader string
+}
+
+// GenerateOutboundRoutes generates a route per peer cluster, sorted by peer name. Requests for a peer's
+// domains reaching the local proxy are sent through the tailscale forward proxy to the peer's gateway,
+// whose Caddy serves them like any remote request, so the Host header is passed through.
+// Invalid peer names are skipped with a warning.
+func GenerateOutboundRoutes(opts OutboundOptions) []OutboundRoute {
+	zone := strings.Trim(opts.Zone, ".")
+	if zone == "" {
+		zone = DefaultRemoteZone
+	}
+	suffix := opts.GatewaySuffix
+	if suffix == "" {
+		suffix = DefaultGatewaySuffix
+	}
+	port := opts.GatewayPort
+	if port == 0 {
+		port = DefaultGatewayPort
+	}
+	proxyURL := opts.ForwardProxyURL
+	if proxyURL == "" {
+		proxyURL = DefaultForwardProxyURL
+	}
+	localCluster, _ := NormalizeClusterName(opts.LocalCluster)
+
+	seen := make(map[string]bool)
+	routes := make([]OutboundRoute, 0, len(opts.Peers))
+	for _, name := range opts.Peers {
+		peer, err := NormalizeClusterName(name)
+		if err != nil {
+			klog.Warningf("Skipping outbound route to peer: %v", err)
+			continue
+		}
+		if peer == localCluster || seen[peer] {
+			continue
+		}
+		seen[peer] = true
+		hosts := []string{
+			"*.*.svc." + peer + "." + zone,
+			"*.*.*.svc." + peer + "." + zone,
+		}
+		if exported, fetched := opts.PeerHosts[peer]; fetched {
+			hosts = exported
+			if len(hosts) == 0 {
+				klog.V(4).Infof("Peer %s exports no HTTP host, not routing it", peer)
+				continue
+			}
+		} else if opts.PeerHosts != nil {
+			klog.Infof("Peer %s never returned its catalog, routing every domain of it by wildcard", peer)
+		}
+		routes = append(routes, OutboundRoute{
+			Peer:            peer,
+			Hosts:           hosts,
+			Upstream:        net.JoinHostPort(peer+suffix, strconv.Itoa(int(port))),
+			ForwardProxyURL: proxyURL,
+		})
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Peer < routes[j].Peer })
+	return routes
+}
+
+// AppendOutboundSites adds the outbound routes to the sites rendered by GenerateCaddyConfigWithOptions
+// and GenerateCaddyJSONConfigWithOptions, after the local ones. The first host of a route is its site
+// address, the others its aliases.
+func AppendOutboundSites(remoteDomains []string, domainMapping map[string]string, siteOptions map[string]SiteOptions, routes []OutboundRoute) []string {
+	for _, route := range routes {
+		site := route.Hosts[0]
+		if _, exists := domainMapping[site]; exists {
+			klog.Warningf("Outbound route to peer %s collides with local domain %s, skipping", route.Peer, site)
+			continue
+		}
+		remoteDomains = append(remoteDomains, site)
+		domainMapping[site] = route.Upstream
+		siteOptions[site] = SiteOptions{Aliases: route.Hosts[1:], ForwardProxyURL: route.ForwardProxyURL, HostHeader: route.HostHeader}
+	}
+	return remoteDomains
+}
+
+// RejectPeerAliases drops the aliases of the routes overlapping the hosts of an outbound route, exactly
+// or through a wildcard, so a local Service cannot take the requests meant for a peer cluster
+func RejectPeerAliases(routes []ServiceRoute, outbound []OutboundRoute) []RouteRejection {
+	rejections := make([]RouteRejection, 0)
+	for i := range routes {
+		route := &routes[i]
+		if len(route.Aliases) == 0 {
+			continue
+		}
+		aliases := make([]string, 0, len(route.Aliases))
+		for _, alias := range route.Aliases {
+			peer, host, overlaps := overlappingPeerHost(alias, outbound)
+			if !overlaps {
+				aliases = append(aliases, alias)
+				continue
+			}
+			rejection := RouteRejection{
+				Namespace:    route.Namespace,
+				ServiceName:  route.ServiceName,
+				RemoteDomain: alias,
+				Reason:       fmt.Sprintf("alias overlaps %s routed to peer %s", host, peer),
+			}
+			klog.Warningf("Rejected route %s", rejection)
+			rejections = append(rejections, rejection)
+		}
+		route.Aliases = aliases
+	}
+	return rejections
+}
+
+// overlappingPeerHost finds the first outbound host overlapping alias and its peer
+func overlappingPeerHost(alias string, outbound []OutboundRoute) (string, string, bool) {
+	for _, route := range outbound {
+		for _, host := range route.Hosts {
+			if HostsOverlap(alias, host) {
+				return route.Peer, host, true
+			}
+		}
+	}
+	return "", "", false
+}
@@ -1,16 +1,13 @@
 package generator
 
 import (
-	"context"
-
 	v1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/klog/v2"
 )
 
 // GenerateCrossClusterServiceDomains generates cross-cluster access domains for services
-// Returns a slice of remote domains and a map from remote domain to local domain
+// Returns a slice of remote domains and a map from remote domain to local upstream (<local-domain>[:<port>])
+// Only HTTP routes are returned, layer-4 ports are handled by GenerateL4Listeners
 func GenerateCrossClusterServiceDomains(clientset kubernetes.Interface, serviceList *v1.ServiceList) ([]string, map[string]string) {
 	remoteDomains := make([]string, 0)
 	domainMapping := make(map[string]string)
@@ -20,34 +17,27 @@ func GenerateCrossClusterServiceDomains(clientset kubernetes.Interface, serviceL
 	}
 
 	// Read cluster name from ConfigMap
-	clusterName := "default-cluster-name" // Default fallback value
-	configMap, err := clientset.CoreV1().ConfigMaps("default").Get(context.TODO(), "tailscale-cluster-name", metav1.GetOptions{})
-	if err != nil {
-		klog.Warningf("Failed to get tailscale-cluster-name ConfigMap: %v, using default cluster name '%s'", err, clusterName)
-	} else {
-		if name, exists := configMap.Data["CLUSTER_NAME"]; exists && name != "" {
-			clusterName = name
-			klog.Infof("Using cluster name from tailscale-cluster-name ConfigMap: CLUSTER_NAME = %s", clusterName)
-		} else {
-			klog.Warningf("CLUSTER_NAME not found or empty in ConfigMap, using default '%s' to generate caddy's configuration", clusterName)
-		}
-	}
+	clusterName := GetClusterName(clientset)
 
-	for _, service := range serviceList.Items {
-		serviceName := service.Name
-		namespace := service.Namespace
+	remoteDomains, domainMapping = DomainMappingFromRoutes(GenerateServiceRoutes(clusterName, serviceList))
+	return remoteDomains, domainMapping
+}
 
-		// Generate remote domain format: <service-name>.<namespace>.svc.<cluster-name>.remote
-		remoteDomain := serviceName + "." + namespace + ".svc." + clusterName + ".remote"
+// DomainMappingFromRoutes flattens the HTTP routes into remote domains and a map from remote domain to upstream
+func DomainMappingFromRoutes(routes []ServiceRoute) ([]string, map[string]string) {
+	remoteDomains := make([]string, 0, len(routes))
+	domainMapping := make(map[string]string, len(routes))
 
-		// Generate local domain format: <service-name>.<namespace>.svc.cluster.local
-		localDomain := serviceName + "." + namespace + ".svc.cluster.local"
+	for _, route := range routes {
+		if route.Protocol != ProtocolHTTP {
+			continue
+		}
 
 		// Add to slice
-		remoteDomains = append(remoteDomains, remoteDomain)
+		remoteDomains = append(remoteDomains, route.RemoteDomain)
 
 		// Add to mapping
-		domainMapping[remoteDomain] = localDomain
+		domainMapping[route.RemoteDomain] = route.Upstream
 	}
 
 	return remoteDomains, domainMapping
@@ -0,0 +1,276 @@
+package generator
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// ServiceRoute is a remote domain published for a Service and the local upstream it is proxied to
+type ServiceRoute struct {
+	// RemoteDomain is the domain peers use to reach the Service
+	RemoteDomain string
+	// ServiceDomain is the service-level remote domain of the Service, equal to RemoteDomain for that route
+	ServiceDomain string
+	// Upstream is the local address the proxy forwards to, <local-domain>:<port> when the port is known
+	Upstream string
+	// HostHeader is the Host header sent to the upstream, empty to pass the remote domain through
+	HostHeader string
+	// Aliases are extra hostnames served like RemoteDomain, only set on the service-level HTTP route
+	Aliases []string
+
+	Namespace   string
+	ServiceName string
+	// PortName is the name of the Service port, empty for unnamed ports
+	PortName string
+	// PortLabel is the port name or number the remote domain is rendered with, empty for the service-level route
+	PortLabel string
+	// Pod is the hostname of the pod a per-pod route of a headless Service targets, empty otherwise
+	Pod string
+	// Port is the Service port number, 0 when the Service declares no ports
+	Port int32
+	// Protocol is ProtocolHTTP for routes served by Caddy, ProtocolTCP or ProtocolUDP for layer-4 routes
+	Protocol string
+}
+
+// GenerateServiceRoutes generates the routes of every Service port with the default domain templates.
+// For a Service with ports:
+//   - <service-name>.<namespace>.svc.<cluster-name>.remote targets the default port
+//   - <port-name>.<service-name>.<namespace>.svc.<cluster-name>.remote targets a named port
+//   - <port-number>.<service-name>.<namespace>.svc.<cluster-name>.remote targets any port
+//
+// The default port is the one named "http", else port 80, else the first port.
+// A Service without ports only gets the service-level domain, proxied without an explicit port.
+// Every route carries the protocol from ClassifyServicePort, ports that cannot be forwarded are skipped.
+func GenerateServiceRoutes(clusterName string, serviceList *v1.ServiceList) []ServiceRoute {
+	return GenerateServiceRoutesWithTemplates(DefaultDomainTemplates(), clusterName, serviceList)
+}
+
+// GenerateServiceRoutesWithTemplates generates the routes of every Service port like GenerateServiceRoutes,
+// rendering remote domains and upstream hosts with the given templates.
+// Rejected routes are only logged, use GenerateServiceRouteTable to get them.
+func GenerateServiceRoutesWithTemplates(templates *DomainTemplates, clusterName string, serviceList *v1.ServiceList) []ServiceRoute {
+	routes, _ := GenerateServiceRouteTable(templates, clusterName, serviceList, nil)
+	return routes
+}
+
+// GenerateServiceRouteTable generates the routes of every Service port and the routes it rejected.
+// A route is rejected when its remote domain or upstream host is not a valid DNS name, or when its
+// remote domain is already used by another Service, in which case the oldest Service keeps it.
+// Every Service is rejected when the cluster name is not a valid DNS label, uppercase is lowered.
+// Headless Services additionally get a route per pod hostname in pods, see generatePodRoutes,
+// their layer-4 ports are rejected as they cannot be routed per pod.
+// Aliases from the cross-cluster.io/aliases annotation are checked like remote domains, but never
+// take a remote domain from another Service.
+// Each rejection is logged as a warning.
+func GenerateServiceRouteTable(templates *DomainTemplates, clusterName string, serviceList *v1.ServiceList, pods PodHostnames) ([]ServiceRoute, []RouteRejection) {
+	routes := make([]ServiceRoute, 0)
+	rejections := make([]RouteRejection, 0)
+	if serviceList == nil {
+		return routes, rejections
+	}
+
+	clusterName, clusterNameErr := NormalizeClusterName(clusterName)
+	perService := make([][]ServiceRoute, len(serviceList.Items))
+	for i := range serviceList.Items {
+		service := &serviceList.Items[i]
+		if clusterNameErr != nil {
+			rejections = append(rejections, RouteRejection{Namespace: service.Namespace, ServiceName: service.Name, Reason: clusterNameErr.Error()})
+			continue
+		}
+		serviceRoutes, err := generateRoutesForService(templates, clusterName, service)
+		if err == nil && IsHeadlessService(service) {
+			podRoutes, podRejections := generatePodRoutes(serviceRoutes, pods.Hostnames(service))
+			serviceRoutes = append(serviceRoutes, podRoutes...)
+			rejections = append(rejections, podRejections...)
+		}
+		if err != nil {
+			rejections = append(rejections, RouteRejection{Namespace: service.Namespace, ServiceName: service.Name, Reason: err.Error()})
+			continue
+		}
+		for _, route := range serviceRoutes {
+			if err := ValidateDomainName(route.RemoteDomain); err != nil {
+				rejections = append(rejections, RouteRejection{
+					Namespace:    route.Namespace,
+					ServiceName:  route.ServiceName,
+					PortName:     route.PortName,
+					Port:         route.Port,
+					RemoteDomain: route.RemoteDomain,
+					Reason:       "invalid remote domain: " + err.Error(),
+				})
+				continue
+			}
+			perService[i] = append(perService[i], route)
+		}
+		rejections = append(rejections, attachAliases(service, perService[i])...)
+	}
+
+	routes, conflicts := resolveRouteConflicts(serviceList.Items, perService, templates.Zone())
+	rejections = append(rejections, conflicts...)
+	for _, rejection := range rejections {
+		klog.Warningf("Rejected route %s", rejection)
+	}
+	return routes, rejections
+}
+
+func generateRoutesForService(templates *DomainTemplates, clusterName string, service *v1.Service) ([]ServiceRoute, error) {
+	data := DomainTemplateData{
+		Service:     service.Name,
+		Namespace:   service.Namespace,
+		ClusterName: clusterName,
+		Labels:      service.Labels,
+	}
+
+	// Render the local host, <service-name>.<namespace>.svc.cluster.local by default
+	localDomain, err := serviceUpstreamHost(templates, service, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidateDomainName(localDomain); err != nil && net.ParseIP(localDomain) == nil {
+		return nil, fmt.Errorf("invalid upstream host: %w", err)
+	}
+	hostHeader := serviceHostHeader(service, localDomain)
+
+	serviceDomain, err := templates.RemoteDomain(data)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := make([]ServiceRoute, 0, 1+2*len(service.Spec.Ports))
+	if len(service.Spec.Ports) == 0 {
+		routes = append(routes, ServiceRoute{
+			RemoteDomain:  serviceDomain,
+			ServiceDomain: serviceDomain,
+			Upstream:      localDomain,
+			HostHeader:    hostHeader,
+			Namespace:     service.Namespace,
+			ServiceName:   service.Name,
+			Protocol:      ProtocolHTTP,
+		})
+		return routes, nil
+	}
+
+	// addRoute renders the remote domain reachable by portName, empty for the service-level route
+	addRoute := func(portName string, port v1.ServicePort) error {
+		portData := data
+		portData.PortName = portName
+		portData.Port = port.Port
+		remoteDomain, err := templates.RemoteDomain(portData)
+		if err != nil {
+			return err
+		}
+		route := newServiceRoute(remoteDomain, serviceDomain, localDomain, service, port)
+		route.PortLabel = portName
+		route.HostHeader = hostHeader
+		routes = append(routes, route)
+		return nil
+	}
+
+	defaultPort := defaultServicePort(service.Spec.Ports)
+	if ClassifyServicePort(service, defaultPort) != "" {
+		if err := addRoute("", defaultPort); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, port := range service.Spec.Ports {
+		if ClassifyServicePort(service, port) == "" {
+			klog.Warningf("Service %s/%s port %d uses unsupported protocol %s, skipping", service.Namespace, service.Name, port.Port, port.Protocol)
+			continue
+		}
+		if port.Name != "" {
+			if err := addRoute(port.Name, port); err != nil {
+				return nil, err
+			}
+		}
+		if err := addRoute(strconv.Itoa(int(port.Port)), port); err != nil {
+			return nil, err
+		}
+	}
+
+	return routes, nil
+}
+
+func newServiceRoute(remoteDomain, serviceDomain, localDomain string, service *v1.Service, port v1.ServicePort) ServiceRoute {
+	return ServiceRoute{
+		RemoteDomain:  remoteDomain,
+		ServiceDomain: serviceDomain,
+		Upstream:      net.JoinHostPort(localDomain, strconv.Itoa(int(port.Port))),
+		Namespace:     service.Namespace,
+		ServiceName:   service.Name,
+		PortName:      port.Name,
+		Port:          port.Port,
+		Protocol:      ClassifyServicePort(service, port),
+	}
+}
+
+// generatePodRoutes derives the per-pod routes of a headless Service from its service-level route:
+// <hostname>.<service-domain> is proxied to <hostname>.<upstream-host> on the same port.
+// A Host header naming the Service's upstream host is rewritten to name the pod.
+// Only an HTTP service-level route is expanded, layer-4 listeners are per port and cannot tell pods apart,
+// so every layer-4 port is rejected for the pods instead of leaving them unreachable silently.
+func generatePodRoutes(serviceRoutes []ServiceRoute, hostnames []string) ([]ServiceRoute, []RouteRejection) {
+	if len(hostnames) == 0 {
+		return nil, nil
+	}
+	var serviceRoute *ServiceRoute
+	var rejections []RouteRejection
+	for i := range serviceRoutes {
+		route := &serviceRoutes[i]
+		if route.PortLabel == "" && route.Protocol == ProtocolHTTP && serviceRoute == nil {
+			serviceRoute = route
+		}
+		// Every port has a route labeled by its number, report each layer-4 port once
+		if route.Protocol == ProtocolHTTP || route.PortLabel != strconv.Itoa(int(route.Port)) {
+			continue
+		}
+		rejection := RouteRejection{
+			Namespace:   route.Namespace,
+			ServiceName: route.ServiceName,
+			PortName:    route.PortName,
+			Port:        route.Port,
+			Reason: fmt.Sprintf("%s port of a headless Service is not routed per pod, pods %s are only reachable through the Service listener",
+				strings.ToUpper(route.Protocol), strings.Join(hostnames, ", ")),
+		}
+		rejections = append(rejections, rejection)
+	}
+	if serviceRoute == nil {
+		return nil, rejections
+	}
+
+	upstreamHost := serviceRoute.Upstream
+	if host, _, err := net.SplitHostPort(upstreamHost); err == nil {
+		upstreamHost = host
+	}
+	routes := make([]ServiceRoute, 0, len(hostnames))
+	for _, hostname := range hostnames {
+		route := *serviceRoute
+		route.Pod = hostname
+		route.RemoteDomain = hostname + "." + serviceRoute.ServiceDomain
+		route.Upstream = hostname + "." + serviceRoute.Upstream
+		if route.HostHeader == upstreamHost {
+			route.HostHeader = hostname + "." + upstreamHost
+		}
+		routes = append(routes, route)
+	}
+	return routes, rejections
+}
+
+// defaultServicePort picks the port served on the service-level remote domain
+func defaultServicePort(ports []v1.ServicePort) v1.ServicePort {
+	for _, port := range ports {
+		if port.Name == "http" {
+			return port
+		}
+	}
+	for _, port := range ports {
+		if port.Port == 80 {
+			return port
+		}
+	}
+	return ports[0]
+}
@@ -0,0 +1,40 @@
+package generator
+
+import (
+	"context"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// ClusterNameConfigMapNamespace is the namespace of the ConfigMap holding the cluster name
+	ClusterNameConfigMapNamespace = "default"
+	// ClusterNameConfigMapName is the name of the ConfigMap holding the cluster name
+	ClusterNameConfigMapName = "tailscale-cluster-name"
+	// ClusterNameConfigMapKey is the key in the ConfigMap holding the cluster name
+	ClusterNameConfigMapKey = "CLUSTER_NAME"
+	// ClusterDomainConfigMapKey is the optional key in the same ConfigMap overriding the detected cluster DNS domain
+	ClusterDomainConfigMapKey = "CLUSTER_DOMAIN"
+	// DefaultClusterName is used when the cluster name cannot be read
+	DefaultClusterName = "default-cluster-name"
+)
+
+// GetClusterName reads the cluster name from the tailscale-cluster-name ConfigMap
+// Falls back to DefaultClusterName if the ConfigMap or the key is missing
+func GetClusterName(clientset kubernetes.Interface) string {
+	clusterName := DefaultClusterName
+	configMap, err := clientset.CoreV1().ConfigMaps(ClusterNameConfigMapNamespace).Get(context.TODO(), ClusterNameConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		klog.Warningf("Failed to get tailscale-cluster-name ConfigMap: %v, using default cluster name '%s'", err, clusterName)
+	} else {
+		if name, exists := configMap.Data[ClusterNameConfigMapKey]; exists && name != "" {
+			clusterName = name
+			klog.Infof("Using cluster name from tailscale-cluster-name ConfigMap: CLUSTER_NAME = %s", clusterName)
+		} else {
+			klog.Warningf("CLUSTER_NAME not found or empty in ConfigMap, using default '%s' to generate caddy's configuration", clusterName)
+		}
+	}
+	return clusterName
+}
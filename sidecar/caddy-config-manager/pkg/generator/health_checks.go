@@ -0,0 +1,366 @@
+package generator
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/klog/v2"
+)
+
+// DefaultFailDuration is how long a failed request is remembered when passive health checks are
+// enabled through AnnotationMaxFails or AnnotationUnhealthyStatus alone
+const DefaultFailDuration = 30 * time.Second
+
+// Defaults of the readinessProbe fields, see the Probe type of the Kubernetes API
+const (
+	probeDefaultPeriodSeconds    = 10
+	probeDefaultTimeoutSeconds   = 1
+	probeDefaultFailureThreshold = 3
+)
+
+// ActiveHealthCheck periodically requests a path on every upstream and takes the failing ones out of rotation
+type ActiveHealthCheck struct {
+	// Path is the requested URI, active health checks are disabled when empty
+	Path string
+	// Port is the port of the requests when it is not the upstream's, 0 for the upstream's
+	Port int32
+	// Interval and Timeout of the requests, Caddy's defaults when zero
+	Interval time.Duration
+	Timeout  time.Duration
+	// ExpectStatus is the expected status code ("200") or class ("2xx"), any 2xx when empty
+	ExpectStatus string
+	// Passes and Fails are the consecutive results marking an upstream healthy or unhealthy, Caddy's defaults when zero
+	Passes int32
+	Fails  int32
+}
+
+// PassiveHealthCheck takes an upstream out of rotation after too many failed proxied requests
+type PassiveHealthCheck struct {
+	// FailDuration is how long a failed request is counted, passive health checks are disabled when zero
+	FailDuration time.Duration
+	// MaxFails is the number of failed requests within FailDuration marking the upstream unhealthy, Caddy's default when zero
+	MaxFails int32
+	// UnhealthyStatus lists the status codes or classes counted as failed requests besides connection errors
+	UnhealthyStatus []string
+}
+
+// HealthCheck is the health checking of the upstreams of a site
+type HealthCheck struct {
+	Active  ActiveHealthCheck
+	Passive PassiveHealthCheck
+}
+
+// IsZero reports whether neither active nor passive health checks are enabled
+func (h HealthCheck) IsZero() bool {
+	return h.Active.Path == "" && h.Passive.FailDuration == 0
+}
+
+// PortHealthCheck is the health check of a Service port depending on the upstream the route proxies to
+type PortHealthCheck struct {
+	// Service is used when proxying to the Service, only the annotations set it for a ClusterIP
+	// Service as its single upstream marked unhealthy would take down every pod behind it
+	Service HealthCheck
+	// Pod is used when proxying to the pods directly, e.g. pod upstreams or headless Services
+	Pod HealthCheck
+}
+
+// HealthChecks maps <namespace>/<service>/<port> to the health check of a Service port, port 0 standing
+// for a Service without ports
+type HealthChecks map[string]PortHealthCheck
+
+// ServiceHealthChecks derives the health check of every Service port from the readinessProbe of the
+// pods selected by the Service, when it is an HTTP probe, then applies the health check annotations
+// of the Service on top. Kubernetes accepts any 2xx or 3xx status from a probe while Caddy only
+// accepts the expected status, so the derived active checks expect Caddy's default of any 2xx.
+// pods may be nil, only the annotations are used then.
+func ServiceHealthChecks(serviceList *v1.ServiceList, pods []*v1.Pod) HealthChecks {
+	checks := make(HealthChecks)
+	if serviceList == nil {
+		return checks
+	}
+	for i := range serviceList.Items {
+		service := &serviceList.Items[i]
+		if IsExternalNameService(service) || strings.EqualFold(strings.TrimSpace(service.Annotations[AnnotationHealthCheck]), "false") {
+			continue
+		}
+		pod := selectedPod(service, pods)
+		ports := service.Spec.Ports
+		if len(ports) == 0 {
+			ports = []v1.ServicePort{{}}
+		}
+		for _, port := range ports {
+			var check PortHealthCheck
+			if pod != nil && port.Port != 0 {
+				check = probeHealthCheck(service, port, pod)
+			}
+			check.Service = annotatedHealthCheck(service, check.Service)
+			check.Pod = annotatedHealthCheck(service, check.Pod)
+			if check.Service.IsZero() && check.Pod.IsZero() {
+				continue
+			}
+			checks[fmt.Sprintf("%s/%s/%d", service.Namespace, service.Name, port.Port)] = check
+		}
+	}
+	return checks
+}
+
+// ApplyHealthChecks sets the health check of the HTTP routes from the checks of their Service port,
+// after ApplyServiceEndpoints so routes proxied to pod upstreams get the check of the pods
+func ApplyHealthChecks(siteOptions map[string]SiteOptions, routes []ServiceRoute, checks HealthChecks) {
+	for _, route := range routes {
+		if route.Protocol != ProtocolHTTP {
+			continue
+		}
+		check, exists := checks[fmt.Sprintf("%s/%s/%d", route.Namespace, route.ServiceName, route.Port)]
+		if !exists {
+			continue
+		}
+		site := siteOptions[route.RemoteDomain]
+		site.HealthCheck = check.Service
+		if route.Pod != "" || len(site.Upstreams) > 0 {
+			site.HealthCheck = check.Pod
+		}
+		if !site.IsZero() {
+			siteOptions[route.RemoteDomain] = site
+		}
+	}
+}
+
+// selectedPod returns the first pod by name selected by the Service, pods of a Service share their
+// template so any of them describes the probes. Selector-less Services select none.
+func selectedPod(service *v1.Service, pods []*v1.Pod) *v1.Pod {
+	if len(service.Spec.Selector) == 0 {
+		return nil
+	}
+	selector := labels.SelectorFromSet(service.Spec.Selector)
+	var selected *v1.Pod
+	for _, pod := range pods {
+		if pod.Namespace != service.Namespace || pod.DeletionTimestamp != nil || !selector.Matches(labels.Set(pod.Labels)) {
+			continue
+		}
+		if selected == nil || pod.Name < selected.Name {
+			selected = pod
+		}
+	}
+	return selected
+}
+
+// probeHealthCheck derives the health check of a Service port from the HTTP readinessProbe of the
+// container serving its target port. The probe describes a single pod, so the checks are only derived
+// for upstreams that are pods, never for the address of a ClusterIP Service.
+func probeHealthCheck(service *v1.Service, port v1.ServicePort, pod *v1.Pod) PortHealthCheck {
+	targetPort := port.TargetPort
+	if targetPort.Type == intstr.Int && targetPort.IntVal == 0 {
+		targetPort = intstr.FromInt32(port.Port)
+	}
+	container, containerPort := targetContainer(pod, targetPort)
+	if container == nil || container.ReadinessProbe == nil || container.ReadinessProbe.HTTPGet == nil {
+		return PortHealthCheck{}
+	}
+	probe := container.ReadinessProbe
+	if probe.HTTPGet.Scheme == v1.URISchemeHTTPS {
+		klog.V(2).Infof("Service %s/%s port %d has an HTTPS readinessProbe, not deriving health checks from it", service.Namespace, service.Name, port.Port)
+		return PortHealthCheck{}
+	}
+	probePort := containerPortNumber(container, probe.HTTPGet.Port)
+	if probePort == 0 {
+		return PortHealthCheck{}
+	}
+
+	period := probe.PeriodSeconds
+	if period == 0 {
+		period = probeDefaultPeriodSeconds
+	}
+	timeout := probe.TimeoutSeconds
+	if timeout == 0 {
+		timeout = probeDefaultTimeoutSeconds
+	}
+	failureThreshold := probe.FailureThreshold
+	if failureThreshold == 0 {
+		failureThreshold = probeDefaultFailureThreshold
+	}
+	path := probe.HTTPGet.Path
+	if path == "" {
+		path = "/"
+	}
+	active := ActiveHealthCheck{
+		Path:     path,
+		Interval: time.Duration(period) * time.Second,
+		Timeout:  time.Duration(timeout) * time.Second,
+		Fails:    failureThreshold,
+	}
+	if probe.SuccessThreshold > 1 {
+		active.Passes = probe.SuccessThreshold
+	}
+	passive := PassiveHealthCheck{
+		FailDuration: time.Duration(period*failureThreshold) * time.Second,
+		MaxFails:     failureThreshold,
+	}
+
+	check := PortHealthCheck{Pod: HealthCheck{Active: active, Passive: passive}}
+	if probePort != containerPort {
+		check.Pod.Active.Port = probePort
+	}
+	if IsHeadlessService(service) {
+		// The domain of a headless Service resolves to the pods themselves
+		check.Service = check.Pod
+	}
+	return check
+}
+
+// targetContainer finds the container serving a target port and the port number, by port name or
+// number. A numbered port no container declares is served by the only container of a single-container pod.
+func targetContainer(pod *v1.Pod, targetPort intstr.IntOrString) (*v1.Container, int32) {
+	for i := range pod.Spec.Containers {
+		container := &pod.Spec.Containers[i]
+		for _, containerPort := range container.Ports {
+			if (targetPort.Type == intstr.String && containerPort.Name == targetPort.StrVal) ||
+				(targetPort.Type == intstr.Int && containerPort.ContainerPort == targetPort.IntVal) {
+				return container, containerPort.ContainerPort
+			}
+		}
+	}
+	if targetPort.Type == intstr.Int && len(pod.Spec.Containers) == 1 {
+		return &pod.Spec.Containers[0], targetPort.IntVal
+	}
+	return nil, 0
+}
+
+// containerPortNumber resolves a probe port of a container to its number, 0 when a named port is not declared
+func containerPortNumber(container *v1.Container, port intstr.IntOrString) int32 {
+	if port.Type == intstr.Int {
+		return port.IntVal
+	}
+	for _, containerPort := range container.Ports {
+		if containerPort.Name == port.StrVal {
+			return containerPort.ContainerPort
+		}
+	}
+	return 0
+}
+
+// annotatedHealthCheck overrides the fields of check set by the health check annotations of the Service,
+// invalid values are logged and ignored
+func annotatedHealthCheck(service *v1.Service, check HealthCheck) HealthCheck {
+	annotation := func(key string) string {
+		return strings.TrimSpace(service.Annotations[key])
+	}
+	warn := func(key string, err error) {
+		klog.Warningf("Service %s/%s has invalid %s value %q: %v, ignoring it", service.Namespace, service.Name, key, annotation(key), err)
+	}
+
+	if value := annotation(AnnotationHealthCheckPath); value != "" {
+		if strings.HasPrefix(value, "/") && !strings.ContainsAny(value, " \t\"{}") {
+			check.Active.Path = value
+		} else {
+			warn(AnnotationHealthCheckPath, fmt.Errorf("expected a path starting with / without spaces, quotes or braces"))
+		}
+	}
+	if value := annotation(AnnotationHealthCheckPort); value != "" {
+		if port, err := strconv.ParseInt(value, 10, 32); err != nil || port < 1 || port > 65535 {
+			warn(AnnotationHealthCheckPort, fmt.Errorf("expected a port number"))
+		} else {
+			check.Active.Port = int32(port)
+		}
+	}
+	if value := annotation(AnnotationHealthCheckInterval); value != "" {
+		if interval, err := parsePositiveDuration(value); err != nil {
+			warn(AnnotationHealthCheckInterval, err)
+		} else {
+			check.Active.Interval = interval
+		}
+	}
+	if value := annotation(AnnotationHealthCheckTimeout); value != "" {
+		if timeout, err := parsePositiveDuration(value); err != nil {
+			warn(AnnotationHealthCheckTimeout, err)
+		} else {
+			check.Active.Timeout = timeout
+		}
+	}
+	if value := annotation(AnnotationHealthCheckStatus); value != "" {
+		if err := ValidateHTTPStatus(value); err != nil {
+			warn(AnnotationHealthCheckStatus, err)
+		} else {
+			check.Active.ExpectStatus = strings.ToLower(value)
+		}
+	}
+
+	passiveSet := false
+	if value := annotation(AnnotationFailDuration); value != "" {
+		if duration, err := parsePositiveDuration(value); err != nil {
+			warn(AnnotationFailDuration, err)
+		} else {
+			check.Passive.FailDuration = duration
+		}
+	}
+	if value := annotation(AnnotationMaxFails); value != "" {
+		if maxFails, err := strconv.ParseInt(value, 10, 32); err != nil || maxFails < 1 {
+			warn(AnnotationMaxFails, fmt.Errorf("expected a positive number"))
+		} else {
+			check.Passive.MaxFails = int32(maxFails)
+			passiveSet = true
+		}
+	}
+	if value := annotation(AnnotationUnhealthyStatus); value != "" {
+		statuses := make([]string, 0)
+		var invalid error
+		for _, status := range strings.Split(value, ",") {
+			status = strings.ToLower(strings.TrimSpace(status))
+			if err := ValidateHTTPStatus(status); err != nil {
+				invalid = err
+				break
+			}
+			statuses = append(statuses, status)
+		}
+		if invalid != nil {
+			warn(AnnotationUnhealthyStatus, invalid)
+		} else {
+			check.Passive.UnhealthyStatus = statuses
+			passiveSet = true
+		}
+	}
+	if passiveSet && check.Passive.FailDuration == 0 {
+		check.Passive.FailDuration = DefaultFailDuration
+	}
+	return check
+}
+
+// parsePositiveDuration parses a Go duration greater than zero, e.g. "10s"
+func parsePositiveDuration(value string) (time.Duration, error) {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("duration must be positive")
+	}
+	return duration, nil
+}
+
+// ValidateHTTPStatus returns an error if status is neither a status code ("503") nor a status class ("5xx")
+func ValidateHTTPStatus(status string) error {
+	if len(status) == 3 && status[0] >= '1' && status[0] <= '5' {
+		if strings.ToLower(status[1:]) == "xx" {
+			return nil
+		}
+		if code, err := strconv.Atoi(status); err == nil && code >= 100 && code <= 599 {
+			return nil
+		}
+	}
+	return fmt.Errorf("expected a status code like 503 or a class like 5xx")
+}
+
+// statusCode converts a validated status code or class to the integer of Caddy's JSON configuration,
+// where a single digit stands for a class
+func statusCode(status string) int {
+	if strings.HasSuffix(strings.ToLower(status), "xx") {
+		return int(status[0] - '0')
+	}
+	code, _ := strconv.Atoi(status)
+	return code
+}
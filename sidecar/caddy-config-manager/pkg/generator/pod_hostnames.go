@@ -0,0 +1,59 @@
+package generator
+
+import (
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+)
+
+// PodHostnames maps <namespace>/<service> to the hostnames of the pods backing a headless Service
+type PodHostnames map[string][]string
+
+// Hostnames returns the pod hostnames of a Service
+func (h PodHostnames) Hostnames(service *v1.Service) []string {
+	if h == nil {
+		return nil
+	}
+	return h[service.Namespace+"/"+service.Name]
+}
+
+// IsHeadlessService reports whether the Service has no ClusterIP, each pod then has its own DNS name
+func IsHeadlessService(service *v1.Service) bool {
+	return service.Spec.ClusterIP == v1.ClusterIPNone
+}
+
+// PodHostnamesFromEndpointSlices collects the hostnames of ready endpoints, sorted and deduplicated.
+// Only endpoints with a hostname are kept, e.g. StatefulSet pods, as only they have a stable DNS name
+// <hostname>.<service>.<namespace>.svc.<cluster-domain>.
+func PodHostnamesFromEndpointSlices(slices []*discoveryv1.EndpointSlice) PodHostnames {
+	seen := make(map[string]map[string]bool)
+	for _, slice := range slices {
+		serviceName := slice.Labels[discoveryv1.LabelServiceName]
+		if serviceName == "" {
+			continue
+		}
+		key := slice.Namespace + "/" + serviceName
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.Hostname == nil || *endpoint.Hostname == "" {
+				continue
+			}
+			if !endpointReady(endpoint) {
+				continue
+			}
+			if seen[key] == nil {
+				seen[key] = make(map[string]bool)
+			}
+			seen[key][*endpoint.Hostname] = true
+		}
+	}
+
+	hostnames := make(PodHostnames, len(seen))
+	for key, names := range seen {
+		for name := range names {
+			hostnames[key] = append(hostnames[key], name)
+		}
+		sort.Strings(hostnames[key])
+	}
+	return hostnames
+}
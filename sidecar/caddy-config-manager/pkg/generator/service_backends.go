@@ -0,0 +1,169 @@
+package generator
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// BackendPolicyProxy publishes the Service like any other
+	BackendPolicyProxy = "proxy"
+	// BackendPolicySkip never publishes the Service
+	BackendPolicySkip = "skip"
+	// BackendPolicyEndpoints publishes a selector-less Service only while its manual EndpointSlices
+	// (or the slices mirrored from manual Endpoints) have a ready endpoint
+	BackendPolicyEndpoints = "endpoints"
+)
+
+const (
+	// HostHeaderPreserve passes the Host header of the remote request, the remote domain, to the upstream
+	HostHeaderPreserve = "preserve"
+	// HostHeaderUpstream sets the Host header to the upstream host, the default for ExternalName Services
+	// whose target usually only answers to its own name
+	HostHeaderUpstream = "upstream"
+)
+
+// BackendPolicy decides how Services that do not select their own pods are published
+type BackendPolicy struct {
+	// ExternalName is BackendPolicyProxy (default when empty), proxying to spec.externalName, or BackendPolicySkip
+	ExternalName string
+	// SelectorLess is BackendPolicyProxy (default when empty), BackendPolicyEndpoints or BackendPolicySkip
+	SelectorLess string
+}
+
+// ValidateBackendPolicy returns an error if a field of the policy is not supported
+func ValidateBackendPolicy(policy BackendPolicy) error {
+	switch policy.ExternalName {
+	case "", BackendPolicyProxy, BackendPolicySkip:
+	default:
+		return fmt.Errorf("unsupported ExternalName policy %q, expected %q or %q", policy.ExternalName, BackendPolicyProxy, BackendPolicySkip)
+	}
+	switch policy.SelectorLess {
+	case "", BackendPolicyProxy, BackendPolicyEndpoints, BackendPolicySkip:
+	default:
+		return fmt.Errorf("unsupported selector-less policy %q, expected %q, %q or %q", policy.SelectorLess, BackendPolicyProxy, BackendPolicyEndpoints, BackendPolicySkip)
+	}
+	return nil
+}
+
+// IsExternalNameService reports whether the Service is an alias of spec.externalName
+func IsExternalNameService(service *v1.Service) bool {
+	return service.Spec.Type == v1.ServiceTypeExternalName
+}
+
+// IsSelectorLessService reports whether the Service has no selector, its endpoints are then managed by hand
+func IsSelectorLessService(service *v1.Service) bool {
+	return !IsExternalNameService(service) && len(service.Spec.Selector) == 0
+}
+
+// ReadyServices is the set of <namespace>/<service> having at least one ready endpoint
+type ReadyServices map[string]bool
+
+// Has reports whether the Service has a ready endpoint
+func (r ReadyServices) Has(service *v1.Service) bool {
+	return r[service.Namespace+"/"+service.Name]
+}
+
+// ReadyServicesFromEndpointSlices collects the Services with a ready endpoint, EndpointSlices are
+// matched to their Service by the kubernetes.io/service-name label, which manual slices must carry too
+func ReadyServicesFromEndpointSlices(slices []*discoveryv1.EndpointSlice) ReadyServices {
+	ready := make(ReadyServices)
+	for _, slice := range slices {
+		serviceName := slice.Labels[discoveryv1.LabelServiceName]
+		if serviceName == "" {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			if len(endpoint.Addresses) > 0 && endpointReady(endpoint) {
+				ready[slice.Namespace+"/"+serviceName] = true
+				break
+			}
+		}
+	}
+	return ready
+}
+
+// endpointReady treats an unknown readiness as ready, as consumers of EndpointSlices should
+func endpointReady(endpoint discoveryv1.Endpoint) bool {
+	return endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready
+}
+
+// FilterServiceBackends applies the policy to ExternalName and selector-less Services and returns the
+// remaining Services with a rejection for each skipped one. ready is only consulted for selector-less
+// Services under BackendPolicyEndpoints. The input list is not modified.
+func FilterServiceBackends(serviceList *v1.ServiceList, policy BackendPolicy, ready ReadyServices) (*v1.ServiceList, []RouteRejection) {
+	kept := &v1.ServiceList{Items: make([]v1.Service, 0)}
+	rejections := make([]RouteRejection, 0)
+	if serviceList == nil {
+		return kept, rejections
+	}
+
+	for i := range serviceList.Items {
+		service := &serviceList.Items[i]
+		reason := ""
+		switch {
+		case IsExternalNameService(service) && policy.ExternalName == BackendPolicySkip:
+			reason = "ExternalName Service skipped by policy"
+		case IsSelectorLessService(service) && policy.SelectorLess == BackendPolicySkip:
+			reason = "selector-less Service skipped by policy"
+		case IsSelectorLessService(service) && policy.SelectorLess == BackendPolicyEndpoints && !ready.Has(service):
+			reason = "selector-less Service has no ready endpoint in its EndpointSlices"
+		}
+		if reason != "" {
+			klog.Infof("Skipping Service %s/%s: %s", service.Namespace, service.Name, reason)
+			rejections = append(rejections, RouteRejection{Namespace: service.Namespace, ServiceName: service.Name, Reason: reason})
+			continue
+		}
+		kept.Items = append(kept.Items, *service)
+	}
+	return kept, rejections
+}
+
+// serviceUpstreamHost returns the host a Service is proxied to: spec.externalName for ExternalName
+// Services, which would otherwise resolve to a CNAME through the cluster DNS, else the rendered upstream host
+func serviceUpstreamHost(templates *DomainTemplates, service *v1.Service, data DomainTemplateData) (string, error) {
+	if !IsExternalNameService(service) {
+		return templates.UpstreamHost(data)
+	}
+	host := strings.ToLower(strings.TrimSuffix(service.Spec.ExternalName, "."))
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+	if err := ValidateDomainName(host); err != nil {
+		return "", fmt.Errorf("invalid externalName %q: %w", service.Spec.ExternalName, err)
+	}
+	return host, nil
+}
+
+// serviceHostHeader returns the Host header sent to the upstream host of the Service, empty to preserve it.
+// The cross-cluster.io/upstream-host-header annotation takes "preserve", "upstream" or a literal host[:port].
+func serviceHostHeader(service *v1.Service, upstreamHost string) string {
+	defaultHeader := ""
+	if IsExternalNameService(service) {
+		defaultHeader = upstreamHost
+	}
+	value := strings.TrimSpace(service.Annotations[AnnotationUpstreamHostHeader])
+	switch value {
+	case "":
+		return defaultHeader
+	case HostHeaderPreserve:
+		return ""
+	case HostHeaderUpstream:
+		return upstreamHost
+	}
+
+	host := value
+	if h, _, err := net.SplitHostPort(value); err == nil {
+		host = h
+	}
+	if err := ValidateDomainName(host); err != nil && net.ParseIP(host) == nil {
+		klog.Warningf("Service %s/%s has invalid %s value %q: %v, ignoring it", service.Namespace, service.Name, AnnotationUpstreamHostHeader, value, err)
+		return defaultHeader
+	}
+	return value
+}
@@ -0,0 +1,142 @@
+package generator
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+)
+
+// Load-balancing policies of reverse_proxy across the pod upstreams of a route
+const (
+	LBPolicyRoundRobin   = "round_robin"
+	LBPolicyRandom       = "random"
+	LBPolicyLeastConn    = "least_conn"
+	LBPolicyFirst        = "first"
+	LBPolicyIPHash       = "ip_hash"
+	LBPolicyClientIPHash = "client_ip_hash"
+	LBPolicyURIHash      = "uri_hash"
+)
+
+// ValidateLBPolicy returns an error if policy is not a supported load-balancing policy, empty keeps Caddy's default
+func ValidateLBPolicy(policy string) error {
+	switch policy {
+	case "", LBPolicyRoundRobin, LBPolicyRandom, LBPolicyLeastConn, LBPolicyFirst, LBPolicyIPHash, LBPolicyClientIPHash, LBPolicyURIHash:
+		return nil
+	default:
+		return fmt.Errorf("unsupported load-balancing policy %q, expected one of %s, %s, %s, %s, %s, %s or %s", policy,
+			LBPolicyRoundRobin, LBPolicyRandom, LBPolicyLeastConn, LBPolicyFirst, LBPolicyIPHash, LBPolicyClientIPHash, LBPolicyURIHash)
+	}
+}
+
+// Endpoints are the ready endpoints of a Service found in its EndpointSlices
+type Endpoints struct {
+	// Ready reports whether at least one endpoint is ready
+	Ready bool
+	// Addresses lists the <ip>:<port> of the ready endpoints per Service port name, "" for an unnamed port, sorted
+	Addresses map[string][]string
+}
+
+// ServiceEndpoints maps <namespace>/<service> to the endpoints of every Service proxied through its
+// ClusterIP or pods, a Service without EndpointSlices has no ready endpoint. ExternalName Services are left out.
+type ServiceEndpoints map[string]Endpoints
+
+// ServiceEndpointsFromEndpointSlices collects the ready endpoints of the Services, EndpointSlices are
+// matched to their Service by the kubernetes.io/service-name label. FQDN endpoints only count for readiness.
+func ServiceEndpointsFromEndpointSlices(serviceList *v1.ServiceList, slices []*discoveryv1.EndpointSlice) ServiceEndpoints {
+	endpoints := make(ServiceEndpoints)
+	if serviceList == nil {
+		return endpoints
+	}
+	for i := range serviceList.Items {
+		service := &serviceList.Items[i]
+		if !IsExternalNameService(service) {
+			endpoints[service.Namespace+"/"+service.Name] = Endpoints{Addresses: make(map[string][]string)}
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, slice := range slices {
+		key := slice.Namespace + "/" + slice.Labels[discoveryv1.LabelServiceName]
+		entry, exists := endpoints[key]
+		if !exists {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			if len(endpoint.Addresses) == 0 || !endpointReady(endpoint) {
+				continue
+			}
+			entry.Ready = true
+			if slice.AddressType == discoveryv1.AddressTypeFQDN {
+				continue
+			}
+			for _, port := range slice.Ports {
+				if port.Port == nil || (port.Protocol != nil && *port.Protocol != v1.ProtocolTCP) {
+					continue
+				}
+				name := ""
+				if port.Name != nil {
+					name = *port.Name
+				}
+				// Every address of an endpoint is the same pod, the first one is enough
+				address := net.JoinHostPort(endpoint.Addresses[0], strconv.Itoa(int(*port.Port)))
+				if seen[key+"/"+name+"/"+address] {
+					continue
+				}
+				seen[key+"/"+name+"/"+address] = true
+				entry.Addresses[name] = append(entry.Addresses[name], address)
+			}
+		}
+		endpoints[key] = entry
+	}
+
+	for _, entry := range endpoints {
+		for _, addresses := range entry.Addresses {
+			sort.Strings(addresses)
+		}
+	}
+	return endpoints
+}
+
+// EndpointOptions decides how the HTTP routes use the ready endpoints of their Service
+type EndpointOptions struct {
+	// ClusterName identifies the cluster in the body of the 503 response
+	ClusterName string
+	// PodUpstreams proxies to the ready pod addresses instead of the Service
+	PodUpstreams bool
+	// LBPolicy is the load-balancing policy across the pod addresses, Caddy's default when empty
+	LBPolicy string
+}
+
+// ApplyServiceEndpoints sets the site options of the HTTP routes from the endpoints of their Service:
+// a route whose Service has no ready endpoint answers 503, else with PodUpstreams it is proxied to
+// the ready pod addresses of its port. Routes of Services missing from endpoints and per-pod routes,
+// which only exist for ready pods, are left as is.
+func ApplyServiceEndpoints(siteOptions map[string]SiteOptions, routes []ServiceRoute, endpoints ServiceEndpoints, opts EndpointOptions) {
+	for _, route := range routes {
+		if route.Protocol != ProtocolHTTP || route.Pod != "" {
+			continue
+		}
+		entry, exists := endpoints[route.Namespace+"/"+route.ServiceName]
+		if !exists {
+			continue
+		}
+		site := siteOptions[route.RemoteDomain]
+		switch {
+		case !entry.Ready:
+			site.Unavailable = fmt.Sprintf("no ready endpoints for Service %s/%s in cluster %s", route.Namespace, route.ServiceName, opts.ClusterName)
+		case opts.PodUpstreams && route.Port != 0:
+			// Without a ready address for the port, e.g. still being rolled out, the Service stays the upstream
+			if addresses := entry.Addresses[route.PortName]; len(addresses) > 0 {
+				site.Upstreams = addresses
+				site.LBPolicy = opts.LBPolicy
+			}
+		}
+		if !site.IsZero() {
+			siteOptions[route.RemoteDomain] = site
+		}
+	}
+}
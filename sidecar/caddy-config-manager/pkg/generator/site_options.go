@@ -0,0 +1,41 @@
+package generator
+
+// SiteOptions are the settings of a generated Caddy site besides its upstream
+type SiteOptions struct {
+	// HostHeader is the Host header sent to the upstream, empty to pass the remote domain through
+	HostHeader string
+	// Aliases are extra hostnames added to the site's addresses
+	Aliases []string
+	// ForwardProxyURL is the proxy the upstream is dialed through, e.g. the tailscale HTTP proxy for peer gateways
+	ForwardProxyURL string
+	// Upstreams replace the local domain of the site, e.g. the ready pod addresses of the Service
+	Upstreams []string
+	// LBPolicy is the load-balancing policy across Upstreams, Caddy's default when empty
+	LBPolicy string
+	// Unavailable is the body of the 503 response answered instead of proxying, empty when the site is proxied
+	Unavailable string
+	// HealthCheck takes the unhealthy upstreams out of rotation, disabled when zero
+	HealthCheck HealthCheck
+}
+
+// IsZero reports whether the site uses the defaults only
+func (o SiteOptions) IsZero() bool {
+	return o.HostHeader == "" && len(o.Aliases) == 0 && o.ForwardProxyURL == "" &&
+		len(o.Upstreams) == 0 && o.LBPolicy == "" && o.Unavailable == "" && o.HealthCheck.IsZero()
+}
+
+// SiteOptionsFromRoutes collects the options of the HTTP routes keyed by remote domain,
+// routes using the defaults only are left out
+func SiteOptionsFromRoutes(routes []ServiceRoute) map[string]SiteOptions {
+	options := make(map[string]SiteOptions)
+	for _, route := range routes {
+		if route.Protocol != ProtocolHTTP {
+			continue
+		}
+		site := SiteOptions{HostHeader: route.HostHeader, Aliases: route.Aliases}
+		if !site.IsZero() {
+			options[route.RemoteDomain] = site
+		}
+	}
+	return options
+}
@@ -0,0 +1,202 @@
+package generator
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// RouteRejection is a route, or a whole Service, left out of the configuration and why
+type RouteRejection struct {
+	Namespace   string
+	ServiceName string
+	// PortName and Port identify the rejected port, both empty when the whole Service is rejected
+	PortName string
+	Port     int32
+	// RemoteDomain is empty when no domain could be rendered
+	RemoteDomain string
+	Reason       string
+}
+
+// String formats the rejection as <namespace>/<service>[:<port>] [<remote-domain>]: <reason>
+func (r RouteRejection) String() string {
+	target := r.Namespace + "/" + r.ServiceName
+	if r.PortName != "" {
+		target += ":" + r.PortName
+	} else if r.Port != 0 {
+		target += ":" + strconv.Itoa(int(r.Port))
+	}
+	if r.RemoteDomain == "" {
+		return target + ": " + r.Reason
+	}
+	return fmt.Sprintf("%s %s: %s", target, r.RemoteDomain, r.Reason)
+}
+
+// ValidateDomainName checks that domain is a valid DNS name: at most 253 characters
+// made of lowercase RFC 1123 labels of at most 63 characters each
+func ValidateDomainName(domain string) error {
+	if len(domain) > validation.DNS1123SubdomainMaxLength {
+		return fmt.Errorf("%q is longer than %d characters", domain, validation.DNS1123SubdomainMaxLength)
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if errs := validation.IsDNS1123Label(label); len(errs) > 0 {
+			return fmt.Errorf("label %q of %q is invalid: %s", label, domain, strings.Join(errs, "; "))
+		}
+	}
+	return nil
+}
+
+// NormalizeClusterName lowercases the cluster name and checks it is a single DNS label.
+// A dotted name is refused rather than rewritten, it would make remote domains ambiguous.
+func NormalizeClusterName(clusterName string) (string, error) {
+	normalized := strings.ToLower(strings.TrimSpace(clusterName))
+	if errs := validation.IsDNS1123Label(normalized); len(errs) > 0 {
+		return "", fmt.Errorf("cluster name %q is not a valid DNS label: %s", clusterName, strings.Join(errs, "; "))
+	}
+	return normalized, nil
+}
+
+// inServiceSpace reports whether name is a .svc.<cluster>.<zone> name, or that parent itself, of any cluster.
+// These names are generated for the Services of the local cluster and routed to the peers.
+func inServiceSpace(name, zone string) bool {
+	if zone == "" {
+		return false
+	}
+	rest, found := strings.CutSuffix(name, "."+zone)
+	if !found {
+		return false
+	}
+	labels := strings.Split(rest, ".")
+	return len(labels) >= 2 && labels[len(labels)-2] == "svc"
+}
+
+// servicePrecedes orders Services for conflict resolution: the oldest Service wins,
+// ties are broken by namespace and name so the result does not depend on list order
+func servicePrecedes(a, b *v1.Service) bool {
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(&b.CreationTimestamp)
+	}
+	if a.Namespace != b.Namespace {
+		return a.Namespace < b.Namespace
+	}
+	return a.Name < b.Name
+}
+
+// resolveRouteConflicts keeps one route per remote domain. perService holds the routes of each Service
+// of services, a domain claimed by several Services goes to the one ordered first by servicePrecedes.
+// Aliases are claimed the same way once every remote domain is, a conflicting alias is dropped from its route.
+// Wildcard aliases are claimed last and dropped whenever they cover a remote domain, another alias or the
+// .svc.<cluster>.<zone> names of any cluster, whatever the Service order, so no Service can take the
+// hostnames of another. The kept routes are returned in the original order, followed by the rejections.
+func resolveRouteConflicts(services []v1.Service, perService [][]ServiceRoute, zone string) ([]ServiceRoute, []RouteRejection) {
+	order := make([]int, len(services))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return servicePrecedes(&services[order[i]], &services[order[j]])
+	})
+
+	owners := make(map[string]int)
+	// firsts holds the route that claimed each remote domain, to name it when the same Service renders the domain twice
+	firsts := make(map[string]ServiceRoute)
+	kept := make([][]ServiceRoute, len(services))
+	rejections := make([]RouteRejection, 0)
+	for _, i := range order {
+		for _, route := range perService[i] {
+			owner, claimed := owners[route.RemoteDomain]
+			if !claimed {
+				owners[route.RemoteDomain] = i
+				firsts[route.RemoteDomain] = route
+				kept[i] = append(kept[i], route)
+				continue
+			}
+			reason := fmt.Sprintf("remote domain already used by Service %s/%s", services[owner].Namespace, services[owner].Name)
+			if owner == i {
+				// The same Service rendered the domain twice, the first port keeps it
+				reason = "remote domain already used by " + describeRoute(firsts[route.RemoteDomain]) + " of the same Service"
+			}
+			rejections = append(rejections, RouteRejection{
+				Namespace:    route.Namespace,
+				ServiceName:  route.ServiceName,
+				PortName:     route.PortName,
+				Port:         route.Port,
+				RemoteDomain: route.RemoteDomain,
+				Reason:       reason,
+			})
+		}
+	}
+
+	for _, wildcards := range []bool{false, true} {
+		// Exact hosts by parent domain, the hosts a wildcard alias over that parent would match
+		children := make(map[string][]string)
+		if wildcards {
+			for host := range owners {
+				if _, parent, found := strings.Cut(host, "."); found && !strings.HasPrefix(host, WildcardPrefix) {
+					children[parent] = append(children[parent], host)
+				}
+			}
+		}
+		for _, i := range order {
+			for j := range kept[i] {
+				route := &kept[i][j]
+				if len(route.Aliases) == 0 {
+					continue
+				}
+				aliases := make([]string, 0, len(route.Aliases))
+				for _, alias := range route.Aliases {
+					if strings.HasPrefix(alias, WildcardPrefix) != wildcards {
+						aliases = append(aliases, alias)
+						continue
+					}
+					reason := ""
+					if owner, claimed := owners[alias]; claimed {
+						reason = fmt.Sprintf("alias already used by Service %s/%s", services[owner].Namespace, services[owner].Name)
+						if owner == i {
+							reason = "alias already used by " + describeRoute(firsts[alias]) + " of the same Service"
+						}
+					} else if inServiceSpace(strings.TrimPrefix(alias, WildcardPrefix), zone) {
+						reason = "alias within the .svc.<cluster>." + zone + " names generated for the Services of the clusters"
+					} else if covered := children[strings.TrimPrefix(alias, WildcardPrefix)]; wildcards && len(covered) > 0 {
+						sort.Strings(covered)
+						owner := services[owners[covered[0]]]
+						reason = fmt.Sprintf("wildcard alias covers %s of Service %s/%s", covered[0], owner.Namespace, owner.Name)
+					}
+					if reason != "" {
+						rejections = append(rejections, RouteRejection{
+							Namespace:    route.Namespace,
+							ServiceName:  route.ServiceName,
+							RemoteDomain: alias,
+							Reason:       reason,
+						})
+						continue
+					}
+					owners[alias] = i
+					aliases = append(aliases, alias)
+				}
+				route.Aliases = aliases
+			}
+		}
+	}
+
+	routes := make([]ServiceRoute, 0)
+	for i := range kept {
+		routes = append(routes, kept[i]...)
+	}
+	return routes, rejections
+}
+
+// describeRoute names a route of a Service in rejection reasons
+func describeRoute(route ServiceRoute) string {
+	switch {
+	case route.Pod != "":
+		return "the route of pod " + route.Pod
+	case route.PortLabel != "":
+		return "the route of port " + route.PortLabel
+	}
+	return "the service-level route"
+}
@@ -0,0 +1,162 @@
+package mcs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/klog/v2"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+)
+
+// ExportResult is what became of the Services listed by ServiceExports in a reconcile
+type ExportResult struct {
+	// Services are the discovered Services, before the export filter
+	Services *v1.ServiceList
+	// Routes and Rejections are the published routes and the routes left out
+	Routes     []generator.ServiceRoute
+	Rejections []generator.RouteRejection
+	// Policy is the export policy in use, whose proxy Service is never exported
+	Policy generator.ExportPolicy
+	// Published reports whether the configuration holding Routes has been written
+	Published bool
+}
+
+// ExportedServices returns the <namespace>/<name> keys of the ServiceExports, for generator.ExportPolicy.Exports
+func ExportedServices(exports []*unstructured.Unstructured) map[string]bool {
+	keys := make(map[string]bool, len(exports))
+	for _, export := range exports {
+		keys[export.GetNamespace()+"/"+export.GetName()] = true
+	}
+	return keys
+}
+
+// ExportConditions computes the Valid and Ready conditions of a ServiceExport
+func ExportConditions(export *unstructured.Unstructured, result ExportResult) []metav1.Condition {
+	namespace, name := export.GetNamespace(), export.GetName()
+	valid := metav1.Condition{Type: ConditionValid, Status: metav1.ConditionTrue, Reason: ReasonExported}
+	ready := metav1.Condition{Type: ConditionReady, Status: metav1.ConditionFalse, Reason: ReasonRejected}
+
+	var service *v1.Service
+	if result.Services != nil {
+		for i := range result.Services.Items {
+			if result.Services.Items[i].Namespace == namespace && result.Services.Items[i].Name == name {
+				service = &result.Services.Items[i]
+				break
+			}
+		}
+	}
+
+	var domains, reasons []string
+	for _, route := range result.Routes {
+		if route.Namespace == namespace && route.ServiceName == name && route.PortLabel == "" && route.Pod == "" {
+			domains = append(domains, route.RemoteDomain)
+		}
+	}
+	for _, rejection := range result.Rejections {
+		if rejection.Namespace == namespace && rejection.ServiceName == name {
+			reasons = append(reasons, rejection.String())
+		}
+	}
+
+	switch {
+	case service == nil:
+		valid.Status, valid.Reason = metav1.ConditionFalse, ReasonNoService
+		valid.Message = fmt.Sprintf("Service %s/%s not found", namespace, name)
+		ready.Reason, ready.Message = ReasonNoService, valid.Message
+		return []metav1.Condition{valid, ready}
+	case !generator.IsServiceExported(service, result.Policy):
+		valid.Status, valid.Reason = metav1.ConditionFalse, ReasonNotExportable
+		valid.Message = fmt.Sprintf("Service %s/%s is the proxy's own Service", namespace, name)
+		ready.Reason, ready.Message = ReasonNotExportable, valid.Message
+		return []metav1.Condition{valid, ready}
+	case len(domains) == 0:
+		valid.Status, valid.Reason = metav1.ConditionFalse, ReasonRejected
+		valid.Message = strings.Join(reasons, "; ")
+		if valid.Message == "" {
+			valid.Message = "no route generated"
+		}
+		ready.Message = valid.Message
+		return []metav1.Condition{valid, ready}
+	case len(reasons) > 0:
+		valid.Reason = ReasonPartiallyExported
+		valid.Message = "published as " + strings.Join(domains, ", ") + ", some routes were left out: " + strings.Join(reasons, "; ")
+	default:
+		valid.Message = "published as " + strings.Join(domains, ", ")
+	}
+
+	if result.Published {
+		ready.Status, ready.Reason, ready.Message = metav1.ConditionTrue, ReasonPublished, "Caddy configuration written"
+	} else {
+		ready.Reason, ready.Message = ReasonPending, "Caddy configuration not written yet"
+	}
+	return []metav1.Condition{valid, ready}
+}
+
+// UpdateExportStatus writes the conditions of every ServiceExport that changed, keeping the transition
+// times of the unchanged ones. A failure is logged and retried on the next reconcile.
+func (m *Manager) UpdateExportStatus(ctx context.Context, exports []*unstructured.Unstructured, result ExportResult) {
+	for _, export := range exports {
+		conditions, err := exportConditions(export)
+		if err != nil {
+			klog.Warningf("ServiceExport %s/%s has invalid conditions, replacing them: %v", export.GetNamespace(), export.GetName(), err)
+		}
+		changed := false
+		for _, condition := range ExportConditions(export, result) {
+			condition.ObservedGeneration = export.GetGeneration()
+			if meta.SetStatusCondition(&conditions, condition) {
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		values := make([]interface{}, 0, len(conditions))
+		for i := range conditions {
+			value, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&conditions[i])
+			if err != nil {
+				klog.Warningf("Failed to convert condition %s: %v", conditions[i].Type, err)
+				continue
+			}
+			values = append(values, value)
+		}
+		updated := export.DeepCopy()
+		if err := unstructured.SetNestedSlice(updated.Object, values, "status", "conditions"); err != nil {
+			klog.Warningf("Failed to set the conditions of ServiceExport %s/%s: %v", export.GetNamespace(), export.GetName(), err)
+			continue
+		}
+		_, err = m.client.Resource(ServiceExportGVR).Namespace(export.GetNamespace()).UpdateStatus(ctx, updated, metav1.UpdateOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			klog.Warningf("Failed to update the status of ServiceExport %s/%s: %v", export.GetNamespace(), export.GetName(), err)
+		}
+	}
+}
+
+// exportConditions reads the conditions of a ServiceExport
+func exportConditions(export *unstructured.Unstructured) ([]metav1.Condition, error) {
+	values, found, err := unstructured.NestedSlice(export.Object, "status", "conditions")
+	if err != nil || !found {
+		return nil, err
+	}
+	conditions := make([]metav1.Condition, 0, len(values))
+	for _, value := range values {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("condition is %T, not an object", value)
+		}
+		var condition metav1.Condition
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(object, &condition); err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, condition)
+	}
+	return conditions, nil
+}
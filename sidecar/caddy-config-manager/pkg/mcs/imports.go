@@ -0,0 +1,241 @@
+package mcs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/klog/v2"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/catalog"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+)
+
+// Import is a Service exported by one or more clusters, imported under its clusterset.local name
+type Import struct {
+	Namespace string
+	Name      string
+	// Clusters export the Service, the local cluster first when it is one of them, then the peers sorted
+	Clusters []string
+	// RemoteDomains are the service-level remote domains of the Service, keyed by cluster
+	RemoteDomains map[string]string
+}
+
+// DesiredImports lists the HTTP Services exported by the local cluster and by the peers, sorted by
+// namespace and name. Only Services in namespace are listed unless namespace is empty, the manager
+// can only write ServiceImports where it discovers Services.
+func DesiredImports(local *catalog.Catalog, peers map[string]*catalog.Catalog, namespace string) []Import {
+	index := make(map[string]int)
+	imports := make([]Import, 0)
+	add := func(cluster string, c *catalog.Catalog) {
+		for _, service := range c.Services {
+			if service.Protocol != generator.ProtocolHTTP || service.RemoteDomain == "" {
+				continue
+			}
+			if namespace != "" && service.Namespace != namespace {
+				continue
+			}
+			key := service.Namespace + "/" + service.Name
+			i, exists := index[key]
+			if !exists {
+				i = len(imports)
+				index[key] = i
+				imports = append(imports, Import{Namespace: service.Namespace, Name: service.Name, RemoteDomains: make(map[string]string)})
+			}
+			imports[i].Clusters = append(imports[i].Clusters, cluster)
+			imports[i].RemoteDomains[cluster] = service.RemoteDomain
+		}
+	}
+
+	if local != nil {
+		add(local.Cluster, local)
+	}
+	clusters := make([]string, 0, len(peers))
+	for cluster := range peers {
+		if local == nil || cluster != local.Cluster {
+			clusters = append(clusters, cluster)
+		}
+	}
+	sort.Strings(clusters)
+	for _, cluster := range clusters {
+		add(cluster, peers[cluster])
+	}
+
+	sort.Slice(imports, func(i, j int) bool {
+		if imports[i].Namespace != imports[j].Namespace {
+			return imports[i].Namespace < imports[j].Namespace
+		}
+		return imports[i].Name < imports[j].Name
+	})
+	return imports
+}
+
+// AppendImportSites routes the clusterset.local name of every import. A Service the local cluster
+// exports is served locally, the name becoming an alias of its remote domain. Otherwise the name is
+// forwarded to the gateway of the first peer exporting it, with the Host header set to the peer's
+// remote domain so the peer's Caddy serves it like any remote request.
+func AppendImportSites(remoteDomains []string, domainMapping map[string]string, siteOptions map[string]generator.SiteOptions, imports []Import, localCluster string, outbound generator.OutboundOptions) []string {
+	peers := make([]string, 0)
+	for _, imported := range imports {
+		if imported.Clusters[0] != localCluster {
+			peers = append(peers, imported.Clusters[0])
+		}
+	}
+	outbound.Peers = peers
+	outbound.PeerHosts = nil
+	gateways := make(map[string]generator.OutboundRoute)
+	for _, route := range generator.GenerateOutboundRoutes(outbound) {
+		gateways[route.Peer] = route
+	}
+
+	routes := make([]generator.OutboundRoute, 0, len(imports))
+	for _, imported := range imports {
+		host := ClusterSetHost(imported.Namespace, imported.Name)
+		cluster := imported.Clusters[0]
+		if cluster == localCluster {
+			site := imported.RemoteDomains[cluster]
+			if _, exists := domainMapping[site]; !exists {
+				continue
+			}
+			options := siteOptions[site]
+			options.Aliases = append(append([]string(nil), options.Aliases...), host)
+			siteOptions[site] = options
+			continue
+		}
+		gateway, exists := gateways[cluster]
+		if !exists {
+			continue
+		}
+		routes = append(routes, generator.OutboundRoute{
+			Peer:            cluster,
+			Hosts:           []string{host},
+			Upstream:        gateway.Upstream,
+			ForwardProxyURL: gateway.ForwardProxyURL,
+			HostHeader:      imported.RemoteDomains[cluster],
+		})
+	}
+	return generator.AppendOutboundSites(remoteDomains, domainMapping, siteOptions, routes)
+}
+
+// SyncImports makes the managed ServiceImports in namespace (every namespace when empty) match imports.
+// They are of type ClusterSetIP with the proxy Service's addresses, so the clusterset.local names resolved
+// by the CoreDNS multicluster plugin reach the proxy. ServiceImports not created by the manager are left alone.
+func (m *Manager) SyncImports(ctx context.Context, imports []Import, namespace string, ips []string) error {
+	desired := make(map[string]*unstructured.Unstructured, len(imports))
+	for _, imported := range imports {
+		desired[imported.Namespace+"/"+imported.Name] = m.serviceImport(imported, ips)
+	}
+	key, err := json.Marshal(desired)
+	if err != nil {
+		return err
+	}
+	if string(key) == m.lastImports {
+		return nil
+	}
+
+	client := m.client.Resource(ServiceImportGVR)
+	existing, err := client.Namespace(namespace).List(ctx, metav1.ListOptions{LabelSelector: LabelManagedBy + "=" + ManagerName})
+	if err != nil {
+		return fmt.Errorf("failed to list ServiceImports: %w", err)
+	}
+
+	var errs []error
+	missingNamespace := false
+	for i := range existing.Items {
+		current := &existing.Items[i]
+		wanted, exists := desired[current.GetNamespace()+"/"+current.GetName()]
+		if !exists {
+			klog.Infof("Deleting ServiceImport %s/%s, no cluster exports it anymore", current.GetNamespace(), current.GetName())
+			if err := client.Namespace(current.GetNamespace()).Delete(ctx, current.GetName(), metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		delete(desired, current.GetNamespace()+"/"+current.GetName())
+
+		if !equality.Semantic.DeepEqual(current.Object["spec"], wanted.Object["spec"]) ||
+			!equality.Semantic.DeepEqual(current.GetAnnotations(), wanted.GetAnnotations()) {
+			updated := current.DeepCopy()
+			updated.Object["spec"] = wanted.Object["spec"]
+			updated.SetAnnotations(wanted.GetAnnotations())
+			if current, err = client.Namespace(current.GetNamespace()).Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		if !equality.Semantic.DeepEqual(current.Object["status"], wanted.Object["status"]) {
+			errs = append(errs, m.updateImportStatus(ctx, current, wanted))
+		}
+	}
+
+	for _, wanted := range desired {
+		klog.Infof("Creating ServiceImport %s/%s", wanted.GetNamespace(), wanted.GetName())
+		created, err := client.Namespace(wanted.GetNamespace()).Create(ctx, wanted, metav1.CreateOptions{})
+		if apierrors.IsNotFound(err) {
+			// The namespace only exists in the exporting clusters
+			klog.V(2).Infof("Namespace %s does not exist, not importing %s", wanted.GetNamespace(), wanted.GetName())
+			missingNamespace = true
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		errs = append(errs, m.updateImportStatus(ctx, created, wanted))
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("failed to sync ServiceImports: %w", err)
+	}
+	// Retried by the next reconcile in case the namespace gets created
+	if !missingNamespace {
+		m.lastImports = string(key)
+	}
+	return nil
+}
+
+// updateImportStatus writes the status of wanted to current, the status subresource ignores it on create and update
+func (m *Manager) updateImportStatus(ctx context.Context, current, wanted *unstructured.Unstructured) error {
+	updated := current.DeepCopy()
+	updated.Object["status"] = wanted.Object["status"]
+	_, err := m.client.Resource(ServiceImportGVR).Namespace(current.GetNamespace()).UpdateStatus(ctx, updated, metav1.UpdateOptions{})
+	return err
+}
+
+// serviceImport builds the managed ServiceImport of an import
+func (m *Manager) serviceImport(imported Import, ips []string) *unstructured.Unstructured {
+	addresses := make([]interface{}, 0, len(ips))
+	for _, ip := range ips {
+		addresses = append(addresses, ip)
+	}
+	clusters := make([]interface{}, 0, len(imported.Clusters))
+	for _, cluster := range imported.Clusters {
+		clusters = append(clusters, map[string]interface{}{"cluster": cluster})
+	}
+
+	serviceImport := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": ServiceImportGVR.GroupVersion().String(),
+		"kind":       "ServiceImport",
+		"spec": map[string]interface{}{
+			"type": "ClusterSetIP",
+			"ips":  addresses,
+			"ports": []interface{}{map[string]interface{}{
+				"name":     "http",
+				"protocol": "TCP",
+				"port":     int64(m.importPort),
+			}},
+		},
+		"status": map[string]interface{}{"clusters": clusters},
+	}}
+	serviceImport.SetNamespace(imported.Namespace)
+	serviceImport.SetName(imported.Name)
+	serviceImport.SetLabels(map[string]string{LabelManagedBy: ManagerName})
+	serviceImport.SetAnnotations(map[string]string{AnnotationRemoteDomain: imported.RemoteDomains[imported.Clusters[0]]})
+	return serviceImport
+}
@@ -0,0 +1,99 @@
+package mcs
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	// Group is the API group of the Multi-Cluster Services API (KEP-1645)
+	Group = "multicluster.x-k8s.io"
+	// ClusterSetDomain is the DNS domain of ServiceImports, <service>.<namespace>.svc.clusterset.local
+	ClusterSetDomain = "clusterset.local"
+
+	// ConditionValid reports whether the exported Service is published
+	ConditionValid = "Valid"
+	// ConditionReady reports whether the published configuration has been delivered to Caddy
+	ConditionReady = "Ready"
+
+	// ReasonExported means every route of the Service is published
+	ReasonExported = "Exported"
+	// ReasonNoService means the ServiceExport has no Service of the same name
+	ReasonNoService = "NoService"
+	// ReasonNotExportable means the Service cannot be exported, e.g. the proxy's own Service
+	ReasonNotExportable = "NotExportable"
+	// ReasonRejected means the Service was left out, the message says why
+	ReasonRejected = "Rejected"
+	// ReasonPartiallyExported means some routes of the Service were left out, the message says why
+	ReasonPartiallyExported = "PartiallyExported"
+	// ReasonPending means the configuration serving the Service has not been written yet
+	ReasonPending = "Pending"
+	// ReasonPublished means the configuration serving the Service has been written
+	ReasonPublished = "Published"
+
+	// LabelManagedBy marks the ServiceImports created by the manager, others are never touched
+	LabelManagedBy = "app.kubernetes.io/managed-by"
+	// ManagerName is the LabelManagedBy value of the managed ServiceImports
+	ManagerName = "caddy-config-manager"
+	// AnnotationRemoteDomain is set on managed ServiceImports to the remote domain they are routed to
+	AnnotationRemoteDomain = "cross-cluster.io/remote-domain"
+
+	// DefaultImportPort is the port of the proxy Service serving Caddy's HTTP sites, the port of the ServiceImports
+	DefaultImportPort = 80
+)
+
+// ServiceExportGVR is the resource of MCS ServiceExports
+var ServiceExportGVR = schema.GroupVersionResource{Group: Group, Version: "v1alpha1", Resource: "serviceexports"}
+
+// ServiceImportGVR is the resource of MCS ServiceImports
+var ServiceImportGVR = schema.GroupVersionResource{Group: Group, Version: "v1alpha1", Resource: "serviceimports"}
+
+// Options selects the parts of the MCS API the manager implements
+type Options struct {
+	// Exports makes ServiceExports the export signal and reports their conditions
+	Exports bool
+	// Imports creates a ServiceImport backed by the proxy for every Service the peers export
+	Imports bool
+	// ImportPort is the port of the ServiceImports, DefaultImportPort when 0
+	ImportPort int32
+}
+
+// Manager reads ServiceExports and manages ServiceImports through the dynamic client, the MCS CRDs
+// are not part of client-go
+type Manager struct {
+	client     dynamic.Interface
+	exports    bool
+	imports    bool
+	importPort int32
+	// lastImports is the set of ServiceImports last applied, compared to skip unchanged syncs
+	lastImports string
+}
+
+// NewManager creates a manager using client for the MCS resources
+func NewManager(client dynamic.Interface, opts Options) *Manager {
+	importPort := opts.ImportPort
+	if importPort == 0 {
+		importPort = DefaultImportPort
+	}
+	return &Manager{client: client, exports: opts.Exports, imports: opts.Imports, importPort: importPort}
+}
+
+// Client returns the dynamic client, used to watch ServiceExports
+func (m *Manager) Client() dynamic.Interface {
+	return m.client
+}
+
+// Exports reports whether ServiceExports are the export signal
+func (m *Manager) Exports() bool {
+	return m.exports
+}
+
+// Imports reports whether ServiceImports are managed
+func (m *Manager) Imports() bool {
+	return m.imports
+}
+
+// ClusterSetHost returns the clusterset.local name of a Service
+func ClusterSetHost(namespace, name string) string {
+	return name + "." + namespace + ".svc." + ClusterSetDomain
+}
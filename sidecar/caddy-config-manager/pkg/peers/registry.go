@@ -0,0 +1,167 @@
+package peers
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+)
+
+// DefaultInterval is how often the registry polls its source
+const DefaultInterval = 30 * time.Second
+
+// Peer is a peer cluster discovered through its tailnet gateway
+type Peer struct {
+	// Cluster is the gateway hostname without the gateway suffix
+	Cluster   string
+	Hostname  string
+	Addresses []net.IP
+	LastSeen  time.Time
+	Online    bool
+}
+
+// Registry keeps the peer clusters discovered from a Source, the nodes named <cluster><suffix>
+type Registry struct {
+	source   Source
+	suffix   string
+	interval time.Duration
+
+	mu       sync.RWMutex
+	peers    map[string]Peer
+	onChange func()
+}
+
+// NewRegistry creates a registry polling source every interval (DefaultInterval when 0) for the gateways
+// named <cluster><suffix>, generator.DefaultGatewaySuffix when empty
+func NewRegistry(source Source, suffix string, interval time.Duration) *Registry {
+	if suffix == "" {
+		suffix = generator.DefaultGatewaySuffix
+	}
+	if interval == 0 {
+		interval = DefaultInterval
+	}
+	return &Registry{
+		source:   source,
+		suffix:   suffix,
+		interval: interval,
+		peers:    make(map[string]Peer),
+	}
+}
+
+// SetOnChange registers a function called after a refresh changed the set of peers or their addresses
+func (r *Registry) SetOnChange(onChange func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onChange = onChange
+}
+
+// Run refreshes the registry until ctx is done, failures are logged and keep the last known peers
+func (r *Registry) Run(ctx context.Context) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := r.Refresh(ctx); err != nil {
+			klog.Warningf("Failed to discover peers from %s: %v, retrying in %s", r.source.Name(), err, r.interval)
+		}
+	}, r.interval)
+}
+
+// Refresh lists the nodes of the source once and replaces the known peers.
+// When several nodes map to the same cluster the one seen last wins, a stale node left behind
+// by a reinstalled gateway must not shadow the new one.
+func (r *Registry) Refresh(ctx context.Context) error {
+	nodes, err := r.source.ListNodes(ctx)
+	if err != nil {
+		return err
+	}
+
+	peers := make(map[string]Peer)
+	for _, node := range nodes {
+		hostname := strings.ToLower(node.Hostname)
+		name, found := strings.CutSuffix(hostname, r.suffix)
+		if !found || name == "" {
+			continue
+		}
+		cluster, err := generator.NormalizeClusterName(name)
+		if err != nil {
+			klog.V(4).Infof("Ignoring gateway %s: %v", node.Hostname, err)
+			continue
+		}
+		peer := Peer{Cluster: cluster, Hostname: hostname, Addresses: node.Addresses, LastSeen: node.LastSeen, Online: node.Online}
+		if existing, exists := peers[cluster]; exists && !peerPrecedes(peer, existing) {
+			continue
+		}
+		peers[cluster] = peer
+	}
+
+	r.mu.Lock()
+	changed := !samePeers(r.peers, peers)
+	r.peers = peers
+	onChange := r.onChange
+	r.mu.Unlock()
+
+	if changed {
+		klog.Infof("Discovered %d peer cluster(s) from %s", len(peers), r.source.Name())
+		if onChange != nil {
+			onChange()
+		}
+	}
+	return nil
+}
+
+// Peers returns the known peers sorted by cluster name
+func (r *Registry) Peers() []Peer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	peers := make([]Peer, 0, len(r.peers))
+	for _, peer := range r.peers {
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Cluster < peers[j].Cluster })
+	return peers
+}
+
+// Clusters returns the names of the known peer clusters, sorted
+func (r *Registry) Clusters() []string {
+	peers := r.Peers()
+	clusters := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		clusters = append(clusters, peer.Cluster)
+	}
+	return clusters
+}
+
+// Lookup returns the tailnet addresses of a peer cluster's gateway
+func (r *Registry) Lookup(cluster string) []net.IP {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.peers[strings.ToLower(cluster)].Addresses
+}
+
+// peerPrecedes prefers online nodes, then the most recently seen one
+func peerPrecedes(a, b Peer) bool {
+	if a.Online != b.Online {
+		return a.Online
+	}
+	return a.LastSeen.After(b.LastSeen)
+}
+
+// samePeers compares what the configuration depends on: the clusters and their addresses
+func samePeers(a, b map[string]Peer) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for cluster, peer := range a {
+		other, exists := b[cluster]
+		if !exists || !slices.EqualFunc(peer.Addresses, other.Addresses, net.IP.Equal) {
+			return false
+		}
+	}
+	return true
+}
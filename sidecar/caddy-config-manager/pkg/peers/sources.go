@@ -0,0 +1,287 @@
+package peers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// SourceLocalAPI reads the peers tailscaled knows from its LocalAPI
+	SourceLocalAPI = "localapi"
+	// SourceTailscale lists the devices of the tailnet from the Tailscale API
+	SourceTailscale = "tailscale"
+	// SourceHeadscale lists the nodes from the Headscale API
+	SourceHeadscale = "headscale"
+
+	// DefaultLocalAPISocket is the tailscaled socket shared through the tailscale-socket volume (TS_SOCKET)
+	DefaultLocalAPISocket = "/var/run/tailscale/tailscaled.sock"
+	// DefaultTailscaleAPIURL is the Tailscale control-plane API
+	DefaultTailscaleAPIURL = "https://api.tailscale.com"
+	// DefaultTailnet names the tailnet of the API key
+	DefaultTailnet = "-"
+	// EnvAPIKey holds the API key of the tailscale and headscale sources, kept out of the command line
+	EnvAPIKey = "PEER_API_KEY"
+
+	// localAPIHost is the Host header tailscaled expects on its LocalAPI
+	localAPIHost = "local-tailscaled.sock"
+)
+
+// Node is a tailnet node as reported by a discovery source
+type Node struct {
+	// Hostname is the machine name, without the MagicDNS suffix
+	Hostname  string
+	Addresses []net.IP
+	// LastSeen is zero when the source does not report it
+	LastSeen time.Time
+	Online   bool
+}
+
+// Source lists the nodes of the tailnet
+type Source interface {
+	// Name identifies the source in logs
+	Name() string
+	ListNodes(ctx context.Context) ([]Node, error)
+}
+
+// SourceConfig holds the settings of every source, only those of the selected source are used
+type SourceConfig struct {
+	// Socket is the tailscaled socket of the localapi source
+	Socket string
+	// APIURL is the control-plane API of the tailscale (DefaultTailscaleAPIURL when empty) and headscale sources
+	APIURL  string
+	Tailnet string
+	APIKey  string
+	Timeout time.Duration
+}
+
+// NewSource creates the source named name, SourceLocalAPI, SourceTailscale or SourceHeadscale
+func NewSource(name string, config SourceConfig) (Source, error) {
+	switch name {
+	case SourceLocalAPI:
+		return NewLocalAPISource(config.Socket, config.Timeout), nil
+	case SourceTailscale:
+		if config.APIKey == "" {
+			return nil, fmt.Errorf("source %s needs an API key in $%s", name, EnvAPIKey)
+		}
+		return NewTailscaleSource(config.APIURL, config.Tailnet, config.APIKey, config.Timeout), nil
+	case SourceHeadscale:
+		if config.APIURL == "" || config.APIKey == "" {
+			return nil, fmt.Errorf("source %s needs the Headscale URL and an API key in $%s", name, EnvAPIKey)
+		}
+		return NewHeadscaleSource(config.APIURL, config.APIKey, config.Timeout), nil
+	default:
+		return nil, fmt.Errorf("unsupported peer discovery source %q, expected %q, %q or %q", name, SourceLocalAPI, SourceTailscale, SourceHeadscale)
+	}
+}
+
+// localAPISource reads /localapi/v0/status from tailscaled over its unix socket
+type localAPISource struct {
+	client *http.Client
+}
+
+// NewLocalAPISource creates a source asking tailscaled through the socket at path
+func NewLocalAPISource(path string, timeout time.Duration) Source {
+	if path == "" {
+		path = DefaultLocalAPISocket
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", path)
+		},
+	}
+	return &localAPISource{client: &http.Client{Transport: transport, Timeout: timeout}}
+}
+
+func (s *localAPISource) Name() string {
+	return SourceLocalAPI
+}
+
+// localAPIStatus is the subset of the ipnstate.Status returned by the LocalAPI
+type localAPIStatus struct {
+	Peer map[string]struct {
+		HostName     string
+		DNSName      string
+		TailscaleIPs []string
+		LastSeen     time.Time
+		Online       bool
+	}
+}
+
+func (s *localAPISource) ListNodes(ctx context.Context) ([]Node, error) {
+	var status localAPIStatus
+	if err := getJSON(ctx, s.client, "http://"+localAPIHost+"/localapi/v0/status", "", &status); err != nil {
+		return nil, err
+	}
+	nodes := make([]Node, 0, len(status.Peer))
+	for _, peer := range status.Peer {
+		// HostName is the OS hostname, the MagicDNS name carries the TS_HOSTNAME the gateway registered with
+		hostname := firstLabel(peer.DNSName)
+		if hostname == "" {
+			hostname = peer.HostName
+		}
+		nodes = append(nodes, Node{
+			Hostname:  hostname,
+			Addresses: parseIPs(peer.TailscaleIPs),
+			LastSeen:  peer.LastSeen,
+			Online:    peer.Online,
+		})
+	}
+	return nodes, nil
+}
+
+// tailscaleSource lists the devices of a tailnet from the Tailscale API
+type tailscaleSource struct {
+	client  *http.Client
+	baseURL string
+	tailnet string
+	apiKey  string
+}
+
+// NewTailscaleSource creates a source listing the devices of tailnet with an API key
+func NewTailscaleSource(baseURL, tailnet, apiKey string, timeout time.Duration) Source {
+	if baseURL == "" {
+		baseURL = DefaultTailscaleAPIURL
+	}
+	if tailnet == "" {
+		tailnet = DefaultTailnet
+	}
+	return &tailscaleSource{
+		client:  &http.Client{Timeout: timeout},
+		baseURL: strings.TrimRight(baseURL, "/"),
+		tailnet: tailnet,
+		apiKey:  apiKey,
+	}
+}
+
+func (s *tailscaleSource) Name() string {
+	return SourceTailscale
+}
+
+func (s *tailscaleSource) ListNodes(ctx context.Context) ([]Node, error) {
+	var response struct {
+		Devices []struct {
+			Hostname           string    `json:"hostname"`
+			Name               string    `json:"name"`
+			Addresses          []string  `json:"addresses"`
+			LastSeen           time.Time `json:"lastSeen"`
+			ConnectedToControl bool      `json:"connectedToControl"`
+		} `json:"devices"`
+	}
+	endpoint := s.baseURL + "/api/v2/tailnet/" + url.PathEscape(s.tailnet) + "/devices"
+	if err := getJSON(ctx, s.client, endpoint, s.apiKey, &response); err != nil {
+		return nil, err
+	}
+	nodes := make([]Node, 0, len(response.Devices))
+	for _, device := range response.Devices {
+		// name is the MagicDNS name, hostname the OS hostname
+		hostname := firstLabel(device.Name)
+		if hostname == "" {
+			hostname = device.Hostname
+		}
+		nodes = append(nodes, Node{
+			Hostname:  hostname,
+			Addresses: parseIPs(device.Addresses),
+			LastSeen:  device.LastSeen,
+			Online:    device.ConnectedToControl,
+		})
+	}
+	return nodes, nil
+}
+
+// headscaleSource lists the nodes from the Headscale API
+type headscaleSource struct {
+	client  *http.Client
+	baseURL string
+	apiKey  string
+}
+
+// NewHeadscaleSource creates a source listing the nodes of the Headscale server at baseURL with an API key
+func NewHeadscaleSource(baseURL, apiKey string, timeout time.Duration) Source {
+	return &headscaleSource{
+		client:  &http.Client{Timeout: timeout},
+		baseURL: strings.TrimRight(baseURL, "/"),
+		apiKey:  apiKey,
+	}
+}
+
+func (s *headscaleSource) Name() string {
+	return SourceHeadscale
+}
+
+func (s *headscaleSource) ListNodes(ctx context.Context) ([]Node, error) {
+	var response struct {
+		Nodes []struct {
+			Name        string    `json:"name"`
+			GivenName   string    `json:"givenName"`
+			IPAddresses []string  `json:"ipAddresses"`
+			LastSeen    time.Time `json:"lastSeen"`
+			Online      bool      `json:"online"`
+		} `json:"nodes"`
+	}
+	if err := getJSON(ctx, s.client, s.baseURL+"/api/v1/node", s.apiKey, &response); err != nil {
+		return nil, err
+	}
+	nodes := make([]Node, 0, len(response.Nodes))
+	for _, node := range response.Nodes {
+		// givenName is the MagicDNS name, which Headscale may have made unique
+		hostname := node.GivenName
+		if hostname == "" {
+			hostname = node.Name
+		}
+		nodes = append(nodes, Node{
+			Hostname:  hostname,
+			Addresses: parseIPs(node.IPAddresses),
+			LastSeen:  node.LastSeen,
+			Online:    node.Online,
+		})
+	}
+	return nodes, nil
+}
+
+// getJSON sends a GET request, authenticated with a bearer token when apiKey is set, and decodes the JSON response
+func getJSON(ctx context.Context, client *http.Client, endpoint, apiKey string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request to %s failed: %w", req.URL.Path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned %s: %s", req.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response of %s: %w", req.URL.Path, err)
+	}
+	return nil
+}
+
+// firstLabel returns the first label of a DNS name, empty for an empty name
+func firstLabel(name string) string {
+	label, _, _ := strings.Cut(name, ".")
+	return label
+}
+
+func parseIPs(values []string) []net.IP {
+	ips := make([]net.IP, 0, len(values))
+	for _, value := range values {
+		if ip := net.ParseIP(value); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
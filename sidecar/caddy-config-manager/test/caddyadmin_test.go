@@ -0,0 +1,106 @@
+package test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/caddyadmin"
+)
+
+// fakeCaddyAdmin is an httptest stand-in for Caddy's admin API
+type fakeCaddyAdmin struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	loaded      string
+	contentType string
+}
+
+// newFakeCaddyAdmin answers POST /load with loadStatus and GET /config/ with the loaded config
+func newFakeCaddyAdmin(loadStatus int) *fakeCaddyAdmin {
+	f := &fakeCaddyAdmin{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/load", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if loadStatus != http.StatusOK {
+			http.Error(w, `{"error":"adapting config using caddyfile: unrecognized directive"}`, loadStatus)
+			return
+		}
+		f.mu.Lock()
+		f.loaded = string(body)
+		f.contentType = r.Header.Get("Content-Type")
+		f.mu.Unlock()
+	})
+	mux.HandleFunc("/config/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"apps":{}}`))
+	})
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+// Loaded returns the last configuration accepted through /load
+func (f *fakeCaddyAdmin) Loaded() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.loaded
+}
+
+// ContentType returns the Content-Type of the last accepted /load request
+func (f *fakeCaddyAdmin) ContentType() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.contentType
+}
+
+func TestCaddyAdminLoad(t *testing.T) {
+	admin := newFakeCaddyAdmin(http.StatusOK)
+	defer admin.Close()
+
+	config := "service1.test-ns.svc.foo.remote {\n    reverse_proxy service1.test-ns.svc.cluster.local\n}\n"
+	client := caddyadmin.NewClient(admin.URL, time.Second)
+	if err := client.Load(context.Background(), []byte(config), caddyadmin.ContentTypeCaddyfile); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if admin.Loaded() != config {
+		t.Errorf("Expected loaded config:\n%s\nGot:\n%s", config, admin.Loaded())
+	}
+	if admin.ContentType() != caddyadmin.ContentTypeCaddyfile {
+		t.Errorf("Expected Content-Type %s, got: %s", caddyadmin.ContentTypeCaddyfile, admin.ContentType())
+	}
+}
+
+func TestCaddyAdminLoad_Rejected(t *testing.T) {
+	admin := newFakeCaddyAdmin(http.StatusBadRequest)
+	defer admin.Close()
+
+	client := caddyadmin.NewClient(admin.URL, time.Second)
+	err := client.Load(context.Background(), []byte("invalid {"), caddyadmin.ContentTypeCaddyfile)
+	if err == nil {
+		t.Fatal("Expected error for rejected config, got nil")
+	}
+	if caddyadmin.IsUnreachable(err) {
+		t.Errorf("Expected rejection not to be reported as unreachable, got: %v", err)
+	}
+}
+
+func TestCaddyAdminLoad_Unreachable(t *testing.T) {
+	admin := newFakeCaddyAdmin(http.StatusOK)
+	admin.Close()
+
+	client := caddyadmin.NewClient(admin.URL, time.Second)
+	err := client.Load(context.Background(), []byte(""), caddyadmin.ContentTypeCaddyfile)
+	if !caddyadmin.IsUnreachable(err) {
+		t.Errorf("Expected unreachable error, got: %v", err)
+	}
+}
@@ -0,0 +1,279 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/catalog"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/controller"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+)
+
+// fakeTailnetProxy stands in for the tailscale HTTP proxy, serving the catalog of each gateway host
+type fakeTailnetProxy struct {
+	mu       sync.Mutex
+	catalogs map[string]*catalog.Server
+}
+
+func (p *fakeTailnetProxy) setCatalog(host string, c *catalog.Catalog) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.catalogs[host] == nil {
+		p.catalogs[host] = catalog.NewServer()
+	}
+	p.catalogs[host].Update(c)
+}
+
+func (p *fakeTailnetProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	server := p.catalogs[r.URL.Host]
+	p.mu.Unlock()
+	if server == nil {
+		http.Error(w, "no route to "+r.URL.Host, http.StatusBadGateway)
+		return
+	}
+	server.ServeHTTP(w, r)
+}
+
+func newFakeTailnetProxy(t *testing.T) (*fakeTailnetProxy, string) {
+	t.Helper()
+	proxy := &fakeTailnetProxy{catalogs: make(map[string]*catalog.Server)}
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+	return proxy, server.URL
+}
+
+func peerCatalog(cluster string, hosts ...string) *catalog.Catalog {
+	c := &catalog.Catalog{Version: catalog.Version, Cluster: cluster}
+	for _, host := range hosts {
+		c.Services = append(c.Services, catalog.Service{RemoteDomain: host, Protocol: generator.ProtocolHTTP})
+	}
+	return c
+}
+
+func TestCatalog_Build(t *testing.T) {
+	serviceList := &v1.ServiceList{Items: []v1.Service{{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "db",
+			Namespace: "shop",
+			Annotations: map[string]string{
+				catalog.AnnotationMetadataPrefix + "owner": "payments-team",
+				"other.io/owner": "ignored",
+			},
+		},
+	}}}
+	routes := []generator.ServiceRoute{
+		{RemoteDomain: "db.shop.svc.foo.remote", Namespace: "shop", ServiceName: "db", Port: 80, Protocol: generator.ProtocolHTTP, Aliases: []string{"db.example.com"}},
+		{RemoteDomain: "http.db.shop.svc.foo.remote", Namespace: "shop", ServiceName: "db", PortName: "http", PortLabel: "http", Port: 80, Protocol: generator.ProtocolHTTP},
+		{RemoteDomain: "80.db.shop.svc.foo.remote", Namespace: "shop", ServiceName: "db", PortName: "http", PortLabel: "80", Port: 80, Protocol: generator.ProtocolHTTP},
+		{RemoteDomain: "pg.db.shop.svc.foo.remote", Namespace: "shop", ServiceName: "db", PortName: "pg", PortLabel: "pg", Port: 5432, Protocol: generator.ProtocolTCP},
+		{RemoteDomain: "db-0.db.shop.svc.foo.remote", Namespace: "shop", ServiceName: "db", Pod: "db-0", Port: 80, Protocol: generator.ProtocolHTTP},
+	}
+	listeners := []generator.L4Listener{{ListenPort: 10000, Protocol: generator.ProtocolTCP, Namespace: "shop", ServiceName: "db", PortName: "pg", Port: 5432}}
+
+	built := catalog.Build("foo", serviceList, routes, listeners)
+	if err := built.Validate("foo"); err != nil {
+		t.Fatalf("Expected a valid catalog, got: %v", err)
+	}
+	if len(built.Services) != 1 {
+		t.Fatalf("Expected 1 service, got: %+v", built.Services)
+	}
+	service := built.Services[0]
+	if service.RemoteDomain != "db.shop.svc.foo.remote" || len(service.Aliases) != 1 || len(service.PodDomains) != 1 {
+		t.Errorf("Expected the service domain, its alias and pod domain, got: %+v", service)
+	}
+	if len(service.Metadata) != 1 || service.Metadata["owner"] != "payments-team" {
+		t.Errorf("Expected metadata owner=payments-team only, got: %v", service.Metadata)
+	}
+	if len(service.Ports) != 2 || len(service.Ports[0].RemoteDomains) != 2 || service.Ports[1].ListenPort != 10000 {
+		t.Errorf("Expected the http port with 2 domains and pg on listen port 10000, got: %+v", service.Ports)
+	}
+
+	hosts := built.HTTPHosts(".svc.foo.remote")
+	expected := []string{"80.db.shop.svc.foo.remote", "db-0.db.shop.svc.foo.remote", "db.shop.svc.foo.remote", "http.db.shop.svc.foo.remote"}
+	if strings.Join(hosts, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected HTTP hosts %v, got: %v", expected, hosts)
+	}
+	// The alias is outside the domains of foo, it is reported instead of routed
+	if ignored := built.IgnoredHTTPHosts(".svc.foo.remote"); strings.Join(ignored, ",") != "db.example.com" {
+		t.Errorf("Expected the alias to be ignored, got: %v", ignored)
+	}
+	if err := built.Validate("bar"); err == nil {
+		t.Errorf("Expected the catalog of foo to be refused for bar")
+	}
+}
+
+func TestCatalog_ServerETag(t *testing.T) {
+	server := catalog.NewServer()
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, catalog.Path, nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 before the first update, got: %d", recorder.Code)
+	}
+
+	server.Update(peerCatalog("foo", "web.shop.svc.foo.remote"))
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, catalog.Path, nil))
+	etag := recorder.Header().Get("ETag")
+	var served catalog.Catalog
+	if err := json.Unmarshal(recorder.Body.Bytes(), &served); err != nil || recorder.Code != http.StatusOK || etag == "" {
+		t.Fatalf("Expected the catalog with an ETag, got: %d %q %v", recorder.Code, etag, err)
+	}
+
+	// A regenerated but identical catalog keeps its ETag
+	unchanged := peerCatalog("foo", "web.shop.svc.foo.remote")
+	unchanged.GeneratedAt = time.Now()
+	server.Update(unchanged)
+	request := httptest.NewRequest(http.MethodGet, catalog.Path, nil)
+	request.Header.Set("If-None-Match", etag)
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for an unchanged catalog, got: %d", recorder.Code)
+	}
+
+	server.Update(peerCatalog("foo", "web.shop.svc.foo.remote", "api.shop.svc.foo.remote"))
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("ETag") == etag {
+		t.Errorf("Expected a changed catalog with a new ETag, got: %d %q", recorder.Code, recorder.Header().Get("ETag"))
+	}
+}
+
+func TestCatalog_Fetcher(t *testing.T) {
+	proxy, proxyURL := newFakeTailnetProxy(t)
+	// A peer cannot claim domains of another cluster
+	proxy.setCatalog("bar-tsgateway:2020", peerCatalog("bar", "web.shop.svc.bar.remote", "web.shop.svc.baz.remote"))
+	proxy.setCatalog("qux-tsgateway:2020", peerCatalog("baz", "web.shop.svc.qux.remote"))
+
+	fetcher, err := catalog.NewFetcher(catalog.FetcherOptions{ProxyURL: proxyURL, StaleAfter: time.Hour})
+	if err != nil {
+		t.Fatalf("Expected fetcher, got: %v", err)
+	}
+	changes := 0
+	fetcher.SetOnChange(func() { changes++ })
+
+	fetcher.FetchAll(context.Background(), []string{"bar", "qux"})
+	hosts := fetcher.Hosts("remote")
+	if len(hosts) != 1 || strings.Join(hosts["bar"], ",") != "web.shop.svc.bar.remote" {
+		t.Errorf("Expected only bar's own domain, got: %v", hosts)
+	}
+	if ignored := fetcher.IgnoredHosts("remote"); len(ignored) != 1 || strings.Join(ignored["bar"], ",") != "web.shop.svc.baz.remote" {
+		t.Errorf("Expected the domain of baz to be reported for bar, got: %v", ignored)
+	}
+	if entry := fetcher.Catalog("qux"); entry == nil || entry.LastError == nil {
+		t.Errorf("Expected the catalog of another cluster to be refused, got: %+v", entry)
+	}
+	if changes != 1 {
+		t.Errorf("Expected 1 change, got: %d", changes)
+	}
+
+	// An unchanged catalog is answered with 304 and does not trigger a reconcile
+	fetcher.FetchAll(context.Background(), []string{"bar", "qux"})
+	if changes != 1 {
+		t.Errorf("Expected no change for an unchanged catalog, got: %d", changes)
+	}
+
+	// Peers no longer listed are forgotten
+	fetcher.FetchAll(context.Background(), []string{"qux"})
+	if hosts := fetcher.Hosts("remote"); len(hosts) != 0 || changes != 2 {
+		t.Errorf("Expected bar to be forgotten, got: %v after %d changes", hosts, changes)
+	}
+}
+
+func TestCatalog_FetcherStale(t *testing.T) {
+	proxy, proxyURL := newFakeTailnetProxy(t)
+	proxy.setCatalog("bar-tsgateway:2020", peerCatalog("bar", "web.shop.svc.bar.remote"))
+
+	fetcher, err := catalog.NewFetcher(catalog.FetcherOptions{ProxyURL: proxyURL, StaleAfter: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Expected fetcher, got: %v", err)
+	}
+	fetcher.FetchAll(context.Background(), []string{"bar"})
+	if stale := fetcher.Stale(); len(stale) != 0 || len(fetcher.Hosts("remote")["bar"]) != 1 {
+		t.Fatalf("Expected a fresh catalog of bar, got stale peers: %v", stale)
+	}
+
+	// The gateway is gone, the last catalog is used until it is stale
+	proxy.mu.Lock()
+	delete(proxy.catalogs, "bar-tsgateway:2020")
+	proxy.mu.Unlock()
+	fetcher.FetchAll(context.Background(), []string{"bar"})
+	if len(fetcher.Hosts("remote")["bar"]) != 1 {
+		t.Errorf("Expected the last catalog of bar to be used while fresh")
+	}
+	time.Sleep(100 * time.Millisecond)
+	fetcher.FetchAll(context.Background(), []string{"bar"})
+	if stale := fetcher.Stale(); len(stale) != 1 || stale[0] != "bar" {
+		t.Errorf("Expected bar to be stale, got: %v", stale)
+	}
+	if hosts, listed := fetcher.Hosts("remote")["bar"]; !listed || len(hosts) != 0 {
+		t.Errorf("Expected no hosts for a stale peer, got: %v", hosts)
+	}
+}
+
+func TestController_Catalog(t *testing.T) {
+	proxy, proxyURL := newFakeTailnetProxy(t)
+	proxy.setCatalog("bar-tsgateway:2020", peerCatalog("bar", "web.shop.svc.bar.remote", "shop.example.com"))
+
+	namespace := "test-ns"
+	clientset := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "tailscale-cluster-name", Namespace: "default"},
+			Data:       map[string]string{"CLUSTER_NAME": "foo"},
+		},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "service1", Namespace: namespace},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 80}}},
+		},
+	)
+	allowAllAccessReviews(clientset)
+
+	fetcher, err := catalog.NewFetcher(catalog.FetcherOptions{ProxyURL: proxyURL, Interval: 50 * time.Millisecond, StaleAfter: time.Hour})
+	if err != nil {
+		t.Fatalf("Expected fetcher, got: %v", err)
+	}
+	port := int(freePort(t, "tcp"))
+	cancel := startController(t, clientset, controller.Options{
+		Namespace:      namespace,
+		Peers:          []string{"foo", "bar", "baz"},
+		CatalogPort:    port,
+		CatalogFetcher: fetcher,
+	})
+	defer cancel()
+
+	// Only the domains bar exports are forwarded, baz never returned a catalog and is routed by wildcard
+	config := waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, "web.shop.svc.bar.remote") && strings.Contains(config, "*.*.svc.baz.remote")
+	})
+	if strings.Contains(config, "*.*.svc.bar.remote") {
+		t.Errorf("Expected only the exported domains of bar, got:\n%s", config)
+	}
+	waitForStatus(t, clientset, namespace, controller.StatusStalePeersKey, "baz")
+	waitForStatus(t, clientset, namespace, controller.StatusIgnoredPeerHostsKey, "bar: shop.example.com")
+
+	// The local catalog is served on the loopback interface
+	resp, err := http.Get("http://127.0.0.1:" + strconv.Itoa(port) + catalog.Path)
+	if err != nil {
+		t.Fatalf("Expected the local catalog, got: %v", err)
+	}
+	defer resp.Body.Close()
+	var served catalog.Catalog
+	if err := json.NewDecoder(resp.Body).Decode(&served); err != nil {
+		t.Fatalf("Failed to decode the local catalog: %v", err)
+	}
+	if served.Cluster != "foo" || len(served.Services) != 1 || served.Services[0].RemoteDomain != "service1.test-ns.svc.foo.remote" {
+		t.Errorf("Expected service1 in the catalog of foo, got: %+v", served)
+	}
+}
@@ -0,0 +1,86 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/clusterdomain"
+)
+
+func TestParseResolvConf(t *testing.T) {
+	tests := []struct {
+		name       string
+		resolvConf string
+		expected   string
+	}{
+		{
+			name:       "pod resolv.conf",
+			resolvConf: "search test-ns.svc.cluster.local svc.cluster.local cluster.local\nnameserver 10.96.0.10\noptions ndots:5\n",
+			expected:   "cluster.local",
+		},
+		{
+			name:       "custom domain",
+			resolvConf: "nameserver 10.96.0.10\nsearch test-ns.svc.corp.example svc.corp.example corp.example ec2.internal\n",
+			expected:   "corp.example",
+		},
+		{
+			name:       "trailing dot and uppercase",
+			resolvConf: "search SVC.Cluster.Local.\n",
+			expected:   "cluster.local",
+		},
+		{
+			name:       "not a pod",
+			resolvConf: "search example.com\nnameserver 1.1.1.1\n",
+			expected:   "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clusterdomain.ParseResolvConf(strings.NewReader(tt.resolvConf)); got != tt.expected {
+				t.Errorf("Expected cluster domain %q, got: %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestDetectFromResolvConf(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(path, []byte("search default.svc.k8s.internal svc.k8s.internal k8s.internal\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write resolv.conf: %v", err)
+	}
+	if got := clusterdomain.DetectFromResolvConf(path); got != "k8s.internal" {
+		t.Errorf("Expected cluster domain k8s.internal, got: %q", got)
+	}
+	if got := clusterdomain.DetectFromResolvConf(filepath.Join(t.TempDir(), "missing")); got != "" {
+		t.Errorf("Expected no cluster domain for a missing file, got: %q", got)
+	}
+}
+
+func TestResolveClusterDomain(t *testing.T) {
+	tests := []struct {
+		name           string
+		flag           string
+		configMap      string
+		detected       string
+		expectedDomain string
+		expectedSource string
+	}{
+		{"flag wins", "flag.local", "cm.local", "detected.local", "flag.local", clusterdomain.SourceFlag},
+		{"configmap over detection", "", "cm.local", "detected.local", "cm.local", clusterdomain.SourceConfigMap},
+		{"detected", "", "", "detected.local", "detected.local", clusterdomain.SourceResolvConf},
+		{"default", "", "", "", clusterdomain.DefaultClusterDomain, clusterdomain.SourceDefault},
+		{"invalid override ignored", "Not_Valid", "", "detected.local", "detected.local", clusterdomain.SourceResolvConf},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := clusterdomain.Resolve(tt.flag, tt.configMap, tt.detected)
+			if result.Domain != tt.expectedDomain || result.Source != tt.expectedSource {
+				t.Errorf("Expected %s from %s, got: %s from %s", tt.expectedDomain, tt.expectedSource, result.Domain, result.Source)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/clusteridentity"
+)
+
+func newFakeDynamicClient(objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{clusteridentity.ClusterPropertyGVR: "ClusterPropertyList"}, objects...)
+}
+
+func clusterProperty(name, value string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "about.k8s.io/v1alpha1",
+		"kind":       "ClusterProperty",
+		"metadata":   map[string]interface{}{"name": name},
+		"spec":       map[string]interface{}{"value": value},
+	}}
+}
+
+func TestClusterIdentityChain(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "cluster-info", Namespace: "kube-public"},
+			Data:       map[string]string{"name": "from-configmap"},
+		},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kube-system", UID: "6F1C2B9E-0A4D-4E51-9C3B-2D7A8E6F0B11"}},
+	)
+	dynamicClient := newFakeDynamicClient(clusterProperty(clusteridentity.ClusterPropertyName, "from-clusterproperty"))
+	ref := clusteridentity.ConfigMapRef{Namespace: "kube-public", Name: "cluster-info", Key: "name"}
+
+	tests := []struct {
+		name           string
+		sources        []string
+		flagValue      string
+		expectedName   string
+		expectedSource string
+	}{
+		{"flag first", clusteridentity.DefaultSources, "from-flag", "from-flag", clusteridentity.SourceFlag},
+		{"empty flag falls through", clusteridentity.DefaultSources, "", "from-configmap", clusteridentity.SourceConfigMap},
+		{"clusterproperty", []string{clusteridentity.SourceClusterProperty, clusteridentity.SourceConfigMap}, "", "from-clusterproperty", clusteridentity.SourceClusterProperty},
+		{"kube-system uid", []string{clusteridentity.SourceKubeSystemUID}, "", "cluster-6f1c2b9e0a4d", clusteridentity.SourceKubeSystemUID},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain, err := clusteridentity.NewChainFromSources(tt.sources, clusteridentity.Config{
+				FlagValue:     tt.flagValue,
+				ConfigMap:     ref,
+				Clientset:     clientset,
+				DynamicClient: dynamicClient,
+			})
+			if err != nil {
+				t.Fatalf("Expected a valid chain, got: %v", err)
+			}
+			identity, err := chain.Resolve(context.Background())
+			if err != nil {
+				t.Fatalf("Expected a cluster name, got: %v", err)
+			}
+			if identity.Name != tt.expectedName || identity.Source != tt.expectedSource {
+				t.Errorf("Expected %s from %s, got: %s from %s", tt.expectedName, tt.expectedSource, identity.Name, identity.Source)
+			}
+		})
+	}
+}
+
+func TestClusterIdentityChain_Env(t *testing.T) {
+	t.Setenv(clusteridentity.EnvClusterName, "from-env")
+	chain, err := clusteridentity.NewChainFromSources(nil, clusteridentity.Config{Clientset: fake.NewSimpleClientset()})
+	if err != nil {
+		t.Fatalf("Expected a valid chain, got: %v", err)
+	}
+	identity, err := chain.Resolve(context.Background())
+	if err != nil || identity.Name != "from-env" || identity.Source != clusteridentity.SourceEnv {
+		t.Errorf("Expected from-env from env, got: %+v, %v", identity, err)
+	}
+}
+
+func TestClusterIdentityChain_MissingSources(t *testing.T) {
+	// No ConfigMap, no ClusterProperty CRD
+	clientset := fake.NewSimpleClientset()
+	config := clusteridentity.Config{Clientset: clientset, DynamicClient: newFakeDynamicClient()}
+
+	chain, err := clusteridentity.NewChainFromSources(nil, config)
+	if err != nil {
+		t.Fatalf("Expected a valid chain, got: %v", err)
+	}
+	if _, err := chain.Resolve(context.Background()); err == nil || !strings.Contains(err.Error(), "no cluster name found in sources [flag, env, configmap, clusterproperty]") {
+		t.Errorf("Expected an error listing the sources, got: %v", err)
+	}
+
+	config.AllowPlaceholder = true
+	chain, err = clusteridentity.NewChainFromSources(nil, config)
+	if err != nil {
+		t.Fatalf("Expected a valid chain, got: %v", err)
+	}
+	identity, err := chain.Resolve(context.Background())
+	if err != nil || identity.Name != clusteridentity.PlaceholderClusterName || identity.Source != clusteridentity.SourcePlaceholder {
+		t.Errorf("Expected the allowed placeholder, got: %+v, %v", identity, err)
+	}
+}
+
+func TestClusterIdentityChain_ConfigMapLister(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	ref := clusteridentity.ConfigMapRef{Namespace: "kube-public", Name: "cluster-info", Key: "name"}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := indexer.Add(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster-info", Namespace: "kube-public"},
+		Data:       map[string]string{"name": "from-cache"},
+	}); err != nil {
+		t.Fatalf("Failed to add ConfigMap to the cache: %v", err)
+	}
+
+	chain := clusteridentity.NewChain(false, clusteridentity.NewConfigMapProvider(clientset, ref))
+	chain.UseConfigMapLister(corelisters.NewConfigMapLister(indexer), ref)
+
+	identity, err := chain.Resolve(context.Background())
+	if err != nil || identity.Name != "from-cache" {
+		t.Errorf("Expected from-cache from the lister, got: %+v, %v", identity, err)
+	}
+	// The name is read from the cache only
+	if actions := clientset.Actions(); len(actions) != 0 {
+		t.Errorf("Expected no request to the API server, got: %v", actions)
+	}
+}
+
+func TestClusterIdentityChain_RefusesPlaceholder(t *testing.T) {
+	chain := clusteridentity.NewChain(false, clusteridentity.NewStaticProvider(clusteridentity.SourceFlag, clusteridentity.PlaceholderClusterName))
+	if _, err := chain.Resolve(context.Background()); err == nil {
+		t.Errorf("Expected the placeholder name to be refused")
+	}
+
+	chain = clusteridentity.NewChain(true, clusteridentity.NewStaticProvider(clusteridentity.SourceFlag, clusteridentity.PlaceholderClusterName))
+	if identity, err := chain.Resolve(context.Background()); err != nil || identity.Source != clusteridentity.SourceFlag {
+		t.Errorf("Expected the allowed placeholder from flag, got: %+v, %v", identity, err)
+	}
+}
+
+func TestParseClusterIdentitySources(t *testing.T) {
+	sources, err := clusteridentity.ParseSources("flag, configmap,kube-system-uid")
+	if err != nil || strings.Join(sources, ",") != "flag,configmap,kube-system-uid" {
+		t.Errorf("Expected flag,configmap,kube-system-uid, got: %v, %v", sources, err)
+	}
+	if _, err := clusteridentity.ParseSources("flag,dns"); err == nil {
+		t.Errorf("Expected an unknown source to be rejected")
+	}
+
+	ref, err := clusteridentity.ParseConfigMapRef("kube-public/cluster-info", "name")
+	if err != nil || ref.String() != "kube-public/cluster-info:name" {
+		t.Errorf("Expected kube-public/cluster-info:name, got: %v, %v", ref, err)
+	}
+	if _, err := clusteridentity.ParseConfigMapRef("cluster-info", "name"); err == nil {
+		t.Errorf("Expected a ConfigMap without namespace to be rejected")
+	}
+}
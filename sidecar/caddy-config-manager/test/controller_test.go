@@ -0,0 +1,628 @@
+package test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/utils/ptr"
+
+	k8sclient "github.com/wold9168/k8s-cross-cluster/lib/k8sclient"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/caddyadmin"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/clusteridentity"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/controller"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+)
+
+// allowAllAccessReviews makes the fake clientset grant every SelfSubjectAccessReview
+func allowAllAccessReviews(clientset *fake.Clientset) {
+	clientset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		sar := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		sar.Status.Allowed = true
+		return true, sar, nil
+	})
+}
+
+// startController runs the controller in the background and returns a function stopping it
+func startController(t *testing.T, clientset *fake.Clientset, opts controller.Options) context.CancelFunc {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	ctrl := controller.New(clientset, opts)
+	go func() {
+		if err := ctrl.Run(ctx, 1); err != nil {
+			t.Errorf("Controller exited with error: %v", err)
+		}
+	}()
+	return cancel
+}
+
+// waitForCaddyConfig waits until the caddy-config ConfigMap satisfies the condition
+func waitForCaddyConfig(t *testing.T, clientset *fake.Clientset, namespace string, condition func(string) bool) string {
+	t.Helper()
+	var caddyConfig string
+	err := wait.PollUntilContextTimeout(context.Background(), 20*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, k8sclient.CaddyConfigMapName, metav1.GetOptions{})
+		if err != nil {
+			return false, nil
+		}
+		caddyConfig = cm.Data[k8sclient.CaddyConfigKey]
+		return condition(caddyConfig), nil
+	})
+	if err != nil {
+		t.Fatalf("Timed out waiting for Caddy config, last seen:\n%s", caddyConfig)
+	}
+	return caddyConfig
+}
+
+func TestController_InitialSync(t *testing.T) {
+	namespace := "test-ns"
+	clientset := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "tailscale-cluster-name", Namespace: "default"},
+			Data:       map[string]string{"CLUSTER_NAME": "foo"},
+		},
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "service1", Namespace: namespace}},
+	)
+	allowAllAccessReviews(clientset)
+
+	cancel := startController(t, clientset, controller.Options{Namespace: namespace})
+	defer cancel()
+
+	expected := "http://service1.test-ns.svc.foo.remote:2015 {\n    reverse_proxy service1.test-ns.svc.cluster.local\n}\n"
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool { return config == expected })
+}
+
+func TestController_ServiceEvents(t *testing.T) {
+	namespace := "test-ns"
+	clientset := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "tailscale-cluster-name", Namespace: "default"},
+			Data:       map[string]string{"CLUSTER_NAME": "foo"},
+		},
+	)
+	allowAllAccessReviews(clientset)
+
+	cancel := startController(t, clientset, controller.Options{Namespace: namespace})
+	defer cancel()
+
+	// Service added
+	_, err := clientset.CoreV1().Services(namespace).Create(context.Background(),
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "service1", Namespace: namespace}}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create Service: %v", err)
+	}
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, "service1.test-ns.svc.foo.remote")
+	})
+
+	// Service deleted
+	err = clientset.CoreV1().Services(namespace).Delete(context.Background(), "service1", metav1.DeleteOptions{})
+	if err != nil {
+		t.Fatalf("Failed to delete Service: %v", err)
+	}
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return !strings.Contains(config, "service1.test-ns.svc.foo.remote")
+	})
+}
+
+func TestController_ClusterNameChange(t *testing.T) {
+	namespace := "test-ns"
+	clusterNameConfigMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "tailscale-cluster-name", Namespace: "default"},
+		Data:       map[string]string{"CLUSTER_NAME": "foo"},
+	}
+	clientset := fake.NewSimpleClientset(
+		clusterNameConfigMap,
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "service1", Namespace: namespace}},
+	)
+	allowAllAccessReviews(clientset)
+
+	cancel := startController(t, clientset, controller.Options{Namespace: namespace})
+	defer cancel()
+
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, "service1.test-ns.svc.foo.remote")
+	})
+
+	updated := clusterNameConfigMap.DeepCopy()
+	updated.Data["CLUSTER_NAME"] = "bar"
+	if _, err := clientset.CoreV1().ConfigMaps("default").Update(context.Background(), updated, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update cluster name ConfigMap: %v", err)
+	}
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, "service1.test-ns.svc.bar.remote")
+	})
+}
+
+func TestController_AdminAPI(t *testing.T) {
+	namespace := "test-ns"
+	clientset := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "tailscale-cluster-name", Namespace: "default"},
+			Data:       map[string]string{"CLUSTER_NAME": "foo"},
+		},
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "service1", Namespace: namespace}},
+	)
+	allowAllAccessReviews(clientset)
+
+	admin := newFakeCaddyAdmin(http.StatusOK)
+	defer admin.Close()
+
+	cancel := startController(t, clientset, controller.Options{
+		Namespace:         namespace,
+		CaddyAdminURL:     admin.URL,
+		CaddyAdminTimeout: time.Second,
+	})
+	defer cancel()
+
+	expected := "http://service1.test-ns.svc.foo.remote:2015 {\n    reverse_proxy service1.test-ns.svc.cluster.local\n}\n"
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool { return config == expected })
+
+	if loaded := admin.Loaded(); loaded != expected {
+		t.Errorf("Expected admin API to receive:\n%s\nGot:\n%s", expected, loaded)
+	}
+}
+
+func TestController_AdminAPIUnreachable(t *testing.T) {
+	namespace := "test-ns"
+	clientset := fake.NewSimpleClientset(
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "service1", Namespace: namespace}},
+	)
+	allowAllAccessReviews(clientset)
+
+	// Start and immediately close a server to get an address nobody listens on
+	admin := newFakeCaddyAdmin(http.StatusOK)
+	admin.Close()
+
+	cancel := startController(t, clientset, controller.Options{
+		Namespace:         namespace,
+		CaddyAdminURL:     admin.URL,
+		CaddyAdminTimeout: time.Second,
+		ClusterIdentity:   clusteridentity.NewChain(true),
+	})
+	defer cancel()
+
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, "service1.test-ns.svc.default-cluster-name.remote")
+	})
+}
+
+func TestController_JSONFormat(t *testing.T) {
+	namespace := "test-ns"
+	clientset := fake.NewSimpleClientset(
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "service1", Namespace: namespace}},
+	)
+	allowAllAccessReviews(clientset)
+
+	admin := newFakeCaddyAdmin(http.StatusOK)
+	defer admin.Close()
+
+	cancel := startController(t, clientset, controller.Options{
+		Namespace:         namespace,
+		CaddyAdminURL:     admin.URL,
+		CaddyAdminTimeout: time.Second,
+		ConfigFormat:      controller.ConfigFormatJSON,
+		ClusterIdentity:   clusteridentity.NewChain(true),
+	})
+	defer cancel()
+
+	err := wait.PollUntilContextTimeout(context.Background(), 20*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, k8sclient.CaddyConfigMapName, metav1.GetOptions{})
+		if err != nil {
+			return false, nil
+		}
+		return strings.Contains(cm.Data[k8sclient.CaddyJSONConfigKey], "service1.test-ns.svc.cluster.local:80"), nil
+	})
+	if err != nil {
+		t.Fatalf("Timed out waiting for JSON config in ConfigMap key %s", k8sclient.CaddyJSONConfigKey)
+	}
+
+	if admin.ContentType() != caddyadmin.ContentTypeJSON {
+		t.Errorf("Expected Content-Type %s, got: %s", caddyadmin.ContentTypeJSON, admin.ContentType())
+	}
+}
+
+func TestController_NamespaceSelector(t *testing.T) {
+	namespace := "proxy-ns"
+	clientset := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "tailscale-cluster-name", Namespace: "default"},
+			Data:       map[string]string{"CLUSTER_NAME": "foo"},
+		},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"export": "true"}}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b"}},
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "team-a"}},
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "team-b"}},
+	)
+	allowAllAccessReviews(clientset)
+
+	cancel := startController(t, clientset, controller.Options{
+		Namespace:         namespace,
+		NamespaceSelector: labels.SelectorFromSet(labels.Set{"export": "true"}),
+	})
+	defer cancel()
+
+	caddyConfig := waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, "api.team-a.svc.foo.remote")
+	})
+	if strings.Contains(caddyConfig, "team-b") {
+		t.Errorf("Expected Services of unselected namespace team-b to be ignored, got:\n%s", caddyConfig)
+	}
+
+	// Labelling team-b selects its Services too
+	teamB := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b", Labels: map[string]string{"export": "true"}}}
+	if _, err := clientset.CoreV1().Namespaces().Update(context.Background(), teamB, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update Namespace: %v", err)
+	}
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, "api.team-b.svc.foo.remote")
+	})
+}
+
+func TestController_AllNamespaces(t *testing.T) {
+	namespace := "proxy-ns"
+	clientset := fake.NewSimpleClientset(
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "team-a"}},
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "team-b"}},
+	)
+	allowAllAccessReviews(clientset)
+
+	cancel := startController(t, clientset, controller.Options{
+		Namespace:       namespace,
+		AllNamespaces:   true,
+		ClusterIdentity: clusteridentity.NewChain(true),
+	})
+	defer cancel()
+
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, "api.team-a.svc.default-cluster-name.remote") &&
+			strings.Contains(config, "api.team-b.svc.default-cluster-name.remote")
+	})
+}
+
+func TestController_ClusterDomain(t *testing.T) {
+	namespace := "test-ns"
+	resolvConf := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(resolvConf, []byte("search test-ns.svc.corp.example svc.corp.example corp.example\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write resolv.conf: %v", err)
+	}
+	clusterNameConfigMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "tailscale-cluster-name", Namespace: "default"},
+		Data:       map[string]string{"CLUSTER_NAME": "foo"},
+	}
+	clientset := fake.NewSimpleClientset(
+		clusterNameConfigMap,
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "service1", Namespace: namespace}},
+	)
+	allowAllAccessReviews(clientset)
+
+	cancel := startController(t, clientset, controller.Options{Namespace: namespace, ResolvConfPath: resolvConf})
+	defer cancel()
+
+	// Detected from resolv.conf
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, "reverse_proxy service1.test-ns.svc.corp.example")
+	})
+	waitForStatus(t, clientset, namespace, controller.StatusClusterDomainSourceKey, "resolv.conf")
+
+	// Overridden by the ConfigMap
+	clusterNameConfigMap.Data["CLUSTER_DOMAIN"] = "override.example"
+	if _, err := clientset.CoreV1().ConfigMaps("default").Update(context.Background(), clusterNameConfigMap, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update ConfigMap: %v", err)
+	}
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, "reverse_proxy service1.test-ns.svc.override.example")
+	})
+	waitForStatus(t, clientset, namespace, controller.StatusClusterDomainKey, "override.example")
+	waitForStatus(t, clientset, namespace, controller.StatusClusterDomainSourceKey, "configmap")
+}
+
+// waitForStatus waits until the status ConfigMap has value under key
+func waitForStatus(t *testing.T, clientset *fake.Clientset, namespace, key, value string) {
+	t.Helper()
+	var last string
+	err := wait.PollUntilContextTimeout(context.Background(), 20*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, controller.StatusConfigMapName, metav1.GetOptions{})
+		if err != nil {
+			return false, nil
+		}
+		last = cm.Data[key]
+		return last == value, nil
+	})
+	if err != nil {
+		t.Fatalf("Timed out waiting for status %s=%s, last seen: %q", key, value, last)
+	}
+}
+
+func TestController_RejectedRoutesStatus(t *testing.T) {
+	namespace := "test-ns"
+	clientset := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "tailscale-cluster-name", Namespace: "default"},
+			Data:       map[string]string{"CLUSTER_NAME": "prod.eu"},
+		},
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "service1", Namespace: namespace}},
+	)
+	allowAllAccessReviews(clientset)
+
+	cancel := startController(t, clientset, controller.Options{Namespace: namespace})
+	defer cancel()
+
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool { return config == "" })
+	waitForStatus(t, clientset, namespace, controller.StatusRejectedRoutesKey,
+		`test-ns/service1: cluster name "prod.eu" is not a valid DNS label: must not contain dots`)
+}
+
+func TestController_RefusesPlaceholderClusterName(t *testing.T) {
+	namespace := "test-ns"
+	clusterNameConfigMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "tailscale-cluster-name", Namespace: "default"},
+		Data:       map[string]string{"CLUSTER_NAME": "default-cluster-name"},
+	}
+	clientset := fake.NewSimpleClientset(
+		clusterNameConfigMap,
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "service1", Namespace: namespace}},
+	)
+	allowAllAccessReviews(clientset)
+
+	cancel := startController(t, clientset, controller.Options{Namespace: namespace})
+	defer cancel()
+
+	waitForStatus(t, clientset, namespace, controller.StatusErrorKey,
+		`cluster name from configmap is the placeholder "default-cluster-name", set a real cluster name or allow the placeholder`)
+	if _, err := clientset.CoreV1().ConfigMaps(namespace).Get(context.Background(), k8sclient.CaddyConfigMapName, metav1.GetOptions{}); err == nil {
+		t.Errorf("Expected no Caddy config to be published under the placeholder name")
+	}
+
+	// Naming the cluster unblocks publishing and clears the error
+	clusterNameConfigMap.Data["CLUSTER_NAME"] = "foo"
+	if _, err := clientset.CoreV1().ConfigMaps("default").Update(context.Background(), clusterNameConfigMap, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update ConfigMap: %v", err)
+	}
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, "service1.test-ns.svc.foo.remote")
+	})
+	waitForStatus(t, clientset, namespace, controller.StatusErrorKey, "")
+	waitForStatus(t, clientset, namespace, controller.StatusClusterNameSourceKey, "configmap")
+}
+
+func TestController_HeadlessPodRoutes(t *testing.T) {
+	namespace := "test-ns"
+	clientset := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "tailscale-cluster-name", Namespace: "default"},
+			Data:       map[string]string{"CLUSTER_NAME": "foo"},
+		},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: namespace},
+			Spec:       v1.ServiceSpec{ClusterIP: v1.ClusterIPNone},
+		},
+	)
+	allowAllAccessReviews(clientset)
+
+	cancel := startController(t, clientset, controller.Options{Namespace: namespace, HeadlessPodRoutes: true})
+	defer cancel()
+
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, "db.test-ns.svc.foo.remote")
+	})
+
+	// A StatefulSet pod becoming ready gets its own remote domain
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "db-abc",
+			Namespace: namespace,
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "db"},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints:   []discoveryv1.Endpoint{{Addresses: []string{"10.0.0.1"}, Hostname: ptr.To("db-0")}},
+	}
+	if _, err := clientset.DiscoveryV1().EndpointSlices(namespace).Create(context.Background(), slice, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create EndpointSlice: %v", err)
+	}
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, "db-0.db.test-ns.svc.foo.remote") &&
+			strings.Contains(config, "reverse_proxy db-0.db.test-ns.svc.cluster.local")
+	})
+
+	// Removing the pod removes its domain
+	if err := clientset.DiscoveryV1().EndpointSlices(namespace).Delete(context.Background(), slice.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("Failed to delete EndpointSlice: %v", err)
+	}
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return !strings.Contains(config, "db-0.db.test-ns.svc.foo.remote")
+	})
+}
+
+func TestController_SelectorLessServices(t *testing.T) {
+	namespace := "test-ns"
+	clientset := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "tailscale-cluster-name", Namespace: "default"},
+			Data:       map[string]string{"CLUSTER_NAME": "foo"},
+		},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: namespace},
+			Spec:       v1.ServiceSpec{Selector: map[string]string{"app": "app"}},
+		},
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "manual", Namespace: namespace}},
+	)
+	allowAllAccessReviews(clientset)
+
+	cancel := startController(t, clientset, controller.Options{
+		Namespace:     namespace,
+		BackendPolicy: generator.BackendPolicy{SelectorLess: generator.BackendPolicyEndpoints},
+	})
+	defer cancel()
+
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, "app.test-ns.svc.foo.remote")
+	})
+	waitForStatus(t, clientset, namespace, controller.StatusRejectedRoutesKey,
+		"test-ns/manual: selector-less Service has no ready endpoint in its EndpointSlices")
+
+	// A manual EndpointSlice publishes the Service
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "manual-1",
+			Namespace: namespace,
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "manual"},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints:   []discoveryv1.Endpoint{{Addresses: []string{"192.168.1.10"}}},
+	}
+	if _, err := clientset.DiscoveryV1().EndpointSlices(namespace).Create(context.Background(), slice, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create EndpointSlice: %v", err)
+	}
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, "manual.test-ns.svc.foo.remote")
+	})
+	waitForStatus(t, clientset, namespace, controller.StatusRejectedRoutesKey, "")
+}
+
+func TestController_OutboundPeers(t *testing.T) {
+	namespace := "test-ns"
+	clientset := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "tailscale-cluster-name", Namespace: "default"},
+			Data:       map[string]string{"CLUSTER_NAME": "foo"},
+		},
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "service1", Namespace: namespace}},
+	)
+	allowAllAccessReviews(clientset)
+
+	cancel := startController(t, clientset, controller.Options{
+		Namespace:        namespace,
+		Peers:            []string{"foo", "bar"},
+		OutboundProxyURL: "socks5://127.0.0.1:1055",
+	})
+	defer cancel()
+
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, "http://*.*.svc.bar.remote:2015, http://*.*.*.svc.bar.remote:2015 {") &&
+			strings.Contains(config, "forward_proxy_url socks5://127.0.0.1:1055") &&
+			!strings.Contains(config, "svc.foo.remote, *")
+	})
+	waitForStatus(t, clientset, namespace, controller.StatusOutboundPeersKey, "bar")
+}
+
+func TestController_UnbindableListener(t *testing.T) {
+	namespace := "test-ns"
+	// Hold the port of the TCP Service so its listener cannot bind
+	occupied, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer occupied.Close()
+	port := int32(occupied.Addr().(*net.TCPAddr).Port)
+
+	clientset := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "tailscale-cluster-name", Namespace: "default"},
+			Data:       map[string]string{"CLUSTER_NAME": "foo"},
+		},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: namespace},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 8080}}},
+		},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "db",
+				Namespace:   namespace,
+				Annotations: map[string]string{generator.AnnotationProtocol: "tcp"},
+			},
+			Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "postgres", Port: port}}},
+		},
+	)
+	allowAllAccessReviews(clientset)
+
+	cancel := startController(t, clientset, controller.Options{
+		Namespace:        namespace,
+		L4Forwarding:     true,
+		L4ListenHost:     "127.0.0.1",
+		AnnotateServices: true,
+	})
+	defer cancel()
+
+	// The HTTP Service is still published
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, "web.test-ns.svc.foo.remote")
+	})
+	reason := "layer-4 listener tcp/" + strconv.Itoa(int(port)) + " failed to start"
+	err = wait.PollUntilContextTimeout(context.Background(), 20*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, controller.StatusConfigMapName, metav1.GetOptions{})
+		return err == nil && strings.Contains(cm.Data[controller.StatusRejectedRoutesKey], "test-ns/db:postgres: "+reason), nil
+	})
+	if err != nil {
+		t.Fatalf("Timed out waiting for the failed listener to be reported in the status: %v", err)
+	}
+	waitForServiceAnnotations(t, clientset, namespace, "db", func(annotations map[string]string) bool {
+		return strings.Contains(annotations[controller.AnnotationWarning], reason)
+	})
+}
+
+func TestController_ClusterIdentityWatched(t *testing.T) {
+	namespace := "test-ns"
+	clientset := fake.NewSimpleClientset(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kube-system", UID: "6F1C2B9E-0A4D-4E51-9C3B-2D7A8E6F0B11"}},
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "service1", Namespace: namespace}},
+	)
+	clientset.Resources = []*metav1.APIResourceList{{
+		GroupVersion: clusteridentity.ClusterPropertyGVR.GroupVersion().String(),
+		APIResources: []metav1.APIResource{{Name: clusteridentity.ClusterPropertyGVR.Resource}},
+	}}
+	allowAllAccessReviews(clientset)
+	dynamicClient := newFakeDynamicClient()
+
+	chain, err := clusteridentity.NewChainFromSources(
+		[]string{clusteridentity.SourceClusterProperty, clusteridentity.SourceKubeSystemUID},
+		clusteridentity.Config{Clientset: clientset, DynamicClient: dynamicClient},
+	)
+	if err != nil {
+		t.Fatalf("Expected a valid chain, got: %v", err)
+	}
+	cancel := startController(t, clientset, controller.Options{Namespace: namespace, ClusterIdentity: chain})
+	defer cancel()
+
+	waitForStatus(t, clientset, namespace, controller.StatusClusterNameKey, "cluster-6f1c2b9e0a4d")
+	reads := countIdentityReads(clientset.Actions(), dynamicClient.Actions())
+
+	// Creating the ClusterProperty is picked up without any other change, from the informer cache
+	_, err = dynamicClient.Resource(clusteridentity.ClusterPropertyGVR).Create(context.Background(),
+		clusterProperty(clusteridentity.ClusterPropertyName, "from-clusterproperty"), metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create ClusterProperty: %v", err)
+	}
+	waitForStatus(t, clientset, namespace, controller.StatusClusterNameKey, "from-clusterproperty")
+	if after := countIdentityReads(clientset.Actions(), dynamicClient.Actions()); after != reads {
+		t.Errorf("Expected the cluster name sources to be read from the caches, got %d more reads", after-reads)
+	}
+}
+
+// countIdentityReads counts the GET requests for the kube-system Namespace and the ClusterProperty
+func countIdentityReads(actionLists ...[]k8stesting.Action) int {
+	reads := 0
+	for _, actions := range actionLists {
+		for _, action := range actions {
+			if action.GetVerb() == "get" && (action.GetResource().Resource == "namespaces" || action.GetResource() == clusteridentity.ClusterPropertyGVR) {
+				reads++
+			}
+		}
+	}
+	return reads
+}
@@ -0,0 +1,170 @@
+package test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/controller"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/coredns"
+)
+
+const testCorefile = `.:53 {
+    errors
+    health
+    kubernetes cluster.local in-addr.arpa ip6.arpa
+    forward . /etc/resolv.conf
+    reload
+}
+`
+
+var testStanzaOptions = coredns.StanzaOptions{
+	Zone:           "remote",
+	ProxyService:   "tailscale-proxy",
+	ProxyNamespace: "default",
+	ClusterDomain:  "cluster.local",
+}
+
+func TestRenderStanza(t *testing.T) {
+	stanza := coredns.RenderStanza(testStanzaOptions)
+
+	expected := `remote:53 {
+    errors
+    cache 30
+    rewrite stop name regex (.*)\.remote\.$ tailscale-proxy.default.svc.cluster.local. answer auto
+    forward . 127.0.0.1:53
+}
+`
+	if stanza != expected {
+		t.Errorf("Expected stanza:\n%s\nGot:\n%s", expected, stanza)
+	}
+	// The uninstall script locates the block inside the JSON encoding of the ConfigMap
+	if strings.Contains(stanza, `"`) {
+		t.Errorf("Expected no double quotes in the stanza, got:\n%s", stanza)
+	}
+}
+
+func TestMergeCorefile(t *testing.T) {
+	stanza := coredns.RenderStanza(testStanzaOptions)
+
+	merged := coredns.MergeCorefile(testCorefile, stanza)
+	if !strings.HasPrefix(merged, testCorefile) || !strings.Contains(merged, coredns.BeginMarker+"\n"+stanza+coredns.EndMarker+"\n") {
+		t.Errorf("Expected the managed block appended to the Corefile, got:\n%s", merged)
+	}
+
+	// The user edits the Corefile around the block, and inside it
+	edited := strings.Replace(merged, "    health\n", "    health\n    prometheus :9153\n", 1)
+	edited = strings.Replace(edited, "cache 30", "cache 300", 1)
+	edited += "example.org:53 {\n    forward . 10.0.0.53\n}\n"
+
+	remerged := coredns.MergeCorefile(edited, stanza)
+	if strings.Count(remerged, coredns.BeginMarker) != 1 {
+		t.Errorf("Expected exactly one managed block, got:\n%s", remerged)
+	}
+	if !strings.Contains(remerged, "prometheus :9153") || !strings.Contains(remerged, "example.org:53") {
+		t.Errorf("Expected edits outside the managed block to be kept, got:\n%s", remerged)
+	}
+	if strings.Contains(remerged, "cache 300") {
+		t.Errorf("Expected edits inside the managed block to be overwritten, got:\n%s", remerged)
+	}
+
+	cleaned, removed := coredns.RemoveManagedBlock(remerged)
+	if !removed {
+		t.Errorf("Expected the managed block to be removed")
+	}
+	expected := strings.Replace(testCorefile, "    health\n", "    health\n    prometheus :9153\n", 1) + "example.org:53 {\n    forward . 10.0.0.53\n}\n"
+	if cleaned != expected {
+		t.Errorf("Expected Corefile:\n%s\nGot:\n%s", expected, cleaned)
+	}
+
+	if _, removed := coredns.RemoveManagedBlock(testCorefile); removed {
+		t.Errorf("Expected nothing to remove from an unmanaged Corefile")
+	}
+}
+
+func TestCoreDNSManager_Corefile(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "coredns", Namespace: "kube-system"},
+		Data:       map[string]string{"Corefile": testCorefile, "NodeHosts": "10.0.0.1 node1"},
+	})
+	manager := coredns.NewManager(clientset, coredns.ModeCorefile, "")
+
+	if err := manager.Apply(context.Background(), testStanzaOptions); err != nil {
+		t.Fatalf("Expected Apply to succeed, got: %v", err)
+	}
+	cm, _ := clientset.CoreV1().ConfigMaps("kube-system").Get(context.Background(), "coredns", metav1.GetOptions{})
+	if !strings.Contains(cm.Data["Corefile"], "remote:53 {") || cm.Data["NodeHosts"] != "10.0.0.1 node1" {
+		t.Errorf("Expected the block added and other keys kept, got: %v", cm.Data)
+	}
+
+	if err := manager.Cleanup(context.Background()); err != nil {
+		t.Fatalf("Expected Cleanup to succeed, got: %v", err)
+	}
+	cm, _ = clientset.CoreV1().ConfigMaps("kube-system").Get(context.Background(), "coredns", metav1.GetOptions{})
+	if cm.Data["Corefile"] != testCorefile {
+		t.Errorf("Expected the original Corefile after cleanup, got:\n%s", cm.Data["Corefile"])
+	}
+}
+
+func TestCoreDNSManager_Custom(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	manager := coredns.NewManager(clientset, coredns.ModeCustom, "")
+
+	if err := manager.Apply(context.Background(), testStanzaOptions); err != nil {
+		t.Fatalf("Expected Apply to succeed, got: %v", err)
+	}
+	cm, err := clientset.CoreV1().ConfigMaps("kube-system").Get(context.Background(), "coredns-custom", metav1.GetOptions{})
+	if err != nil || cm.Data["cross-cluster.server"] != coredns.RenderStanza(testStanzaOptions) {
+		t.Fatalf("Expected coredns-custom to be created with the stanza, got: %v, %v", cm, err)
+	}
+
+	// A key added by the user survives the cleanup
+	cm.Data["user.server"] = "example.org:53 {\n}\n"
+	if _, err := clientset.CoreV1().ConfigMaps("kube-system").Update(context.Background(), cm, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update ConfigMap: %v", err)
+	}
+	if err := manager.Cleanup(context.Background()); err != nil {
+		t.Fatalf("Expected Cleanup to succeed, got: %v", err)
+	}
+	cm, _ = clientset.CoreV1().ConfigMaps("kube-system").Get(context.Background(), "coredns-custom", metav1.GetOptions{})
+	if _, exists := cm.Data["cross-cluster.server"]; exists || cm.Data["user.server"] == "" {
+		t.Errorf("Expected only the managed key removed, got: %v", cm.Data)
+	}
+
+	// Cleaning up in Corefile mode without a coredns ConfigMap is not an error
+	if err := coredns.NewManager(clientset, coredns.ModeCorefile, "").Cleanup(context.Background()); err != nil {
+		t.Errorf("Expected no error without a Corefile, got: %v", err)
+	}
+}
+
+func TestController_CoreDNS(t *testing.T) {
+	namespace := "test-ns"
+	clientset := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "tailscale-cluster-name", Namespace: "default"},
+			Data:       map[string]string{"CLUSTER_NAME": "foo"},
+		},
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "coredns", Namespace: "kube-system"},
+			Data:       map[string]string{"Corefile": testCorefile},
+		},
+	)
+	allowAllAccessReviews(clientset)
+
+	cancel := startController(t, clientset, controller.Options{
+		Namespace:        namespace,
+		ProxyServiceName: "tailscale-proxy",
+		CoreDNS:          coredns.NewManager(clientset, coredns.ModeCorefile, ""),
+	})
+	defer cancel()
+
+	waitForStatus(t, clientset, namespace, controller.StatusCoreDNSKey, "managed in kube-system/coredns:Corefile")
+	cm, _ := clientset.CoreV1().ConfigMaps("kube-system").Get(context.Background(), "coredns", metav1.GetOptions{})
+	if !strings.Contains(cm.Data["Corefile"], "tailscale-proxy.test-ns.svc.cluster.local. answer auto") {
+		t.Errorf("Expected the remote zone to point at the proxy Service, got:\n%s", cm.Data["Corefile"])
+	}
+}
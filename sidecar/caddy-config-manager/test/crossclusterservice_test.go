@@ -0,0 +1,194 @@
+package test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/apis/crosscluster/v1alpha1"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/controller"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/crossclusterservice"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+)
+
+func crossClusterService(namespace, name string, spec v1alpha1.CrossClusterServiceSpec) *v1alpha1.CrossClusterService {
+	return &v1alpha1.CrossClusterService{
+		TypeMeta:   metav1.TypeMeta{APIVersion: v1alpha1.SchemeGroupVersion.String(), Kind: "CrossClusterService"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec:       spec,
+	}
+}
+
+// toUnstructured converts a CrossClusterService for the fake dynamic client
+func toUnstructured(t *testing.T, resource *v1alpha1.CrossClusterService) *unstructured.Unstructured {
+	t.Helper()
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(resource)
+	if err != nil {
+		t.Fatalf("Failed to convert CrossClusterService: %v", err)
+	}
+	return &unstructured.Unstructured{Object: object}
+}
+
+func TestCrossClusterService_Apply(t *testing.T) {
+	services := &v1.ServiceList{Items: []v1.Service{{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "shop", Annotations: map[string]string{generator.AnnotationExport: "false"}},
+		Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+			{Name: "http", Port: 80},
+			{Name: "grpc", Port: 9000},
+		}},
+	}}}
+	older := crossClusterService("shop", "web", v1alpha1.CrossClusterServiceSpec{
+		Ports:       []string{"http", "metrics"},
+		Protocols:   map[string]string{"grpc": "quic", "http": "HTTP"},
+		ListenPorts: map[string]int32{"grpc": 70000},
+		Aliases:     []string{"Shop.Example.com.", "bad_alias"},
+	})
+	older.CreationTimestamp = metav1.NewTime(time.Unix(100, 0))
+	newer := crossClusterService("shop", "web-again", v1alpha1.CrossClusterServiceSpec{ServiceName: "web"})
+	newer.CreationTimestamp = metav1.NewTime(time.Unix(200, 0))
+	missing := crossClusterService("shop", "ghost", v1alpha1.CrossClusterServiceSpec{})
+
+	bindings := crossclusterservice.Apply(services, []*v1alpha1.CrossClusterService{newer, missing, older})
+
+	annotations := bindings.Services.Items[0].Annotations
+	expected := map[string]string{
+		generator.AnnotationExport:      "true",
+		generator.AnnotationExportPorts: "http",
+		generator.AnnotationProtocol:    "http=http",
+		generator.AnnotationListenPorts: "",
+		generator.AnnotationAliases:     "shop.example.com",
+	}
+	for key, value := range expected {
+		if annotations[key] != value {
+			t.Errorf("Expected annotation %s=%q, got: %q", key, value, annotations[key])
+		}
+	}
+	if services.Items[0].Annotations[generator.AnnotationExport] != "false" {
+		t.Errorf("Expected the original Service to be left untouched, got: %v", services.Items[0].Annotations)
+	}
+	if errs := bindings.Errors["shop/web"]; len(errs) != 4 {
+		t.Errorf("Expected 4 validation errors for shop/web, got: %v", errs)
+	}
+	if errs := bindings.Errors["shop/web-again"]; len(errs) != 1 || !strings.Contains(errs[0], "already exported by CrossClusterService shop/web") {
+		t.Errorf("Expected the newer CrossClusterService to be rejected, got: %v", errs)
+	}
+	if errs := bindings.Errors["shop/ghost"]; len(errs) != 1 || !strings.Contains(errs[0], "not found") {
+		t.Errorf("Expected a missing Service error, got: %v", errs)
+	}
+	if target := bindings.Targets["shop/web"]; target != "shop/web" {
+		t.Errorf("Expected shop/web to be bound to its Service, got: %q", target)
+	}
+}
+
+func TestCrossClusterService_Status(t *testing.T) {
+	resource := crossClusterService("shop", "web", v1alpha1.CrossClusterServiceSpec{})
+	resource.Generation = 3
+	input := crossclusterservice.StatusInput{
+		Bindings: crossclusterservice.Bindings{Targets: map[string]string{"shop/web": "shop/web"}},
+		Routes: []generator.ServiceRoute{
+			{RemoteDomain: "http.web.shop.svc.foo.remote", Upstream: "web.shop.svc.cluster.local:80", Namespace: "shop", ServiceName: "web", PortLabel: "http"},
+			{RemoteDomain: "web.shop.svc.foo.remote", Upstream: "web.shop.svc.cluster.local:8080", Namespace: "shop", ServiceName: "web"},
+			{RemoteDomain: "db.shop.svc.foo.remote", Namespace: "shop", ServiceName: "db"},
+		},
+		Revision: "abc123",
+	}
+
+	status := crossclusterservice.Status(resource, input)
+	if strings.Join(status.RemoteDomains, ",") != "http.web.shop.svc.foo.remote,web.shop.svc.foo.remote" {
+		t.Errorf("Expected the sorted domains of the Service, got: %v", status.RemoteDomains)
+	}
+	if status.Upstream != "web.shop.svc.cluster.local:8080" {
+		t.Errorf("Expected the service-level upstream, got: %q", status.Upstream)
+	}
+	ready := meta.FindStatusCondition(status.Conditions, v1alpha1.ConditionReady)
+	if status.ConfigRevision != "abc123" || status.ObservedGeneration != 3 || ready == nil || ready.Status != metav1.ConditionTrue {
+		t.Errorf("Expected a published status at generation 3, got: %+v", status)
+	}
+
+	// A rejected port is reported and keeps the resource from being ready
+	input.Rejections = []generator.RouteRejection{{Namespace: "shop", ServiceName: "web", PortName: "grpc", Port: 9000, Reason: "duplicate remote domain"}}
+	status = crossclusterservice.Status(resource, input)
+	ready = meta.FindStatusCondition(status.Conditions, v1alpha1.ConditionReady)
+	if len(status.ValidationErrors) != 1 || ready == nil || ready.Reason != v1alpha1.ReasonInvalid || status.ConfigRevision != "" {
+		t.Errorf("Expected the rejection to invalidate the status, got: %+v", status)
+	}
+}
+
+// waitForCrossClusterService waits until the status of a CrossClusterService satisfies the condition
+func waitForCrossClusterService(t *testing.T, client *dynamicfake.FakeDynamicClient, namespace, name string, condition func(*v1alpha1.CrossClusterService) bool) *v1alpha1.CrossClusterService {
+	t.Helper()
+	var last *v1alpha1.CrossClusterService
+	err := wait.PollUntilContextTimeout(context.Background(), 20*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		object, err := client.Resource(v1alpha1.CrossClusterServiceGVR).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, nil
+		}
+		if last, err = crossclusterservice.FromUnstructured(object); err != nil {
+			return false, nil
+		}
+		return condition(last), nil
+	})
+	if err != nil {
+		t.Fatalf("Timed out waiting for CrossClusterService %s/%s, last seen: %+v", namespace, name, last)
+	}
+	return last
+}
+
+func TestController_CrossClusterServices(t *testing.T) {
+	namespace := "test-ns"
+	clientset := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "tailscale-cluster-name", Namespace: "default"},
+			Data:       map[string]string{"CLUSTER_NAME": "foo"},
+		},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "service1", Namespace: namespace},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 8080}}},
+		},
+	)
+	allowAllAccessReviews(clientset)
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		v1alpha1.CrossClusterServiceGVR: "CrossClusterServiceList",
+	}, toUnstructured(t, crossClusterService(namespace, "service1", v1alpha1.CrossClusterServiceSpec{
+		Aliases: []string{"shop.example.com"},
+	})))
+
+	// In deny mode only the CrossClusterService exports service1
+	cancel := startController(t, clientset, controller.Options{
+		Namespace:            namespace,
+		ExportMode:           generator.ExportModeDeny,
+		CrossClusterServices: crossclusterservice.NewManager(client),
+	})
+	defer cancel()
+
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, "service1.test-ns.svc.foo.remote") && strings.Contains(config, "shop.example.com")
+	})
+	resource := waitForCrossClusterService(t, client, namespace, "service1", func(resource *v1alpha1.CrossClusterService) bool {
+		return meta.IsStatusConditionTrue(resource.Status.Conditions, v1alpha1.ConditionReady)
+	})
+	if resource.Status.ConfigRevision == "" || resource.Status.Upstream != "service1.test-ns.svc.cluster.local:8080" {
+		t.Errorf("Expected the revision and upstream in the status, got: %+v", resource.Status)
+	}
+
+	// An invalid spec is reported without blocking the valid options
+	_, err := client.Resource(v1alpha1.CrossClusterServiceGVR).Namespace(namespace).Create(context.Background(),
+		toUnstructured(t, crossClusterService(namespace, "missing", v1alpha1.CrossClusterServiceSpec{ServiceName: "nope"})), metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create CrossClusterService: %v", err)
+	}
+	waitForCrossClusterService(t, client, namespace, "missing", func(resource *v1alpha1.CrossClusterService) bool {
+		return len(resource.Status.ValidationErrors) == 1 && meta.IsStatusConditionFalse(resource.Status.Conditions, v1alpha1.ConditionReady)
+	})
+}
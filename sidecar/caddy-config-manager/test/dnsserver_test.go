@@ -0,0 +1,188 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/controller"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/dnsserver"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+)
+
+// newTestResolver returns a resolver sending every query to addr
+func newTestResolver(addr string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+func startDNSServer(t *testing.T) (*dnsserver.Server, *net.Resolver) {
+	t.Helper()
+	server := dnsserver.NewServer("remote")
+	if err := server.Start("127.0.0.1:0"); err != nil {
+		t.Fatalf("Failed to start DNS server: %v", err)
+	}
+	t.Cleanup(server.Close)
+	return server, newTestResolver(server.Addr().String())
+}
+
+func TestDNSServer(t *testing.T) {
+	server, resolver := startDNSServer(t)
+	ctx := context.Background()
+
+	serviceList := &v1.ServiceList{
+		Items: []v1.Service{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "test-ns"},
+				Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+					{Name: "http", Port: 8080},
+					{Name: "postgres", Port: 5432},
+				}},
+			},
+		},
+	}
+	routes := generator.GenerateServiceRoutes("foo", serviceList)
+	listeners := generator.GenerateL4Listeners(serviceList)
+	server.Update(dnsserver.BuildTable(routes, listeners, dnsserver.TableOptions{
+		ProxyAddresses: []net.IP{net.ParseIP("10.96.0.42"), net.ParseIP("fd00::42")},
+	}))
+
+	// A and AAAA records point at the proxy
+	for _, name := range []string{"api.test-ns.svc.foo.remote.", "http.api.test-ns.svc.foo.remote.", "5432.api.test-ns.svc.foo.remote."} {
+		addrs, err := resolver.LookupHost(ctx, name)
+		if err != nil {
+			t.Errorf("Expected %s to resolve, got: %v", name, err)
+			continue
+		}
+		sort.Strings(addrs)
+		if len(addrs) != 2 || addrs[0] != "10.96.0.42" || addrs[1] != "fd00::42" {
+			t.Errorf("Expected %s to resolve to the proxy addresses, got: %v", name, addrs)
+		}
+	}
+
+	// SRV records target the per-port domain on the proxy port serving it
+	_, srvs, err := resolver.LookupSRV(ctx, "http", "tcp", "api.test-ns.svc.foo.remote.")
+	if err != nil || len(srvs) != 1 || srvs[0].Target != "http.api.test-ns.svc.foo.remote." || srvs[0].Port != 80 {
+		t.Errorf("Expected SRV http.api.test-ns.svc.foo.remote.:80, got: %v, %v", srvs, err)
+	}
+	_, srvs, err = resolver.LookupSRV(ctx, "postgres", "tcp", "api.test-ns.svc.foo.remote.")
+	if err != nil || len(srvs) != 1 || srvs[0].Target != "postgres.api.test-ns.svc.foo.remote." || srvs[0].Port != 5432 {
+		t.Errorf("Expected SRV postgres.api.test-ns.svc.foo.remote.:5432, got: %v, %v", srvs, err)
+	}
+
+	// Unknown names in the zone do not exist
+	_, err = resolver.LookupHost(ctx, "missing.test-ns.svc.foo.remote.")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("Expected NXDOMAIN for an unknown name, got: %v", err)
+	}
+}
+
+func TestDNSServer_Peers(t *testing.T) {
+	server, resolver := startDNSServer(t)
+	// Static peers have outbound routes served by the local proxy, pods cannot reach the tailnet themselves
+	outbound := generator.GenerateOutboundRoutes(generator.OutboundOptions{LocalCluster: "foo", Peers: []string{"bar"}})
+	server.Update(dnsserver.BuildTable(nil, nil, dnsserver.TableOptions{
+		ProxyAddresses: []net.IP{net.ParseIP("10.96.0.42")},
+		Outbound:       outbound,
+	}))
+
+	for _, name := range []string{"api.test-ns.svc.bar.remote.", "http.api.test-ns.svc.bar.remote.", "db-0.db.test-ns.svc.bar.remote."} {
+		addrs, err := resolver.LookupHost(context.Background(), name)
+		if err != nil || len(addrs) != 1 || addrs[0] != "10.96.0.42" {
+			t.Errorf("Expected %s to resolve to the proxy, got: %v, %v", name, addrs, err)
+		}
+	}
+	if _, err := resolver.LookupHost(context.Background(), "api.test-ns.svc.baz.remote."); err == nil {
+		t.Errorf("Expected a peer without outbound route not to resolve")
+	}
+}
+
+func TestController_DNSServer(t *testing.T) {
+	namespace := "test-ns"
+	clientset := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "tailscale-cluster-name", Namespace: "default"},
+			Data:       map[string]string{"CLUSTER_NAME": "foo"},
+		},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "tailscale-proxy", Namespace: namespace},
+			Spec:       v1.ServiceSpec{ClusterIP: "10.96.0.42", ClusterIPs: []string{"10.96.0.42"}},
+		},
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "service1", Namespace: namespace}},
+	)
+	allowAllAccessReviews(clientset)
+
+	addr := "127.0.0.1:" + strconv.Itoa(int(freePort(t, "udp")))
+	cancel := startController(t, clientset, controller.Options{
+		Namespace:        namespace,
+		ProxyServiceName: "tailscale-proxy",
+		DNSListenAddress: addr,
+	})
+	defer cancel()
+
+	resolver := newTestResolver(addr)
+	var addrs []string
+	err := wait.PollUntilContextTimeout(context.Background(), 20*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		addrs, _ = resolver.LookupHost(ctx, "service1.test-ns.svc.foo.remote.")
+		return len(addrs) == 1 && addrs[0] == "10.96.0.42", nil
+	})
+	if err != nil {
+		t.Errorf("Expected service1.test-ns.svc.foo.remote to resolve to the proxy, last seen: %v", addrs)
+	}
+}
+
+func TestDNSServer_Aliases(t *testing.T) {
+	server, resolver := startDNSServer(t)
+	ctx := context.Background()
+
+	server.Update(dnsserver.BuildTable([]generator.ServiceRoute{{
+		RemoteDomain:  "payments.team-a.svc.foo.remote",
+		ServiceDomain: "payments.team-a.svc.foo.remote",
+		Protocol:      generator.ProtocolHTTP,
+		Aliases:       []string{"payments.prod.remote", "*.payments.prod.remote"},
+	}}, nil, dnsserver.TableOptions{ProxyAddresses: []net.IP{net.ParseIP("10.96.0.42")}}))
+
+	for _, name := range []string{"payments.prod.remote.", "eu.payments.prod.remote."} {
+		if addrs, err := resolver.LookupHost(ctx, name); err != nil || len(addrs) != 1 || addrs[0] != "10.96.0.42" {
+			t.Errorf("Expected %s to resolve to the proxy, got: %v, %v", name, addrs, err)
+		}
+	}
+	if _, err := resolver.LookupHost(ctx, "a.eu.payments.prod.remote."); err == nil {
+		t.Errorf("Expected the wildcard to cover a single label only")
+	}
+}
+
+func TestDNSServer_SerialFollowsRecords(t *testing.T) {
+	build := func(services ...string) *dnsserver.Table {
+		serviceList := &v1.ServiceList{}
+		for _, name := range services {
+			serviceList.Items = append(serviceList.Items, v1.Service{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "test-ns"}})
+		}
+		return dnsserver.BuildTable(generator.GenerateServiceRoutes("foo", serviceList), nil, dnsserver.TableOptions{
+			ProxyAddresses: []net.IP{net.ParseIP("10.96.0.42")},
+		})
+	}
+
+	// Rebuilding the same records keeps the serial, whatever the Service order
+	if first, again := build("api", "web"), build("web", "api"); first.Serial() != again.Serial() {
+		t.Errorf("Expected the same serial for the same records, got: %d and %d", first.Serial(), again.Serial())
+	}
+	if first, changed := build("api"), build("api", "web"); first.Serial() == changed.Serial() {
+		t.Errorf("Expected a new serial when the records change, got: %d", first.Serial())
+	}
+}
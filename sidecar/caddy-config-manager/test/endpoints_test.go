@@ -0,0 +1,229 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/controller"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+)
+
+// endpointSlice returns an EndpointSlice of a Service with one endpoint per address and a port named "http"
+func endpointSlice(namespace, name, serviceName string, ready bool, addresses ...string) *discoveryv1.EndpointSlice {
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    map[string]string{discoveryv1.LabelServiceName: serviceName},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Ports:       []discoveryv1.EndpointPort{{Name: ptr.To("http"), Port: ptr.To(int32(8080))}},
+	}
+	for _, address := range addresses {
+		slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{
+			Addresses:  []string{address},
+			Conditions: discoveryv1.EndpointConditions{Ready: ptr.To(ready)},
+		})
+	}
+	return slice
+}
+
+func TestServiceEndpointsFromEndpointSlices(t *testing.T) {
+	namespace := "test-ns"
+	serviceList := &v1.ServiceList{Items: []v1.Service{
+		{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: namespace}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "down", Namespace: namespace}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "empty", Namespace: namespace}},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "external", Namespace: namespace},
+			Spec:       v1.ServiceSpec{Type: v1.ServiceTypeExternalName, ExternalName: "example.com"},
+		},
+	}}
+	unnamed := endpointSlice(namespace, "web-unnamed", "web", true, "10.0.0.3")
+	unnamed.Ports = []discoveryv1.EndpointPort{
+		{Port: ptr.To(int32(9090))},
+		{Name: ptr.To("dns"), Port: ptr.To(int32(53)), Protocol: ptr.To(v1.ProtocolUDP)},
+	}
+	slices := []*discoveryv1.EndpointSlice{
+		endpointSlice(namespace, "web-1", "web", true, "10.0.0.2", "10.0.0.1"),
+		// The same endpoint seen in two slices during an update is listed once
+		endpointSlice(namespace, "web-2", "web", true, "10.0.0.1"),
+		endpointSlice(namespace, "web-3", "web", false, "10.0.0.9"),
+		unnamed,
+		endpointSlice(namespace, "down-1", "down", false, "10.0.1.1"),
+		endpointSlice(namespace, "orphan-1", "orphan", true, "10.0.2.1"),
+	}
+
+	endpoints := generator.ServiceEndpointsFromEndpointSlices(serviceList, slices)
+
+	expected := generator.ServiceEndpoints{
+		"test-ns/web": {Ready: true, Addresses: map[string][]string{
+			"http": {"10.0.0.1:8080", "10.0.0.2:8080"},
+			"":     {"10.0.0.3:9090"},
+		}},
+		"test-ns/down":  {Addresses: map[string][]string{}},
+		"test-ns/empty": {Addresses: map[string][]string{}},
+	}
+	if !reflect.DeepEqual(endpoints, expected) {
+		t.Errorf("Expected endpoints %+v, got: %+v", expected, endpoints)
+	}
+}
+
+func TestApplyServiceEndpoints(t *testing.T) {
+	routes := []generator.ServiceRoute{
+		{RemoteDomain: "web.test-ns.svc.foo.remote", Namespace: "test-ns", ServiceName: "web", Port: 8080, PortName: "http", Protocol: generator.ProtocolHTTP},
+		{RemoteDomain: "metrics.web.test-ns.svc.foo.remote", Namespace: "test-ns", ServiceName: "web", Port: 9090, PortName: "metrics", Protocol: generator.ProtocolHTTP},
+		{RemoteDomain: "down.test-ns.svc.foo.remote", Namespace: "test-ns", ServiceName: "down", Port: 80, Protocol: generator.ProtocolHTTP},
+		{RemoteDomain: "web-0.db.test-ns.svc.foo.remote", Namespace: "test-ns", ServiceName: "db", Pod: "web-0", Port: 5432, Protocol: generator.ProtocolHTTP},
+		{RemoteDomain: "dns.test-ns.svc.foo.remote", Namespace: "test-ns", ServiceName: "dns", Port: 53, Protocol: generator.ProtocolUDP},
+	}
+	endpoints := generator.ServiceEndpoints{
+		"test-ns/web":  {Ready: true, Addresses: map[string][]string{"http": {"10.0.0.1:8080", "10.0.0.2:8080"}}},
+		"test-ns/down": {Addresses: map[string][]string{}},
+		"test-ns/db":   {Addresses: map[string][]string{}},
+		"test-ns/dns":  {Addresses: map[string][]string{}},
+	}
+	siteOptions := map[string]generator.SiteOptions{
+		"web.test-ns.svc.foo.remote": {HostHeader: "web.example.com"},
+	}
+
+	generator.ApplyServiceEndpoints(siteOptions, routes, endpoints, generator.EndpointOptions{
+		ClusterName:  "foo",
+		PodUpstreams: true,
+		LBPolicy:     generator.LBPolicyLeastConn,
+	})
+
+	expected := map[string]generator.SiteOptions{
+		"web.test-ns.svc.foo.remote": {
+			HostHeader: "web.example.com",
+			Upstreams:  []string{"10.0.0.1:8080", "10.0.0.2:8080"},
+			LBPolicy:   generator.LBPolicyLeastConn,
+		},
+		"down.test-ns.svc.foo.remote": {Unavailable: "no ready endpoints for Service test-ns/down in cluster foo"},
+	}
+	if !reflect.DeepEqual(siteOptions, expected) {
+		t.Errorf("Expected site options %+v, got: %+v", expected, siteOptions)
+	}
+}
+
+func TestGenerateCaddyConfigWithOptions_Endpoints(t *testing.T) {
+	remoteDomains := []string{"down.test-ns.svc.foo.remote", "web.test-ns.svc.foo.remote"}
+	domainMapping := map[string]string{
+		"down.test-ns.svc.foo.remote": "down.test-ns.svc.cluster.local:80",
+		"web.test-ns.svc.foo.remote":  "web.test-ns.svc.cluster.local:8080",
+	}
+	siteOptions := map[string]generator.SiteOptions{
+		"down.test-ns.svc.foo.remote": {Unavailable: "no ready endpoints for Service test-ns/down in cluster foo"},
+		"web.test-ns.svc.foo.remote": {
+			Upstreams: []string{"10.0.0.1:8080", "10.0.0.2:8080"},
+			LBPolicy:  generator.LBPolicyRoundRobin,
+		},
+	}
+
+	config := generator.GenerateCaddyConfigWithOptions(remoteDomains, domainMapping, siteOptions)
+
+	expected := `http://down.test-ns.svc.foo.remote:2015 {
+    respond "no ready endpoints for Service test-ns/down in cluster foo" 503
+}
+http://web.test-ns.svc.foo.remote:2015 {
+    reverse_proxy 10.0.0.1:8080 10.0.0.2:8080 {
+        lb_policy round_robin
+    }
+}
+`
+	if config != expected {
+		t.Errorf("Expected config:\n%s\nGot:\n%s", expected, config)
+	}
+
+	data, err := generator.GenerateCaddyJSONConfigWithOptions(remoteDomains, domainMapping, siteOptions)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	var jsonConfig generator.CaddyJSONConfig
+	if err := json.Unmarshal(data, &jsonConfig); err != nil {
+		t.Fatalf("Generated config is not valid JSON: %v", err)
+	}
+	routes := jsonConfig.Apps.HTTP.Servers[generator.CaddyJSONServerName].Routes
+	if len(routes) != 2 {
+		t.Fatalf("Expected 2 routes, got: %d", len(routes))
+	}
+	unavailable := routes[0].Handle[0]
+	if unavailable.Handler != "static_response" || unavailable.StatusCode != 503 || !strings.Contains(unavailable.Body, "test-ns/down") {
+		t.Errorf("Expected a 503 static_response naming the Service, got: %+v", unavailable)
+	}
+	proxy := routes[1].Handle[0]
+	if len(proxy.Upstreams) != 2 || proxy.Upstreams[0].Dial != "10.0.0.1:8080" || proxy.Upstreams[1].Dial != "10.0.0.2:8080" {
+		t.Errorf("Expected the pod upstreams, got: %+v", proxy.Upstreams)
+	}
+	if proxy.LoadBalancing == nil || proxy.LoadBalancing.SelectionPolicy == nil || proxy.LoadBalancing.SelectionPolicy.Policy != generator.LBPolicyRoundRobin {
+		t.Errorf("Expected the round_robin selection policy, got: %+v", proxy.LoadBalancing)
+	}
+}
+
+func TestValidateLBPolicy(t *testing.T) {
+	for _, policy := range []string{"", generator.LBPolicyRoundRobin, generator.LBPolicyIPHash} {
+		if err := generator.ValidateLBPolicy(policy); err != nil {
+			t.Errorf("Expected policy %q to be valid, got: %v", policy, err)
+		}
+	}
+	if err := generator.ValidateLBPolicy("weighted"); err == nil {
+		t.Error("Expected an error for an unsupported policy")
+	}
+}
+
+func TestController_EndpointAware(t *testing.T) {
+	namespace := "test-ns"
+	clientset := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "tailscale-cluster-name", Namespace: "default"},
+			Data:       map[string]string{"CLUSTER_NAME": "foo"},
+		},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: namespace},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 8080}}},
+		},
+	)
+	allowAllAccessReviews(clientset)
+
+	cancel := startController(t, clientset, controller.Options{
+		Namespace:    namespace,
+		PodUpstreams: true,
+		LBPolicy:     generator.LBPolicyRoundRobin,
+	})
+	defer cancel()
+
+	// Without EndpointSlices the Service has no ready endpoint
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, `respond "no ready endpoints for Service test-ns/web in cluster foo" 503`)
+	})
+
+	slice := endpointSlice(namespace, "web-1", "web", true, "10.0.0.1")
+	if _, err := clientset.DiscoveryV1().EndpointSlices(namespace).Create(context.Background(), slice, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create EndpointSlice: %v", err)
+	}
+	config := waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, "reverse_proxy 10.0.0.1:8080 {")
+	})
+	if !strings.Contains(config, "lb_policy round_robin") || strings.Contains(config, "503") {
+		t.Errorf("Expected only pod upstreams with lb_policy round_robin, got:\n%s", config)
+	}
+
+	// An endpoint turning not ready brings the 503 back
+	slice.Endpoints[0].Conditions.Ready = ptr.To(false)
+	if _, err := clientset.DiscoveryV1().EndpointSlices(namespace).Update(context.Background(), slice, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update EndpointSlice: %v", err)
+	}
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, `respond "no ready endpoints for Service test-ns/web in cluster foo" 503`) &&
+			!strings.Contains(config, "10.0.0.1")
+	})
+}
@@ -0,0 +1,125 @@
+package test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/controller"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+)
+
+// waitForEvent waits until the fake recorder emits an Event containing all the parts, returning it
+func waitForEvent(t *testing.T, recorder *record.FakeRecorder, parts ...string) string {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-recorder.Events:
+			matches := true
+			for _, part := range parts {
+				matches = matches && strings.Contains(event, part)
+			}
+			if matches {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for an Event with %q", parts)
+			return ""
+		}
+	}
+}
+
+func TestController_Events(t *testing.T) {
+	namespace := "test-ns"
+	clientset := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "tailscale-cluster-name", Namespace: "default"},
+			Data:       map[string]string{"CLUSTER_NAME": "foo"},
+		},
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "service1", Namespace: namespace}},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "external", Namespace: namespace},
+			Spec:       v1.ServiceSpec{Type: v1.ServiceTypeExternalName, ExternalName: "example.com"},
+		},
+	)
+	allowAllAccessReviews(clientset)
+	recorder := record.NewFakeRecorder(100)
+	recorder.IncludeObject = true
+
+	cancel := startController(t, clientset, controller.Options{
+		Namespace:     namespace,
+		BackendPolicy: generator.BackendPolicy{ExternalName: generator.BackendPolicySkip},
+		EventRecorder: recorder,
+		PodName:       "manager-0",
+	})
+	defer cancel()
+
+	waitForEvent(t, recorder, "Warning "+controller.EventReasonExportSkipped, "external: ExternalName")
+	waitForEvent(t, recorder, "Normal "+controller.EventReasonPublished, "kind=ConfigMap")
+
+	// A reconcile with unchanged rejections records no new ExportSkipped Event
+	if _, err := clientset.CoreV1().Services(namespace).Create(context.Background(),
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "service2", Namespace: namespace}}, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create Service: %v", err)
+	}
+	waitForEvent(t, recorder, "Normal "+controller.EventReasonPublished)
+	select {
+	case event := <-recorder.Events:
+		if strings.Contains(event, controller.EventReasonExportSkipped) {
+			t.Errorf("Expected the skipped Service to be reported once, got: %s", event)
+		}
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestController_EventsClusterNameUnresolved(t *testing.T) {
+	namespace := "test-ns"
+	clientset := fake.NewSimpleClientset()
+	allowAllAccessReviews(clientset)
+	recorder := record.NewFakeRecorder(100)
+	recorder.IncludeObject = true
+
+	cancel := startController(t, clientset, controller.Options{
+		Namespace:     namespace,
+		EventRecorder: recorder,
+		PodName:       "manager-0",
+	})
+	defer cancel()
+
+	waitForEvent(t, recorder, "Warning "+controller.EventReasonClusterNameUnresolved, "kind=Pod")
+}
+
+func TestEventRecorder_Aggregation(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	recorder, stop := controller.NewEventRecorder(clientset)
+	defer stop()
+
+	ref := &v1.ObjectReference{APIVersion: "v1", Kind: "ConfigMap", Namespace: "test-ns", Name: "caddy-config"}
+	for i := 0; i < 100; i++ {
+		recorder.Event(ref, v1.EventTypeWarning, controller.EventReasonPublishFailed, "failed to update Caddy ConfigMap")
+	}
+
+	var events *v1.EventList
+	err := wait.PollUntilContextTimeout(context.Background(), 20*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		var err error
+		events, err = clientset.CoreV1().Events("test-ns").List(ctx, metav1.ListOptions{})
+		return err == nil && len(events.Items) == 1 && events.Items[0].Count > 1, nil
+	})
+	if err != nil {
+		t.Fatalf("Timed out waiting for an aggregated Event, last seen: %+v", events)
+	}
+	// Let the remaining Events be processed, the spam filter drops them
+	time.Sleep(200 * time.Millisecond)
+	events, err = clientset.CoreV1().Events("test-ns").List(context.Background(), metav1.ListOptions{})
+	if err != nil || len(events.Items) != 1 || events.Items[0].Count >= 100 {
+		t.Errorf("Expected one Event counting part of the repetitions, got: %+v (%v)", events, err)
+	}
+}
@@ -0,0 +1,207 @@
+package test
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/forwarder"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+)
+
+// freePort returns a port that is currently unused on 127.0.0.1 for the given network
+func freePort(t *testing.T, network string) int32 {
+	t.Helper()
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to find free UDP port: %v", err)
+		}
+		defer conn.Close()
+		return int32(conn.LocalAddr().(*net.UDPAddr).Port)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find free TCP port: %v", err)
+	}
+	defer ln.Close()
+	return int32(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// startTCPEcho starts a TCP server echoing every line back
+func startTCPEcho(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start TCP echo server: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln
+}
+
+// startUDPEcho starts a UDP server echoing every datagram back
+func startUDPEcho(t *testing.T) net.PacketConn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start UDP echo server: %v", err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+func TestForwarder_TCP(t *testing.T) {
+	echo := startTCPEcho(t)
+	defer echo.Close()
+
+	listenPort := freePort(t, "tcp")
+	fwd := forwarder.New("127.0.0.1")
+	defer fwd.Close()
+
+	err := fwd.Apply([]generator.L4Listener{{
+		ListenPort: listenPort,
+		Protocol:   generator.ProtocolTCP,
+		Upstream:   echo.Addr().String(),
+	}})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(listenPort))), time.Second)
+	if err != nil {
+		t.Fatalf("Failed to connect to listener: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := conn.Write([]byte("PING\n")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read echo: %v", err)
+	}
+	if line != "PING\n" {
+		t.Errorf("Expected PING echoed back, got: %q", line)
+	}
+}
+
+func TestForwarder_UDP(t *testing.T) {
+	echo := startUDPEcho(t)
+	defer echo.Close()
+
+	listenPort := freePort(t, "udp")
+	fwd := forwarder.New("127.0.0.1")
+	defer fwd.Close()
+
+	err := fwd.Apply([]generator.L4Listener{{
+		ListenPort: listenPort,
+		Protocol:   generator.ProtocolUDP,
+		Upstream:   echo.LocalAddr().String(),
+	}})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(listenPort))))
+	if err != nil {
+		t.Fatalf("Failed to dial listener: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := conn.Write([]byte("query")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read echo: %v", err)
+	}
+	if string(buf[:n]) != "query" {
+		t.Errorf("Expected query echoed back, got: %q", string(buf[:n]))
+	}
+}
+
+func TestForwarder_ApplyRemovesListener(t *testing.T) {
+	echo := startTCPEcho(t)
+	defer echo.Close()
+
+	listenPort := freePort(t, "tcp")
+	fwd := forwarder.New("127.0.0.1")
+	defer fwd.Close()
+
+	desired := []generator.L4Listener{{
+		ListenPort: listenPort,
+		Protocol:   generator.ProtocolTCP,
+		Upstream:   echo.Addr().String(),
+	}}
+	if err := fwd.Apply(desired); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	// Applying the same listeners again keeps the socket
+	if err := fwd.Apply(desired); err != nil {
+		t.Fatalf("Expected no error re-applying, got: %v", err)
+	}
+	if err := fwd.Apply(nil); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if _, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(listenPort))), time.Second); err == nil {
+		t.Errorf("Expected listener on port %d to be closed", listenPort)
+	}
+}
+
+func TestForwarder_ApplyReportsFailedListener(t *testing.T) {
+	echo := startTCPEcho(t)
+	defer echo.Close()
+
+	occupied, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer occupied.Close()
+	occupiedPort := int32(occupied.Addr().(*net.TCPAddr).Port)
+	listenPort := freePort(t, "tcp")
+	fwd := forwarder.New("127.0.0.1")
+	defer fwd.Close()
+
+	err = fwd.Apply([]generator.L4Listener{
+		{ListenPort: occupiedPort, Protocol: generator.ProtocolTCP, Upstream: echo.Addr().String(), Namespace: "test-ns", ServiceName: "db"},
+		{ListenPort: listenPort, Protocol: generator.ProtocolTCP, Upstream: echo.Addr().String(), Namespace: "test-ns", ServiceName: "cache"},
+	})
+	var applyErr *forwarder.ApplyError
+	if !errors.As(err, &applyErr) || len(applyErr.Failures) != 1 || applyErr.Failures[0].Listener.ServiceName != "db" {
+		t.Fatalf("Expected the listener of db to fail, got: %v", err)
+	}
+	// The other listener is still started
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(listenPort))), time.Second)
+	if err != nil {
+		t.Fatalf("Expected the listener of cache to be started, got: %v", err)
+	}
+	conn.Close()
+}
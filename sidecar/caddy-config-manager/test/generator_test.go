@@ -1,11 +1,17 @@
 package test
 
 import (
+	"encoding/json"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
 
 	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
 )
@@ -170,10 +176,10 @@ func TestGenerateCaddyConfig(t *testing.T) {
 
 	config := generator.GenerateCaddyConfig(remoteDomains, domainMapping)
 
-	expected := `service1.test-ns.svc.clusterwise.remote {
+	expected := `http://service1.test-ns.svc.clusterwise.remote:2015 {
     reverse_proxy service1.test-ns.svc.cluster.local
 }
-service2.test-ns.svc.clusterwise.remote {
+http://service2.test-ns.svc.clusterwise.remote:2015 {
     reverse_proxy service2.test-ns.svc.cluster.local
 }
 `
@@ -205,4 +211,1139 @@ func TestGenerateCaddyConfig_MissingMapping(t *testing.T) {
 	if config != "" {
 		t.Errorf("Expected empty config due to missing mapping, got: %s", config)
 	}
-}
\ No newline at end of file
+}
+
+func TestGenerateCaddyJSONConfig(t *testing.T) {
+	remoteDomains := []string{
+		"service1.test-ns.svc.clusterwise.remote",
+		"service2.test-ns.svc.clusterwise.remote",
+	}
+	domainMapping := map[string]string{
+		"service1.test-ns.svc.clusterwise.remote": "service1.test-ns.svc.cluster.local",
+		"service2.test-ns.svc.clusterwise.remote": "service2.test-ns.svc.cluster.local:8080",
+	}
+
+	data, err := generator.GenerateCaddyJSONConfig(remoteDomains, domainMapping)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	var config generator.CaddyJSONConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatalf("Generated config is not valid JSON: %v", err)
+	}
+
+	server, exists := config.Apps.HTTP.Servers[generator.CaddyJSONServerName]
+	if !exists {
+		t.Fatalf("Expected server %s, got: %v", generator.CaddyJSONServerName, config.Apps.HTTP.Servers)
+	}
+
+	// The Caddyfile serves its sites on the same plain HTTP port
+	listen := ":" + strconv.Itoa(generator.CaddyHTTPPort)
+	if len(server.Listen) != 1 || server.Listen[0] != listen || server.AutomaticHTTPS == nil || !server.AutomaticHTTPS.Disable {
+		t.Errorf("Expected plain HTTP on %s, got: %v %+v", listen, server.Listen, server.AutomaticHTTPS)
+	}
+
+	if len(server.Routes) != 2 {
+		t.Fatalf("Expected 2 routes, got: %d", len(server.Routes))
+	}
+
+	expectedDials := []string{"service1.test-ns.svc.cluster.local:80", "service2.test-ns.svc.cluster.local:8080"}
+	for i, route := range server.Routes {
+		if route.ID != remoteDomains[i] {
+			t.Errorf("Expected route @id %s, got: %s", remoteDomains[i], route.ID)
+		}
+		if len(route.Match) != 1 || len(route.Match[0].Host) != 1 || route.Match[0].Host[0] != remoteDomains[i] {
+			t.Errorf("Expected host matcher for %s, got: %v", remoteDomains[i], route.Match)
+		}
+		if len(route.Handle) != 1 || route.Handle[0].Handler != "reverse_proxy" {
+			t.Fatalf("Expected a single reverse_proxy handler, got: %v", route.Handle)
+		}
+		if dial := route.Handle[0].Upstreams[0].Dial; dial != expectedDials[i] {
+			t.Errorf("Expected upstream %s, got: %s", expectedDials[i], dial)
+		}
+	}
+}
+
+func TestGenerateCaddyJSONConfig_MissingMapping(t *testing.T) {
+	remoteDomains := []string{
+		"service1.test-ns.svc.clusterwise.remote",
+	}
+	domainMapping := map[string]string{} // Empty mapping
+
+	data, err := generator.GenerateCaddyJSONConfig(remoteDomains, domainMapping)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	var config generator.CaddyJSONConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatalf("Generated config is not valid JSON: %v", err)
+	}
+
+	if routes := config.Apps.HTTP.Servers[generator.CaddyJSONServerName].Routes; len(routes) != 0 {
+		t.Errorf("Expected no routes due to missing mapping, got: %v", routes)
+	}
+}
+
+func TestGenerateServiceRoutes_Ports(t *testing.T) {
+	serviceList := &v1.ServiceList{
+		Items: []v1.Service{
+			{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "api",
+					Namespace: "test-ns",
+				},
+				Spec: v1.ServiceSpec{
+					Ports: []v1.ServicePort{
+						{Name: "metrics", Port: 9090},
+						{Name: "http", Port: 8080},
+					},
+				},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "web",
+					Namespace: "test-ns",
+				},
+				Spec: v1.ServiceSpec{
+					Ports: []v1.ServicePort{
+						{Port: 3000},
+					},
+				},
+			},
+		},
+	}
+
+	routes := generator.GenerateServiceRoutes("foo", serviceList)
+
+	expected := map[string]string{
+		"api.test-ns.svc.foo.remote":         "api.test-ns.svc.cluster.local:8080",
+		"metrics.api.test-ns.svc.foo.remote": "api.test-ns.svc.cluster.local:9090",
+		"9090.api.test-ns.svc.foo.remote":    "api.test-ns.svc.cluster.local:9090",
+		"http.api.test-ns.svc.foo.remote":    "api.test-ns.svc.cluster.local:8080",
+		"8080.api.test-ns.svc.foo.remote":    "api.test-ns.svc.cluster.local:8080",
+		"web.test-ns.svc.foo.remote":         "web.test-ns.svc.cluster.local:3000",
+		"3000.web.test-ns.svc.foo.remote":    "web.test-ns.svc.cluster.local:3000",
+	}
+
+	if len(routes) != len(expected) {
+		t.Errorf("Expected %d routes, got: %d (%v)", len(expected), len(routes), routes)
+	}
+
+	for _, route := range routes {
+		upstream, exists := expected[route.RemoteDomain]
+		if !exists {
+			t.Errorf("Unexpected remote domain: %s", route.RemoteDomain)
+			continue
+		}
+		if route.Upstream != upstream {
+			t.Errorf("Expected mapping %s -> %s, got: %s", route.RemoteDomain, upstream, route.Upstream)
+		}
+	}
+}
+
+func TestGenerateServiceRoutes_DefaultPort80(t *testing.T) {
+	serviceList := &v1.ServiceList{
+		Items: []v1.Service{
+			{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "web",
+					Namespace: "test-ns",
+				},
+				Spec: v1.ServiceSpec{
+					Ports: []v1.ServicePort{
+						{Name: "admin", Port: 9000},
+						{Name: "web", Port: 80},
+					},
+				},
+			},
+		},
+	}
+
+	routes := generator.GenerateServiceRoutes("foo", serviceList)
+
+	if len(routes) == 0 || routes[0].RemoteDomain != "web.test-ns.svc.foo.remote" {
+		t.Fatalf("Expected service-level route first, got: %v", routes)
+	}
+	if routes[0].Upstream != "web.test-ns.svc.cluster.local:80" {
+		t.Errorf("Expected service-level route to target port 80, got: %s", routes[0].Upstream)
+	}
+}
+
+func TestGenerateCaddyConfig_Ports(t *testing.T) {
+	remoteDomains := []string{
+		"http.api.test-ns.svc.clusterwise.remote",
+	}
+	domainMapping := map[string]string{
+		"http.api.test-ns.svc.clusterwise.remote": "api.test-ns.svc.cluster.local:8080",
+	}
+
+	config := generator.GenerateCaddyConfig(remoteDomains, domainMapping)
+
+	expected := `http://http.api.test-ns.svc.clusterwise.remote:2015 {
+    reverse_proxy api.test-ns.svc.cluster.local:8080
+}
+`
+
+	if config != expected {
+		t.Errorf("Expected config:\n%s\nGot:\n%s", expected, config)
+	}
+}
+
+func TestClassifyServicePort(t *testing.T) {
+	ws := "kubernetes.io/ws"
+	h2c := "kubernetes.io/h2c"
+	mysql := "mysql"
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		port        v1.ServicePort
+		expected    string
+	}{
+		{name: "unnamed port 80", port: v1.ServicePort{Port: 80}, expected: generator.ProtocolHTTP},
+		{name: "unknown port defaults to http", port: v1.ServicePort{Port: 8081}, expected: generator.ProtocolHTTP},
+		{name: "udp port", port: v1.ServicePort{Port: 53, Protocol: v1.ProtocolUDP}, expected: generator.ProtocolUDP},
+		{name: "sctp port", port: v1.ServicePort{Port: 9999, Protocol: v1.ProtocolSCTP}, expected: ""},
+		{name: "http appProtocol", port: v1.ServicePort{Port: 5432, AppProtocol: &ws}, expected: generator.ProtocolHTTP},
+		{name: "h2c appProtocol", port: v1.ServicePort{Port: 8080, AppProtocol: &h2c}, expected: generator.ProtocolTCP},
+		{name: "https port name", port: v1.ServicePort{Name: "https", Port: 8443}, expected: generator.ProtocolTCP},
+		{name: "non-http appProtocol", port: v1.ServicePort{Port: 8080, AppProtocol: &mysql}, expected: generator.ProtocolTCP},
+		{name: "tcp port name", port: v1.ServicePort{Name: "tcp-kafka", Port: 8080}, expected: generator.ProtocolTCP},
+		{name: "redis port name", port: v1.ServicePort{Name: "redis", Port: 7000}, expected: generator.ProtocolTCP},
+		{name: "http port name", port: v1.ServicePort{Name: "http-metrics", Port: 5432}, expected: generator.ProtocolHTTP},
+		{name: "well-known port", port: v1.ServicePort{Port: 6379}, expected: generator.ProtocolTCP},
+		{
+			name:        "annotation for all ports",
+			annotations: map[string]string{generator.AnnotationProtocol: "tcp"},
+			port:        v1.ServicePort{Name: "http", Port: 80},
+			expected:    generator.ProtocolTCP,
+		},
+		{
+			name:        "per-port annotation by number",
+			annotations: map[string]string{generator.AnnotationProtocol: "9000=tcp,http=http"},
+			port:        v1.ServicePort{Name: "api", Port: 9000},
+			expected:    generator.ProtocolTCP,
+		},
+		{
+			name:        "annotation cannot turn udp into tcp",
+			annotations: map[string]string{generator.AnnotationProtocol: "tcp"},
+			port:        v1.ServicePort{Port: 53, Protocol: v1.ProtocolUDP},
+			expected:    generator.ProtocolUDP,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "svc", Namespace: "test-ns", Annotations: tt.annotations}}
+			if protocol := generator.ClassifyServicePort(service, tt.port); protocol != tt.expected {
+				t.Errorf("Expected protocol %q, got: %q", tt.expected, protocol)
+			}
+		})
+	}
+}
+
+func TestGenerateCrossClusterServiceDomains_SkipsL4Ports(t *testing.T) {
+	serviceList := &v1.ServiceList{
+		Items: []v1.Service{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "test-ns"},
+				Spec: v1.ServiceSpec{
+					Ports: []v1.ServicePort{{Name: "postgres", Port: 5432}},
+				},
+			},
+		},
+	}
+
+	remoteDomains, domainMapping := generator.GenerateCrossClusterServiceDomains(fake.NewSimpleClientset(), serviceList)
+
+	if len(remoteDomains) != 0 || len(domainMapping) != 0 {
+		t.Errorf("Expected no HTTP routes for a postgres port, got: %v", remoteDomains)
+	}
+}
+
+func TestGenerateL4Listeners(t *testing.T) {
+	serviceList := &v1.ServiceList{
+		Items: []v1.Service{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "db-b", Namespace: "test-ns"},
+				Spec: v1.ServiceSpec{
+					Ports: []v1.ServicePort{{Name: "postgres", Port: 5432}},
+				},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "db-a", Namespace: "test-ns"},
+				Spec: v1.ServiceSpec{
+					Ports: []v1.ServicePort{{Name: "postgres", Port: 5432}},
+				},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "db-c",
+					Namespace:   "test-ns",
+					Annotations: map[string]string{generator.AnnotationListenPorts: "postgres=15432"},
+				},
+				Spec: v1.ServiceSpec{
+					Ports: []v1.ServicePort{{Name: "postgres", Port: 5432}},
+				},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "dns", Namespace: "test-ns"},
+				Spec: v1.ServiceSpec{
+					Ports: []v1.ServicePort{
+						{Name: "dns", Port: 53, Protocol: v1.ProtocolUDP},
+						{Name: "dns-tcp", Port: 53, Protocol: v1.ProtocolTCP},
+						{Name: "http", Port: 8080},
+					},
+				},
+			},
+		},
+	}
+
+	listeners := generator.GenerateL4Listeners(serviceList)
+
+	expected := map[string]string{
+		"tcp/5432":  "db-a.test-ns.svc.cluster.local:5432",
+		"tcp/15432": "db-c.test-ns.svc.cluster.local:5432",
+		"udp/53":    "dns.test-ns.svc.cluster.local:53",
+		"tcp/53":    "dns.test-ns.svc.cluster.local:53",
+	}
+
+	if len(listeners) != len(expected) {
+		t.Errorf("Expected %d listeners, got: %d (%v)", len(expected), len(listeners), listeners)
+	}
+	for _, listener := range listeners {
+		if upstream, exists := expected[listener.Key()]; !exists || upstream != listener.Upstream {
+			t.Errorf("Unexpected listener %s -> %s", listener.Key(), listener.Upstream)
+		}
+	}
+}
+
+func TestGenerateL4Listeners_ReservedPorts(t *testing.T) {
+	serviceList := &v1.ServiceList{
+		Items: []v1.Service{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "dns", Namespace: "test-ns"},
+				Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "dns", Port: 53, Protocol: v1.ProtocolUDP}}},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "test-ns"},
+				Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "postgres", Port: 5432}}},
+			},
+		},
+	}
+
+	// The caller reserves the ports it is configured with, e.g. the embedded DNS server on :53
+	reserved := map[int32]bool{53: true}
+	listeners := generator.GenerateL4ListenersWithTemplates(generator.DefaultDomainTemplates(), reserved, serviceList)
+	if len(listeners) != 1 || listeners[0].Key() != "tcp/5432" {
+		t.Errorf("Expected only tcp/5432, got: %v", listeners)
+	}
+}
+
+func TestFilterExportedServices(t *testing.T) {
+	serviceList := &v1.ServiceList{
+		Items: []v1.Service{
+			{ObjectMeta: metav1.ObjectMeta{Name: "kubernetes", Namespace: "default"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "tailscale-proxy", Namespace: "default"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "plain", Namespace: "default"}},
+			{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "opted-out",
+					Namespace:   "default",
+					Annotations: map[string]string{generator.AnnotationExport: "false"},
+				},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "opted-in",
+					Namespace: "default",
+					Labels:    map[string]string{generator.AnnotationExport: "true"},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		mode     string
+		expected []string
+	}{
+		{mode: generator.ExportModeAllow, expected: []string{"plain", "opted-in"}},
+		{mode: generator.ExportModeDeny, expected: []string{"opted-in"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			policy := generator.ExportPolicy{Mode: tt.mode, ProxyNamespace: "default", ProxyServiceName: "tailscale-proxy"}
+			exported := generator.FilterExportedServices(serviceList, policy)
+
+			names := make([]string, 0, len(exported.Items))
+			for _, service := range exported.Items {
+				names = append(names, service.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("Expected exported Services %v, got: %v", tt.expected, names)
+			}
+		})
+	}
+}
+
+func TestFilterExportedServices_Ports(t *testing.T) {
+	serviceList := &v1.ServiceList{
+		Items: []v1.Service{
+			{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "api",
+					Namespace:   "test-ns",
+					Annotations: map[string]string{generator.AnnotationExportPorts: "http, 9090"},
+				},
+				Spec: v1.ServiceSpec{
+					Ports: []v1.ServicePort{
+						{Name: "http", Port: 8080},
+						{Name: "grpc", Port: 9000},
+						{Name: "metrics", Port: 9090},
+					},
+				},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "nothing",
+					Namespace:   "test-ns",
+					Annotations: map[string]string{generator.AnnotationExportPorts: "missing"},
+				},
+				Spec: v1.ServiceSpec{
+					Ports: []v1.ServicePort{{Name: "http", Port: 8080}},
+				},
+			},
+		},
+	}
+
+	exported := generator.FilterExportedServices(serviceList, generator.ExportPolicy{})
+
+	if len(exported.Items) != 1 {
+		t.Fatalf("Expected 1 exported Service, got: %d", len(exported.Items))
+	}
+	ports := exported.Items[0].Spec.Ports
+	if len(ports) != 2 || ports[0].Name != "http" || ports[1].Name != "metrics" {
+		t.Errorf("Expected ports http and metrics, got: %v", ports)
+	}
+	if len(serviceList.Items[0].Spec.Ports) != 3 {
+		t.Errorf("Expected input Service to keep its ports, got: %v", serviceList.Items[0].Spec.Ports)
+	}
+}
+
+func TestNewDomainTemplates_Invalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		remote   string
+		upstream string
+	}{
+		{name: "parse error", remote: "{{.Service", upstream: generator.DefaultUpstreamHostTemplate},
+		{name: "unknown field", remote: "{{.Unknown}}.remote", upstream: generator.DefaultUpstreamHostTemplate},
+		{name: "ignores port", remote: "{{.Service}}.{{.Namespace}}.{{.ClusterName}}.remote", upstream: generator.DefaultUpstreamHostTemplate},
+		{name: "ignores namespace", remote: "{{with .PortName}}{{.}}.{{end}}{{.Service}}.{{.ClusterName}}.remote", upstream: generator.DefaultUpstreamHostTemplate},
+		{name: "invalid domain", remote: "{{with .PortName}}{{.}}.{{end}}{{.Service}}_{{.Namespace}}.{{.ClusterName}}.remote", upstream: generator.DefaultUpstreamHostTemplate},
+		{name: "invalid upstream", remote: generator.DefaultRemoteDomainTemplate, upstream: "{{.Service}}..local"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := generator.NewDomainTemplates(tt.remote, tt.upstream); err == nil {
+				t.Errorf("Expected error for remote template %q and upstream template %q", tt.remote, tt.upstream)
+			}
+		})
+	}
+}
+
+func TestDomainTemplates_WithZone(t *testing.T) {
+	templates, err := generator.DefaultDomainTemplates().WithZone("Mesh.")
+	if err != nil {
+		t.Fatalf("Expected the default template to follow the zone, got: %v", err)
+	}
+	domain, err := templates.RemoteDomain(generator.DomainTemplateData{Service: "web", Namespace: "test-ns", ClusterName: "foo"})
+	if err != nil || domain != "web.test-ns.svc.foo.mesh" {
+		t.Errorf("Expected web.test-ns.svc.foo.mesh, got: %q (%v)", domain, err)
+	}
+
+	// A custom template hardcoding another suffix renders names nothing resolves
+	custom, err := generator.NewDomainTemplates("{{with .PortName}}{{.}}.{{end}}{{.Service}}.{{.Namespace}}.{{.ClusterName}}.remote", generator.DefaultUpstreamHostTemplate)
+	if err != nil {
+		t.Fatalf("Expected valid templates, got: %v", err)
+	}
+	if _, err := custom.WithZone("mesh"); err == nil {
+		t.Error("Expected an error for remote domains outside the zone")
+	}
+	if _, err := custom.WithZone("remote"); err != nil {
+		t.Errorf("Expected remote domains inside the zone to be accepted, got: %v", err)
+	}
+}
+
+func TestGenerateServiceRoutesWithTemplates(t *testing.T) {
+	templates, err := generator.NewDomainTemplates(
+		`{{with .PortName}}{{.}}-{{end}}{{.Service}}-{{.Namespace}}.{{or .Labels.team "shared"}}.{{.ClusterName}}.example`,
+		"{{.Service}}.{{.Namespace}}.svc.corp.internal",
+	)
+	if err != nil {
+		t.Fatalf("Expected valid templates, got: %v", err)
+	}
+
+	serviceList := &v1.ServiceList{
+		Items: []v1.Service{
+			{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "api",
+					Namespace: "test-ns",
+					Labels:    map[string]string{"team": "payments"},
+				},
+				Spec: v1.ServiceSpec{
+					Ports: []v1.ServicePort{{Name: "http", Port: 8080}},
+				},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "test-ns"},
+			},
+		},
+	}
+
+	_, domainMapping := generator.DomainMappingFromRoutes(generator.GenerateServiceRoutesWithTemplates(templates, "foo", serviceList))
+
+	expected := map[string]string{
+		"api-test-ns.payments.foo.example":      "api.test-ns.svc.corp.internal:8080",
+		"http-api-test-ns.payments.foo.example": "api.test-ns.svc.corp.internal:8080",
+		"8080-api-test-ns.payments.foo.example": "api.test-ns.svc.corp.internal:8080",
+		"web-test-ns.shared.foo.example":        "web.test-ns.svc.corp.internal",
+	}
+
+	if len(domainMapping) != len(expected) {
+		t.Errorf("Expected %d mappings, got: %v", len(expected), domainMapping)
+	}
+	for remoteDomain, upstream := range expected {
+		if domainMapping[remoteDomain] != upstream {
+			t.Errorf("Expected mapping %s -> %s, got: %s", remoteDomain, upstream, domainMapping[remoteDomain])
+		}
+	}
+}
+
+func TestGenerateServiceRouteTable_ClusterName(t *testing.T) {
+	serviceList := &v1.ServiceList{
+		Items: []v1.Service{
+			{ObjectMeta: metav1.ObjectMeta{Name: "service1", Namespace: "test-ns"}},
+		},
+	}
+
+	// Uppercase is lowered, DNS names are case-insensitive
+	routes, rejections := generator.GenerateServiceRouteTable(generator.DefaultDomainTemplates(), "Prod-EU", serviceList, nil)
+	if len(rejections) != 0 || len(routes) != 1 || routes[0].RemoteDomain != "service1.test-ns.svc.prod-eu.remote" {
+		t.Errorf("Expected route to service1.test-ns.svc.prod-eu.remote, got routes: %v, rejections: %v", routes, rejections)
+	}
+
+	// A dotted cluster name would be ambiguous, every Service is rejected
+	routes, rejections = generator.GenerateServiceRouteTable(generator.DefaultDomainTemplates(), "prod.eu", serviceList, nil)
+	if len(routes) != 0 {
+		t.Errorf("Expected no routes for a dotted cluster name, got: %v", routes)
+	}
+	if len(rejections) != 1 || !strings.Contains(rejections[0].String(), "test-ns/service1: cluster name \"prod.eu\"") {
+		t.Errorf("Expected service1 to be rejected for the cluster name, got: %v", rejections)
+	}
+}
+
+func TestGenerateServiceRouteTable_LabelTooLong(t *testing.T) {
+	templates, err := generator.NewDomainTemplates(
+		"{{with .PortName}}{{.}}-{{end}}{{.Service}}-{{.Namespace}}.{{.ClusterName}}.remote",
+		generator.DefaultUpstreamHostTemplate,
+	)
+	if err != nil {
+		t.Fatalf("Expected valid templates, got: %v", err)
+	}
+
+	longName := strings.Repeat("a", 40)
+	serviceList := &v1.ServiceList{
+		Items: []v1.Service{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: longName, Namespace: "test-ns"},
+				Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}}},
+			},
+		},
+	}
+
+	routes, rejections := generator.GenerateServiceRouteTable(templates, "foo", serviceList, nil)
+
+	// <service>-<namespace> is 48 characters, still below 63 with the "http-" prefix
+	if len(rejections) != 0 {
+		t.Errorf("Expected no rejections, got: %v", rejections)
+	}
+	if len(routes) != 3 {
+		t.Errorf("Expected 3 routes, got: %v", routes)
+	}
+
+	serviceList.Items[0].Namespace = strings.Repeat("b", 20)
+	routes, rejections = generator.GenerateServiceRouteTable(templates, "foo", serviceList, nil)
+	// 40 + 1 + 20 = 61 characters fits, adding "http-" or "80-" exceeds 63
+	if len(routes) != 1 || routes[0].RemoteDomain != longName+"-"+strings.Repeat("b", 20)+".foo.remote" {
+		t.Errorf("Expected only the service-level route, got: %v", routes)
+	}
+	if len(rejections) != 2 {
+		t.Errorf("Expected 2 rejections, got: %v", rejections)
+	}
+	for _, rejection := range rejections {
+		if !strings.Contains(rejection.Reason, "invalid remote domain") {
+			t.Errorf("Expected an invalid remote domain rejection, got: %s", rejection)
+		}
+	}
+}
+
+func TestGenerateServiceRouteTable_Conflicts(t *testing.T) {
+	// Services sharing the alias label collide on the same remote domain
+	templates, err := generator.NewDomainTemplates(
+		"{{with .PortName}}{{.}}.{{end}}{{or .Labels.alias .Service}}.{{.Namespace}}.svc.{{.ClusterName}}.remote",
+		generator.DefaultUpstreamHostTemplate,
+	)
+	if err != nil {
+		t.Fatalf("Expected valid templates, got: %v", err)
+	}
+
+	older := metav1.NewTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	newer := metav1.NewTime(older.Add(time.Hour))
+	serviceList := &v1.ServiceList{
+		Items: []v1.Service{
+			{ObjectMeta: metav1.ObjectMeta{Name: "a-new", Namespace: "test-ns", CreationTimestamp: newer, Labels: map[string]string{"alias": "api"}}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "z-old", Namespace: "test-ns", CreationTimestamp: older, Labels: map[string]string{"alias": "api"}}},
+		},
+	}
+
+	for _, items := range [][]v1.Service{serviceList.Items, {serviceList.Items[1], serviceList.Items[0]}} {
+		routes, rejections := generator.GenerateServiceRouteTable(templates, "foo", &v1.ServiceList{Items: items}, nil)
+
+		if len(routes) != 1 || routes[0].ServiceName != "z-old" {
+			t.Errorf("Expected the oldest Service to keep the domain, got: %v", routes)
+		}
+		expected := "test-ns/a-new api.test-ns.svc.foo.remote: remote domain already used by Service test-ns/z-old"
+		if len(rejections) != 1 || rejections[0].String() != expected {
+			t.Errorf("Expected rejection %q, got: %v", expected, rejections)
+		}
+	}
+}
+
+func TestGenerateServiceRouteTable_SameServiceConflicts(t *testing.T) {
+	// Rendering the port number for the port name too gives both routes of a port the same domain
+	templates, err := generator.NewDomainTemplates(
+		"{{with .PortName}}p{{$.Port}}.{{end}}{{.Service}}.{{.Namespace}}.svc.{{.ClusterName}}.remote",
+		generator.DefaultUpstreamHostTemplate,
+	)
+	if err != nil {
+		t.Fatalf("Expected valid templates, got: %v", err)
+	}
+	serviceList := &v1.ServiceList{
+		Items: []v1.Service{{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "api",
+				Namespace:   "test-ns",
+				Annotations: map[string]string{generator.AnnotationAliases: "p8080.api.test-ns.svc.foo.remote"},
+			},
+			Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 8080}}},
+		}},
+	}
+
+	routes, rejections := generator.GenerateServiceRouteTable(templates, "foo", serviceList, nil)
+
+	if len(routes) != 2 || routes[1].PortLabel != "http" {
+		t.Errorf("Expected the service-level route and the named port route, got: %v", routes)
+	}
+	expected := []string{
+		"test-ns/api:http p8080.api.test-ns.svc.foo.remote: remote domain already used by the route of port http of the same Service",
+		"test-ns/api p8080.api.test-ns.svc.foo.remote: alias already used by the route of port http of the same Service",
+	}
+	if len(rejections) != len(expected) {
+		t.Fatalf("Expected %d rejections, got: %v", len(expected), rejections)
+	}
+	for i, rejection := range rejections {
+		if rejection.String() != expected[i] {
+			t.Errorf("Expected rejection %q, got: %q", expected[i], rejection.String())
+		}
+	}
+}
+
+func TestGenerateServiceRouteTable_HeadlessPods(t *testing.T) {
+	serviceList := &v1.ServiceList{
+		Items: []v1.Service{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "test-ns"},
+				Spec: v1.ServiceSpec{
+					ClusterIP: v1.ClusterIPNone,
+					Ports:     []v1.ServicePort{{Name: "http", Port: 8080, Protocol: v1.ProtocolTCP}},
+				},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "test-ns"},
+				Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}}},
+			},
+		},
+	}
+	ready, notReady := true, false
+	slices := []*discoveryv1.EndpointSlice{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "db-abc", Namespace: "test-ns", Labels: map[string]string{discoveryv1.LabelServiceName: "db"}},
+			Endpoints: []discoveryv1.Endpoint{
+				{Hostname: ptr.To("db-1"), Conditions: discoveryv1.EndpointConditions{Ready: &ready}},
+				{Hostname: ptr.To("db-0")},
+				{Hostname: ptr.To("db-2"), Conditions: discoveryv1.EndpointConditions{Ready: &notReady}},
+				{Addresses: []string{"10.0.0.9"}},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "web-abc", Namespace: "test-ns", Labels: map[string]string{discoveryv1.LabelServiceName: "web"}},
+			Endpoints:  []discoveryv1.Endpoint{{Hostname: ptr.To("web-0")}},
+		},
+	}
+	pods := generator.PodHostnamesFromEndpointSlices(slices)
+	if hostnames := pods.Hostnames(&serviceList.Items[0]); len(hostnames) != 2 || hostnames[0] != "db-0" || hostnames[1] != "db-1" {
+		t.Errorf("Expected ready hostnames [db-0 db-1], got: %v", hostnames)
+	}
+
+	routes, rejections := generator.GenerateServiceRouteTable(generator.DefaultDomainTemplates(), "foo", serviceList, pods)
+	if len(rejections) != 0 {
+		t.Errorf("Expected no rejections, got: %v", rejections)
+	}
+
+	podRoutes := map[string]generator.ServiceRoute{}
+	for _, route := range routes {
+		if route.Pod != "" {
+			podRoutes[route.RemoteDomain] = route
+		}
+	}
+	if len(podRoutes) != 2 {
+		t.Fatalf("Expected 2 per-pod routes for the headless Service only, got: %v", podRoutes)
+	}
+	route, ok := podRoutes["db-0.db.test-ns.svc.foo.remote"]
+	if !ok {
+		t.Fatalf("Expected route for db-0.db.test-ns.svc.foo.remote, got: %v", podRoutes)
+	}
+	if route.Upstream != "db-0.db.test-ns.svc.cluster.local:8080" {
+		t.Errorf("Expected upstream db-0.db.test-ns.svc.cluster.local:8080, got: %s", route.Upstream)
+	}
+	if route.Pod != "db-0" || route.ServiceName != "db" {
+		t.Errorf("Expected pod db-0 of Service db, got: %s of %s", route.Pod, route.ServiceName)
+	}
+}
+
+func TestGenerateServiceRouteTable_HeadlessLayer4Ports(t *testing.T) {
+	serviceList := &v1.ServiceList{
+		Items: []v1.Service{{
+			ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "test-ns"},
+			Spec: v1.ServiceSpec{
+				ClusterIP: v1.ClusterIPNone,
+				Ports: []v1.ServicePort{
+					{Name: "postgres", Port: 5432, Protocol: v1.ProtocolTCP},
+					{Name: "metrics", Port: 9187, AppProtocol: ptr.To("http")},
+				},
+			},
+		}},
+	}
+	pods := generator.PodHostnames{"test-ns/db": {"db-0", "db-1"}}
+
+	routes, rejections := generator.GenerateServiceRouteTable(generator.DefaultDomainTemplates(), "foo", serviceList, pods)
+
+	// The service-level port is TCP, no pod gets a route but the pods are reported
+	for _, route := range routes {
+		if route.Pod != "" {
+			t.Errorf("Expected no per-pod route for a layer-4 port, got: %+v", route)
+		}
+	}
+	expected := "test-ns/db:postgres: TCP port of a headless Service is not routed per pod, pods db-0, db-1 are only reachable through the Service listener"
+	if len(rejections) != 1 || rejections[0].String() != expected {
+		t.Errorf("Expected rejection %q, got: %v", expected, rejections)
+	}
+}
+
+func TestGenerateServiceRoutes_ExternalName(t *testing.T) {
+	serviceList := &v1.ServiceList{
+		Items: []v1.Service{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "test-ns"},
+				Spec: v1.ServiceSpec{
+					Type:         v1.ServiceTypeExternalName,
+					ExternalName: "API.Example.com.",
+					Ports:        []v1.ServicePort{{Name: "http", Port: 8080}},
+				},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "legacy",
+					Namespace:   "test-ns",
+					Annotations: map[string]string{generator.AnnotationUpstreamHostHeader: "preserve"},
+				},
+				Spec: v1.ServiceSpec{Type: v1.ServiceTypeExternalName, ExternalName: "legacy.example.com"},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "web",
+					Namespace:   "test-ns",
+					Annotations: map[string]string{generator.AnnotationUpstreamHostHeader: "web.internal:8080"},
+				},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "broken", Namespace: "test-ns"},
+				Spec:       v1.ServiceSpec{Type: v1.ServiceTypeExternalName, ExternalName: "not a host"},
+			},
+		},
+	}
+
+	routes, rejections := generator.GenerateServiceRouteTable(generator.DefaultDomainTemplates(), "foo", serviceList, nil)
+
+	byDomain := make(map[string]generator.ServiceRoute)
+	for _, route := range routes {
+		byDomain[route.RemoteDomain] = route
+	}
+	expected := map[string][2]string{
+		"api.test-ns.svc.foo.remote":      {"api.example.com:8080", "api.example.com"},
+		"http.api.test-ns.svc.foo.remote": {"api.example.com:8080", "api.example.com"},
+		"legacy.test-ns.svc.foo.remote":   {"legacy.example.com", ""},
+		"web.test-ns.svc.foo.remote":      {"web.test-ns.svc.cluster.local", "web.internal:8080"},
+	}
+	for domain, want := range expected {
+		route, exists := byDomain[domain]
+		if !exists {
+			t.Errorf("Expected route for %s, got: %v", domain, routes)
+			continue
+		}
+		if route.Upstream != want[0] || route.HostHeader != want[1] {
+			t.Errorf("Expected %s -> %s with Host %q, got: %s with Host %q", domain, want[0], want[1], route.Upstream, route.HostHeader)
+		}
+	}
+	if len(rejections) != 1 || rejections[0].ServiceName != "broken" || !strings.Contains(rejections[0].Reason, "invalid externalName") {
+		t.Errorf("Expected the invalid externalName to be rejected, got: %v", rejections)
+	}
+}
+
+func TestFilterServiceBackends(t *testing.T) {
+	serviceList := &v1.ServiceList{
+		Items: []v1.Service{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "test-ns"},
+				Spec:       v1.ServiceSpec{Selector: map[string]string{"app": "app"}},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "test-ns"},
+				Spec:       v1.ServiceSpec{Type: v1.ServiceTypeExternalName, ExternalName: "api.example.com"},
+			},
+			{ObjectMeta: metav1.ObjectMeta{Name: "manual", Namespace: "test-ns"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "empty", Namespace: "test-ns"}},
+		},
+	}
+	notReady := false
+	ready := generator.ReadyServicesFromEndpointSlices([]*discoveryv1.EndpointSlice{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "manual-1", Namespace: "test-ns", Labels: map[string]string{discoveryv1.LabelServiceName: "manual"}},
+			Endpoints:  []discoveryv1.Endpoint{{Addresses: []string{"192.168.1.10"}}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "empty-1", Namespace: "test-ns", Labels: map[string]string{discoveryv1.LabelServiceName: "empty"}},
+			Endpoints:  []discoveryv1.Endpoint{{Addresses: []string{"192.168.1.11"}, Conditions: discoveryv1.EndpointConditions{Ready: &notReady}}},
+		},
+	})
+
+	tests := []struct {
+		policy   generator.BackendPolicy
+		expected []string
+		skipped  int
+	}{
+		{generator.BackendPolicy{}, []string{"app", "api", "manual", "empty"}, 0},
+		{generator.BackendPolicy{SelectorLess: generator.BackendPolicyEndpoints}, []string{"app", "api", "manual"}, 1},
+		{generator.BackendPolicy{ExternalName: generator.BackendPolicySkip, SelectorLess: generator.BackendPolicySkip}, []string{"app"}, 3},
+	}
+	for _, tt := range tests {
+		filtered, rejections := generator.FilterServiceBackends(serviceList, tt.policy, ready)
+		names := make([]string, 0, len(filtered.Items))
+		for _, service := range filtered.Items {
+			names = append(names, service.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(tt.expected, ",") {
+			t.Errorf("Policy %+v: expected Services %v, got: %v", tt.policy, tt.expected, names)
+		}
+		if len(rejections) != tt.skipped {
+			t.Errorf("Policy %+v: expected %d rejections, got: %v", tt.policy, tt.skipped, rejections)
+		}
+	}
+
+	if err := generator.ValidateBackendPolicy(generator.BackendPolicy{ExternalName: generator.BackendPolicyEndpoints}); err == nil {
+		t.Errorf("Expected the endpoints policy to be refused for ExternalName Services")
+	}
+}
+
+func TestGenerateCaddyConfigWithOptions(t *testing.T) {
+	remoteDomains := []string{"api.test-ns.svc.foo.remote", "web.test-ns.svc.foo.remote"}
+	domainMapping := map[string]string{
+		"api.test-ns.svc.foo.remote": "api.example.com:8080",
+		"web.test-ns.svc.foo.remote": "web.test-ns.svc.cluster.local",
+	}
+	siteOptions := map[string]generator.SiteOptions{
+		"api.test-ns.svc.foo.remote": {HostHeader: "api.example.com"},
+	}
+
+	config := generator.GenerateCaddyConfigWithOptions(remoteDomains, domainMapping, siteOptions)
+
+	expected := `http://api.test-ns.svc.foo.remote:2015 {
+    reverse_proxy api.example.com:8080 {
+        header_up Host api.example.com
+    }
+}
+http://web.test-ns.svc.foo.remote:2015 {
+    reverse_proxy web.test-ns.svc.cluster.local
+}
+`
+	if config != expected {
+		t.Errorf("Expected config:\n%s\nGot:\n%s", expected, config)
+	}
+
+	data, err := generator.GenerateCaddyJSONConfigWithOptions(remoteDomains, domainMapping, siteOptions)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	var jsonConfig generator.CaddyJSONConfig
+	if err := json.Unmarshal(data, &jsonConfig); err != nil {
+		t.Fatalf("Generated config is not valid JSON: %v", err)
+	}
+	routes := jsonConfig.Apps.HTTP.Servers[generator.CaddyJSONServerName].Routes
+	if headers := routes[0].Handle[0].Headers; headers == nil || headers.Request.Set["Host"][0] != "api.example.com" {
+		t.Errorf("Expected Host header api.example.com on the first route, got: %+v", headers)
+	}
+	if headers := routes[1].Handle[0].Headers; headers != nil {
+		t.Errorf("Expected no header manipulation on the second route, got: %+v", headers)
+	}
+}
+
+func TestGenerateServiceRouteTable_Aliases(t *testing.T) {
+	older := metav1.NewTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	newer := metav1.NewTime(older.Add(time.Hour))
+	serviceList := &v1.ServiceList{
+		Items: []v1.Service{
+			{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              "payments",
+					Namespace:         "team-a",
+					CreationTimestamp: older,
+					Annotations:       map[string]string{generator.AnnotationAliases: "Payments.prod.remote., *.payments.prod.remote, bad_alias.remote, *.remote"},
+				},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              "checkout",
+					Namespace:         "team-b",
+					CreationTimestamp: newer,
+					Annotations:       map[string]string{generator.AnnotationAliases: "payments.prod.remote, checkout.prod.remote, payments.team-a.svc.foo.remote"},
+				},
+			},
+		},
+	}
+
+	routes, rejections := generator.GenerateServiceRouteTable(generator.DefaultDomainTemplates(), "foo", serviceList, nil)
+
+	aliases := make(map[string][]string)
+	for _, route := range routes {
+		aliases[route.RemoteDomain] = route.Aliases
+	}
+	if got := strings.Join(aliases["payments.team-a.svc.foo.remote"], ","); got != "payments.prod.remote,*.payments.prod.remote" {
+		t.Errorf("Expected the valid aliases of payments, got: %s", got)
+	}
+	if got := strings.Join(aliases["checkout.team-b.svc.foo.remote"], ","); got != "checkout.prod.remote" {
+		t.Errorf("Expected checkout to keep only its unclaimed alias, got: %s", got)
+	}
+
+	expected := []string{
+		`team-a/payments bad_alias.remote: invalid alias: label "bad_alias" of "bad_alias.remote" is invalid`,
+		`team-a/payments *.remote: invalid alias: "*.remote" is a wildcard over a top-level domain`,
+		"team-b/checkout payments.prod.remote: alias already used by Service team-a/payments",
+		"team-b/checkout payments.team-a.svc.foo.remote: alias already used by Service team-a/payments",
+	}
+	if len(rejections) != len(expected) {
+		t.Fatalf("Expected %d rejections, got: %v", len(expected), rejections)
+	}
+	for i, prefix := range expected {
+		if !strings.HasPrefix(rejections[i].String(), prefix) {
+			t.Errorf("Expected rejection %q, got: %s", prefix, rejections[i])
+		}
+	}
+
+	remoteDomains, domainMapping := generator.DomainMappingFromRoutes(routes)
+	config := generator.GenerateCaddyConfigWithOptions(remoteDomains, domainMapping, generator.SiteOptionsFromRoutes(routes))
+	if !strings.Contains(config, "http://payments.team-a.svc.foo.remote:2015, http://payments.prod.remote:2015, http://*.payments.prod.remote:2015 {\n") {
+		t.Errorf("Expected the aliases in the site address list, got:\n%s", config)
+	}
+}
+
+func TestGenerateServiceRouteTable_WildcardAliases(t *testing.T) {
+	older := metav1.NewTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	newer := metav1.NewTime(older.Add(time.Hour))
+	serviceList := &v1.ServiceList{
+		Items: []v1.Service{
+			{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              "payments",
+					Namespace:         "team-a",
+					CreationTimestamp: older,
+					// The oldest Service cannot take the alias of a newer one through a wildcard
+					Annotations: map[string]string{generator.AnnotationAliases: "*.prod.remote, *.payments.prod.remote"},
+				},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              "checkout",
+					Namespace:         "team-b",
+					CreationTimestamp: newer,
+					Annotations:       map[string]string{generator.AnnotationAliases: "checkout.prod.remote, *.team-a.svc.foo.remote, *.svc.bar.remote"},
+				},
+			},
+		},
+	}
+
+	routes, rejections := generator.GenerateServiceRouteTable(generator.DefaultDomainTemplates(), "foo", serviceList, nil)
+
+	aliases := make(map[string][]string)
+	for _, route := range routes {
+		aliases[route.RemoteDomain] = route.Aliases
+	}
+	if got := strings.Join(aliases["payments.team-a.svc.foo.remote"], ","); got != "*.payments.prod.remote" {
+		t.Errorf("Expected payments to keep only its non-overlapping wildcard, got: %s", got)
+	}
+	if got := strings.Join(aliases["checkout.team-b.svc.foo.remote"], ","); got != "checkout.prod.remote" {
+		t.Errorf("Expected checkout to keep its exact alias, got: %s", got)
+	}
+	expected := []string{
+		"team-a/payments *.prod.remote: wildcard alias covers checkout.prod.remote of Service team-b/checkout",
+		"team-b/checkout *.team-a.svc.foo.remote: alias within the .svc.<cluster>.remote names",
+		"team-b/checkout *.svc.bar.remote: alias within the .svc.<cluster>.remote names",
+	}
+	if len(rejections) != len(expected) {
+		t.Fatalf("Expected %d rejections, got: %v", len(expected), rejections)
+	}
+	for i, prefix := range expected {
+		if !strings.HasPrefix(rejections[i].String(), prefix) {
+			t.Errorf("Expected rejection %q, got: %s", prefix, rejections[i])
+		}
+	}
+
+	// A wildcard alias covering a remote domain of another Service is rejected too
+	templates, err := generator.NewDomainTemplates("{{with .PortName}}{{.}}-{{end}}{{.Service}}.{{.Namespace}}.{{.ClusterName}}.example", generator.DefaultUpstreamHostTemplate)
+	if err != nil {
+		t.Fatalf("Expected valid templates, got: %v", err)
+	}
+	serviceList.Items[1].Annotations = map[string]string{generator.AnnotationAliases: "*.team-a.foo.example"}
+	_, rejections = generator.GenerateServiceRouteTable(templates, "foo", serviceList, nil)
+	found := false
+	for _, rejection := range rejections {
+		found = found || strings.HasPrefix(rejection.String(), "team-b/checkout *.team-a.foo.example: wildcard alias covers payments.team-a.foo.example of Service team-a/payments")
+	}
+	if !found {
+		t.Errorf("Expected the wildcard over the domain of payments to be rejected, got: %v", rejections)
+	}
+}
+
+func TestRejectPeerAliases(t *testing.T) {
+	routes := []generator.ServiceRoute{{
+		RemoteDomain: "web.test-ns.svc.foo.remote",
+		Namespace:    "test-ns",
+		ServiceName:  "web",
+		Aliases:      []string{"*.example.com", "web.example.org"},
+	}}
+	outbound := []generator.OutboundRoute{{Peer: "bar", Hosts: []string{"shop.example.com"}}}
+
+	rejections := generator.RejectPeerAliases(routes, outbound)
+
+	if len(rejections) != 1 || rejections[0].String() != "test-ns/web *.example.com: alias overlaps shop.example.com routed to peer bar" {
+		t.Errorf("Expected the wildcard over the peer host to be rejected, got: %v", rejections)
+	}
+	if got := strings.Join(routes[0].Aliases, ","); got != "web.example.org" {
+		t.Errorf("Expected the other alias to be kept, got: %s", got)
+	}
+}
+
+func TestGenerateCaddyJSONConfig_ExactHostsFirst(t *testing.T) {
+	remoteDomains := []string{"api.test-ns.svc.foo.remote", "web.test-ns.svc.foo.remote"}
+	domainMapping := map[string]string{
+		"api.test-ns.svc.foo.remote": "api.test-ns.svc.cluster.local",
+		"web.test-ns.svc.foo.remote": "web.test-ns.svc.cluster.local",
+	}
+	siteOptions := map[string]generator.SiteOptions{
+		"api.test-ns.svc.foo.remote": {Aliases: []string{"api.example.com", "*.api.example.com"}},
+	}
+
+	data, err := generator.GenerateCaddyJSONConfigWithOptions(remoteDomains, domainMapping, siteOptions)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	var jsonConfig generator.CaddyJSONConfig
+	if err := json.Unmarshal(data, &jsonConfig); err != nil {
+		t.Fatalf("Generated config is not valid JSON: %v", err)
+	}
+	routes := jsonConfig.Apps.HTTP.Servers[generator.CaddyJSONServerName].Routes
+	var order []string
+	for _, route := range routes {
+		order = append(order, route.ID+"="+strings.Join(route.Match[0].Host, ","))
+	}
+	expected := []string{
+		"api.test-ns.svc.foo.remote=api.test-ns.svc.foo.remote,api.example.com",
+		"web.test-ns.svc.foo.remote=web.test-ns.svc.foo.remote",
+		"api.test-ns.svc.foo.remote#wildcard=*.api.example.com",
+	}
+	if strings.Join(order, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected routes %v, got: %v", expected, order)
+	}
+}
+
+func TestGenerateOutboundRoutes(t *testing.T) {
+	routes := generator.GenerateOutboundRoutes(generator.OutboundOptions{
+		Peers:        []string{"Bar", "foo", "bad.name", "bar"},
+		LocalCluster: "foo",
+	})
+	if len(routes) != 1 {
+		t.Fatalf("Expected a single route to peer bar, got: %v", routes)
+	}
+	route := routes[0]
+	if route.Peer != "bar" || route.Upstream != "bar-tsgateway:2015" || route.ForwardProxyURL != generator.DefaultForwardProxyURL {
+		t.Errorf("Expected bar -> bar-tsgateway:2015 via %s, got: %+v", generator.DefaultForwardProxyURL, route)
+	}
+
+	remoteDomains := []string{"web.test-ns.svc.foo.remote"}
+	domainMapping := map[string]string{"web.test-ns.svc.foo.remote": "web.test-ns.svc.cluster.local"}
+	siteOptions := map[string]generator.SiteOptions{}
+	remoteDomains = generator.AppendOutboundSites(remoteDomains, domainMapping, siteOptions, routes)
+
+	config := generator.GenerateCaddyConfigWithOptions(remoteDomains, domainMapping, siteOptions)
+	expected := `http://web.test-ns.svc.foo.remote:2015 {
+    reverse_proxy web.test-ns.svc.cluster.local
+}
+http://*.*.svc.bar.remote:2015, http://*.*.*.svc.bar.remote:2015 {
+    reverse_proxy bar-tsgateway:2015 {
+        transport http {
+            forward_proxy_url http://127.0.0.1:1050
+        }
+    }
+}
+`
+	if config != expected {
+		t.Errorf("Expected config:\n%s\nGot:\n%s", expected, config)
+	}
+
+	data, err := generator.GenerateCaddyJSONConfigWithOptions(remoteDomains, domainMapping, siteOptions)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	var jsonConfig generator.CaddyJSONConfig
+	if err := json.Unmarshal(data, &jsonConfig); err != nil {
+		t.Fatalf("Generated config is not valid JSON: %v", err)
+	}
+	outbound := jsonConfig.Apps.HTTP.Servers[generator.CaddyJSONServerName].Routes[1]
+	if hosts := outbound.Match[0].Host; len(hosts) != 2 || hosts[1] != "*.*.*.svc.bar.remote" {
+		t.Errorf("Expected the peer wildcards in the host matcher, got: %v", hosts)
+	}
+	if transport := outbound.Handle[0].Transport; transport == nil || transport.ForwardProxyURL != generator.DefaultForwardProxyURL {
+		t.Errorf("Expected the forward proxy transport, got: %+v", transport)
+	}
+
+	if err := generator.ValidateForwardProxyURL("socks5://127.0.0.1:1055"); err != nil {
+		t.Errorf("Expected the SOCKS5 proxy to be valid, got: %v", err)
+	}
+	if err := generator.ValidateForwardProxyURL("ftp://127.0.0.1"); err == nil {
+		t.Errorf("Expected an ftp proxy to be refused")
+	}
+}
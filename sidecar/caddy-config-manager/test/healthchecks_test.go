@@ -0,0 +1,289 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/controller"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+)
+
+// probedPod returns a pod labeled app=<app> whose container serves port 8080 named "http" and is probed on path and port
+func probedPod(namespace, name, app, path string, port intstr.IntOrString) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: map[string]string{"app": app}},
+		Spec: v1.PodSpec{Containers: []v1.Container{{
+			Name: "app",
+			Ports: []v1.ContainerPort{
+				{Name: "http", ContainerPort: 8080},
+				{Name: "admin", ContainerPort: 8081},
+			},
+			ReadinessProbe: &v1.Probe{
+				ProbeHandler:     v1.ProbeHandler{HTTPGet: &v1.HTTPGetAction{Path: path, Port: port}},
+				PeriodSeconds:    5,
+				FailureThreshold: 2,
+			},
+		}}},
+	}
+}
+
+func TestServiceHealthChecks(t *testing.T) {
+	namespace := "test-ns"
+	serviceList := &v1.ServiceList{Items: []v1.Service{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: namespace},
+			Spec: v1.ServiceSpec{
+				Selector: map[string]string{"app": "web"},
+				Ports:    []v1.ServicePort{{Name: "http", Port: 80, TargetPort: intstr.FromString("http")}},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "admin", Namespace: namespace},
+			Spec: v1.ServiceSpec{
+				Selector: map[string]string{"app": "admin"},
+				Ports: []v1.ServicePort{
+					{Name: "http", Port: 80, TargetPort: intstr.FromInt32(8080)},
+					{Name: "admin", Port: 9000, TargetPort: intstr.FromString("admin")},
+				},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "headless", Namespace: namespace},
+			Spec: v1.ServiceSpec{
+				ClusterIP: v1.ClusterIPNone,
+				Selector:  map[string]string{"app": "web"},
+				Ports:     []v1.ServicePort{{Name: "http", Port: 80, TargetPort: intstr.FromString("http")}},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "annotated",
+				Namespace: namespace,
+				Annotations: map[string]string{
+					generator.AnnotationHealthCheckPath:   "/healthz",
+					generator.AnnotationHealthCheckStatus: "2XX",
+					generator.AnnotationMaxFails:          "4",
+					generator.AnnotationUnhealthyStatus:   "5xx, 429",
+					generator.AnnotationHealthCheckPort:   "not-a-port",
+				},
+			},
+			Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "disabled",
+				Namespace:   namespace,
+				Annotations: map[string]string{generator.AnnotationHealthCheck: "false"},
+			},
+			Spec: v1.ServiceSpec{
+				Selector: map[string]string{"app": "web"},
+				Ports:    []v1.ServicePort{{Name: "http", Port: 80, TargetPort: intstr.FromString("http")}},
+			},
+		},
+	}}
+	pods := []*v1.Pod{
+		probedPod(namespace, "web-1", "web", "/ready", intstr.FromString("http")),
+		probedPod(namespace, "admin-1", "admin", "/ready", intstr.FromString("admin")),
+	}
+
+	checks := generator.ServiceHealthChecks(serviceList, pods)
+
+	probeActive := generator.ActiveHealthCheck{Path: "/ready", Interval: 5 * time.Second, Timeout: time.Second, Fails: 2}
+	probePassive := generator.PassiveHealthCheck{FailDuration: 10 * time.Second, MaxFails: 2}
+	adminPodActive := probeActive
+	adminPodActive.Port = 8081
+	annotated := generator.HealthCheck{
+		Active:  generator.ActiveHealthCheck{Path: "/healthz", ExpectStatus: "2xx"},
+		Passive: generator.PassiveHealthCheck{FailDuration: generator.DefaultFailDuration, MaxFails: 4, UnhealthyStatus: []string{"5xx", "429"}},
+	}
+	expected := generator.HealthChecks{
+		// The probe of one pod does not describe the ClusterIP, only the pods are checked
+		"test-ns/web/80":     {Pod: generator.HealthCheck{Active: probeActive, Passive: probePassive}},
+		"test-ns/admin/80":   {Pod: generator.HealthCheck{Active: adminPodActive, Passive: probePassive}},
+		"test-ns/admin/9000": {Pod: generator.HealthCheck{Active: probeActive, Passive: probePassive}},
+		// The domain of a headless Service resolves to the pods
+		"test-ns/headless/80": {
+			Service: generator.HealthCheck{Active: probeActive, Passive: probePassive},
+			Pod:     generator.HealthCheck{Active: probeActive, Passive: probePassive},
+		},
+		"test-ns/annotated/80": {Service: annotated, Pod: annotated},
+	}
+	if !reflect.DeepEqual(checks, expected) {
+		t.Errorf("Expected health checks %+v, got: %+v", expected, checks)
+	}
+}
+
+func TestServiceHealthChecks_ServiceUpstream(t *testing.T) {
+	namespace := "test-ns"
+	serviceList := &v1.ServiceList{Items: []v1.Service{{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   namespace,
+			Annotations: map[string]string{generator.AnnotationMaxFails: "3"},
+		},
+		Spec: v1.ServiceSpec{
+			Selector: map[string]string{"app": "web"},
+			Ports:    []v1.ServicePort{{Name: "http", Port: 80, TargetPort: intstr.FromInt32(8080)}},
+		},
+	}}}
+	pods := []*v1.Pod{probedPod(namespace, "web-1", "web", "/ready", intstr.FromInt32(8081))}
+
+	check := generator.ServiceHealthChecks(serviceList, pods)["test-ns/web/80"]
+	// The Service upstream only gets what the annotations set, never the checks derived from the probe
+	expectedService := generator.HealthCheck{Passive: generator.PassiveHealthCheck{FailDuration: generator.DefaultFailDuration, MaxFails: 3}}
+	if !reflect.DeepEqual(check.Service, expectedService) {
+		t.Errorf("Expected only the annotated checks through the Service %+v, got: %+v", expectedService, check.Service)
+	}
+	if check.Pod.Active.Path != "/ready" || check.Pod.Active.Port != 8081 || check.Pod.Passive.FailDuration != 10*time.Second || check.Pod.Passive.MaxFails != 3 {
+		t.Errorf("Expected the derived checks of the pods on port 8081 with the annotated max fails, got: %+v", check.Pod)
+	}
+
+	routes := []generator.ServiceRoute{{RemoteDomain: "web.test-ns.svc.foo.remote", Namespace: namespace, ServiceName: "web", Port: 80, PortName: "http", Protocol: generator.ProtocolHTTP}}
+	siteOptions := map[string]generator.SiteOptions{}
+	generator.ApplyHealthChecks(siteOptions, routes, generator.HealthChecks{"test-ns/web/80": check})
+	if !reflect.DeepEqual(siteOptions["web.test-ns.svc.foo.remote"].HealthCheck, check.Service) {
+		t.Errorf("Expected the Service health check on the Service upstream, got: %+v", siteOptions)
+	}
+	siteOptions = map[string]generator.SiteOptions{"web.test-ns.svc.foo.remote": {Upstreams: []string{"10.0.0.1:8080"}}}
+	generator.ApplyHealthChecks(siteOptions, routes, generator.HealthChecks{"test-ns/web/80": check})
+	if !reflect.DeepEqual(siteOptions["web.test-ns.svc.foo.remote"].HealthCheck, check.Pod) {
+		t.Errorf("Expected the pod health check on pod upstreams, got: %+v", siteOptions)
+	}
+}
+
+func TestGenerateCaddyConfigWithOptions_HealthChecks(t *testing.T) {
+	remoteDomains := []string{"web.test-ns.svc.foo.remote"}
+	domainMapping := map[string]string{"web.test-ns.svc.foo.remote": "web.test-ns.svc.cluster.local:80"}
+	siteOptions := map[string]generator.SiteOptions{
+		"web.test-ns.svc.foo.remote": {HealthCheck: generator.HealthCheck{
+			Active: generator.ActiveHealthCheck{
+				Path:         "/ready",
+				Port:         9000,
+				Interval:     5 * time.Second,
+				Timeout:      time.Second,
+				ExpectStatus: "2xx",
+				Fails:        2,
+			},
+			Passive: generator.PassiveHealthCheck{FailDuration: 10 * time.Second, MaxFails: 2, UnhealthyStatus: []string{"5xx", "429"}},
+		}},
+	}
+
+	config := generator.GenerateCaddyConfigWithOptions(remoteDomains, domainMapping, siteOptions)
+
+	expected := `http://web.test-ns.svc.foo.remote:2015 {
+    reverse_proxy web.test-ns.svc.cluster.local:80 {
+        health_uri /ready
+        health_port 9000
+        health_interval 5s
+        health_timeout 1s
+        health_status 2xx
+        health_fails 2
+        fail_duration 10s
+        max_fails 2
+        unhealthy_status 5xx 429
+    }
+}
+`
+	if config != expected {
+		t.Errorf("Expected config:\n%s\nGot:\n%s", expected, config)
+	}
+
+	data, err := generator.GenerateCaddyJSONConfigWithOptions(remoteDomains, domainMapping, siteOptions)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	var jsonConfig generator.CaddyJSONConfig
+	if err := json.Unmarshal(data, &jsonConfig); err != nil {
+		t.Fatalf("Generated config is not valid JSON: %v", err)
+	}
+	healthChecks := jsonConfig.Apps.HTTP.Servers[generator.CaddyJSONServerName].Routes[0].Handle[0].HealthChecks
+	expectedJSON := &generator.CaddyJSONHealthChecks{
+		Active: &generator.CaddyJSONActiveHealthChecks{
+			URI:          "/ready",
+			Port:         9000,
+			Interval:     "5s",
+			Timeout:      "1s",
+			ExpectStatus: 2,
+			Fails:        2,
+		},
+		Passive: &generator.CaddyJSONPassiveHealthChecks{FailDuration: "10s", MaxFails: 2, UnhealthyStatus: []int{5, 429}},
+	}
+	if !reflect.DeepEqual(healthChecks, expectedJSON) {
+		t.Errorf("Expected health checks %+v, got: %+v", expectedJSON, healthChecks)
+	}
+}
+
+func TestValidateHTTPStatus(t *testing.T) {
+	for _, status := range []string{"200", "503", "2xx", "5XX"} {
+		if err := generator.ValidateHTTPStatus(status); err != nil {
+			t.Errorf("Expected status %q to be valid, got: %v", status, err)
+		}
+	}
+	for _, status := range []string{"", "20", "600", "6xx", "abc"} {
+		if err := generator.ValidateHTTPStatus(status); err == nil {
+			t.Errorf("Expected an error for status %q", status)
+		}
+	}
+}
+
+func TestController_ProbeHealthChecks(t *testing.T) {
+	namespace := "test-ns"
+	clientset := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "tailscale-cluster-name", Namespace: "default"},
+			Data:       map[string]string{"CLUSTER_NAME": "foo"},
+		},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: namespace},
+			Spec: v1.ServiceSpec{
+				ClusterIP: v1.ClusterIPNone,
+				Selector:  map[string]string{"app": "web"},
+				Ports:     []v1.ServicePort{{Port: 8080}},
+			},
+		},
+	)
+	allowAllAccessReviews(clientset)
+
+	cancel := startController(t, clientset, controller.Options{
+		Namespace:         namespace,
+		ProbeHealthChecks: true,
+	})
+	defer cancel()
+
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, "reverse_proxy web.test-ns.svc.cluster.local:8080\n")
+	})
+
+	pod := probedPod(namespace, "web-1", "web", "/ready", intstr.FromString("http"))
+	if _, err := clientset.CoreV1().Pods(namespace).Create(context.Background(), pod, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create Pod: %v", err)
+	}
+	config := waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, "health_uri /ready")
+	})
+	if !strings.Contains(config, "health_interval 5s") || !strings.Contains(config, "max_fails 2") {
+		t.Errorf("Expected the health checks derived from the readinessProbe, got:\n%s", config)
+	}
+
+	// The annotations override the derived values
+	service, err := clientset.CoreV1().Services(namespace).Get(context.Background(), "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get Service: %v", err)
+	}
+	service.Annotations = map[string]string{generator.AnnotationHealthCheckPath: "/healthz"}
+	if _, err := clientset.CoreV1().Services(namespace).Update(context.Background(), service, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update Service: %v", err)
+	}
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, "health_uri /healthz") && strings.Contains(config, "health_interval 5s")
+	})
+}
@@ -0,0 +1,251 @@
+package test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/catalog"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/controller"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/mcs"
+)
+
+// newMCSClient returns a fake dynamic client serving the MCS resources
+func newMCSClient(objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		mcs.ServiceExportGVR: "ServiceExportList",
+		mcs.ServiceImportGVR: "ServiceImportList",
+	}, objects...)
+}
+
+func serviceExport(namespace, name string) *unstructured.Unstructured {
+	export := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": mcs.ServiceExportGVR.GroupVersion().String(),
+		"kind":       "ServiceExport",
+	}}
+	export.SetNamespace(namespace)
+	export.SetName(name)
+	return export
+}
+
+// waitForExportCondition waits until a condition of a ServiceExport has the expected status and reason
+func waitForExportCondition(t *testing.T, client *dynamicfake.FakeDynamicClient, namespace, name, conditionType string, status metav1.ConditionStatus, reason string) {
+	t.Helper()
+	var last *metav1.Condition
+	err := wait.PollUntilContextTimeout(context.Background(), 20*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		export, err := client.Resource(mcs.ServiceExportGVR).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, nil
+		}
+		values, _, _ := unstructured.NestedSlice(export.Object, "status", "conditions")
+		conditions := make([]metav1.Condition, 0, len(values))
+		for _, value := range values {
+			var condition metav1.Condition
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(value.(map[string]interface{}), &condition); err == nil {
+				conditions = append(conditions, condition)
+			}
+		}
+		last = meta.FindStatusCondition(conditions, conditionType)
+		return last != nil && last.Status == status && last.Reason == reason, nil
+	})
+	if err != nil {
+		t.Fatalf("Timed out waiting for ServiceExport %s/%s condition %s=%s (%s), last seen: %+v", namespace, name, conditionType, status, reason, last)
+	}
+}
+
+func TestMCS_ExportConditions(t *testing.T) {
+	services := &v1.ServiceList{Items: []v1.Service{
+		{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "shop"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "shop"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "tailscale-proxy", Namespace: "default"}},
+	}}
+	result := mcs.ExportResult{
+		Services: services,
+		Routes:   []generator.ServiceRoute{{RemoteDomain: "web.shop.svc.foo.remote", Namespace: "shop", ServiceName: "web", Protocol: generator.ProtocolHTTP}},
+		Rejections: []generator.RouteRejection{
+			{Namespace: "shop", ServiceName: "db", Reason: "no ready endpoints"},
+		},
+		Policy:    generator.ExportPolicy{ProxyNamespace: "default", ProxyServiceName: "tailscale-proxy", Exports: map[string]bool{}},
+		Published: true,
+	}
+
+	tests := []struct {
+		namespace, name string
+		validStatus     metav1.ConditionStatus
+		validReason     string
+		readyStatus     metav1.ConditionStatus
+	}{
+		{"shop", "web", metav1.ConditionTrue, mcs.ReasonExported, metav1.ConditionTrue},
+		{"shop", "db", metav1.ConditionFalse, mcs.ReasonRejected, metav1.ConditionFalse},
+		{"shop", "ghost", metav1.ConditionFalse, mcs.ReasonNoService, metav1.ConditionFalse},
+		{"default", "tailscale-proxy", metav1.ConditionFalse, mcs.ReasonNotExportable, metav1.ConditionFalse},
+	}
+	for _, tt := range tests {
+		result.Policy.Exports[tt.namespace+"/"+tt.name] = true
+		conditions := mcs.ExportConditions(serviceExport(tt.namespace, tt.name), result)
+		valid := meta.FindStatusCondition(conditions, mcs.ConditionValid)
+		ready := meta.FindStatusCondition(conditions, mcs.ConditionReady)
+		if valid == nil || ready == nil {
+			t.Fatalf("%s/%s: expected Valid and Ready conditions, got: %+v", tt.namespace, tt.name, conditions)
+		}
+		if valid.Status != tt.validStatus || valid.Reason != tt.validReason || ready.Status != tt.readyStatus {
+			t.Errorf("%s/%s: expected Valid=%s (%s) Ready=%s, got: %+v", tt.namespace, tt.name, tt.validStatus, tt.validReason, tt.readyStatus, conditions)
+		}
+	}
+	if conditions := mcs.ExportConditions(serviceExport("shop", "db"), result); !strings.Contains(conditions[0].Message, "no ready endpoints") {
+		t.Errorf("Expected the rejection reason in the message, got: %q", conditions[0].Message)
+	}
+}
+
+func TestMCS_ImportSites(t *testing.T) {
+	local := peerCatalog("foo", "web.shop.svc.foo.remote")
+	local.Services[0].Namespace, local.Services[0].Name = "shop", "web"
+	bar := peerCatalog("bar", "web.shop.svc.bar.remote", "api.shop.svc.bar.remote")
+	bar.Services[0].Namespace, bar.Services[0].Name = "shop", "web"
+	bar.Services[1].Namespace, bar.Services[1].Name = "shop", "api"
+	other := peerCatalog("baz", "web.other.svc.baz.remote")
+	other.Services[0].Namespace, other.Services[0].Name = "other", "web"
+
+	imports := mcs.DesiredImports(local, map[string]*catalog.Catalog{"bar": bar, "baz": other}, "shop")
+	if len(imports) != 2 || imports[0].Name != "api" || imports[1].Name != "web" {
+		t.Fatalf("Expected shop/api and shop/web, got: %+v", imports)
+	}
+	if strings.Join(imports[1].Clusters, ",") != "foo,bar" {
+		t.Errorf("Expected shop/web from the local cluster first, got: %v", imports[1].Clusters)
+	}
+
+	mapping := map[string]string{"web.shop.svc.foo.remote": "web.shop.svc.cluster.local:80"}
+	siteOptions := map[string]generator.SiteOptions{}
+	domains := mcs.AppendImportSites([]string{"web.shop.svc.foo.remote"}, mapping, siteOptions, imports, "foo", generator.OutboundOptions{})
+	config := generator.GenerateCaddyConfigWithOptions(domains, mapping, siteOptions)
+
+	// The local export is served locally, the peer-only one through the peer's gateway
+	if !strings.Contains(config, "http://web.shop.svc.foo.remote:2015, http://web.shop.svc.clusterset.local:2015 {") {
+		t.Errorf("Expected the clusterset name of shop/web as a local alias, got:\n%s", config)
+	}
+	if !strings.Contains(config, "http://api.shop.svc.clusterset.local:2015 {") || !strings.Contains(config, "header_up Host api.shop.svc.bar.remote") ||
+		!strings.Contains(config, "bar-tsgateway:2015") {
+		t.Errorf("Expected shop/api forwarded to bar's gateway, got:\n%s", config)
+	}
+}
+
+func TestController_ServiceExports(t *testing.T) {
+	namespace := "test-ns"
+	clientset := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "tailscale-cluster-name", Namespace: "default"},
+			Data:       map[string]string{"CLUSTER_NAME": "foo"},
+		},
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "service1", Namespace: namespace}},
+		// Exported by annotation, ignored once ServiceExports decide
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "service2", Namespace: namespace, Annotations: map[string]string{generator.AnnotationExport: "true"}}},
+	)
+	allowAllAccessReviews(clientset)
+	client := newMCSClient(serviceExport(namespace, "service1"), serviceExport(namespace, "ghost"))
+
+	cancel := startController(t, clientset, controller.Options{
+		Namespace: namespace,
+		MCS:       mcs.NewManager(client, mcs.Options{Exports: true}),
+	})
+	defer cancel()
+
+	config := waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, "service1.test-ns.svc.foo.remote")
+	})
+	if strings.Contains(config, "service2") {
+		t.Errorf("Expected only Services with a ServiceExport, got:\n%s", config)
+	}
+	waitForExportCondition(t, client, namespace, "service1", mcs.ConditionValid, metav1.ConditionTrue, mcs.ReasonExported)
+	waitForExportCondition(t, client, namespace, "service1", mcs.ConditionReady, metav1.ConditionTrue, mcs.ReasonPublished)
+	waitForExportCondition(t, client, namespace, "ghost", mcs.ConditionValid, metav1.ConditionFalse, mcs.ReasonNoService)
+
+	// Creating a ServiceExport exports the Service
+	_, err := client.Resource(mcs.ServiceExportGVR).Namespace(namespace).Create(context.Background(), serviceExport(namespace, "service2"), metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create ServiceExport: %v", err)
+	}
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, "service2.test-ns.svc.foo.remote")
+	})
+	waitForExportCondition(t, client, namespace, "service2", mcs.ConditionReady, metav1.ConditionTrue, mcs.ReasonPublished)
+}
+
+func TestController_ServiceImports(t *testing.T) {
+	namespace := "test-ns"
+	proxy, proxyURL := newFakeTailnetProxy(t)
+	exported := peerCatalog("bar", "web.test-ns.svc.bar.remote")
+	exported.Services[0].Namespace, exported.Services[0].Name = namespace, "web"
+	proxy.setCatalog("bar-tsgateway:2020", exported)
+
+	clientset := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "tailscale-cluster-name", Namespace: "default"},
+			Data:       map[string]string{"CLUSTER_NAME": "foo"},
+		},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "tailscale-proxy", Namespace: namespace},
+			Spec:       v1.ServiceSpec{ClusterIP: "10.96.0.42", ClusterIPs: []string{"10.96.0.42"}},
+		},
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "service1", Namespace: namespace}},
+	)
+	allowAllAccessReviews(clientset)
+	client := newMCSClient()
+
+	fetcher, err := catalog.NewFetcher(catalog.FetcherOptions{ProxyURL: proxyURL, Interval: 50 * time.Millisecond, StaleAfter: time.Hour})
+	if err != nil {
+		t.Fatalf("Expected fetcher, got: %v", err)
+	}
+	cancel := startController(t, clientset, controller.Options{
+		Namespace:        namespace,
+		ProxyServiceName: "tailscale-proxy",
+		Peers:            []string{"bar"},
+		CatalogFetcher:   fetcher,
+		MCS:              mcs.NewManager(client, mcs.Options{Imports: true}),
+	})
+	defer cancel()
+
+	config := waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, "http://web.test-ns.svc.clusterset.local:2015 {")
+	})
+	if !strings.Contains(config, "header_up Host web.test-ns.svc.bar.remote") ||
+		!strings.Contains(config, "http://service1.test-ns.svc.foo.remote:2015, http://service1.test-ns.svc.clusterset.local:2015 {") {
+		t.Errorf("Expected the clusterset names routed to bar and to the local Service, got:\n%s", config)
+	}
+	waitForStatus(t, clientset, namespace, controller.StatusServiceImportsKey, "test-ns/service1,test-ns/web")
+
+	var serviceImport *unstructured.Unstructured
+	err = wait.PollUntilContextTimeout(context.Background(), 20*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		serviceImport, err = client.Resource(mcs.ServiceImportGVR).Namespace(namespace).Get(ctx, "web", metav1.GetOptions{})
+		return err == nil, nil
+	})
+	if err != nil {
+		t.Fatalf("Timed out waiting for ServiceImport test-ns/web")
+	}
+	ips, _, _ := unstructured.NestedStringSlice(serviceImport.Object, "spec", "ips")
+	clusters, _, _ := unstructured.NestedSlice(serviceImport.Object, "status", "clusters")
+	if serviceImport.GetLabels()[mcs.LabelManagedBy] != mcs.ManagerName || len(ips) != 1 || ips[0] != "10.96.0.42" || len(clusters) != 1 {
+		t.Errorf("Expected a managed ServiceImport on the proxy address exported by bar, got: %+v", serviceImport.Object)
+	}
+
+	// A Service no longer exported anywhere loses its ServiceImport
+	proxy.setCatalog("bar-tsgateway:2020", peerCatalog("bar"))
+	err = wait.PollUntilContextTimeout(context.Background(), 20*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		_, err := client.Resource(mcs.ServiceImportGVR).Namespace(namespace).Get(ctx, "web", metav1.GetOptions{})
+		return err != nil, nil
+	})
+	if err != nil {
+		t.Errorf("Timed out waiting for ServiceImport test-ns/web to be deleted")
+	}
+}
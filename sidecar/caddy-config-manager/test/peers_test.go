@@ -0,0 +1,206 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/controller"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/peers"
+)
+
+const fakeAPIKey = "tskey-api-test"
+
+// fakeNode is a tailnet node served by the fake control server
+type fakeNode struct {
+	hostname string
+	ip       string
+	lastSeen time.Time
+	online   bool
+}
+
+// fakeControlServer serves the device lists of the Tailscale API, the Headscale API and tailscaled's LocalAPI
+type fakeControlServer struct {
+	mu    sync.Mutex
+	nodes []fakeNode
+}
+
+func (f *fakeControlServer) setNodes(nodes ...fakeNode) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nodes = nodes
+}
+
+func (f *fakeControlServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	nodes := append([]fakeNode(nil), f.nodes...)
+	f.mu.Unlock()
+
+	var response interface{}
+	switch r.URL.Path {
+	case "/api/v2/tailnet/-/devices":
+		devices := make([]map[string]interface{}, 0, len(nodes))
+		for _, node := range nodes {
+			devices = append(devices, map[string]interface{}{
+				"hostname":           "tailscale-proxy-7d9f",
+				"name":               node.hostname + ".tail1234.ts.net",
+				"addresses":          []string{node.ip},
+				"lastSeen":           node.lastSeen,
+				"connectedToControl": node.online,
+			})
+		}
+		response = map[string]interface{}{"devices": devices}
+	case "/api/v1/node":
+		list := make([]map[string]interface{}, 0, len(nodes))
+		for _, node := range nodes {
+			list = append(list, map[string]interface{}{
+				"name":        "tailscale-proxy-7d9f",
+				"givenName":   node.hostname,
+				"ipAddresses": []string{node.ip},
+				"lastSeen":    node.lastSeen,
+				"online":      node.online,
+			})
+		}
+		response = map[string]interface{}{"nodes": list}
+	case "/localapi/v0/status":
+		status := make(map[string]interface{}, len(nodes))
+		for _, node := range nodes {
+			status["nodekey:"+node.hostname] = map[string]interface{}{
+				"HostName":     "tailscale-proxy-7d9f",
+				"DNSName":      node.hostname + ".tail1234.ts.net.",
+				"TailscaleIPs": []string{node.ip},
+				"LastSeen":     node.lastSeen,
+				"Online":       node.online,
+			}
+		}
+		response = map[string]interface{}{"Peer": status}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	// The LocalAPI is authenticated by the socket, the control-plane APIs by the key
+	if !strings.HasPrefix(r.URL.Path, "/localapi/") && r.Header.Get("Authorization") != "Bearer "+fakeAPIKey {
+		http.Error(w, "invalid API key", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// newFakeControlServer starts the fake control server over TCP and on a unix socket
+func newFakeControlServer(t *testing.T) (*fakeControlServer, string, string) {
+	t.Helper()
+	control := &fakeControlServer{}
+	server := httptest.NewServer(control)
+	t.Cleanup(server.Close)
+
+	socket := filepath.Join(t.TempDir(), "tailscaled.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %v", socket, err)
+	}
+	localAPI := &http.Server{Handler: control}
+	go localAPI.Serve(listener)
+	t.Cleanup(func() { localAPI.Close() })
+
+	return control, server.URL, socket
+}
+
+func TestPeerRegistry_Sources(t *testing.T) {
+	control, apiURL, socket := newFakeControlServer(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	control.setNodes(
+		fakeNode{hostname: "bar-tsgateway", ip: "100.64.0.2", lastSeen: now.Add(-time.Hour), online: false},
+		fakeNode{hostname: "BAR-tsgateway", ip: "100.64.0.3", lastSeen: now, online: true},
+		fakeNode{hostname: "baz-tsgateway", ip: "100.64.0.4", lastSeen: now, online: true},
+		fakeNode{hostname: "laptop", ip: "100.64.0.5", lastSeen: now, online: true},
+	)
+
+	sources := map[string]peers.SourceConfig{
+		peers.SourceTailscale: {APIURL: apiURL, APIKey: fakeAPIKey, Timeout: time.Second},
+		peers.SourceHeadscale: {APIURL: apiURL, APIKey: fakeAPIKey, Timeout: time.Second},
+		peers.SourceLocalAPI:  {Socket: socket, Timeout: time.Second},
+	}
+	for name, config := range sources {
+		source, err := peers.NewSource(name, config)
+		if err != nil {
+			t.Fatalf("Expected source %s, got: %v", name, err)
+		}
+		registry := peers.NewRegistry(source, "", time.Minute)
+		if err := registry.Refresh(context.Background()); err != nil {
+			t.Fatalf("Source %s: expected refresh to succeed, got: %v", name, err)
+		}
+
+		discovered := registry.Peers()
+		if len(discovered) != 2 || discovered[0].Cluster != "bar" || discovered[1].Cluster != "baz" {
+			t.Errorf("Source %s: expected peers bar and baz, got: %+v", name, discovered)
+			continue
+		}
+		// The online node wins over the stale one left by a reinstalled gateway
+		if !discovered[0].LastSeen.Equal(now) || !discovered[0].Online {
+			t.Errorf("Source %s: expected the online bar gateway seen at %s, got: %+v", name, now, discovered[0])
+		}
+		if ips := registry.Lookup("bar"); len(ips) != 1 || ips[0].String() != "100.64.0.3" {
+			t.Errorf("Source %s: expected bar at 100.64.0.3, got: %v", name, ips)
+		}
+	}
+
+	if _, err := peers.NewSource(peers.SourceHeadscale, peers.SourceConfig{APIKey: fakeAPIKey}); err == nil {
+		t.Errorf("Expected the headscale source to require its URL")
+	}
+	source, _ := peers.NewSource(peers.SourceTailscale, peers.SourceConfig{APIURL: apiURL, APIKey: "wrong", Timeout: time.Second})
+	if err := peers.NewRegistry(source, "", time.Minute).Refresh(context.Background()); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected the wrong API key to be refused, got: %v", err)
+	}
+}
+
+func TestController_PeerRegistry(t *testing.T) {
+	control, apiURL, _ := newFakeControlServer(t)
+	control.setNodes(fakeNode{hostname: "foo-tsgateway", ip: "100.64.0.1", online: true})
+
+	namespace := "test-ns"
+	clientset := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "tailscale-cluster-name", Namespace: "default"},
+			Data:       map[string]string{"CLUSTER_NAME": "foo"},
+		},
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "service1", Namespace: namespace}},
+	)
+	allowAllAccessReviews(clientset)
+
+	source, err := peers.NewSource(peers.SourceTailscale, peers.SourceConfig{APIURL: apiURL, APIKey: fakeAPIKey, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("Expected source, got: %v", err)
+	}
+	registry := peers.NewRegistry(source, "", 50*time.Millisecond)
+
+	cancel := startController(t, clientset, controller.Options{Namespace: namespace, PeerRegistry: registry})
+	defer cancel()
+
+	// The local gateway is never a peer
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, "service1.test-ns.svc.foo.remote")
+	})
+
+	// A new cluster joining the tailnet is routed without restarting
+	control.setNodes(
+		fakeNode{hostname: "foo-tsgateway", ip: "100.64.0.1", online: true},
+		fakeNode{hostname: "bar-tsgateway", ip: "100.64.0.2", online: true},
+	)
+	waitForCaddyConfig(t, clientset, namespace, func(config string) bool {
+		return strings.Contains(config, "*.*.svc.bar.remote") && !strings.Contains(config, "*.*.svc.foo.remote")
+	})
+	waitForStatus(t, clientset, namespace, controller.StatusOutboundPeersKey, "bar")
+}
@@ -0,0 +1,159 @@
+package test
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/controller"
+	"github.com/wold9168/k8s-cross-cluster/sidecar/caddy-config-manager/pkg/generator"
+)
+
+// waitForServiceAnnotations waits until the annotations of a Service satisfy the condition
+func waitForServiceAnnotations(t *testing.T, clientset *fake.Clientset, namespace, name string, condition func(map[string]string) bool) map[string]string {
+	t.Helper()
+	var annotations map[string]string
+	err := wait.PollUntilContextTimeout(context.Background(), 20*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		service, err := clientset.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, nil
+		}
+		annotations = service.Annotations
+		return condition(annotations), nil
+	})
+	if err != nil {
+		t.Fatalf("Timed out waiting for the annotations of Service %s/%s, last seen: %v", namespace, name, annotations)
+	}
+	return annotations
+}
+
+func TestController_ServiceAnnotations(t *testing.T) {
+	namespace := "test-ns"
+	clientset := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "tailscale-cluster-name", Namespace: "default"},
+			Data:       map[string]string{"CLUSTER_NAME": "foo"},
+		},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "service1", Namespace: namespace},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 8080}}},
+		},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "external", Namespace: namespace},
+			Spec:       v1.ServiceSpec{Type: v1.ServiceTypeExternalName, ExternalName: "example.com"},
+		},
+	)
+	allowAllAccessReviews(clientset)
+	var mu sync.Mutex
+	var fieldManagers []string
+	clientset.PrependReactor("patch", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		fieldManagers = append(fieldManagers, action.(k8stesting.PatchActionImpl).PatchOptions.FieldManager)
+		return false, nil, nil
+	})
+
+	cancel := startController(t, clientset, controller.Options{
+		Namespace:        namespace,
+		BackendPolicy:    generator.BackendPolicy{ExternalName: generator.BackendPolicySkip},
+		AnnotateServices: true,
+	})
+	defer cancel()
+
+	annotations := waitForServiceAnnotations(t, clientset, namespace, "service1", func(annotations map[string]string) bool {
+		return annotations[controller.AnnotationPublishedAt] != ""
+	})
+	if annotations[controller.AnnotationRemoteDomains] != "8080.service1.test-ns.svc.foo.remote,http.service1.test-ns.svc.foo.remote,service1.test-ns.svc.foo.remote" {
+		t.Errorf("Expected the remote domains of service1, got: %q", annotations[controller.AnnotationRemoteDomains])
+	}
+	if annotations[controller.AnnotationClusterName] != "foo" {
+		t.Errorf("Expected cluster name foo, got: %q", annotations[controller.AnnotationClusterName])
+	}
+	if _, err := time.Parse(time.RFC3339, annotations[controller.AnnotationPublishedAt]); err != nil {
+		t.Errorf("Expected an RFC 3339 publish time, got: %v", err)
+	}
+	if _, exists := annotations[controller.AnnotationWarning]; exists {
+		t.Errorf("Expected no warning on service1, got: %q", annotations[controller.AnnotationWarning])
+	}
+
+	annotations = waitForServiceAnnotations(t, clientset, namespace, "external", func(annotations map[string]string) bool {
+		return annotations[controller.AnnotationWarning] != ""
+	})
+	if !strings.Contains(annotations[controller.AnnotationWarning], "ExternalName") || annotations[controller.AnnotationRemoteDomains] != "" {
+		t.Errorf("Expected only a warning on the skipped Service, got: %v", annotations)
+	}
+
+	// Opting out removes the status annotations
+	service, err := clientset.CoreV1().Services(namespace).Get(context.Background(), "service1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get Service: %v", err)
+	}
+	service.Annotations[generator.AnnotationExport] = "false"
+	if _, err := clientset.CoreV1().Services(namespace).Update(context.Background(), service, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update Service: %v", err)
+	}
+	waitForServiceAnnotations(t, clientset, namespace, "service1", func(annotations map[string]string) bool {
+		_, exists := annotations[controller.AnnotationRemoteDomains]
+		return !exists && annotations[controller.AnnotationClusterName] == "" && annotations[controller.AnnotationPublishedAt] == ""
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, fieldManager := range fieldManagers {
+		if fieldManager != controller.ServiceStatusFieldManager {
+			t.Errorf("Expected patches by %s, got: %q", controller.ServiceStatusFieldManager, fieldManager)
+		}
+	}
+}
+
+func TestController_ServiceStatusUnchangedOnPublish(t *testing.T) {
+	namespace := "test-ns"
+	// service1 was annotated by an earlier publish, only the publish time differs
+	clientset := fake.NewSimpleClientset(
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "tailscale-cluster-name", Namespace: "default"},
+			Data:       map[string]string{"CLUSTER_NAME": "foo"},
+		},
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{
+			Name:      "service1",
+			Namespace: namespace,
+			Annotations: map[string]string{
+				controller.AnnotationRemoteDomains: "service1.test-ns.svc.foo.remote",
+				controller.AnnotationClusterName:   "foo",
+				controller.AnnotationPublishedAt:   "2024-01-01T00:00:00Z",
+			},
+		}},
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "service2", Namespace: namespace}},
+	)
+	allowAllAccessReviews(clientset)
+	var mu sync.Mutex
+	patches := make(map[string]int)
+	clientset.PrependReactor("patch", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		patches[action.(k8stesting.PatchActionImpl).Name]++
+		return false, nil, nil
+	})
+
+	cancel := startController(t, clientset, controller.Options{Namespace: namespace, AnnotateServices: true})
+	defer cancel()
+
+	waitForServiceAnnotations(t, clientset, namespace, "service2", func(annotations map[string]string) bool {
+		return annotations[controller.AnnotationPublishedAt] != ""
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if patches["service1"] != 0 {
+		t.Errorf("Expected service1 not to be patched, got %d patches", patches["service1"])
+	}
+}
@@ -11,15 +11,17 @@ LOGIN_SERVER=""
 CLUSTER_NAME=""
 CLUSTER_CONTEXT=""
 USE_CONTEXT_FLAG=""
+ALL_NAMESPACES=false
 VERBOSE=false
 
 # Function to display usage
 usage() {
-    echo "Usage: $0 --authkey <TS_AUTHKEY> [--login-server <LOGIN_SERVER_URL>] [--cluster-name <CLUSTER_NAME>] [--context <CLUSTER_CONTEXT>] [-v]"
+    echo "Usage: $0 --authkey <TS_AUTHKEY> [--login-server <LOGIN_SERVER_URL>] [--cluster-name <CLUSTER_NAME>] [--context <CLUSTER_CONTEXT>] [--all-namespaces] [-v]"
     echo "  --authkey: Tailscale auth key (required)"
     echo "  --login-server: Tailscale login server URL (optional, uses default if not specified)"
     echo "  --cluster-name: Cluster name for identification (optional, required for cross-cluster scenarios)"
     echo "  --context: Kubernetes cluster context (optional, uses current context if not specified)"
+    echo "  --all-namespaces: Grant the cluster-wide RBAC needed by caddy-config-manager -all-namespaces or -namespace-selector (optional)"
     echo "  -v: Enable verbose output for debugging"
     echo ""
     echo "Example: $0 --authkey tskey-1234567890 --login-server https://my-login-server.example.com --cluster-name my-cluster --context my-cluster-context -v"
@@ -109,6 +111,17 @@ apply_rbac() {
     echo "Applying Tailscale RBAC resources..."
     verbose_log "Running: kubectl apply -f tailscale-rbac.yaml $USE_CONTEXT_FLAG"
     kubectl apply -f tailscale-rbac.yaml $USE_CONTEXT_FLAG
+    if [[ "$ALL_NAMESPACES" == true ]]; then
+        verbose_log "Running: kubectl apply -f tailscale-rbac-all-namespaces.yaml $USE_CONTEXT_FLAG"
+        kubectl apply -f tailscale-rbac-all-namespaces.yaml $USE_CONTEXT_FLAG
+    fi
+}
+
+# Function to apply the CrossClusterService CRD
+apply_crds() {
+    echo "Applying CrossClusterService CRD..."
+    verbose_log "Running: kubectl apply -f crossclusterservice-crd.yaml $USE_CONTEXT_FLAG"
+    kubectl apply -f crossclusterservice-crd.yaml $USE_CONTEXT_FLAG
 }
 
 # Function to update the extra args ConfigMap
@@ -246,6 +259,10 @@ while [[ $# -gt 0 ]]; do
             CLUSTER_CONTEXT="$2"
             shift 2
             ;;
+        --all-namespaces)
+            ALL_NAMESPACES=true
+            shift
+            ;;
         -v|--verbose)
             VERBOSE=true
             shift
@@ -264,6 +281,7 @@ done
 validate_arguments
 validate_kubectl
 handle_kubernetes_context
+apply_crds
 apply_rbac
 update_auth_secret
 apply_userspace_proxy